@@ -0,0 +1,67 @@
+package frontd
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// _AccessLog is nil unless ACCESS_LOG is configured
+var _AccessLog *accessLog
+
+// accessLog writes one JSON line per client connection
+type accessLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type accessLogRecord struct {
+	Time        string  `json:"time"`
+	ConnID      string  `json:"conn_id"`
+	ClientIP    string  `json:"client_ip"`
+	Backend     string  `json:"backend,omitempty"`
+	Duration    float64 `json:"duration"`
+	BytesIn     uint64  `json:"bytes_in"`
+	BytesOut    uint64  `json:"bytes_out"`
+	CloseReason string  `json:"close_reason"`
+}
+
+// openAccessLog opens path for appending, "-" means stdout. The file is
+// rotated according to the LOG_ROTATE_* settings.
+func openAccessLog(path string) (*accessLog, error) {
+	if path == "-" {
+		return &accessLog{w: os.Stdout}, nil
+	}
+	f, err := newRotatingFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLog{w: f}, nil
+}
+
+func (l *accessLog) write(s *session) {
+	_, backend := s.status()
+	b, err := json.Marshal(accessLogRecord{
+		Time:        s.start.UTC().Format(time.RFC3339Nano),
+		ConnID:      s.id,
+		ClientIP:    ipAddrFromRemoteAddr(s.RemoteAddr().String()),
+		Backend:     backend,
+		Duration:    time.Since(s.start).Seconds(),
+		BytesIn:     s.up.Value(),
+		BytesOut:    s.down.Value(),
+		CloseReason: s.closeReason(),
+	})
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	_, err = l.w.Write(b)
+	l.mu.Unlock()
+	if err != nil {
+		logger().Error("access log write failed", "err", err)
+	}
+}
@@ -0,0 +1,200 @@
+package frontd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// clientACL restricts the clients allowed to connect by network, country
+// and autonomous system. Deny rules take precedence, clients must match one
+// of the allow rules if there are any.
+type clientACL struct {
+	allow          []*net.IPNet
+	deny           []*net.IPNet
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+	allowASNs      map[uint64]bool
+	denyASNs       map[uint64]bool
+}
+
+var _ClientACL atomic.Value // *clientACL
+
+// parseIPNets parses a comma separated list of networks in CIDR notation or
+// single addresses
+func parseIPNets(v string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func checkIPNets(v string) error {
+	_, err := parseIPNets(v)
+	return err
+}
+
+// parseCountries parses a comma separated list of ISO 3166 country codes
+func parseCountries(v string) (map[string]bool, error) {
+	m := make(map[string]bool)
+	for _, item := range strings.Split(v, ",") {
+		item = strings.ToUpper(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if len(item) != 2 || item[0] < 'A' || item[0] > 'Z' || item[1] < 'A' || item[1] > 'Z' {
+			return nil, fmt.Errorf("invalid country code %q", item)
+		}
+		m[item] = true
+	}
+	return m, nil
+}
+
+func checkCountries(v string) error {
+	_, err := parseCountries(v)
+	return err
+}
+
+// parseASNs parses a comma separated list of AS numbers like AS13335 or 13335
+func parseASNs(v string) (map[uint64]bool, error) {
+	m := make(map[uint64]bool)
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(item), "AS"), 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid AS number %q", item)
+		}
+		m[n] = true
+	}
+	return m, nil
+}
+
+func checkASNs(v string) error {
+	_, err := parseASNs(v)
+	return err
+}
+
+// loadClientACL reads the access control settings
+func loadClientACL() (acl *clientACL, err error) {
+	acl = &clientACL{}
+	acl.allow, err = parseIPNets(getenv("CLIENT_ALLOW"))
+	if err == nil {
+		acl.deny, err = parseIPNets(getenv("CLIENT_DENY"))
+	}
+	if err == nil {
+		acl.allowCountries, err = parseCountries(getenv("CLIENT_ALLOW_COUNTRIES"))
+	}
+	if err == nil {
+		acl.denyCountries, err = parseCountries(getenv("CLIENT_DENY_COUNTRIES"))
+	}
+	if err == nil {
+		acl.allowASNs, err = parseASNs(getenv("CLIENT_ALLOW_ASNS"))
+	}
+	if err == nil {
+		acl.denyASNs, err = parseASNs(getenv("CLIENT_DENY_ASNS"))
+	}
+	return acl, err
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of a client address or nil
+func addrIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	return net.ParseIP(host)
+}
+
+// addrPort returns the port of a client address or 0
+func addrPort(addr net.Addr) int {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.Port
+	}
+	_, p, _ := net.SplitHostPort(addr.String())
+	port, _ := strconv.Atoi(p)
+	return port
+}
+
+// tcpConn returns the TCP connection of c, unwrapping connections of
+// listeners given to Server.Serve like those of crypto/tls, or nil if c
+// isn't one
+func tcpConn(c net.Conn) *net.TCPConn {
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// clientAllowed reports whether the client at addr may connect
+func clientAllowed(addr net.Addr) bool {
+	acl, _ := _ClientACL.Load().(*clientACL)
+	if acl == nil {
+		return true
+	}
+	hasAllow := len(acl.allow) > 0 || len(acl.allowCountries) > 0 || len(acl.allowASNs) > 0
+	hasDeny := len(acl.deny) > 0 || len(acl.denyCountries) > 0 || len(acl.denyASNs) > 0
+	if !hasAllow && !hasDeny {
+		return true
+	}
+
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	// GeoIP lookups only if there are rules for them
+	var country string
+	if len(acl.allowCountries) > 0 || len(acl.denyCountries) > 0 {
+		country = ipCountry(ip)
+	}
+	var asn uint64
+	if len(acl.allowASNs) > 0 || len(acl.denyASNs) > 0 {
+		asn = ipASN(ip)
+	}
+
+	if containsIP(acl.deny, ip) || acl.denyCountries[country] || acl.denyASNs[asn] {
+		return false
+	}
+	return !hasAllow || containsIP(acl.allow, ip) || acl.allowCountries[country] || acl.allowASNs[asn]
+}
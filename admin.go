@@ -0,0 +1,76 @@
+package frontd
+
+import (
+	_ "embed"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+//go:embed dashboard.html
+var _Dashboard []byte
+
+func init() {
+	// counters and gauges are also visible at /debug/vars
+	expvar.Publish("frontd", expvar.Func(func() interface{} {
+		m := make(map[string]float64)
+		collectMetrics(func(name, typ string, labels, values []string, v float64) {
+			m[name+formatLabels(labels, values)] = v
+		})
+		return m
+	}))
+}
+
+// adminAddr completes addr to listen on loopback if only a port is given
+func adminAddr(addr string) string {
+	if !strings.Contains(addr, ":") {
+		return net.JoinHostPort("127.0.0.1", addr)
+	}
+	return addr
+}
+
+// dashboardHandler serves a single page polling /debug/vars and /backends
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(_Dashboard)
+}
+
+// adminMux serves operator endpoints, it must never be exposed publicly
+func adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", dashboardHandler)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/loglevel", logLevelHandler)
+	mux.HandleFunc("/debug/panics", panicsHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/maintenance", maintenanceHandler)
+	mux.HandleFunc("/connections", connectionsHandler)
+	mux.HandleFunc("/connections/", connectionHandler)
+	mux.HandleFunc("/backends", backendsHandler)
+	mux.HandleFunc("/usage", usageHandler)
+	mux.HandleFunc("/bans", bansHandler)
+	mux.HandleFunc("/bans/", banHandler)
+	mux.HandleFunc("/captures", capturesHandler)
+	mux.HandleFunc("/captures/", captureHandler)
+	return mux
+}
+
+func listenAndServeAdmin(addr string) {
+	l, err := listenRetry(adminAddr(addr))
+	if err == nil {
+		err = http.Serve(l, adminMux())
+	}
+	logger().Error("admin server stopped", "err", err)
+}
@@ -0,0 +1,208 @@
+package frontd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With ALERT_WEBHOOK set, backends whose dials fail at ALERT_FAILURE_RATE or
+// more within a window are reported to the webhook, and reported again once
+// a window shows them recovered. Reports of a backend are at least
+// ALERT_COOLDOWN apart so a flapping backend doesn't flood operators.
+
+const (
+	_AlertBackendFailing   = "backend_failing"
+	_AlertBackendRecovered = "backend_recovered"
+)
+
+// _MaxAlertTracked bounds the backends tracked, dials of further backends are
+// ignored until idle ones are pruned
+const _MaxAlertTracked = 10000
+
+type alertConfig struct {
+	url      string
+	rate     float64 // failure rate alerted
+	minDials int     // dials within the window before the rate is meaningful
+	window   time.Duration
+	cooldown time.Duration
+}
+
+// backendAlert is posted to the webhook, Text makes it readable as is by
+// chat webhooks
+type backendAlert struct {
+	Alert       string    `json:"alert"`
+	Backend     string    `json:"backend"`
+	Host        string    `json:"host"`
+	Time        time.Time `json:"time"`
+	Dials       int       `json:"dials"`
+	Failures    int       `json:"failures"`
+	FailureRate float64   `json:"failure_rate"`
+	Window      float64   `json:"window"`
+	LastError   string    `json:"last_error,omitempty"`
+	Text        string    `json:"text"`
+}
+
+type alertEntry struct {
+	window   time.Time // start of the dial window
+	dials    int
+	failures int
+	lastErr  error
+	failing  bool      // reported failing and not recovered since
+	alerted  time.Time // last report
+}
+
+var (
+	_Alerts atomic.Value // *alertConfig, nil if disabled
+
+	_AlertsMutex sync.Mutex
+	_AlertsState = make(map[string]*alertEntry)
+
+	_AlertClient = &http.Client{Timeout: time.Second * 10}
+
+	_MetricAlerts = newCounterVec("frontd_alerts_total",
+		"Total number of backend alerts fired, by alert.", "alert")
+)
+
+func alertConf() *alertConfig {
+	c, _ := _Alerts.Load().(*alertConfig)
+	return c
+}
+
+// loadAlerts reads the ALERT_* settings, it returns nil without a webhook
+func loadAlerts() (*alertConfig, error) {
+	url := getenv("ALERT_WEBHOOK")
+	if url == "" {
+		return nil, nil
+	}
+	err := checkURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("ALERT_WEBHOOK: %v", err)
+	}
+	c := &alertConfig{url: url, rate: 0.5, minDials: 10, window: time.Minute, cooldown: time.Minute * 10}
+	if v := getenv("ALERT_FAILURE_RATE"); v != "" {
+		c.rate, err = parseRate("ALERT_FAILURE_RATE")
+		if err != nil {
+			return nil, err
+		}
+	}
+	n, err := strconv.Atoi(getenv("ALERT_MIN_DIALS"))
+	if err == nil && n > 0 {
+		c.minDials = n
+	}
+	n, err = strconv.Atoi(getenv("ALERT_WINDOW"))
+	if err == nil && n > 0 {
+		c.window = time.Second * time.Duration(n)
+	}
+	n, err = strconv.Atoi(getenv("ALERT_COOLDOWN"))
+	if err == nil && n >= 0 {
+		c.cooldown = time.Second * time.Duration(n)
+	}
+	return c, nil
+}
+
+// recordDial counts a dial of the backend addr failed with err, or
+// succeeded if nil, and fires the alerts due
+func recordDial(addr string, err error) {
+	ac := alertConf()
+	if ac == nil {
+		return
+	}
+	now := time.Now()
+
+	_AlertsMutex.Lock()
+	defer _AlertsMutex.Unlock()
+	e, ok := _AlertsState[addr]
+	if !ok {
+		if len(_AlertsState) >= _MaxAlertTracked {
+			pruneAlerts(now, ac.window)
+			if len(_AlertsState) >= _MaxAlertTracked {
+				return
+			}
+		}
+		e = &alertEntry{window: now}
+		_AlertsState[addr] = e
+	}
+	if now.Sub(e.window) >= ac.window {
+		dials, failures := e.dials, e.failures
+		e.window, e.dials, e.failures = now, 0, 0
+		// a quiet window tells nothing about recovery
+		if e.failing && dials >= ac.minDials && float64(failures) < ac.rate*float64(dials) {
+			e.failing = false
+			if now.Sub(e.alerted) >= ac.cooldown {
+				e.alerted = now
+				go fireAlert(ac, e.alert(_AlertBackendRecovered, addr, now, ac, dials, failures))
+			}
+		}
+	}
+	e.dials++
+	if err != nil {
+		e.failures++
+		e.lastErr = err
+	}
+	if !e.failing && e.dials >= ac.minDials && float64(e.failures) >= ac.rate*float64(e.dials) &&
+		now.Sub(e.alerted) >= ac.cooldown {
+		e.failing = true
+		e.alerted = now
+		go fireAlert(ac, e.alert(_AlertBackendFailing, addr, now, ac, e.dials, e.failures))
+	}
+}
+
+// pruneAlerts forgets backends neither failing nor dialed recently, it must
+// be called with _AlertsMutex held
+func pruneAlerts(now time.Time, window time.Duration) {
+	for k, e := range _AlertsState {
+		if now.Sub(e.window) >= window && !e.failing {
+			delete(_AlertsState, k)
+		}
+	}
+}
+
+func (e *alertEntry) alert(typ, addr string, now time.Time, ac *alertConfig, dials, failures int) *backendAlert {
+	a := &backendAlert{
+		Alert:       typ,
+		Backend:     addr,
+		Time:        now,
+		Dials:       dials,
+		Failures:    failures,
+		FailureRate: float64(failures) / float64(dials),
+		Window:      ac.window.Seconds(),
+	}
+	a.Host, _ = os.Hostname()
+	if typ == _AlertBackendFailing {
+		if e.lastErr != nil {
+			a.LastError = e.lastErr.Error()
+		}
+		a.Text = fmt.Sprintf("frontd on %s: backend %s failing, %d of %d dials failed within %s",
+			a.Host, addr, failures, dials, ac.window)
+	} else {
+		a.Text = fmt.Sprintf("frontd on %s: backend %s recovered, %d of %d dials failed within %s",
+			a.Host, addr, failures, dials, ac.window)
+	}
+	return a
+}
+
+func fireAlert(ac *alertConfig, a *backendAlert) {
+	_MetricAlerts.With(a.Alert).Inc()
+	logger().Warn("backend alert", "alert", a.Alert, "backend", a.Backend, "dials", a.Dials, "failures", a.Failures)
+	b, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+	res, err := _AlertClient.Post(ac.url, "application/json", bytes.NewReader(b))
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode/100 != 2 {
+			err = fmt.Errorf("http status %d", res.StatusCode)
+		}
+	}
+	if err != nil {
+		logger().Warn("alert webhook failed", "alert", a.Alert, "backend", a.Backend, "err", err)
+	}
+}
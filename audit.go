@@ -0,0 +1,195 @@
+package frontd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// _VerifyAudit is the audit log file to verify given by -verify-audit
+var _VerifyAudit string
+
+// _AuditLog is nil unless AUDIT_LOG is configured
+var _AuditLog *auditLog
+
+// audit events
+const (
+	auditAuthSuccess = "auth_success"
+	auditAuthFailure = "auth_failure"
+)
+
+// auditLog writes one JSON line per authentication event. Every line ends
+// with the SHA-256 of the line before it, which includes the hash of the
+// previous line, so removing or altering lines breaks the chain.
+type auditLog struct {
+	mu   sync.Mutex
+	w    io.Writer
+	seq  uint64
+	prev string
+}
+
+type auditRecord struct {
+	Seq       uint64 `json:"seq"`
+	Time      string `json:"time"`
+	Event     string `json:"event"`
+	ConnID    string `json:"conn_id"`
+	ClientIP  string `json:"client_ip"`
+	Token     string `json:"token,omitempty"`
+	Backend   string `json:"backend,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+	Prev      string `json:"prev"`
+}
+
+var _auditHashField = []byte(`,"hash":"`)
+
+// openAuditLog opens path for appending, "-" means stdout. The chain is
+// continued from the last line of an existing file. The file is rotated
+// according to the LOG_ROTATE_* settings.
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "-" {
+		return &auditLog{w: os.Stdout}, nil
+	}
+	l := &auditLog{}
+	last, err := lastLine(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(last) > 0 {
+		var r auditRecord
+		hash, err := auditHash(last, &r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: last line: %v", path, err)
+		}
+		l.seq, l.prev = r.Seq, hash
+	}
+	f, err := newRotatingFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l.w = f
+	return l, nil
+}
+
+// lastLine returns the last non-empty line of the file at path
+func lastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	off := fi.Size() - 64*1024
+	if off < 0 {
+		off = 0
+	}
+	b := make([]byte, fi.Size()-off)
+	_, err = f.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	b = bytes.TrimRight(b, "\n")
+	return b[bytes.LastIndexByte(b, '\n')+1:], nil
+}
+
+// tokenHash identifies a cipher address in the audit log without revealing
+// it
+func tokenHash(cipher []byte) string {
+	sum := sha256.Sum256(cipher)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (l *auditLog) write(s *session, event, backend string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	b, err := json.Marshal(auditRecord{
+		Seq:       l.seq,
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Event:     event,
+		ConnID:    s.id,
+		ClientIP:  ipAddrFromRemoteAddr(s.RemoteAddr().String()),
+		Token:     s.token,
+		Backend:   backend,
+		ErrorCode: s.errCode,
+		Prev:      l.prev,
+	})
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(b)
+	l.prev = hex.EncodeToString(sum[:])
+	b = append(b[:len(b)-1], _auditHashField...)
+	b = append(b, l.prev...)
+	b = append(b, "\"}\n"...)
+
+	_, err = l.w.Write(b)
+	if err != nil {
+		logger().Error("audit log write failed", "err", err)
+	}
+}
+
+// audit records an authentication event of s, if the audit log is enabled
+func audit(s *session, event, backend string) {
+	if _AuditLog != nil {
+		_AuditLog.write(s, event, backend)
+	}
+}
+
+// auditHash checks the hash of an audit log line, decodes it into r and
+// returns the hash
+func auditHash(line []byte, r *auditRecord) (string, error) {
+	i := bytes.LastIndex(line, _auditHashField)
+	if i < 0 || !bytes.HasSuffix(line, []byte(`"}`)) {
+		return "", errors.New("hash missing")
+	}
+	hash := string(line[i+len(_auditHashField) : len(line)-2])
+	body := append(line[:i:i], '}')
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != hash {
+		return "", errors.New("hash mismatch")
+	}
+	return hash, json.Unmarshal(body, r)
+}
+
+// verifyAudit checks the hash chain of an audit log and reports to stderr,
+// it returns the exit code
+func verifyAudit(path string) int {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var prev string
+	var seq uint64
+	n := 0
+	for i, line := range bytes.Split(bytes.TrimRight(b, "\n"), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var r auditRecord
+		hash, err := auditHash(line, &r)
+		if err == nil && n > 0 && (r.Prev != prev || r.Seq != seq+1) {
+			err = errors.New("chain broken, lines removed or reordered")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: %v\n", path, i+1, err)
+			return 1
+		}
+		prev, seq = hash, r.Seq
+		n++
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d records ok\n", path, n)
+	return 0
+}
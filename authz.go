@@ -0,0 +1,208 @@
+package frontd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// With AUTHZ_WEBHOOK set the authz middleware posts every handshake to the
+// webhook, which allows or denies it and may override the backend dialed.
+// With AUTHZ_FORMAT=opa the webhook is a policy of an Open Policy Agent,
+// queried through its data API.
+
+const (
+	_AuthzAllow = "allow"
+	_AuthzDeny  = "deny"
+
+	_AuthzFormatFrontd = "frontd"
+	_AuthzFormatOPA    = "opa"
+)
+
+// authzRequest is posted to the webhook
+type authzRequest struct {
+	ConnID     string `json:"conn_id"`
+	ClientIP   string `json:"client_ip"`
+	ClientPort int    `json:"client_port"`
+	Token      string `json:"token"`
+	Backend    string `json:"backend"`
+	Country    string `json:"country,omitempty"`
+	ASN        uint64 `json:"asn,omitempty"`
+}
+
+// authzResponse is the decision of the webhook, Backend overrides the
+// backend dialed if not empty
+type authzResponse struct {
+	Decision string `json:"decision"`
+	Backend  string `json:"backend"`
+}
+
+type authzConfig struct {
+	url     string
+	opa     bool
+	timeout time.Duration
+	// failure is the decision if the webhook fails
+	failure string
+}
+
+var (
+	_Authz atomic.Value // *authzConfig, nil if disabled
+
+	_AuthzClient = &http.Client{}
+
+	_MetricAuthzDecisions = newCounterVec("frontd_authz_decisions_total",
+		"Total number of handshakes decided by the authorization webhook, by decision.", "decision")
+)
+
+func authzConf() *authzConfig {
+	c, _ := _Authz.Load().(*authzConfig)
+	return c
+}
+
+// loadAuthz reads the AUTHZ_* settings, it returns nil without a webhook
+func loadAuthz() (*authzConfig, error) {
+	url := getenv("AUTHZ_WEBHOOK")
+	if url == "" {
+		return nil, nil
+	}
+	err := checkURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("AUTHZ_WEBHOOK: %v", err)
+	}
+	c := &authzConfig{url: url, timeout: time.Second, failure: _AuthzDeny}
+	ms, err := strconv.Atoi(getenv("AUTHZ_TIMEOUT"))
+	if err == nil && ms > 0 {
+		c.timeout = time.Millisecond * time.Duration(ms)
+	}
+	if getenv("AUTHZ_FAILURE") == _AuthzAllow {
+		c.failure = _AuthzAllow
+	}
+	c.opa = getenv("AUTHZ_FORMAT") == _AuthzFormatOPA
+	return c, nil
+}
+
+// authorize asks the webhook for the decision on the handshake of c
+func (ac *authzConfig) authorize(c *Conn) (*authzResponse, error) {
+	req := authzRequest{ConnID: c.ID(), Token: c.s.token, Backend: c.Backend()}
+	if ip := addrIP(c.RemoteAddr()); ip != nil {
+		req.ClientIP = ip.String()
+		req.ClientPort = addrPort(c.RemoteAddr())
+		req.Country = ipCountry(ip)
+		req.ASN = ipASN(ip)
+	}
+	var b []byte
+	var err error
+	if ac.opa {
+		b, err = json.Marshal(struct {
+			Input authzRequest `json:"input"`
+		}{req})
+	} else {
+		b, err = json.Marshal(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), ac.timeout)
+	defer cancel()
+	hr, err := http.NewRequestWithContext(ctx, "POST", ac.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	res, err := _AuthzClient.Do(hr)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("authorization webhook failed with http status %d", res.StatusCode)
+	}
+
+	var resp authzResponse
+	body := json.NewDecoder(io.LimitReader(res.Body, 64*1024))
+	if ac.opa {
+		err = decodeOPAResult(body, &resp)
+	} else {
+		err = body.Decode(&resp)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid authorization webhook response: %v", err)
+	}
+	if resp.Decision != _AuthzAllow && resp.Decision != _AuthzDeny {
+		return nil, fmt.Errorf("invalid authorization webhook decision %q", resp.Decision)
+	}
+	return &resp, nil
+}
+
+// decodeOPAResult decodes the result of a policy query, either a boolean
+// or an object with the boolean allow and an optional backend. Undefined
+// results deny like most policies do by default.
+func decodeOPAResult(d *json.Decoder, resp *authzResponse) error {
+	var res struct {
+		Result json.RawMessage `json:"result"`
+	}
+	err := d.Decode(&res)
+	if err != nil {
+		return err
+	}
+	var allow bool
+	if len(res.Result) == 0 {
+		resp.Decision = _AuthzDeny
+		return nil
+	}
+	if err = json.Unmarshal(res.Result, &allow); err != nil {
+		var obj struct {
+			Allow   bool   `json:"allow"`
+			Backend string `json:"backend"`
+		}
+		if err = json.Unmarshal(res.Result, &obj); err != nil {
+			return errors.New("policy result is neither a boolean nor an object")
+		}
+		allow = obj.Allow
+		resp.Backend = obj.Backend
+	}
+	resp.Decision = _AuthzDeny
+	if allow {
+		resp.Decision = _AuthzAllow
+	}
+	return nil
+}
+
+// authzMiddleware refuses the handshakes denied by the webhook with 4111
+func authzMiddleware(next Handler) Handler {
+	return func(c *Conn) {
+		ac := authzConf()
+		if ac == nil {
+			next(c)
+			return
+		}
+		resp, err := ac.authorize(c)
+		if err != nil {
+			c.Logger().Warn("authorization webhook failed", "err", err, "decision", ac.failure)
+			_MetricAuthzDecisions.With("error").Inc()
+			if ac.failure == _AuthzDeny {
+				c.Refuse("4111", err)
+				return
+			}
+			next(c)
+			return
+		}
+		_MetricAuthzDecisions.With(resp.Decision).Inc()
+		if resp.Decision == _AuthzDeny {
+			c.Refuse("4111", errors.New("denied by the authorization webhook"))
+			return
+		}
+		if resp.Backend != "" {
+			c.SetBackend(resp.Backend)
+		}
+		next(c)
+	}
+}
@@ -0,0 +1,268 @@
+package frontd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var errBackendForbidden = errors.New("backend address not allowed")
+
+// _InternalNets are loopback, private, shared, link-local, unspecified,
+// documentation and reserved addresses, and the NAT64 and 6to4 prefixes
+// mapping IPv4 addresses to IPv6. Backends on them can't be dialed unless
+// re-enabled by BACKEND_ALLOW_INTERNAL, so a token holder can't reach
+// frontd's own host, its network or cloud metadata services.
+var _InternalNets, _ = parseIPNets("0.0.0.0/8, 10.0.0.0/8, 100.64.0.0/10, 127.0.0.0/8, 169.254.0.0/16, " +
+	"172.16.0.0/12, 192.0.0.0/24, 192.0.2.0/24, 192.168.0.0/16, 198.18.0.0/15, 198.51.100.0/24, " +
+	"203.0.113.0/24, 240.0.0.0/4, 255.255.255.255/32, " +
+	"::/128, ::1/128, 64:ff9b::/96, 64:ff9b:1::/48, 2002::/16, fc00::/7, fe80::/10")
+
+var _BackendAllowInternal atomic.Value // []*net.IPNet
+
+// checkBackendIP returns errBackendForbidden if ip must not be dialed
+func checkBackendIP(ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsMulticast() {
+		return errBackendForbidden
+	}
+	if !containsIP(_InternalNets, ip) {
+		return nil
+	}
+	allow, _ := _BackendAllowInternal.Load().([]*net.IPNet)
+	if containsIP(allow, ip) {
+		return nil
+	}
+	return errBackendForbidden
+}
+
+// backendRule matches backends by host name pattern or network, and port
+type backendRule struct {
+	glob  string     // host name pattern, see path.Match
+	ipnet *net.IPNet // or network
+	ports [][2]int   // port ranges, nil for any
+}
+
+// backendPolicy restricts the backends any token may reach. Deny rules take
+// precedence, backends must match one of the allow rules if there are any.
+type backendPolicy struct {
+	allow []backendRule
+	deny  []backendRule
+}
+
+var _BackendPolicy atomic.Value // *backendPolicy
+
+// parseBackendRules parses a comma separated list of rules host[:ports],
+// where host is a network in CIDR notation, an address or a host name
+// pattern like *.example.com, and ports are port numbers or ranges separated
+// by |, like 80|443|8000-8999. IPv6 networks with ports must be bracketed.
+func parseBackendRules(v string) ([]backendRule, error) {
+	var rules []backendRule
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, ports := item, ""
+		switch {
+		case strings.HasPrefix(item, "["):
+			end := strings.IndexByte(item, ']')
+			if end < 0 || end+1 < len(item) && item[end+1] != ':' {
+				return nil, fmt.Errorf("invalid backend rule %q", item)
+			}
+			host, ports = item[1:end], strings.TrimPrefix(item[end+1:], ":")
+		case strings.Count(item, ":") == 1:
+			i := strings.IndexByte(item, ':')
+			host, ports = item[:i], item[i+1:]
+		}
+
+		var r backendRule
+		if nets, err := parseIPNets(host); err == nil && len(nets) == 1 {
+			r.ipnet = nets[0]
+		} else if strings.ContainsAny(host, ":/") || host == "" {
+			return nil, fmt.Errorf("invalid backend rule %q", item)
+		} else if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q", host)
+		} else {
+			r.glob = strings.ToLower(host)
+		}
+
+		for _, p := range strings.Split(ports, "|") {
+			if p == "" || p == "*" {
+				continue
+			}
+			lo, hi := p, p
+			if i := strings.IndexByte(p, '-'); i >= 0 {
+				lo, hi = p[:i], p[i+1:]
+			}
+			from, err1 := strconv.Atoi(lo)
+			to, err2 := strconv.Atoi(hi)
+			if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+				return nil, fmt.Errorf("invalid ports %q", p)
+			}
+			r.ports = append(r.ports, [2]int{from, to})
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func checkBackendRules(v string) error {
+	_, err := parseBackendRules(v)
+	return err
+}
+
+func (r *backendRule) matchPort(port int) bool {
+	if r.ports == nil {
+		return true
+	}
+	for _, p := range r.ports {
+		if port >= p[0] && port <= p[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName matches rules of host name patterns
+func (r *backendRule) matchName(host string, port int) bool {
+	if r.glob == "" || !r.matchPort(port) {
+		return false
+	}
+	ok, _ := path.Match(r.glob, strings.ToLower(host))
+	return ok
+}
+
+// matchIP matches rules of networks
+func (r *backendRule) matchIP(ip net.IP, port int) bool {
+	return r.ipnet != nil && r.ipnet.Contains(ip) && r.matchPort(port)
+}
+
+// dialBackend connects to a backend, refusing addresses forbidden by the
+// backend policy or checkBackendIP. Host names are checked before and the
+// addresses connected to after name resolution, so DNS can't be used to get
+// around the checks. A *net.Dialer set as the Dialer checks them the same
+// way, other Dialers have the address they connected to checked if TCP.
+func dialBackend(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.Atoi(p)
+	policy, _ := _BackendPolicy.Load().(*backendPolicy)
+	if policy == nil {
+		policy = &backendPolicy{}
+	}
+
+	allowedByName := false
+	if net.ParseIP(host) == nil {
+		for i := range policy.deny {
+			if policy.deny[i].matchName(host, port) {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errBackendForbidden}
+			}
+		}
+		for i := range policy.allow {
+			allowedByName = allowedByName || policy.allow[i].matchName(host, port)
+		}
+	}
+
+	checkIP := func(ip net.IP) error {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for i := range policy.deny {
+			if policy.deny[i].matchIP(ip, port) {
+				return errBackendForbidden
+			}
+		}
+		if len(policy.allow) > 0 && !allowedByName {
+			allowed := false
+			for i := range policy.allow {
+				allowed = allowed || policy.allow[i].matchIP(ip, port)
+			}
+			if !allowed {
+				return errBackendForbidden
+			}
+		}
+		return checkBackendIP(ip)
+	}
+
+	control := func(network, address string, c syscall.RawConn) error {
+		h, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(h)
+		if ip == nil {
+			return errBackendForbidden
+		}
+		return checkIP(ip)
+	}
+
+	if d := dialer(); d != nil {
+		// host names are only checked by their patterns before dialing
+		if ip := net.ParseIP(host); ip != nil {
+			err = checkIP(ip)
+		} else if len(policy.allow) > 0 && !allowedByName {
+			err = errBackendForbidden
+		}
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		if nd, ok := d.(*net.Dialer); ok {
+			return withControl(nd, control).DialContext(ctx, "tcp", addr)
+		}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		// the address connected to if the dialer connected over TCP itself,
+		// others like pipes and tunnels are up to the dialer
+		if ra, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			if err := checkIP(ra.IP); err != nil {
+				conn.Close()
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: ra, Err: err}
+			}
+		}
+		return conn, nil
+	}
+
+	return dialWith(ctx, &net.Dialer{Timeout: timeout, Control: control}, "tcp", addr)
+}
+
+// withControl returns a copy of d running control on the addresses it
+// connects to before its own Control or ControlContext
+func withControl(d *net.Dialer, control func(network, address string, c syscall.RawConn) error) *net.Dialer {
+	nd := *d
+	if cc := d.ControlContext; cc != nil {
+		nd.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+			return cc(ctx, network, address, c)
+		}
+		return &nd
+	}
+	own := d.Control
+	nd.Control = func(network, address string, c syscall.RawConn) error {
+		if err := control(network, address, c); err != nil {
+			return err
+		}
+		if own != nil {
+			return own(network, address, c)
+		}
+		return nil
+	}
+	return &nd
+}
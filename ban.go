@@ -0,0 +1,167 @@
+package frontd
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clients failing too many handshakes within a window are banned for a
+// while, protecting the relay from scanners and brute force. Settings are
+// replaced by applySettings, a threshold of 0 disables banning.
+var (
+	_BanThreshold int64
+	_BanWindow    int64 = int64(time.Minute)
+	_BanDuration  int64 = int64(time.Minute * 10)
+)
+
+// _MaxBanTracked bounds the clients tracked, failures of further clients are
+// ignored until expired ones are pruned
+const _MaxBanTracked = 100000
+
+type banEntry struct {
+	window   time.Time // start of the failure window
+	failures int
+	until    time.Time // banned until
+}
+
+var (
+	_BansMutex sync.Mutex
+	_Bans      = make(map[string]*banEntry)
+
+	_MetricBans = newCounter("frontd_bans_total",
+		"Total number of clients banned after repeated handshake failures.")
+	_ = newGaugeFunc("frontd_banned_clients",
+		"Number of clients currently banned.", func() float64 {
+			return float64(len(bannedClients()))
+		})
+)
+
+// banInfo is a banned client as listed by the admin API
+type banInfo struct {
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// recordFailure counts a failed handshake with code of the client at addr
+// and bans it once the threshold is reached
+func recordFailure(addr net.Addr, code string) {
+	threshold := atomic.LoadInt64(&_BanThreshold)
+	if threshold <= 0 || !_AuthFailureCodes[code] {
+		return
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return
+	}
+	key := ip.String()
+	now := time.Now()
+	window := time.Duration(atomic.LoadInt64(&_BanWindow))
+
+	_BansMutex.Lock()
+	defer _BansMutex.Unlock()
+	e, ok := _Bans[key]
+	if !ok {
+		if len(_Bans) >= _MaxBanTracked {
+			pruneBans(now, window)
+			if len(_Bans) >= _MaxBanTracked {
+				return
+			}
+		}
+		e = &banEntry{window: now}
+		_Bans[key] = e
+	}
+	if now.Sub(e.window) >= window {
+		e.window, e.failures = now, 0
+	}
+	e.failures++
+	if int64(e.failures) >= threshold && !now.Before(e.until) {
+		e.until = now.Add(time.Duration(atomic.LoadInt64(&_BanDuration)))
+		_MetricBans.Inc()
+		logger().Warn("client banned", "client_ip", key, "failures", e.failures, "until", e.until)
+	}
+}
+
+// pruneBans forgets clients neither banned nor failing recently, it must be
+// called with _BansMutex held
+func pruneBans(now time.Time, window time.Duration) {
+	for k, e := range _Bans {
+		if now.Sub(e.window) >= window && !now.Before(e.until) {
+			delete(_Bans, k)
+		}
+	}
+}
+
+// banned reports whether the client at addr is banned
+func banned(addr net.Addr) bool {
+	if atomic.LoadInt64(&_BanThreshold) <= 0 {
+		return false
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	_BansMutex.Lock()
+	defer _BansMutex.Unlock()
+	e, ok := _Bans[ip.String()]
+	return ok && time.Now().Before(e.until)
+}
+
+// unban lifts the ban of ip and forgets its failures, it reports whether ip
+// was banned
+func unban(ip string) bool {
+	_BansMutex.Lock()
+	defer _BansMutex.Unlock()
+	e, ok := _Bans[ip]
+	delete(_Bans, ip)
+	return ok && time.Now().Before(e.until)
+}
+
+func bannedClients() []banInfo {
+	now := time.Now()
+	_BansMutex.Lock()
+	defer _BansMutex.Unlock()
+	var bans []banInfo
+	for k, e := range _Bans {
+		if now.Before(e.until) {
+			bans = append(bans, banInfo{IP: k, Failures: e.failures, Until: e.until})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// bansHandler lists banned clients as JSON
+func bansHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bannedClients())
+}
+
+// banHandler lifts the ban of the IP in the path on DELETE
+func banHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := net.ParseIP(strings.TrimPrefix(r.URL.Path, "/bans/"))
+	if ip == nil {
+		http.Error(w, "invalid IP address", http.StatusBadRequest)
+		return
+	}
+	if !unban(ip.String()) {
+		http.Error(w, "not banned", http.StatusNotFound)
+		return
+	}
+	logger().Info("client unbanned by admin", "client_ip", ip.String())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"unbanned": 1})
+}
@@ -0,0 +1,321 @@
+package frontd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BANDWIDTH_LIMIT caps the bytes per second relayed each way by all tunnels
+// and BANDWIDTH_BACKENDS, a comma separated list of backend=rate, those of
+// the tunnels to the backends matching each rule, e.g. 10.9.0.0/16=10MB. A
+// tunnel under a cap writes as much as the scheduler of the cap grants it.
+// The scheduler is a deficit round robin: tunnels queue up for the budget of
+// the cap, refilled at its rate, and are granted up to a quantum in turn, a
+// tunnel asking again going to the back of the queue. So every tunnel gets
+// an equal share whichever goroutine asks first, and a tunnel writing less
+// than its share leaves the rest to the others. Writes are split at the
+// quantum, so no deficit is carried over to the next round. Tunnels are
+// granted at once while the budget lasts, the queue is then served every
+// tick.
+
+const (
+	_BandwidthTick    = 10 * time.Millisecond
+	_BandwidthQuantum = 16 * 1024
+)
+
+var (
+	_BandwidthCaps atomic.Value // *bandwidthCaps
+
+	_BandwidthWaitNanos int64
+	_                   = newCounterFunc("frontd_bandwidth_wait_seconds_total",
+		"Total time tunnels waited for BANDWIDTH_LIMIT or BANDWIDTH_BACKENDS in seconds.", func() float64 {
+			return time.Duration(atomic.LoadInt64(&_BandwidthWaitNanos)).Seconds()
+		})
+)
+
+// bandwidthCaps are the limiters of BANDWIDTH_LIMIT and BANDWIDTH_BACKENDS,
+// upstream and downstream
+type bandwidthCaps struct {
+	global [2]*fairLimiter // nil without BANDWIDTH_LIMIT
+	rules  []bandwidthRule
+}
+
+// bandwidthRule caps the tunnels to backends matching an address, a host or
+// a network
+type bandwidthRule struct {
+	rule     string // as configured
+	addr     string // host:port or host
+	ipnet    *net.IPNet
+	limiters [2]*fairLimiter
+}
+
+// parseBandwidthRules parses a comma separated list of backend=rate, where
+// backend is a host:port, a host or a network in CIDR notation
+func parseBandwidthRules(v string) ([]bandwidthRule, error) {
+	var rules []bandwidthRule
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.LastIndexByte(item, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("expected backend=rate, got %q", item)
+		}
+		rate, ok := parseSize(item[eq+1:])
+		if !ok || rate > 1<<40 {
+			return nil, fmt.Errorf("invalid bandwidth in %q", item)
+		}
+		r := bandwidthRule{rule: item, addr: item[:eq]}
+		if strings.Contains(r.addr, "/") {
+			var err error
+			_, r.ipnet, err = net.ParseCIDR(r.addr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		r.limiters = [2]*fairLimiter{newFairLimiter(int64(rate)), newFairLimiter(int64(rate))}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func checkBandwidthRules(v string) error {
+	_, err := parseBandwidthRules(v)
+	return err
+}
+
+func checkBandwidth(v string) error {
+	rate, ok := parseSize(v)
+	if !ok || rate > 1<<40 {
+		return fmt.Errorf("invalid bandwidth %q", v)
+	}
+	return nil
+}
+
+// loadBandwidthCaps reads BANDWIDTH_LIMIT and BANDWIDTH_BACKENDS, it returns
+// nil without caps. Caps unchanged since prev keep their limiters, so the
+// tunnels relayed across a reload share them with the new ones.
+func loadBandwidthCaps(prev *bandwidthCaps) (*bandwidthCaps, error) {
+	rules, err := parseBandwidthRules(getenv("BANDWIDTH_BACKENDS"))
+	if err != nil {
+		return nil, err
+	}
+	caps := &bandwidthCaps{rules: rules}
+	if v := getenv("BANDWIDTH_LIMIT"); v != "" {
+		rate, ok := parseSize(v)
+		if !ok || rate > 1<<40 {
+			return nil, fmt.Errorf("invalid BANDWIDTH_LIMIT %q", v)
+		}
+		caps.global = [2]*fairLimiter{newFairLimiter(int64(rate)), newFairLimiter(int64(rate))}
+	}
+	if caps.global[0] == nil && len(rules) == 0 {
+		return nil, nil
+	}
+	if prev != nil {
+		if caps.global[0] != nil && prev.global[0] != nil && caps.global[0].rate == prev.global[0].rate {
+			caps.global = prev.global
+		}
+		for i := range caps.rules {
+			for _, p := range prev.rules {
+				if p.rule == caps.rules[i].rule {
+					caps.rules[i].limiters = p.limiters
+					break
+				}
+			}
+		}
+	}
+	return caps, nil
+}
+
+func currentBandwidthCaps() *bandwidthCaps {
+	caps, _ := _BandwidthCaps.Load().(*bandwidthCaps)
+	return caps
+}
+
+// limiters returns the limiters of tunnels to the backend addr in
+// direction 0 for upstream or 1 for downstream, the global one last so a
+// tunnel waiting for its backend's cap doesn't hold bytes of all tunnels
+func (caps *bandwidthCaps) limiters(addr string, direction int) []*fairLimiter {
+	var limiters []*fairLimiter
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	for _, r := range caps.rules {
+		if (r.ipnet != nil && ip != nil && r.ipnet.Contains(ip)) || r.addr == addr || r.addr == host {
+			limiters = append(limiters, r.limiters[direction])
+			break
+		}
+	}
+	if caps.global[direction] != nil {
+		limiters = append(limiters, caps.global[direction])
+	}
+	return limiters
+}
+
+// fairLimiter schedules the writes of the tunnels waiting for a cap of rate
+// bytes per second
+type fairLimiter struct {
+	rate  int64
+	burst int64 // the budget not spent is kept up to
+
+	mu      sync.Mutex
+	budget  int64
+	refill  time.Time
+	waiting []*bandwidthFlow // in round robin order
+	running bool             // whether the scheduler runs
+}
+
+// bandwidthFlow is a tunnel waiting for a limiter
+type bandwidthFlow struct {
+	want  int64 // bytes asked for
+	grant chan int64
+}
+
+func newFairLimiter(rate int64) *fairLimiter {
+	burst := rate / 10
+	if burst < _BandwidthQuantum {
+		burst = _BandwidthQuantum
+	}
+	return &fairLimiter{rate: rate, burst: burst, budget: burst, refill: time.Now()}
+}
+
+// wait blocks until up to n bytes of f are granted and returns how many
+func (l *fairLimiter) wait(ctx context.Context, f *bandwidthFlow, n int64) (int64, error) {
+	l.mu.Lock()
+	f.want = n
+	l.waiting = append(l.waiting, f)
+	l.schedule(time.Now())
+	if len(l.waiting) > 0 && !l.running {
+		l.running = true
+		go l.run()
+	}
+	l.mu.Unlock()
+
+	start := time.Now()
+	defer func() { atomic.AddInt64(&_BandwidthWaitNanos, int64(time.Since(start))) }()
+	select {
+	case m := <-f.grant:
+		return m, nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	for i, w := range l.waiting {
+		if w == f {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			break
+		}
+	}
+	l.mu.Unlock()
+	select {
+	case m := <-f.grant:
+		l.refund(m)
+	default:
+	}
+	return 0, context.Cause(ctx)
+}
+
+// refund returns n bytes granted but not written to the budget
+func (l *fairLimiter) refund(n int64) {
+	l.mu.Lock()
+	l.budget = min(l.budget+n, l.burst)
+	l.mu.Unlock()
+}
+
+// run schedules the waiting flows every tick until none is left
+func (l *fairLimiter) run() {
+	ticker := time.NewTicker(_BandwidthTick)
+	defer ticker.Stop()
+	for {
+		l.mu.Lock()
+		l.schedule(time.Now())
+		if len(l.waiting) == 0 {
+			l.running = false
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+		<-ticker.C
+	}
+}
+
+// schedule refills the budget and grants it to the waiting flows in turn
+func (l *fairLimiter) schedule(now time.Time) {
+	// the time of the fraction of a byte not added is kept for the next
+	// refill, frequent ones would lose it otherwise
+	added := int64(float64(l.rate) * now.Sub(l.refill).Seconds())
+	if l.budget+added >= l.burst {
+		l.budget = l.burst
+		l.refill = now
+	} else if added > 0 {
+		l.budget += added
+		l.refill = l.refill.Add(time.Duration(float64(added) / float64(l.rate) * float64(time.Second)))
+	}
+	for len(l.waiting) > 0 {
+		f := l.waiting[0]
+		n := min(f.want, _BandwidthQuantum)
+		if n > l.budget {
+			// f keeps its turn until the budget covers it
+			return
+		}
+		l.budget -= n
+		l.waiting = l.waiting[1:]
+		f.grant <- n
+	}
+}
+
+// cappedWriter writes to w what the limiters grant it
+type cappedWriter struct {
+	w        io.Writer
+	ctx      context.Context
+	limiters []*fairLimiter
+	flows    []*bandwidthFlow
+}
+
+func newCappedWriter(ctx context.Context, w io.Writer, limiters []*fairLimiter) *cappedWriter {
+	c := &cappedWriter{w: w, ctx: ctx, limiters: limiters}
+	for range limiters {
+		c.flows = append(c.flows, &bandwidthFlow{grant: make(chan int64, 1)})
+	}
+	return c
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// limiters are waited for in order, each granting at most what the
+		// one before it did, which gets back the rest
+		granted := make([]int64, len(c.limiters))
+		size := int64(len(p))
+		for i, l := range c.limiters {
+			m, err := l.wait(c.ctx, c.flows[i], size)
+			if err != nil {
+				for j := 0; j < i; j++ {
+					c.limiters[j].refund(granted[j])
+				}
+				return n, err
+			}
+			granted[i], size = m, m
+		}
+		for i := range c.limiters {
+			if granted[i] > size {
+				c.limiters[i].refund(granted[i] - size)
+			}
+		}
+		m, err := c.w.Write(p[:size])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
@@ -0,0 +1,218 @@
+package frontd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xindong/frontd/client"
+)
+
+// _Subcommands run instead of the relay when named by the first argument,
+// they return the exit code
+var _Subcommands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"bench":    bench,
+	"selftest": selftest,
+	"replay":   replay,
+}
+
+// benchResult is the outcome of one tunnel
+type benchResult struct {
+	handshake  time.Duration // until the first payload was echoed
+	roundTrips []time.Duration
+	bytes      int64
+	elapsed    time.Duration
+	err        error
+}
+
+// echoServer accepts connections on a loopback port and echoes them
+func echoServer() (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l, nil
+}
+
+// benchTunnel opens a tunnel and echoes rounds payloads of size bytes
+func benchTunnel(d *client.Dialer, backend string, size, rounds int) (r benchResult) {
+	start := time.Now()
+	defer func() { r.elapsed = time.Since(start) }()
+
+	conn, err := d.Dial("tcp", backend)
+	if err != nil {
+		r.err = err
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+
+	out := make([]byte, size)
+	rand.Read(out)
+	in := make([]byte, size)
+	for i := 0; i < rounds; i++ {
+		rt := time.Now()
+		_, err = conn.Write(out)
+		if err == nil {
+			_, err = io.ReadFull(conn, in)
+		}
+		if err == nil && !bytes.Equal(in, out) {
+			err = errors.New("echo mismatch")
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
+		if i == 0 {
+			r.handshake = time.Since(start)
+		} else {
+			r.roundTrips = append(r.roundTrips, time.Since(rt))
+		}
+		r.bytes += int64(size) * 2
+	}
+	return
+}
+
+// percentiles returns p50, p90, p99 and the maximum of sorted
+func percentiles(sorted []float64) [4]float64 {
+	var p [4]float64
+	if len(sorted) == 0 {
+		return p
+	}
+	for i, q := range []float64{.5, .9, .99} {
+		p[i] = sorted[int(q*float64(len(sorted)-1))]
+	}
+	p[3] = sorted[len(sorted)-1]
+	return p
+}
+
+// bench opens concurrent tunnels against a frontd for a while and reports
+// latency and throughput percentiles
+func bench(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	target := fs.String("target", "127.0.0.1:4043", "`addr` of the frontd to benchmark")
+	backend := fs.String("backend", "", "echo backend `addr` to tunnel to, defaults to one started by bench on loopback, which frontd must allow by BACKEND_ALLOW_INTERNAL")
+	secret := fs.String("secret", "", "secret passphrase ($SECRET)")
+	concurrency := fs.Int("c", 10, "`number` of concurrent tunnels")
+	duration := fs.Duration("d", time.Second*10, "`duration` of the benchmark")
+	size := fs.Int("size", 1024, "payload size in `bytes`")
+	rounds := fs.Int("rounds", 10, "payloads echoed per tunnel")
+	binary := fs.Bool("binary", false, "use the binary handshake")
+	obfuscated := fs.Bool("obfuscate", false, "scramble tunnels for a frontd with OBFUSCATE set")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+	if *secret == "" {
+		*secret = os.Getenv("SECRET")
+	}
+	if *secret == "" {
+		if path := os.Getenv("SECRET_FILE"); path != "" {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				return 2
+			}
+			*secret = strings.TrimSpace(string(b))
+		}
+	}
+	if *secret == "" || *concurrency < 1 || *size < 1 || *rounds < 1 {
+		fs.Usage()
+		return 2
+	}
+	if *backend == "" {
+		l, err := echoServer()
+		if err != nil {
+			fmt.Fprintln(stderr, "echo backend not started:", err)
+			return 1
+		}
+		defer l.Close()
+		*backend = l.Addr().String()
+	}
+
+	d := &client.Dialer{Gateway: *target, Secret: []byte(*secret), Binary: *binary, Obfuscate: *obfuscated, Timeout: time.Second * 5}
+	deadline := time.Now().Add(*duration)
+	results := make(chan benchResult, *concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				results <- benchTunnel(d, *backend, *size, *rounds)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	start := time.Now()
+	var handshakes, roundTrips, throughputs []float64
+	var total int64
+	errs := make(map[string]int)
+	tunnels := 0
+	for r := range results {
+		tunnels++
+		if r.err != nil {
+			errs[r.err.Error()]++
+			continue
+		}
+		handshakes = append(handshakes, r.handshake.Seconds()*1000)
+		for _, rt := range r.roundTrips {
+			roundTrips = append(roundTrips, rt.Seconds()*1000)
+		}
+		throughputs = append(throughputs, float64(r.bytes)/r.elapsed.Seconds()/1024/1024)
+		total += r.bytes
+	}
+	elapsed := time.Since(start)
+
+	fmt.Fprintf(stdout, "%d tunnels in %.1fs to %s through %s, %d concurrent, %d x %d bytes each\n",
+		tunnels, elapsed.Seconds(), *backend, *target, *concurrency, *rounds, *size)
+	fmt.Fprintf(stdout, "%.1f tunnels/s, %.2f MiB/s relayed in both directions\n\n",
+		float64(tunnels)/elapsed.Seconds(), float64(total)/elapsed.Seconds()/1024/1024)
+	fmt.Fprintf(stdout, "%-24s %10s %10s %10s %10s\n", "", "p50", "p90", "p99", "max")
+	for _, row := range []struct {
+		name   string
+		values []float64
+	}{
+		{"handshake (ms)", handshakes},
+		{"round trip (ms)", roundTrips},
+		{"tunnel MiB/s", throughputs},
+	} {
+		sort.Float64s(row.values)
+		p := percentiles(row.values)
+		fmt.Fprintf(stdout, "%-24s %10.3f %10.3f %10.3f %10.3f\n", row.name, p[0], p[1], p[2], p[3])
+	}
+
+	if len(errs) == 0 {
+		return 0
+	}
+	fmt.Fprintln(stdout, "\nerrors:")
+	for e, n := range errs {
+		fmt.Fprintf(stdout, "%8d %s\n", n, e)
+	}
+	return 1
+}
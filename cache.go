@@ -0,0 +1,230 @@
+package frontd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type backendAddrMap map[string][]byte
+
+// addrCache caches decrypted backend addresses keyed by their cipher text.
+// Implementations flush themselves once _MaxBackendAddrCacheCount is reached.
+type addrCache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, val []byte)
+	Len() int
+	// Snapshot returns all cached entries, callers must not modify it
+	Snapshot() backendAddrMap
+	// Restore replaces all cached entries with m
+	Restore(m backendAddrMap)
+}
+
+// cowAddrCache is a copy-on-write map, lookups are lock free and cheap
+// but every insertion copies the whole map. Suits high hit rate workloads.
+type cowAddrCache struct {
+	mu sync.Mutex
+	m  atomic.Value
+}
+
+func newCOWAddrCache() *cowAddrCache {
+	c := &cowAddrCache{}
+	c.m.Store(make(backendAddrMap))
+	return c
+}
+
+func (c *cowAddrCache) Get(key string) ([]byte, bool) {
+	val, ok := c.m.Load().(backendAddrMap)[key]
+	return val, ok
+}
+
+func (c *cowAddrCache) Set(key string, val []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	m1 := c.m.Load().(backendAddrMap)
+	// double check
+	if _, ok := m1[key]; ok {
+		return
+	}
+
+	m2 := make(backendAddrMap)
+	// flush cache if there is way too many
+	if len(m1) < _MaxBackendAddrCacheCount {
+		// copy-on-write
+		for k, v := range m1 {
+			m2[k] = v // copy all data from the current object to the new one
+		}
+	}
+	m2[key] = val
+	c.m.Store(m2) // atomically replace the current object with the new one
+}
+
+func (c *cowAddrCache) Len() int {
+	return len(c.m.Load().(backendAddrMap))
+}
+
+func (c *cowAddrCache) Snapshot() backendAddrMap {
+	// the stored map is never modified, no need to copy
+	return c.m.Load().(backendAddrMap)
+}
+
+func (c *cowAddrCache) Restore(m backendAddrMap) {
+	c.mu.Lock()
+	c.m.Store(m)
+	c.mu.Unlock()
+}
+
+// syncMapAddrCache is backed by sync.Map, insertions are cheap which suits
+// workloads where nearly every connection carries a fresh cipher text.
+type syncMapAddrCache struct {
+	mu  sync.Mutex
+	gen atomic.Pointer[syncMapGen]
+}
+
+// syncMapGen is the map of the cache until it's flushed, counting its
+// entries, so entries stored into a map being flushed aren't counted in the
+// next one
+type syncMapGen struct {
+	m sync.Map
+	n int64
+}
+
+func newSyncMapAddrCache() *syncMapAddrCache {
+	c := &syncMapAddrCache{}
+	c.gen.Store(new(syncMapGen))
+	return c
+}
+
+func (c *syncMapAddrCache) Get(key string) ([]byte, bool) {
+	val, ok := c.gen.Load().m.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return val.([]byte), true
+}
+
+func (c *syncMapAddrCache) Set(key string, val []byte) {
+	g := c.gen.Load()
+	_, loaded := g.m.LoadOrStore(key, val)
+	if loaded {
+		return
+	}
+
+	// flush cache if there is way too many
+	if atomic.AddInt64(&g.n, 1) > _MaxBackendAddrCacheCount {
+		c.mu.Lock()
+		if c.gen.Load() == g {
+			c.gen.Store(new(syncMapGen))
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *syncMapAddrCache) Len() int {
+	return int(atomic.LoadInt64(&c.gen.Load().n))
+}
+
+func (c *syncMapAddrCache) Snapshot() backendAddrMap {
+	m := make(backendAddrMap)
+	c.gen.Load().m.Range(func(k, v interface{}) bool {
+		m[k.(string)] = v.([]byte)
+		return true
+	})
+	return m
+}
+
+func (c *syncMapAddrCache) Restore(m backendAddrMap) {
+	g := &syncMapGen{n: int64(len(m))}
+	for k, v := range m {
+		g.m.Store(k, v)
+	}
+
+	c.mu.Lock()
+	c.gen.Store(g)
+	c.mu.Unlock()
+}
+
+// addrCacheSnapshot is the on-disk form of the backend address cache
+type addrCacheSnapshot struct {
+	// SecretHash is sha256 of the passphrase used to decrypt the entries,
+	// snapshots taken with another passphrase are ignored
+	SecretHash []byte
+	Entries    backendAddrMap
+}
+
+func secretHash() []byte {
+	h := sha256.Sum256(secretPassphrase())
+	return h[:]
+}
+
+// loadAddrCache warm up the backend address cache from a snapshot file
+func loadAddrCache(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var s addrCacheSnapshot
+	err = gob.NewDecoder(f).Decode(&s)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(s.SecretHash, secretHash()) {
+		return errors.New("address cache snapshot was taken with another secret")
+	}
+
+	if len(s.Entries) > _MaxBackendAddrCacheCount {
+		return errors.New("address cache snapshot has too many entries")
+	}
+
+	_BackendAddrCache.Restore(s.Entries)
+
+	logger().Info("address cache loaded", "entries", len(s.Entries), "path", path)
+	return nil
+}
+
+// saveAddrCache write the backend address cache to path atomically
+func saveAddrCache(path string) error {
+	s := addrCacheSnapshot{
+		SecretHash: secretHash(),
+		Entries:    _BackendAddrCache.Snapshot(),
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = gob.NewEncoder(f).Encode(&s)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// snapshotAddrCache saves the backend address cache every interval
+func snapshotAddrCache(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := saveAddrCache(path)
+		if err != nil {
+			logger().Error("address cache snapshot failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package frontd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Captures mirror tunnel bytes for debugging protocols inside tunnels the
+// operator owns. The bytes are written as synthesized TCP/IP packets in pcap
+// format, so tools like Wireshark dissect them as if sniffed between client
+// and backend.
+
+const (
+	_CaptureDefaultDuration = time.Minute
+	_CaptureMaxDuration     = time.Minute * 10
+
+	// payload bytes per synthesized packet, well below the IP length limit
+	_CaptureSegmentSize = 1 << 15
+	// packets queued for the output, beyond them packets are dropped rather
+	// than stalling the tunnels
+	_CaptureQueueSize = 256
+	// how long a stopped capture may take to write the queued packets
+	_CaptureFlushTimeout = time.Second
+
+	_PcapLinkTypeRaw = 101 // packets start with the IPv4 or IPv6 header
+)
+
+// captureInfo describes a capture in the admin API
+type captureInfo struct {
+	ID      string    `json:"id"`
+	Conn    string    `json:"conn,omitempty"`
+	Backend string    `json:"backend,omitempty"`
+	Output  string    `json:"output"`
+	Until   time.Time `json:"until"`
+	Packets uint64    `json:"packets"`
+	Dropped uint64    `json:"dropped"`
+}
+
+// capture mirrors the tunnel of a connection, or of every connection to a
+// backend, until it expires or is stopped. Tunnels queue the packets, which
+// are written to the output by a goroutine of the capture, so a slow output
+// drops packets instead of slowing down the tunnels.
+type capture struct {
+	captureInfo
+
+	mu      sync.Mutex
+	w       io.WriteCloser
+	packets chan []byte   // nil once stopped
+	done    chan struct{} // closed once the packets were written
+	timer   *time.Timer
+}
+
+var (
+	// _Captures holds the active captures, usually none, so relaying only
+	// pays for an atomic load
+	_Captures      atomic.Value // []*capture
+	_CapturesMutex sync.Mutex
+	_CaptureDir    atomic.Value // string, file captures are disabled if empty
+
+	_captureSeq uint64
+
+	_MetricCaptureDropped = newCounter("frontd_capture_dropped_packets_total",
+		"Total number of captured packets dropped as the capture output fell behind.")
+)
+
+func captureDir() string {
+	d, _ := _CaptureDir.Load().(string)
+	return d
+}
+
+func activeCaptures() []*capture {
+	c, _ := _Captures.Load().([]*capture)
+	return c
+}
+
+func (c *capture) matches(s *session) bool {
+	if c.Conn != "" {
+		return c.Conn == s.id
+	}
+	_, backend := s.status()
+	return backend == c.Backend
+}
+
+// startCapture mirrors the matching tunnels to w for d
+func startCapture(c *capture, w io.WriteCloser, d time.Duration) error {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], _PcapLinkTypeRaw)
+	_, err := w.Write(hdr)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	c.ID = "cap-" + strconv.FormatUint(atomic.AddUint64(&_captureSeq, 1), 36)
+	c.Until = time.Now().Add(d)
+	c.w = w
+	c.packets = make(chan []byte, _CaptureQueueSize)
+	c.done = make(chan struct{})
+	go c.drain(c.packets)
+
+	c.timer = time.AfterFunc(d, func() { stopCapture(c.ID) })
+	_CapturesMutex.Lock()
+	_Captures.Store(append([]*capture{c}, activeCaptures()...))
+	_CapturesMutex.Unlock()
+	logger().Info("capture started", "capture_id", c.ID, "conn_id", c.Conn, "backend_addr", c.Backend,
+		"output", c.Output, "duration", d.Seconds())
+	return nil
+}
+
+// stopCapture ends the capture of id and reports whether it was active
+func stopCapture(id string) bool {
+	_CapturesMutex.Lock()
+	var c *capture
+	var rest []*capture
+	for _, a := range activeCaptures() {
+		if a.ID == id {
+			c = a
+		} else {
+			rest = append(rest, a)
+		}
+	}
+	_Captures.Store(rest)
+	_CapturesMutex.Unlock()
+	if c == nil {
+		return false
+	}
+
+	c.timer.Stop()
+	c.mu.Lock()
+	close(c.packets)
+	c.packets = nil
+	c.mu.Unlock()
+	select {
+	case <-c.done:
+	case <-time.After(_CaptureFlushTimeout):
+		// the output is stalled, what's queued is lost
+		c.w.Close()
+		<-c.done
+	}
+
+	c.mu.Lock()
+	packets, dropped := c.Packets, c.Dropped
+	c.mu.Unlock()
+	logger().Info("capture stopped", "capture_id", c.ID, "packets", packets, "dropped", dropped)
+	return true
+}
+
+// drain writes the queued packets to the output until the capture is
+// stopped, then closes it
+func (c *capture) drain(packets <-chan []byte) {
+	defer close(c.done)
+	defer c.w.Close()
+	var err error
+	for rec := range packets {
+		if err != nil {
+			continue
+		}
+		_, err = c.w.Write(rec)
+		if err != nil {
+			// e.g. the reader of the tap socket is gone
+			logger().Warn("capture failed", "capture_id", c.ID, "err", err)
+			go stopCapture(c.ID)
+			continue
+		}
+		c.mu.Lock()
+		c.Packets++
+		c.mu.Unlock()
+	}
+}
+
+// write queues the packets carrying payload from src to dst
+func (c *capture) write(src, dst net.Addr, seq, ack uint32, payload []byte) {
+	now := time.Now()
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > _CaptureSegmentSize {
+			n = _CaptureSegmentSize
+		}
+		pkt := tcpPacket(src, dst, seq, ack, payload[:n])
+		rec := make([]byte, 16, 16+len(pkt))
+		binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+		binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+
+		c.mu.Lock()
+		// the capture may have been stopped after the tunnel picked it up
+		if c.packets == nil {
+			c.mu.Unlock()
+			return
+		}
+		select {
+		case c.packets <- append(rec, pkt...):
+		default:
+			c.Dropped++
+			_MetricCaptureDropped.Inc()
+		}
+		c.mu.Unlock()
+		seq += uint32(n)
+		payload = payload[n:]
+	}
+}
+
+func tcpAddr(a net.Addr) *net.TCPAddr {
+	if ta, ok := a.(*net.TCPAddr); ok {
+		return ta
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// tcpPacket synthesizes an IP packet of a TCP segment carrying payload
+func tcpPacket(src, dst net.Addr, seq, ack uint32, payload []byte) []byte {
+	s, d := tcpAddr(src), tcpAddr(dst)
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], uint16(s.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(d.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18 // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+
+	var ip []byte
+	if s4, d4 := s.IP.To4(), d.IP.To4(); s4 != nil && d4 != nil {
+		ip = make([]byte, 20, 40+len(payload))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(40+len(payload)))
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], s4)
+		copy(ip[16:], d4)
+		var sum uint32
+		for i := 0; i < 20; i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(ip[i:]))
+		}
+		for sum > 0xffff {
+			sum = sum>>16 + sum&0xffff
+		}
+		binary.BigEndian.PutUint16(ip[10:], ^uint16(sum))
+	} else {
+		ip = make([]byte, 40, 60+len(payload))
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(20+len(payload)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], s.IP.To16())
+		copy(ip[24:], d.IP.To16())
+	}
+	return append(append(ip, tcp...), payload...)
+}
+
+// tapWriter writes one direction of a tunnel and mirrors what was written
+// to the captures matching the session and its recording
+type tapWriter struct {
+	io.Writer
+	s        *session
+	src, dst net.Addr
+	dir      byte   // _RecordUp or _RecordDown
+	seq      uint32 // accessed atomically, the peer reads it as ack
+	peer     *tapWriter
+}
+
+// newTaps returns the writers of both directions of a tunnel between the
+// session's client and backend
+func newTaps(s *session, backend net.Conn) (up, down *tapWriter) {
+	up = &tapWriter{Writer: backend, s: s, src: s.RemoteAddr(), dst: backend.RemoteAddr(), dir: _RecordUp, seq: 1}
+	down = &tapWriter{Writer: s.Conn, s: s, src: backend.RemoteAddr(), dst: s.RemoteAddr(), dir: _RecordDown, seq: 1, peer: up}
+	up.peer = down
+	return up, down
+}
+
+func (t *tapWriter) Write(p []byte) (int, error) {
+	n, err := t.Writer.Write(p)
+	if n > 0 {
+		if t.s.rec != nil {
+			t.s.rec.write(t.dir, p[:n])
+		}
+		seq := atomic.LoadUint32(&t.seq)
+		for _, c := range activeCaptures() {
+			if c.matches(t.s) {
+				c.write(t.src, t.dst, seq, atomic.LoadUint32(&t.peer.seq), p[:n])
+			}
+		}
+		atomic.AddUint32(&t.seq, uint32(n))
+	}
+	return n, err
+}
+
+// captureOutput opens where a capture is written: a file named in the
+// CAPTURE_DIR, or a unix socket a tap listens on
+func captureOutput(file, socket string) (io.WriteCloser, string, error) {
+	switch {
+	case file != "" && socket != "":
+		return nil, "", errors.New("only one of file and socket may be given")
+	case socket != "":
+		conn, err := net.Dial("unix", socket)
+		return conn, "unix:" + socket, err
+	case file != "":
+		dir := captureDir()
+		if dir == "" {
+			return nil, "", errors.New("file captures are disabled, set CAPTURE_DIR")
+		}
+		if file != filepath.Base(file) || strings.HasPrefix(file, ".") {
+			return nil, "", errors.New("file must be a plain name within CAPTURE_DIR")
+		}
+		path := filepath.Join(dir, file)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		return f, path, err
+	}
+	return nil, "", errors.New("file or socket parameter required")
+}
+
+// capturesHandler lists the active captures as JSON on GET. POST starts a
+// capture of the connection given by the conn parameter or of every
+// connection to the backend parameter, for duration seconds, written to the
+// file or socket parameter.
+func capturesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET", "HEAD":
+		captures := []captureInfo{}
+		for _, c := range activeCaptures() {
+			c.mu.Lock()
+			captures = append(captures, c.captureInfo)
+			c.mu.Unlock()
+		}
+		sort.Slice(captures, func(i, j int) bool { return captures[i].Until.Before(captures[j].Until) })
+		json.NewEncoder(w).Encode(captures)
+	case "POST":
+		q := r.URL.Query()
+		c := &capture{captureInfo: captureInfo{Conn: q.Get("conn"), Backend: q.Get("backend")}}
+		if (c.Conn == "") == (c.Backend == "") {
+			http.Error(w, "either conn or backend parameter required", http.StatusBadRequest)
+			return
+		}
+		if c.Conn != "" {
+			if _, ok := _Sessions.Load(c.Conn); !ok {
+				http.Error(w, "connection not found", http.StatusNotFound)
+				return
+			}
+		}
+		d := _CaptureDefaultDuration
+		if v := q.Get("duration"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || time.Second*time.Duration(n) > _CaptureMaxDuration {
+				http.Error(w, "duration must be between 1 and "+strconv.Itoa(int(_CaptureMaxDuration.Seconds()))+" seconds",
+					http.StatusBadRequest)
+				return
+			}
+			d = time.Second * time.Duration(n)
+		}
+		out, name, err := captureOutput(q.Get("file"), q.Get("socket"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.Output = name
+		err = startCapture(c, out, d)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c.mu.Lock()
+		info := c.captureInfo
+		c.mu.Unlock()
+		json.NewEncoder(w).Encode(info)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// captureHandler stops the capture of the ID in the path on DELETE
+func captureHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !stopCapture(strings.TrimPrefix(r.URL.Path, "/captures/")) {
+		http.Error(w, "capture not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"stopped": 1})
+}
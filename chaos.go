@@ -0,0 +1,112 @@
+package frontd
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// chaosConfig injects faults into relayed traffic so clients and their retry
+// logic can be tested against a misbehaving network. It's meant for test
+// deployments only, every setting defaults to no faults.
+type chaosConfig struct {
+	latency   time.Duration // added before relaying every chunk
+	corrupt   float64       // probability of flipping a byte of a chunk
+	stall     float64       // probability of holding a chunk for stallTime
+	stallTime time.Duration
+	reset     float64 // probability of resetting the tunnel at a chunk
+}
+
+var (
+	// _Chaos is nil unless a fault is configured
+	_Chaos atomic.Value // *chaosConfig
+
+	_MetricChaosFaults = newCounterVec("frontd_chaos_faults_total",
+		"Total number of faults injected into tunnels by chaos mode.", "fault")
+)
+
+func chaos() *chaosConfig {
+	c, _ := _Chaos.Load().(*chaosConfig)
+	return c
+}
+
+func parseRate(key string) (float64, error) {
+	v := getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	err := checkRate(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key, err)
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+func checkRate(v string) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || f > 1 {
+		return fmt.Errorf("must be a probability between 0 and 1")
+	}
+	return nil
+}
+
+// loadChaos reads the CHAOS_* settings, it returns nil if no fault is
+// configured
+func loadChaos() (*chaosConfig, error) {
+	c := &chaosConfig{stallTime: time.Second * 5}
+	latency, err := strconv.Atoi(getenv("CHAOS_LATENCY"))
+	if err == nil && latency > 0 {
+		c.latency = time.Millisecond * time.Duration(latency)
+	}
+	stallTime, err := strconv.Atoi(getenv("CHAOS_STALL_TIME"))
+	if err == nil && stallTime > 0 {
+		c.stallTime = time.Millisecond * time.Duration(stallTime)
+	}
+	c.corrupt, err = parseRate("CHAOS_CORRUPT_RATE")
+	if err != nil {
+		return nil, err
+	}
+	c.stall, err = parseRate("CHAOS_STALL_RATE")
+	if err != nil {
+		return nil, err
+	}
+	c.reset, err = parseRate("CHAOS_RESET_RATE")
+	if err != nil {
+		return nil, err
+	}
+	if c.latency == 0 && c.corrupt == 0 && c.stall == 0 && c.reset == 0 {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// disrupt injects the configured faults into chunk read from src before it's
+// written to dst. It returns true if the tunnel was reset, both connections
+// are closed then.
+func (c *chaosConfig) disrupt(chunk []byte, dst, src net.Conn) bool {
+	if c.reset > 0 && rand.Float64() < c.reset {
+		_MetricChaosFaults.With("reset").Inc()
+		for _, conn := range []net.Conn{dst, src} {
+			if tc := tcpConn(conn); tc != nil {
+				tc.SetLinger(0)
+			}
+			conn.Close()
+		}
+		return true
+	}
+	if c.stall > 0 && rand.Float64() < c.stall {
+		_MetricChaosFaults.With("stall").Inc()
+		time.Sleep(c.stallTime)
+	}
+	if c.latency > 0 {
+		time.Sleep(c.latency)
+	}
+	if c.corrupt > 0 && len(chunk) > 0 && rand.Float64() < c.corrupt {
+		_MetricChaosFaults.With("corrupt").Inc()
+		chunk[rand.Intn(len(chunk))] ^= byte(1 + rand.Intn(255))
+	}
+	return false
+}
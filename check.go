@@ -0,0 +1,513 @@
+package frontd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// _CheckConfig is the configuration file to validate given by -check
+var _CheckConfig string
+
+// minimum length of the secret passphrase accepted by -check, shorter ones
+// are warned about at startup
+const _MinSecretLength = 8
+
+// _SettingChecks validates every known setting, keyed by environment
+// variable name. Settings only need an entry to be accepted in the
+// configuration file, a nil check accepts any value.
+var _SettingChecks = map[string]func(string) error{
+	"SECRET":                       nil,
+	"SECRET_FILE":                  nil,
+	"CONFIG_FILE":                  nil,
+	"LISTEN_ADDR":                  checkHostPort,
+	"LISTEN_PORT":                  checkInt(1, 65535),
+	"LISTEN_BACKLOG":               checkInt(0, 1<<31-1),
+	"TCP_DEFER_ACCEPT":             checkInt(0, 3600),
+	"BACKEND_TIMEOUT":              checkInt(1, 3600),
+	"BACKEND_ALLOW_INTERNAL":       checkIPNets,
+	"BACKEND_ALLOW":                checkBackendRules,
+	"BACKEND_DENY":                 checkBackendRules,
+	"CONN_READ_TIMEOUT":            checkInt(0, 1<<31-1),
+	"MAX_HTTP_HEADER_SIZE":         checkInt(_minHTTPHeaderSize+1, 1<<20),
+	"MAX_CONN_LIFETIME":            checkInt(0, 1<<31-1),
+	"MAX_CONNS":                    checkInt(0, 1<<31-1),
+	"IDLE_TIMEOUT":                 checkInt(0, 1<<31-1),
+	"WATCHDOG_TIMEOUT":             checkInt(0, 1<<31-1),
+	"TICKET_LIFETIME":              checkInt(0, 1<<31-1),
+	"COMPRESSION_LEVEL":            checkInt(1, 9),
+	"TRANSPORT":                    checkTransport,
+	"TLS_CERT_FILE":                nil,
+	"TLS_KEY_FILE":                 nil,
+	"ECH_KEY_FILE":                 nil,
+	"SNI_ROUTES":                   checkHostRoutes,
+	"SNI_BACKEND_CA_FILE":          nil,
+	"MUX_HTTP":                     checkBool,
+	"OBFUSCATE":                    checkBool,
+	"OBFUSCATE_PADDING":            checkInt(0, 65535),
+	"CONN_LINGER":                  checkInt(0, 1<<31-1),
+	"DSCP":                         checkInt(0, 63),
+	"DSCP_BACKENDS":                checkDSCPRules,
+	"CLIENT_ALLOW":                 checkIPNets,
+	"CLIENT_DENY":                  checkIPNets,
+	"CLIENT_ALLOW_COUNTRIES":       checkCountries,
+	"CLIENT_DENY_COUNTRIES":        checkCountries,
+	"CLIENT_ALLOW_ASNS":            checkASNs,
+	"CLIENT_DENY_ASNS":             checkASNs,
+	"GEOIP_COUNTRY_DB":             checkMMDB,
+	"GEOIP_ASN_DB":                 checkMMDB,
+	"GEOIP_RELOAD_INTERVAL":        checkInt(1, 1<<31-1),
+	"BAN_THRESHOLD":                checkInt(0, 1<<31-1),
+	"BAN_WINDOW":                   checkInt(1, 1<<31-1),
+	"BAN_DURATION":                 checkInt(1, 1<<31-1),
+	"MAX_PANICS_PER_MINUTE":        checkInt(0, 1<<31-1),
+	"ERROR_CLOSE":                  checkOneOf(_ErrorCloseDefault, _ErrorCloseFlush, _ErrorCloseReset),
+	"AUTH_FAILURE":                 checkOneOf(_AuthFailureCode, _AuthFailureDrop, _AuthFailureTarpit, _AuthFailureDecoy),
+	"TARPIT_TIMEOUT":               checkInt(1, 1<<31-1),
+	"REPLAY_WINDOW":                checkInt(0, 1<<31-1),
+	"FAILURE_DELAY":                checkInt(0, 60000),
+	"ROUTE_SCRIPT":                 checkRouteScript,
+	"HOST_ROUTES":                  checkHostRoutes,
+	"MIDDLEWARES":                  checkMiddlewares,
+	"AUTHZ_WEBHOOK":                checkURL,
+	"AUTHZ_TIMEOUT":                checkInt(1, 60000),
+	"AUTHZ_FAILURE":                checkOneOf(_AuthzDeny, _AuthzAllow),
+	"AUTHZ_FORMAT":                 checkOneOf(_AuthzFormatFrontd, _AuthzFormatOPA),
+	"ALERT_WEBHOOK":                checkURL,
+	"ALERT_FAILURE_RATE":           checkRate,
+	"ALERT_MIN_DIALS":              checkInt(1, 1<<31-1),
+	"ALERT_WINDOW":                 checkInt(1, 1<<31-1),
+	"ALERT_COOLDOWN":               checkInt(0, 1<<31-1),
+	"CHAOS_LATENCY":                checkInt(0, 60000),
+	"CHAOS_CORRUPT_RATE":           checkRate,
+	"CHAOS_STALL_RATE":             checkRate,
+	"CHAOS_STALL_TIME":             checkInt(1, 1<<31-1),
+	"CHAOS_RESET_RATE":             checkRate,
+	"DISABLE_ADDR_CACHE":           checkBool,
+	"ADDR_CACHE_TYPE":              checkOneOf("cow", "syncmap"),
+	"ADDR_CACHE_FILE":              nil,
+	"ADDR_CACHE_SNAPSHOT_INTERVAL": checkInt(1, 1<<31-1),
+	"USAGE_FILE":                   nil,
+	"USAGE_FLUSH_INTERVAL":         checkInt(1, 1<<31-1),
+	"USAGE_EXPORT":                 checkUsageExport,
+	"USAGE_EXPORT_SCHEDULE":        checkCron,
+	"USAGE_EXPORT_FORMAT":          checkOneOf("csv", "json"),
+	"USAGE_EXPORT_S3_ENDPOINT":     checkURL,
+	"USAGE_EXPORT_S3_REGION":       nil,
+	"QUOTAS":                       checkQuotas,
+	"QUOTA_THROTTLE_RATE":          checkInt(1, 1<<31-1),
+	"PRIORITY_BACKENDS":            checkPriorityRules,
+	"PRIORITY_SHED_CONNS":          checkPriorityConns,
+	"PRIORITY_THROTTLE_BANDWIDTH":  checkPriorityBandwidth,
+	"PRIORITY_THROTTLE_RATE":       checkInt(1, 1<<31-1),
+	"BANDWIDTH_LIMIT":              checkBandwidth,
+	"BANDWIDTH_BACKENDS":           checkBandwidthRules,
+	"LOG_FORMAT":                   checkOneOf("json", "text"),
+	"LOG_LEVEL":                    checkLogLevel,
+	"LOG_RATE_LIMIT":               checkInt(0, 1<<31-1),
+	"LOG_FILE":                     nil,
+	"LOG_ROTATE_SIZE":              checkInt(0, 1<<31-1),
+	"LOG_ROTATE_INTERVAL":          checkInt(0, 1<<31-1),
+	"LOG_ROTATE_KEEP":              checkInt(0, 1<<31-1),
+	"LOG_ROTATE_COMPRESS":          checkBool,
+	"ACCESS_LOG":                   nil,
+	"CAPTURE_DIR":                  checkDir,
+	"RECORD_DIR":                   checkDir,
+	"RECORD_BACKENDS":              checkBackendRules,
+	"RECONNECT_BACKENDS":           checkBackendRules,
+	"RECONNECT_MAX":                checkInt(1, 1<<31-1),
+	"RECORD_MAX_SIZE":              checkInt(1, 1<<31-1),
+	"AUDIT_LOG":                    nil,
+	"SYSLOG_ADDR":                  checkSyslogAddr,
+	"SYSLOG_FACILITY":              checkSyslogFacility,
+	"METRICS_PORT":                 checkInt(1, 65535),
+	"STATSD_ADDR":                  checkHostPort,
+	"STATSD_PREFIX":                nil,
+	"STATSD_DOGSTATSD":             checkBool,
+	"STATSD_INTERVAL":              checkInt(1, 1<<31-1),
+	"STATSD_TAGS":                  nil,
+	"EVENTS_URL":                   checkEventsURL,
+	"EVENTS_SUBJECT":               nil,
+	"OTEL_EXPORTER_OTLP_ENDPOINT":  checkURL,
+	"OTEL_SERVICE_NAME":            nil,
+	"ADMIN_ADDR":                   checkAdminAddr,
+	"GOPS_ADDR":                    checkAdminAddr,
+	"PPROF_PORT":                   checkInt(1, 65535),
+	"SHUTDOWN_DELAY":               checkInt(0, 1<<31-1),
+	"DRAIN_TIMEOUT":                checkInt(0, 1<<31-1),
+	"PID_FILE":                     nil,
+	"DAEMON":                       checkBool,
+	"RUN_AS_USER":                  checkUser,
+	"RUN_AS_GROUP":                 checkGroup,
+	"CHROOT":                       checkDir,
+	"SANDBOX":                      checkBool,
+}
+
+func checkInt(min, max int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min || n > max {
+			return fmt.Errorf("must be an integer between %d and %d", min, max)
+		}
+		return nil
+	}
+}
+
+func checkBool(v string) error {
+	_, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("must be true or false")
+	}
+	return nil
+}
+
+func checkOneOf(values ...string) func(string) error {
+	return func(v string) error {
+		for _, s := range values {
+			if v == s {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+func checkLogLevel(v string) error {
+	var l slog.Level
+	return l.UnmarshalText([]byte(v))
+}
+
+func checkHostPort(v string) error {
+	_, port, err := net.SplitHostPort(v)
+	if err != nil {
+		return err
+	}
+	return checkInt(0, 65535)(port)
+}
+
+func checkAdminAddr(v string) error {
+	return checkHostPort(adminAddr(v))
+}
+
+func checkSyslogAddr(v string) error {
+	switch {
+	case v == "local":
+		return nil
+	case strings.HasPrefix(v, "udp://"), strings.HasPrefix(v, "tcp://"):
+		return checkHostPort(v[len("udp://"):])
+	}
+	return fmt.Errorf("must be local, udp://host:port or tcp://host:port")
+}
+
+func checkSyslogFacility(v string) error {
+	if _, ok := _SyslogFacilities[strings.ToLower(v)]; !ok {
+		return fmt.Errorf("unknown facility")
+	}
+	return nil
+}
+
+func checkUser(v string) error {
+	_, err := user.Lookup(v)
+	return err
+}
+
+func checkGroup(v string) error {
+	_, err := user.LookupGroup(v)
+	return err
+}
+
+func checkDir(v string) error {
+	fi, err := os.Stat(v)
+	if err == nil && !fi.IsDir() {
+		err = fmt.Errorf("not a directory")
+	}
+	return err
+}
+
+func checkURL(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an http or https URL")
+	}
+	return nil
+}
+
+// settingSource describes where the effective value of key comes from
+func settingSource(key string) string {
+	if _, ok := flags()[key]; ok {
+		return "flag"
+	}
+	if _, ok := os.LookupEnv(key); ok {
+		return "environment"
+	}
+	return "config"
+}
+
+// checkSettings validates the effective settings and returns every problem
+// found, including unknown settings in the configuration file
+func checkSettings() []error {
+	var errs []error
+	fail := func(key, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s (%s): %s", key, settingSource(key), fmt.Sprintf(format, args...)))
+	}
+
+	var unknown []string
+	for k := range config() {
+		if _, ok := _SettingChecks[k]; !ok {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	for _, k := range unknown {
+		errs = append(errs, fmt.Errorf("%s (config): unknown setting", k))
+	}
+
+	var keys []string
+	for k := range _SettingChecks {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, ok := lookupEnv(k)
+		if !ok || _SettingChecks[k] == nil {
+			continue
+		}
+		if err := _SettingChecks[k](v); err != nil {
+			fail(k, "%v, got %q", err, v)
+		}
+	}
+
+	// the secret
+	secret, hasSecret := lookupEnv("SECRET")
+	secretFile, hasSecretFile := lookupEnv("SECRET_FILE")
+	switch {
+	case hasSecret && hasSecretFile:
+		fail("SECRET_FILE", "conflicts with SECRET, set only one of them")
+	case hasSecretFile:
+		b, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			fail("SECRET_FILE", "%v", err)
+		}
+		secret = strings.TrimRight(string(b), "\r\n")
+		if err == nil && len(secret) < _MinSecretLength {
+			fail("SECRET_FILE", "passphrase must be at least %d bytes, got %d", _MinSecretLength, len(secret))
+		}
+	case !hasSecret || secret == "":
+		errs = append(errs, fmt.Errorf("SECRET: not set"))
+	case len(secret) < _MinSecretLength:
+		fail("SECRET", "passphrase must be at least %d bytes, got %d", _MinSecretLength, len(secret))
+	}
+
+	// listeners must not collide
+	listen := ":" + strconv.Itoa(_DefaultPort)
+	if v := getenv("LISTEN_PORT"); v != "" {
+		listen = ":" + v
+	}
+	if v := getenv("LISTEN_ADDR"); v != "" {
+		listen = v
+	}
+	ports := map[string]string{}
+	addPort := func(key, addr string) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil || port == "0" {
+			return
+		}
+		if other, ok := ports[port]; ok {
+			fail(key, "port %s is also used by %s", port, other)
+			return
+		}
+		ports[port] = key
+	}
+	addPort("LISTEN_ADDR", listen)
+	for _, k := range []string{"METRICS_PORT", "PPROF_PORT"} {
+		if v := getenv(k); v != "" {
+			addPort(k, ":"+v)
+		}
+	}
+	for _, k := range []string{"ADMIN_ADDR", "GOPS_ADDR"} {
+		if v := getenv(k); v != "" {
+			addPort(k, adminAddr(v))
+		}
+	}
+
+	// settings without effect
+	noCache, _ := strconv.ParseBool(getenv("DISABLE_ADDR_CACHE"))
+	if noCache && getenv("ADDR_CACHE_FILE") != "" {
+		fail("ADDR_CACHE_FILE", "has no effect as DISABLE_ADDR_CACHE is set")
+	}
+	if getenv("USAGE_FLUSH_INTERVAL") != "" && getenv("USAGE_FILE") == "" {
+		fail("USAGE_FLUSH_INTERVAL", "has no effect without USAGE_FILE")
+	}
+	if getenv("USAGE_EXPORT") == "" {
+		for _, k := range []string{"USAGE_EXPORT_SCHEDULE", "USAGE_EXPORT_FORMAT"} {
+			if getenv(k) != "" {
+				fail(k, "has no effect without USAGE_EXPORT")
+			}
+		}
+	} else if getenv("USAGE_FILE") == "" {
+		fail("USAGE_EXPORT", "has no effect without USAGE_FILE")
+	} else if strings.HasPrefix(getenv("USAGE_EXPORT"), "s3:") {
+		if os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
+			fail("USAGE_EXPORT", "needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY in the environment")
+		}
+	}
+	if !strings.HasPrefix(getenv("USAGE_EXPORT"), "s3:") {
+		for _, k := range []string{"USAGE_EXPORT_S3_ENDPOINT", "USAGE_EXPORT_S3_REGION"} {
+			if getenv(k) != "" {
+				fail(k, "has no effect without an s3:// USAGE_EXPORT")
+			}
+		}
+	}
+	if getenv("USAGE_FILE") == "" {
+		rules, _ := parseQuotas(getenv("QUOTAS"))
+		for _, r := range rules {
+			if r.bytes > 0 {
+				fail("QUOTAS", "%s: bytes per day are not accounted without USAGE_FILE", r.rule)
+			}
+		}
+	}
+	if getenv("QUOTA_THROTTLE_RATE") != "" && getenv("QUOTAS") == "" {
+		fail("QUOTA_THROTTLE_RATE", "has no effect without QUOTAS")
+	}
+	if getenv("PRIORITY_THROTTLE_RATE") != "" && getenv("PRIORITY_THROTTLE_BANDWIDTH") == "" {
+		fail("PRIORITY_THROTTLE_RATE", "has no effect without PRIORITY_THROTTLE_BANDWIDTH")
+	}
+	if getenv("PRIORITY_BACKENDS") != "" && getenv("PRIORITY_SHED_CONNS") == "" && getenv("PRIORITY_THROTTLE_BANDWIDTH") == "" {
+		fail("PRIORITY_BACKENDS", "has no effect without PRIORITY_SHED_CONNS or PRIORITY_THROTTLE_BANDWIDTH")
+	}
+	if mws := getenv("MIDDLEWARES"); getenv("PRIORITY_SHED_CONNS") != "" && mws != "" &&
+		!strings.Contains(","+strings.ReplaceAll(mws, " ", "")+",", ",priority,") {
+		fail("PRIORITY_SHED_CONNS", "has no effect as MIDDLEWARES leaves out priority")
+	}
+	if getenv("STATSD_ADDR") == "" {
+		for _, k := range []string{"STATSD_PREFIX", "STATSD_DOGSTATSD", "STATSD_INTERVAL", "STATSD_TAGS"} {
+			if getenv(k) != "" {
+				fail(k, "has no effect without STATSD_ADDR")
+			}
+		}
+	}
+	for _, k := range []string{"SNI_ROUTES", "ECH_KEY_FILE"} {
+		if getenv(k) != "" && getenv("TLS_CERT_FILE") == "" {
+			fail(k, "has no effect without TLS_CERT_FILE")
+		}
+	}
+	if getenv("SNI_BACKEND_CA_FILE") != "" && getenv("SNI_ROUTES") == "" {
+		fail("SNI_BACKEND_CA_FILE", "has no effect without SNI_ROUTES")
+	}
+	if getenv("LOG_FILE") == "" && getenv("ACCESS_LOG") == "" && getenv("AUDIT_LOG") == "" {
+		for _, k := range []string{"LOG_ROTATE_SIZE", "LOG_ROTATE_INTERVAL"} {
+			if getenv(k) != "" && getenv(k) != "0" {
+				fail(k, "has no effect without LOG_FILE, ACCESS_LOG or AUDIT_LOG")
+			}
+		}
+	}
+	if getenv("BAN_THRESHOLD") == "" || getenv("BAN_THRESHOLD") == "0" {
+		for _, k := range []string{"BAN_WINDOW", "BAN_DURATION"} {
+			if getenv(k) != "" {
+				fail(k, "has no effect without BAN_THRESHOLD")
+			}
+		}
+	}
+	for db, keys := range map[string][]string{
+		"GEOIP_COUNTRY_DB": {"CLIENT_ALLOW_COUNTRIES", "CLIENT_DENY_COUNTRIES"},
+		"GEOIP_ASN_DB":     {"CLIENT_ALLOW_ASNS", "CLIENT_DENY_ASNS"},
+	} {
+		for _, k := range keys {
+			if getenv(k) != "" && getenv(db) == "" {
+				fail(k, "has no effect without %s", db)
+			}
+		}
+	}
+	if getenv("AUTHZ_WEBHOOK") == "" {
+		for _, k := range []string{"AUTHZ_TIMEOUT", "AUTHZ_FAILURE", "AUTHZ_FORMAT"} {
+			if getenv(k) != "" {
+				fail(k, "has no effect without AUTHZ_WEBHOOK")
+			}
+		}
+	} else if mws := getenv("MIDDLEWARES"); mws != "" && !strings.Contains(","+strings.ReplaceAll(mws, " ", "")+",", ",authz,") {
+		fail("AUTHZ_WEBHOOK", "has no effect as MIDDLEWARES leaves out authz")
+	}
+	if getenv("ALERT_WEBHOOK") == "" {
+		for _, k := range []string{"ALERT_FAILURE_RATE", "ALERT_MIN_DIALS", "ALERT_WINDOW", "ALERT_COOLDOWN"} {
+			if getenv(k) != "" {
+				fail(k, "has no effect without ALERT_WEBHOOK")
+			}
+		}
+	}
+	if getenv("EVENTS_SUBJECT") != "" && !strings.HasPrefix(getenv("EVENTS_URL"), "nats:") {
+		fail("EVENTS_SUBJECT", "has no effect without a nats:// EVENTS_URL")
+	}
+	if getenv("RECONNECT_MAX") != "" && getenv("RECONNECT_BACKENDS") == "" {
+		fail("RECONNECT_MAX", "has no effect without RECONNECT_BACKENDS")
+	}
+	if _, err := loadTLSCert(); err != nil {
+		fail("TLS_CERT_FILE", "%v", err)
+	}
+	if _, err := loadECHKeys(); err != nil {
+		fail("ECH_KEY_FILE", "%v", err)
+	}
+	if _, err := loadSNIRoutes(); err != nil {
+		fail("SNI_ROUTES", "%v", err)
+	}
+	if t, err := loadTransport(); err != nil {
+		fail("OBFUSCATE", "%v", err)
+	} else if t.name != "scramble" && getenv("OBFUSCATE_PADDING") != "" {
+		fail("OBFUSCATE_PADDING", "has no effect without the scramble transport")
+	}
+	if getenv("RECORD_BACKENDS") != "" && getenv("RECORD_DIR") == "" {
+		fail("RECORD_BACKENDS", "has no effect without RECORD_DIR")
+	}
+	if wt, err := strconv.Atoi(getenv("WATCHDOG_TIMEOUT")); err == nil && wt > 0 {
+		// a handshake may take a read and a dial before it's wedged
+		rt, bt := 30, 5
+		if v, err := strconv.Atoi(getenv("CONN_READ_TIMEOUT")); err == nil && v >= 0 {
+			rt = v
+		}
+		if v, err := strconv.Atoi(getenv("BACKEND_TIMEOUT")); err == nil && v > 0 {
+			bt = v
+		}
+		if wt <= rt+bt {
+			fail("WATCHDOG_TIMEOUT", "closes healthy handshakes, must exceed CONN_READ_TIMEOUT plus BACKEND_TIMEOUT (%d)", rt+bt)
+		}
+	}
+	daemon, _ := strconv.ParseBool(getenv("DAEMON"))
+	if daemon && getenv("LOG_FILE") == "" && getenv("SYSLOG_ADDR") == "" {
+		fail("DAEMON", "logs are discarded without LOG_FILE or SYSLOG_ADDR")
+	}
+	if getenv("SYSLOG_ADDR") != "" && getenv("LOG_FILE") != "" {
+		fail("LOG_FILE", "has no effect as SYSLOG_ADDR is set")
+	}
+
+	return errs
+}
+
+// checkConfig validates the configuration file at path merged with flags and
+// environment, reporting every problem to stderr. It returns the exit code.
+func checkConfig(path string) int {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	_Config.Store(cfg)
+
+	errs := checkSettings()
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+	}
+	if len(errs) > 0 {
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%s: configuration ok\n", path)
+	return 0
+}
@@ -0,0 +1,119 @@
+package frontd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/xindong/frontd/seal"
+)
+
+// A cipher address may carry claims after the backend address as a URL
+// query, e.g. "10.1.2.3:22?until=1767225600". The session of a token with
+// an until claim is refused from then on with 4113, and torn down when it
+// is reached during the tunnel. The failover claim is the address redialed
+// if the backend of a reconnecting tunnel drops, compress=deflate
+// compresses the tunnel, see compress.go, encrypt=aes-256-gcm seals it,
+// see seal.go, but not together as the lengths of the compressed frames
+// would leak the plain text, tenant names who the usage of the token is accounted and
+// limited for besides the token, see quota.go, and priority sets the class of
+// its tunnels, see priority.go. Unknown claims are ignored so newer tokens
+// still work with older relays.
+
+var (
+	errTokenExpired = errors.New("token expired")
+	errClaims       = errors.New("invalid token claims")
+)
+
+// tokenClaims are the claims of a cipher address
+type tokenClaims struct {
+	until    time.Time // zero if the session isn't time boxed
+	failover string
+	compress string // empty for plain tunnels
+	encrypt  string // empty for tunnels not sealed
+	tenant   string
+	priority string // empty for the class of the backend
+}
+
+// parseClaims splits a decrypted cipher address into the backend address
+// and its claims
+func parseClaims(addr []byte) ([]byte, *tokenClaims, error) {
+	i := bytes.IndexByte(addr, '?')
+	if i < 0 {
+		return addr, nil, nil
+	}
+	q, err := url.ParseQuery(string(addr[i+1:]))
+	if err != nil {
+		return nil, nil, errClaims
+	}
+	claims := &tokenClaims{}
+	if v := q.Get("until"); v != "" {
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || sec <= 0 {
+			return nil, nil, errClaims
+		}
+		claims.until = time.Unix(sec, 0)
+	}
+	if v := q.Get("failover"); v != "" {
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			return nil, nil, errClaims
+		}
+		claims.failover = v
+	}
+	if v := q.Get("compress"); v != "" {
+		if v != _CompressDeflate {
+			return nil, nil, errClaims
+		}
+		claims.compress = v
+	}
+	if v := q.Get("encrypt"); v != "" {
+		if v != seal.Name {
+			return nil, nil, errClaims
+		}
+		claims.encrypt = v
+	}
+	if claims.compress != "" && claims.encrypt != "" {
+		return nil, nil, errClaims
+	}
+	claims.tenant = q.Get("tenant")
+	if v := q.Get("priority"); v != "" {
+		if !_PriorityClasses[v] {
+			return nil, nil, errClaims
+		}
+		claims.priority = v
+	}
+	return addr[:i], claims, nil
+}
+
+// enforceClaims refuses the session of expired claims with 4113, or bounds
+// it by their until, and keeps the failover, compression, encryption,
+// tenant and priority. The returned function releases the deadline.
+func enforceClaims(c *Conn, claims *tokenClaims) (func(), bool) {
+	if claims == nil {
+		return func() {}, true
+	}
+	c.s.failover = claims.failover
+	c.s.compress = claims.compress
+	c.s.encrypt = claims.encrypt
+	c.s.tenant = claims.tenant
+	c.s.priority = claims.priority
+	if claims.until.IsZero() {
+		return func() {}, true
+	}
+	if !time.Now().Before(claims.until) {
+		c.Refuse("4113", errTokenExpired)
+		return nil, false
+	}
+	s := c.s
+	ctx, cancel := context.WithDeadlineCause(s.ctx, claims.until, errTokenExpired)
+	s.ctx = ctx
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	return func() {
+		stop()
+		cancel()
+	}, true
+}
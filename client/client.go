@@ -0,0 +1,408 @@
+// Package client connects to backends through a frontd gateway. It encrypts
+// the backend address with the shared secret, performs the handshake and
+// returns the tunnel as a net.Conn.
+//
+//	d := &client.Dialer{Gateway: "gw.example.com:4043", Secret: []byte("SomePassphrase")}
+//	conn, err := d.Dial("tcp", "10.1.2.3:80")
+//
+// Dialer implements the Dialer and ContextDialer interfaces of
+// golang.org/x/net/proxy, so it can be used wherever those are accepted.
+package client
+
+import (
+	"compress/flate"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xindong/frontd/aes256cbc"
+	"github.com/xindong/frontd/obfs"
+	"github.com/xindong/frontd/seal"
+)
+
+var _Aes256CBC = aes256cbc.New()
+
+// first bytes of the handshakes and frame of session tickets
+const (
+	_HandshakeTicket = 0x02
+	_HandshakeResume = 0x03
+	_TicketFrame     = 0x02
+)
+
+// Encrypt returns the base64 encoded cipher address of addr, as sent in the
+// text handshake or the X-Cipher-Origin header. Every call uses a new salt.
+func Encrypt(secret []byte, addr string) (string, error) {
+	b, err := _Aes256CBC.EncryptString(secret, []byte(addr))
+	return string(b), err
+}
+
+// Decrypt returns the backend address of a base64 encoded cipher address
+func Decrypt(secret []byte, cipherAddr string) (string, error) {
+	b, err := _Aes256CBC.DecryptString(secret, []byte(cipherAddr))
+	return string(b), err
+}
+
+// Error is a handshake failure reported by the gateway
+type Error struct {
+	Code string // e.g. 4101 when the backend timed out
+}
+
+var _ErrorMessages = map[string]string{
+	"4100": "client refused",
+	"4101": "backend timeout",
+	"4102": "backend unreachable",
+	"4103": "invalid handshake",
+	"4104": "invalid handshake",
+	"4106": "cipher address not decrypted",
+	"4107": "invalid http header",
+	"4108": "cipher address missing",
+	"4109": "invalid handshake",
+	"4110": "gateway in maintenance",
+	"4111": "backend not allowed",
+	"4112": "cipher address replayed",
+	"4113": "token expired",
+	"4114": "quota exceeded",
+	"4115": "gateway busy",
+}
+
+func (e *Error) Error() string {
+	msg, ok := _ErrorMessages[e.Code]
+	if !ok {
+		msg = "handshake failed"
+	}
+	return fmt.Sprintf("frontd: %s (%s)", msg, e.Code)
+}
+
+// Dialer connects to backends through the gateway
+type Dialer struct {
+	// Gateway is the host:port of frontd
+	Gateway string
+	// Secret is the passphrase shared with frontd
+	Secret []byte
+	// Binary uses the binary handshake, which is 12 bytes shorter
+	Binary bool
+	// Tickets asks the gateway for a session ticket with the binary
+	// handshake and presents it instead of the cipher address when the
+	// address is dialed again, which the gateway routes at once. The ticket
+	// is renewed by every connection and dropped once the gateway refuses
+	// it with 4106 or 4113, the next Dial then sends the cipher address.
+	// Tickets are received by the first Read of a connection.
+	Tickets bool
+	// Compress asks the gateway to compress the tunnel with deflate, which
+	// saves bandwidth on slow links for compressible protocols. Older
+	// gateways refuse the address or relay the compressed bytes as is.
+	Compress bool
+	// Encrypt asks the gateway to encrypt and authenticate the tunnel with
+	// AES-256-GCM under keys derived from the secret, see package seal, for
+	// gateways reached without TLS. Writes wait for the gateway to connect
+	// the backend and return its error code, Close ends the tunnel so the
+	// gateway can tell it from a truncated one. It can't be used with
+	// Compress, whose lengths would leak the plain text. Older gateways relay
+	// it unencrypted.
+	Encrypt bool
+	// Obfuscate scrambles everything sent to and received from the gateway,
+	// which must use the scramble transport
+	Obfuscate bool
+	// Transport wraps the connection to the gateway like the custom
+	// ClientTransport the gateway uses, nil for none
+	Transport func(c net.Conn) (net.Conn, error)
+	// Timeout bounds connecting to the gateway, 0 for none
+	Timeout time.Duration
+	// Forward connects to the gateway, nil uses a net.Dialer
+	Forward interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	}
+
+	tickets sync.Map // address to its last ticket
+}
+
+// Dial connects to addr through the gateway, network must be "tcp"
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the gateway, network must be "tcp".
+// frontd only answers failed handshakes, they are returned by the first Read
+// of the connection as *Error.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("frontd: network %s not supported", network)
+	}
+	if d.Compress && d.Encrypt {
+		return nil, errors.New("frontd: can't both compress and encrypt")
+	}
+
+	hs, err := d.handshake(addr)
+	if err != nil {
+		return nil, err
+	}
+	var nonce []byte
+	if d.Encrypt {
+		nonce, err = seal.NewNonce()
+		if err != nil {
+			return nil, err
+		}
+		hs = append(hs, nonce...)
+	}
+
+	fwd := d.Forward
+	if fwd == nil {
+		fwd = &net.Dialer{Timeout: d.Timeout}
+	}
+	c, err := fwd.DialContext(ctx, "tcp", d.Gateway)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Obfuscate {
+		c = obfs.NewConn(c, obfs.Key(d.Secret), obfs.DefaultPadding)
+	}
+	if d.Transport != nil {
+		tc, err := d.Transport(c)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetWriteDeadline(deadline)
+		defer c.SetWriteDeadline(time.Time{})
+	}
+	_, err = c.Write(hs)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	conn := &Conn{Conn: c}
+	if d.Tickets {
+		conn.onTicket = func(ticket []byte) {
+			if len(ticket) == 0 {
+				d.tickets.Delete(addr)
+			} else {
+				d.tickets.Store(addr, ticket)
+			}
+		}
+	}
+	if d.Encrypt {
+		conn.sr, conn.sw = seal.NewClient(rawReader{conn}, c, d.Secret, nonce)
+	}
+	if d.Compress {
+		conn.zw, _ = flate.NewWriter(c, flate.BestSpeed)
+		conn.zr = flate.NewReader(rawReader{conn})
+	}
+	return conn, nil
+}
+
+// handshake returns the bytes sent to the gateway for addr
+func (d *Dialer) handshake(addr string) ([]byte, error) {
+	if t, ok := d.tickets.Load(addr); ok && d.Tickets {
+		ticket := t.([]byte)
+		hs := binary.BigEndian.AppendUint16([]byte{_HandshakeResume}, uint16(len(ticket)))
+		return append(hs, ticket...), nil
+	}
+	var claims []string
+	if d.Compress {
+		claims = append(claims, "compress=deflate")
+	}
+	if d.Encrypt {
+		claims = append(claims, "encrypt="+seal.Name)
+	}
+	if len(claims) > 0 {
+		addr += "?" + strings.Join(claims, "&")
+	}
+	b, err := _Aes256CBC.Encrypt(d.Secret, []byte(addr))
+	if err != nil {
+		return nil, err
+	}
+	if d.Binary || d.Tickets {
+		if len(b) > 255 {
+			return nil, errors.New("frontd: address too long for the binary handshake")
+		}
+		first := byte(0)
+		if d.Tickets {
+			first = _HandshakeTicket
+		}
+		return append([]byte{first, byte(len(b))}, b...), nil
+	}
+	hs := make([]byte, base64.StdEncoding.EncodedLen(len(b))+1)
+	base64.StdEncoding.Encode(hs, b)
+	hs[len(hs)-1] = '\n'
+	return hs, nil
+}
+
+// Dial connects to addr through the gateway with the default settings
+func Dial(gateway string, secret []byte, addr string) (net.Conn, error) {
+	d := &Dialer{Gateway: gateway, Secret: secret}
+	return d.Dial("tcp", addr)
+}
+
+// Conn is a tunnel through the gateway. Its first Read reports an error code
+// of the gateway, which is 4 bytes followed by the end of the connection, as
+// *Error. Backends sending exactly such 4 bytes first and then waiting for
+// the client can't be told apart from it and are not supported, unless the
+// Dialer uses Tickets.
+type Conn struct {
+	net.Conn
+
+	checked bool
+	pending []byte // read while checking for an error code
+	err     error  // returned after pending
+	code    *Error // returned by every read once received
+
+	// of tunnels with tickets, the ticket frame precedes the data
+	onTicket func(ticket []byte)
+
+	// of encrypted tunnels
+	sr *seal.Reader
+	sw *seal.Writer
+
+	// of compressed tunnels
+	zr  io.ReadCloser
+	zw  *flate.Writer
+	eof bool // the gateway closed the connection
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.zr == nil {
+		if c.sr != nil {
+			return c.sr.Read(p)
+		}
+		return c.readRaw(p)
+	}
+	n, err := c.zr.Read(p)
+	if errors.Is(err, io.ErrUnexpectedEOF) && c.eof {
+		// the gateway hangs up without ending the stream
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Write sends p, compressed and flushed at once in compressed tunnels
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.zw == nil {
+		if c.sw != nil {
+			return c.sw.Write(p)
+		}
+		return c.Conn.Write(p)
+	}
+	n, err := c.zw.Write(p)
+	if err == nil {
+		err = c.zw.Flush()
+	}
+	return n, err
+}
+
+// Close closes the connection, after ending the tunnel in encrypted ones
+func (c *Conn) Close() error {
+	if c.sw != nil {
+		c.sw.Close()
+	}
+	return c.Conn.Close()
+}
+
+// rawReader reads the connection before decryption and decompression
+type rawReader struct {
+	c *Conn
+}
+
+func (r rawReader) Read(p []byte) (int, error) {
+	n, err := r.c.readRaw(p)
+	r.c.eof = err == io.EOF
+	return n, err
+}
+
+// readRaw reads from the gateway, reporting an error code as *Error
+func (c *Conn) readRaw(p []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		var code string
+		var err error
+		if c.onTicket != nil {
+			// error codes are sent instead of the ticket frame, so any
+			// data is told apart from them
+			code, err = c.readTicket()
+		} else {
+			code, err = c.readCode()
+		}
+		if code != "" {
+			c.code = &Error{Code: code}
+		}
+		c.err = err
+	}
+	if c.code != nil {
+		return 0, c.code
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		err := c.err
+		c.err = nil
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+// readCode reads what may be an error code, the gateway sends it with a
+// single write and closes the connection right after it. What is not a code
+// is kept in pending.
+func (c *Conn) readCode() (string, error) {
+	buf := make([]byte, 5)
+	n, err := c.Conn.Read(buf[:4])
+	c.pending = buf[:n]
+	if n < 4 || !isCode(buf[:4]) {
+		return "", err
+	}
+	m, err := c.Conn.Read(buf[4:5])
+	if m == 0 && err == io.EOF {
+		c.pending = nil
+		return string(buf[:4]), nil
+	}
+	c.pending = buf[:4+m]
+	return "", err
+}
+
+// readTicket reads the ticket frame sent before the data, or the error code
+// sent instead of it
+func (c *Conn) readTicket() (string, error) {
+	var h [4]byte
+	_, err := io.ReadFull(c.Conn, h[:3])
+	if err != nil {
+		return "", err
+	}
+	if h[0] != _TicketFrame {
+		_, err = io.ReadFull(c.Conn, h[3:])
+		if err != nil || !isCode(h[:]) {
+			return "", errors.New("frontd: invalid ticket frame")
+		}
+		if code := string(h[:]); code == "4106" || code == "4113" {
+			// the ticket presented was refused
+			c.onTicket(nil)
+		}
+		return string(h[:]), nil
+	}
+	ticket := make([]byte, binary.BigEndian.Uint16(h[1:]))
+	_, err = io.ReadFull(c.Conn, ticket)
+	if err != nil {
+		return "", err
+	}
+	c.onTicket(ticket)
+	return "", nil
+}
+
+// isCode reports whether b is an error code 41xx
+func isCode(b []byte) bool {
+	return b[0] == '4' && b[1] == '1' && b[2] >= '0' && b[2] <= '9' && b[3] >= '0' && b[3] <= '9'
+}
@@ -0,0 +1,270 @@
+package client
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xindong/frontd/seal"
+)
+
+var _secret = []byte("p0S8rX680*48")
+
+// gateway imitates frontd, it echoes after a handshake for "echo" and
+// answers 4102 otherwise. Compressed tunnels are echoed as is, which makes
+// the stream of the client the one it decompresses, encrypted ones are
+// opened and sealed again like frontd does. Its tickets are the address,
+// refused unless it's "echo".
+func gateway(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				rdr := bufio.NewReader(c)
+				var key []byte
+				b, _ := rdr.ReadByte()
+				if b == _HandshakeResume {
+					var l [2]byte
+					io.ReadFull(rdr, l[:])
+					ticket := make([]byte, int(l[0])<<8|int(l[1]))
+					io.ReadFull(rdr, ticket)
+					if string(ticket) != "echo" {
+						c.Write([]byte("4106"))
+						return
+					}
+					c.Write(append([]byte{_TicketFrame, 0, 4}, ticket...))
+					io.Copy(c, rdr)
+					return
+				}
+				if b == 0 || b == _HandshakeTicket {
+					n, _ := rdr.ReadByte()
+					key = make([]byte, n)
+					io.ReadFull(rdr, key)
+				} else {
+					rdr.UnreadByte()
+					line, _, _ := rdr.ReadLine()
+					key, _ = base64.StdEncoding.DecodeString(string(line))
+				}
+				addr, err := _Aes256CBC.Decrypt(_secret, key)
+				host, claims, _ := strings.Cut(string(addr), "?")
+				if err != nil || host != "echo" {
+					c.Write([]byte("4102"))
+					return
+				}
+				if b == _HandshakeTicket {
+					c.Write([]byte{_TicketFrame, 0, 4, 'e', 'c', 'h', 'o'})
+				}
+				if strings.Contains(claims, "encrypt="+seal.Name) {
+					clientNonce := make([]byte, seal.NonceSize)
+					io.ReadFull(rdr, clientNonce)
+					nonce, _ := seal.NewNonce()
+					c.Write(nonce)
+					w := seal.NewWriter(c, seal.DownstreamKey(_secret, clientNonce, nonce))
+					_, err := io.Copy(w, seal.NewReader(rdr, seal.UpstreamKey(_secret, clientNonce, nonce)))
+					if err == nil {
+						w.Close()
+					}
+					return
+				}
+				io.Copy(c, rdr)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestDialer(t *testing.T) {
+	l := gateway(t)
+	defer l.Close()
+
+	for _, binary := range []bool{false, true} {
+		d := &Dialer{Gateway: l.Addr().String(), Secret: _secret, Binary: binary, Timeout: time.Second}
+		conn, err := d.Dial("tcp", "echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 3))
+		// replies shorter than and looking like error codes are relayed
+		for _, msg := range []string{"41", "4199!", "hello"} {
+			conn.Write([]byte(msg))
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(conn, buf)
+			if err != nil || string(buf) != msg {
+				t.Fatal("unexpected echo:", string(buf), err)
+			}
+		}
+		conn.Close()
+
+		conn, err = d.Dial("tcp", "other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 3))
+		_, err = conn.Read(make([]byte, 16))
+		var e *Error
+		if !errors.As(err, &e) || e.Code != "4102" {
+			t.Fatal("error code not reported:", err)
+		}
+		conn.Close()
+	}
+
+	if _, err := (&Dialer{}).Dial("udp", "echo"); err == nil {
+		t.Fatal("udp dialed")
+	}
+}
+
+func TestCompress(t *testing.T) {
+	l := gateway(t)
+	defer l.Close()
+
+	d := &Dialer{Gateway: l.Addr().String(), Secret: _secret, Compress: true, Timeout: time.Second}
+	conn, err := d.Dial("tcp", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	for _, msg := range []string{"4199", strings.Repeat("hello ", 1000)} {
+		conn.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, buf)
+		if err != nil || string(buf) != msg {
+			t.Fatal("unexpected echo:", len(buf), err)
+		}
+	}
+	conn.Close()
+
+	conn, err = d.Dial("tcp", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	_, err = conn.Read(make([]byte, 16))
+	var e *Error
+	if !errors.As(err, &e) || e.Code != "4102" {
+		t.Fatal("error code not reported:", err)
+	}
+	conn.Close()
+}
+
+func TestSeal(t *testing.T) {
+	l := gateway(t)
+	defer l.Close()
+
+	for _, d := range []*Dialer{
+		{Gateway: l.Addr().String(), Secret: _secret, Encrypt: true, Timeout: time.Second},
+		{Gateway: l.Addr().String(), Secret: _secret, Encrypt: true, Binary: true, Timeout: time.Second},
+	} {
+		conn, err := d.Dial("tcp", "echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 3))
+		for _, msg := range []string{"4199", strings.Repeat("hello ", 5000)} {
+			conn.Write([]byte(msg))
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(conn, buf)
+			if err != nil || string(buf) != msg {
+				t.Fatal("unexpected echo:", len(buf), err)
+			}
+		}
+		// the gateway ends the tunnel once the client did
+		conn.(*Conn).sw.Close()
+		_, err = conn.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Fatal("tunnel not ended:", err)
+		}
+		conn.Close()
+
+		// writes wait for the nonce of the gateway, reporting its error code
+		conn, err = d.Dial("tcp", "other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 3))
+		_, err = conn.Write([]byte("hello"))
+		var e *Error
+		if !errors.As(err, &e) || e.Code != "4102" {
+			t.Fatal("error code not reported by the write:", err)
+		}
+		_, err = conn.Read(make([]byte, 16))
+		if !errors.As(err, &e) || e.Code != "4102" {
+			t.Fatal("error code not reported by the read:", err)
+		}
+		conn.Close()
+	}
+
+	d := &Dialer{Gateway: l.Addr().String(), Secret: _secret, Encrypt: true, Compress: true}
+	if _, err := d.Dial("tcp", "echo"); err == nil {
+		t.Fatal("dialed compressed and encrypted")
+	}
+}
+
+func TestTickets(t *testing.T) {
+	l := gateway(t)
+	defer l.Close()
+
+	d := &Dialer{Gateway: l.Addr().String(), Secret: _secret, Tickets: true, Timeout: time.Second}
+	echo := func() error {
+		conn, err := d.Dial("tcp", "echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second * 3))
+		conn.Write([]byte("4199"))
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		if err == nil && string(buf) != "4199" {
+			t.Fatal("unexpected echo:", string(buf))
+		}
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		if err := echo(); err != nil {
+			t.Fatal(err)
+		}
+		if ticket, ok := d.tickets.Load("echo"); !ok || string(ticket.([]byte)) != "echo" {
+			t.Fatal("ticket not kept:", ticket)
+		}
+	}
+	if hs, _ := d.handshake("echo"); hs[0] != _HandshakeResume {
+		t.Fatal("ticket not presented:", hs)
+	}
+
+	// refused tickets are dropped
+	d.tickets.Store("echo", []byte("stale"))
+	var e *Error
+	if err := echo(); !errors.As(err, &e) || e.Code != "4106" {
+		t.Fatal("refused ticket not reported:", err)
+	}
+	if _, ok := d.tickets.Load("echo"); ok {
+		t.Fatal("refused ticket kept")
+	}
+	if err := echo(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	c, err := Encrypt(_secret, "127.0.0.1:62863")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := Decrypt(_secret, c)
+	if err != nil || addr != "127.0.0.1:62863" {
+		t.Fatal("round trip failed:", addr, err)
+	}
+}
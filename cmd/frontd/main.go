@@ -0,0 +1,9 @@
+// Command frontd is the encrypted TCP/HTTP relay, see the frontd package for
+// embedding it in other programs.
+package main
+
+import "github.com/xindong/frontd"
+
+func main() {
+	frontd.Main()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+)
+
+func init() {
+	_Commands = append(_Commands,
+		command{"ech keygen", "generate the key and configuration of Encrypted ClientHello", echKeygen})
+}
+
+// ECH with DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and AES-128-GCM or
+// ChaCha20Poly1305
+const (
+	_ECHVersion = 0xfe0d
+	_KEMX25519  = 0x0020
+	_KDFSHA256  = 0x0001
+)
+
+var _AEADs = []uint16{0x0001, 0x0003}
+
+// echConfigList marshals the ECHConfigList of a single ECHConfig
+func echConfigList(id uint8, pub []byte, publicName string) []byte {
+	var c []byte
+	c = append(c, id)
+	c = binary.BigEndian.AppendUint16(c, _KEMX25519)
+	c = binary.BigEndian.AppendUint16(c, uint16(len(pub)))
+	c = append(c, pub...)
+	c = binary.BigEndian.AppendUint16(c, uint16(4*len(_AEADs)))
+	for _, aead := range _AEADs {
+		c = binary.BigEndian.AppendUint16(c, _KDFSHA256)
+		c = binary.BigEndian.AppendUint16(c, aead)
+	}
+	c = append(c, 0) // maximum_name_length, up to the client
+	c = append(c, uint8(len(publicName)))
+	c = append(c, publicName...)
+	c = binary.BigEndian.AppendUint16(c, 0) // no extensions
+
+	config := binary.BigEndian.AppendUint16(nil, _ECHVersion)
+	config = binary.BigEndian.AppendUint16(config, uint16(len(c)))
+	config = append(config, c...)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(config))), config...)
+}
+
+func echKeygen(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("ech keygen", "", stderr)
+	publicName := fs.String("public-name", "", "server `name` visible on the wire, which frontd's certificate must cover")
+	id := fs.Uint("config-id", 0, "`id` of the configuration, to tell apart those of rotated keys")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+	if fs.NArg() != 0 || *publicName == "" || len(*publicName) > 255 || *id > 255 {
+		fs.Usage()
+		return 2
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	list := echConfigList(uint8(*id), key.PublicKey().Bytes(), *publicName)
+	pem.Encode(stdout, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	pem.Encode(stdout, &pem.Block{Type: "ECHCONFIG", Bytes: list})
+	fmt.Fprintf(stderr, "save the above as ECH_KEY_FILE and publish ech=%s in the HTTPS record of %s\n",
+		base64.StdEncoding.EncodeToString(list), *publicName)
+	return 0
+}
@@ -0,0 +1,55 @@
+// Command frontdctl helps operating frontd: it encrypts backend addresses
+// into tokens and inspects tokens given the secret.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// command is a subcommand, run returns the exit code
+type command struct {
+	name, usage string
+	run         func(args []string, stdout, stderr io.Writer) int
+}
+
+var _Commands []command
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: frontdctl <command> [flags] [arguments]")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, c := range _Commands {
+		fmt.Fprintf(w, "  %-14s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(w, "\nrun frontdctl <command> -h for its flags")
+}
+
+// run dispatches args to the command named by the leading arguments
+func run(args []string, stdout, stderr io.Writer) int {
+	for _, c := range _Commands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == c.name {
+			return c.run(args[len(words):], stdout, stderr)
+		}
+	}
+	usage(stderr)
+	return 2
+}
+
+// newFlagSet returns the flag set of a command writing errors to stderr
+func newFlagSet(name, args string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: frontdctl %s [flags] %s\n", name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
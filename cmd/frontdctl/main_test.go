@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func ctl(args ...string) (code int, stdout, stderr string) {
+	var out, errOut bytes.Buffer
+	code = run(args, &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+func TestStatus(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"frontd": {
+			"frontd_build_info{version=\"1.2.0\",commit=\"abc\",go_version=\"go1\"}": 1,
+			"frontd_connections_active": 3,
+			"frontd_connections_accepted_total": 200,
+			"frontd_handshake_failures_total{code=\"4106\"}": 8,
+			"frontd_handshake_failures_total{code=\"4101\"}": 2,
+			"frontd_addr_cache_hits_total": 90,
+			"frontd_addr_cache_misses_total": 10,
+			"frontd_addr_cache_entries": 4,
+			"frontd_relayed_bytes_total{direction=\"upstream\"}": 2048,
+			"frontd_relayed_bytes_total{direction=\"downstream\"}": 1048576
+		}}`))
+	})
+	mux.HandleFunc("/backends", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"backend":"10.0.0.1:80","active":2,"connections":150,"errors":2,"error_rate":0.0133,"bytes_up":1024,"bytes_down":4096},
+			{"backend":"10.0.0.2:80","active":1,"connections":40,"errors":0,"error_rate":0,"bytes_up":1,"bytes_down":2}]`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	code, out, errOut := ctl("status", "-admin", ts.URL, "-top", "1")
+	if code != 0 {
+		t.Fatal("status failed:", errOut)
+	}
+	for _, s := range []string{"frontd 1.2.0", "3 active, 200 accepted", "10 failed (5.00%): 4101 2, 4106 8",
+		"90.00% hits, 4 entries", "2.0 KiB up, 1.0 MiB down", "10.0.0.1:80"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("%q missing in status:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "10.0.0.2:80") {
+		t.Fatal("more than top backends listed:", out)
+	}
+
+	code, out, _ = ctl("status", "-admin", strings.TrimPrefix(ts.URL, "http://"), "-json")
+	var r statusReport
+	if code != 0 || json.Unmarshal([]byte(out), &r) != nil || r.HandshakeFailureRate != 0.05 || len(r.Backends) != 2 {
+		t.Fatal("unexpected JSON status:", out)
+	}
+
+	ts.Close()
+	if code, _, _ := ctl("status", "-admin", ts.URL); code != 1 {
+		t.Fatal("status of a stopped frontd succeeded")
+	}
+}
+
+func TestToken(t *testing.T) {
+	// the example of the README
+	code, out, _ := ctl("token", "decode", "-secret", "p0S8rX680*48", "U2FsdGVkX19KIJ9OQJKT/yHGMrS+5SsBAAjetomptQ0=")
+	if code != 0 || !strings.Contains(out, "backend:  127.0.0.1:62863") || !strings.Contains(out, "salt:     4a209f4e409293ff") {
+		t.Fatal("README token not decoded:", code, out)
+	}
+
+	for _, binary := range []string{"-binary=false", "-binary"} {
+		code, out, errOut := ctl("token", "encode", "-secret", "s3cr3t", binary, "10.0.0.1:80")
+		if code != 0 {
+			t.Fatal("not encoded:", errOut)
+		}
+		token := strings.TrimSpace(out)
+
+		code, out, errOut = ctl("token", "decode", "-secret", "s3cr3t", token)
+		if code != 0 || !strings.Contains(out, "backend:  10.0.0.1:80") {
+			t.Fatal("not decoded:", token, out, errOut)
+		}
+		code, _, errOut = ctl("token", "decode", "-secret", "wrong", token)
+		if code != 1 || !strings.Contains(errOut, "secret") {
+			t.Fatal("secret mismatch not reported:", code, errOut)
+		}
+	}
+
+	code, out, _ = ctl("token", "encode", "-secret", "s3cr3t", "-valid-for", "2h", "-encrypt", "-tenant", "acme",
+		"-priority", "low", "10.0.0.1:22")
+	if code != 0 {
+		t.Fatal("time boxed token not encoded")
+	}
+	code, out, _ = ctl("token", "decode", "-secret", "s3cr3t", strings.TrimSpace(out))
+	if code != 0 || !strings.Contains(out, "backend:  10.0.0.1:22\n") || !strings.Contains(out, "until:    ") ||
+		!strings.Contains(out, "encrypt:  aes-256-gcm\n") ||
+		!strings.Contains(out, "tenant:   acme\n") || !strings.Contains(out, "priority: low\n") {
+		t.Fatal("time boxed token not decoded:", out)
+	}
+	code, out, _ = ctl("token", "encode", "-secret", "s3cr3t", "-compress", "10.0.0.1:22")
+	if code != 0 {
+		t.Fatal("compressed token not encoded")
+	}
+	code, out, _ = ctl("token", "decode", "-secret", "s3cr3t", strings.TrimSpace(out))
+	if code != 0 || !strings.Contains(out, "compress: deflate\n") {
+		t.Fatal("compressed token not decoded:", out)
+	}
+	if code, _, _ := ctl("token", "encode", "-secret", "s3cr3t", "-compress", "-encrypt", "10.0.0.1:22"); code != 2 {
+		t.Fatal("compressed and encrypted token encoded")
+	}
+
+	t.Setenv("SECRET", "")
+	t.Setenv("SECRET_FILE", "")
+	if code, _, _ := ctl("token", "encode", "10.0.0.1:80"); code != 2 {
+		t.Fatal("encoded without secret")
+	}
+	if code, _, _ := ctl("token", "decode", "-secret", "s", "!!"); code != 1 {
+		t.Fatal("invalid token decoded")
+	}
+	if code, _, _ := ctl("nonsense"); code != 2 {
+		t.Fatal("unknown command run")
+	}
+}
+
+func TestECHKeygen(t *testing.T) {
+	code, out, errOut := ctl("ech", "keygen", "-public-name", "front.example.com", "-config-id", "7")
+	if code != 0 || !strings.Contains(errOut, "ech=") {
+		t.Fatal("not generated:", code, errOut)
+	}
+	blocks := map[string][]byte{}
+	for rest := []byte(out); ; {
+		var b *pem.Block
+		b, rest = pem.Decode(rest)
+		if b == nil {
+			break
+		}
+		blocks[b.Type] = b.Bytes
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(blocks["PRIVATE KEY"]); err != nil {
+		t.Fatal("no private key:", err)
+	}
+	list := blocks["ECHCONFIG"]
+	if len(list) < 8 || int(binary.BigEndian.Uint16(list)) != len(list)-2 || list[6] != 7 ||
+		!bytes.HasSuffix(list, []byte("front.example.com\x00\x00")) {
+		t.Fatal("invalid ECHConfigList:", list)
+	}
+	if !strings.Contains(errOut, base64.StdEncoding.EncodeToString(list)) {
+		t.Fatal("published configuration differs:", errOut)
+	}
+
+	if code, _, _ := ctl("ech", "keygen"); code != 2 {
+		t.Fatal("generated without public name")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	_Commands = append(_Commands,
+		command{"status", "print live statistics from the admin API", status})
+}
+
+type backendStatus struct {
+	Backend     string  `json:"backend"`
+	Active      int     `json:"active"`
+	Connections uint64  `json:"connections"`
+	Errors      uint64  `json:"errors"`
+	ErrorRate   float64 `json:"error_rate"`
+	BytesUp     uint64  `json:"bytes_up"`
+	BytesDown   uint64  `json:"bytes_down"`
+}
+
+// statusReport is printed by the status command
+type statusReport struct {
+	Admin       string `json:"admin"`
+	Version     string `json:"version,omitempty"`
+	Maintenance bool   `json:"maintenance"`
+
+	ActiveConns   float64 `json:"active_connections"`
+	AcceptedConns float64 `json:"accepted_connections"`
+
+	HandshakeFailures    float64            `json:"handshake_failures"`
+	HandshakeFailureRate float64            `json:"handshake_failure_rate"`
+	FailuresByCode       map[string]float64 `json:"handshake_failures_by_code"`
+
+	CacheHits    float64 `json:"addr_cache_hits"`
+	CacheMisses  float64 `json:"addr_cache_misses"`
+	CacheHitRate float64 `json:"addr_cache_hit_rate"`
+	CacheEntries float64 `json:"addr_cache_entries"`
+
+	BytesUp   float64 `json:"bytes_up"`
+	BytesDown float64 `json:"bytes_down"`
+
+	Backends []backendStatus `json:"top_backends"`
+}
+
+// metrics are the frontd metrics of /debug/vars keyed by name and labels
+type metrics map[string]float64
+
+// labeled returns the values of metric name by the value of label
+func (m metrics) labeled(name, label string) map[string]float64 {
+	values := make(map[string]float64)
+	for k, v := range m {
+		if !strings.HasPrefix(k, name+"{") {
+			continue
+		}
+		i := strings.Index(k, label+`="`)
+		if i < 0 {
+			continue
+		}
+		lv := k[i+len(label)+2:]
+		values[lv[:strings.IndexByte(lv, '"')]] += v
+	}
+	return values
+}
+
+func ratio(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+// adminURL completes addr like frontd does for ADMIN_ADDR, loopback if only
+// a port is given
+func adminURL(addr string) string {
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return strings.TrimSuffix(addr, "/")
+	}
+	if !strings.Contains(addr, ":") {
+		addr = net.JoinHostPort("127.0.0.1", addr)
+	}
+	return "http://" + addr
+}
+
+func getJSON(c *http.Client, url string, v interface{}) error {
+	res, err := c.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func fetchStatus(admin string, top int, timeout time.Duration) (*statusReport, error) {
+	base := adminURL(admin)
+	c := &http.Client{Timeout: timeout}
+
+	var vars struct {
+		Frontd metrics `json:"frontd"`
+	}
+	err := getJSON(c, base+"/debug/vars", &vars)
+	if err != nil {
+		return nil, err
+	}
+	var backends []backendStatus
+	err = getJSON(c, base+"/backends", &backends)
+	if err != nil {
+		return nil, err
+	}
+
+	m := vars.Frontd
+	r := &statusReport{
+		Admin:          base,
+		Maintenance:    m["frontd_maintenance"] == 1,
+		ActiveConns:    m["frontd_connections_active"],
+		AcceptedConns:  m["frontd_connections_accepted_total"],
+		FailuresByCode: m.labeled("frontd_handshake_failures_total", "code"),
+		CacheHits:      m["frontd_addr_cache_hits_total"],
+		CacheMisses:    m["frontd_addr_cache_misses_total"],
+		CacheEntries:   m["frontd_addr_cache_entries"],
+		BytesUp:        m["frontd_relayed_bytes_total{direction=\"upstream\"}"],
+		BytesDown:      m["frontd_relayed_bytes_total{direction=\"downstream\"}"],
+	}
+	for v := range m.labeled("frontd_build_info", "version") {
+		r.Version = v
+	}
+	for _, n := range r.FailuresByCode {
+		r.HandshakeFailures += n
+	}
+	r.HandshakeFailureRate = ratio(r.HandshakeFailures, r.AcceptedConns)
+	r.CacheHitRate = ratio(r.CacheHits, r.CacheHits+r.CacheMisses)
+	if len(backends) > top {
+		backends = backends[:top]
+	}
+	r.Backends = backends
+	return r, nil
+}
+
+// humanBytes formats n with binary prefixes
+func humanBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+func (r *statusReport) print(w io.Writer) {
+	fmt.Fprintf(w, "frontd %s at %s", r.Version, r.Admin)
+	if r.Maintenance {
+		fmt.Fprint(w, " (maintenance)")
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "connections:  %.0f active, %.0f accepted\n", r.ActiveConns, r.AcceptedConns)
+	fmt.Fprintf(w, "handshakes:   %.0f failed (%.2f%%)", r.HandshakeFailures, r.HandshakeFailureRate*100)
+	codes := make([]string, 0, len(r.FailuresByCode))
+	for c := range r.FailuresByCode {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	for i, c := range codes {
+		sep := ", "
+		if i == 0 {
+			sep = ": "
+		}
+		fmt.Fprintf(w, "%s%s %.0f", sep, c, r.FailuresByCode[c])
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "addr cache:   %.2f%% hits, %.0f entries\n", r.CacheHitRate*100, r.CacheEntries)
+	fmt.Fprintf(w, "relayed:      %s up, %s down\n", humanBytes(r.BytesUp), humanBytes(r.BytesDown))
+
+	if len(r.Backends) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%-30s %8s %12s %8s %8s %12s %12s\n", "BACKEND", "ACTIVE", "CONNECTIONS", "ERRORS", "ERR%", "UP", "DOWN")
+	for _, b := range r.Backends {
+		fmt.Fprintf(w, "%-30s %8d %12d %8d %7.2f%% %12s %12s\n", b.Backend, b.Active, b.Connections, b.Errors,
+			b.ErrorRate*100, humanBytes(float64(b.BytesUp)), humanBytes(float64(b.BytesDown)))
+	}
+}
+
+func status(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("status", "", stderr)
+	admin := fs.String("admin", "", "`addr` of the admin API, loopback if only a port is given ($ADMIN_ADDR, default 4044)")
+	asJSON := fs.Bool("json", false, "print JSON instead of a summary")
+	top := fs.Int("top", 10, "show the `n` busiest backends")
+	timeout := fs.Duration("timeout", time.Second*5, "admin API request `timeout`")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	if *admin == "" {
+		*admin = os.Getenv("ADMIN_ADDR")
+	}
+	if *admin == "" {
+		*admin = "4044"
+	}
+
+	r, err := fetchStatus(*admin, *top, *timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, "status not fetched:", err)
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+		return 0
+	}
+	r.print(stdout)
+	return 0
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xindong/frontd/aes256cbc"
+	"github.com/xindong/frontd/seal"
+)
+
+func init() {
+	_Commands = append(_Commands,
+		command{"token encode", "encrypt a backend address into a token", tokenEncode},
+		command{"token decode", "decrypt and inspect a token", tokenDecode})
+}
+
+var (
+	_Aes256CBC         = aes256cbc.New()
+	_OpenSSLSaltHeader = []byte("Salted__")
+)
+
+// secretFlags adds the flags of the shared secret, which default to the
+// SECRET and SECRET_FILE environment variables like frontd
+func secretFlags(fs *flag.FlagSet) func() ([]byte, error) {
+	secret := fs.String("secret", "", "secret passphrase ($SECRET)")
+	file := fs.String("secret-file", "", "read the secret passphrase from `file` ($SECRET_FILE)")
+	return func() ([]byte, error) {
+		switch {
+		case *secret != "":
+			return []byte(*secret), nil
+		case *file != "":
+			return readSecretFile(*file)
+		case os.Getenv("SECRET") != "":
+			return []byte(os.Getenv("SECRET")), nil
+		case os.Getenv("SECRET_FILE") != "":
+			return readSecretFile(os.Getenv("SECRET_FILE"))
+		}
+		return nil, errors.New("secret required, set -secret, -secret-file or $SECRET")
+	}
+}
+
+func readSecretFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	return bytes.TrimSpace(b), err
+}
+
+// tokenID identifies a token like the token field of the frontd audit log
+func tokenID(cipher []byte) string {
+	sum := sha256.Sum256(cipher)
+	return hex.EncodeToString(sum[:8])
+}
+
+func tokenEncode(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("token encode", "host:port", stderr)
+	secret := secretFlags(fs)
+	binary := fs.Bool("binary", false, "print the binary handshake as hex instead of the base64 token")
+	validFor := fs.Duration("valid-for", 0, "time box sessions of the token, which frontd refuses or tears down after `duration`")
+	compress := fs.Bool("compress", false, "compress tunnels of the token with deflate, the client must do so too")
+	tenant := fs.String("tenant", "", "account and limit the usage of the token as that of `tenant` too")
+	priority := fs.String("priority", "", "priority `class` of tunnels of the token, high, normal or low")
+	encrypt := fs.Bool("encrypt", false, "encrypt tunnels of the token with "+seal.Name+", the client must do so too")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	switch *priority {
+	case "", "high", "normal", "low":
+	default:
+		fmt.Fprintln(stderr, "invalid priority class, must be high, normal or low:", *priority)
+		return 2
+	}
+	if *compress && *encrypt {
+		fmt.Fprintln(stderr, "-compress and -encrypt can't be used together")
+		return 2
+	}
+	key, err := secret()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	addr := fs.Arg(0)
+	claims := url.Values{}
+	if *validFor > 0 {
+		claims.Set("until", strconv.FormatInt(time.Now().Add(*validFor).Unix(), 10))
+	}
+	if *compress {
+		claims.Set("compress", "deflate")
+	}
+	if *encrypt {
+		claims.Set("encrypt", seal.Name)
+	}
+	if *tenant != "" {
+		claims.Set("tenant", *tenant)
+	}
+	if *priority != "" {
+		claims.Set("priority", *priority)
+	}
+	if len(claims) > 0 {
+		addr += "?" + claims.Encode()
+	}
+	cipher, err := _Aes256CBC.Encrypt(key, []byte(addr))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if *binary {
+		if len(cipher) > 255 {
+			fmt.Fprintln(stderr, "address too long for the binary handshake")
+			return 1
+		}
+		fmt.Fprintln(stdout, hex.EncodeToString(append([]byte{0, byte(len(cipher))}, cipher...)))
+		return 0
+	}
+	fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString(cipher))
+	return 0
+}
+
+// parseToken decodes a base64 token, or the hex of a binary one with or
+// without its handshake prefix
+func parseToken(token string) ([]byte, error) {
+	token = strings.TrimSpace(token)
+	if b, err := hex.DecodeString(token); err == nil {
+		if len(b) > 2 && b[0] == 0 && int(b[1]) == len(b)-2 {
+			b = b[2:]
+		}
+		if bytes.HasPrefix(b, _OpenSSLSaltHeader) {
+			return b, nil
+		}
+	}
+	b, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("neither base64 nor hex: %v", err)
+	}
+	return b, nil
+}
+
+func tokenDecode(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("token decode", "token", stderr)
+	secret := secretFlags(fs)
+	if fs.Parse(args) != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	key, err := secret()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	cipher, err := parseToken(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, "invalid token:", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "token id: %s\n", tokenID(cipher))
+	fmt.Fprintf(stdout, "length:   %d bytes\n", len(cipher))
+	if !bytes.HasPrefix(cipher, _OpenSSLSaltHeader) || len(cipher) < 32 || len(cipher)%16 != 0 {
+		fmt.Fprintln(stderr, "invalid token: not encrypted by frontdctl or openssl enc -aes-256-cbc -salt")
+		return 1
+	}
+	fmt.Fprintf(stdout, "salt:     %s\n", hex.EncodeToString(cipher[8:16]))
+
+	addr, err := _Aes256CBC.Decrypt(key, cipher)
+	if err != nil {
+		// padding is only valid for the right secret, but a wrong one may
+		// pass it by chance
+		fmt.Fprintln(stderr, "not decrypted, the secret doesn't match the one the token was encrypted with")
+		return 1
+	}
+	backend, claims, _ := strings.Cut(string(addr), "?")
+	fmt.Fprintf(stdout, "backend:  %s\n", backend)
+	if !printable(addr) {
+		fmt.Fprintln(stderr, "warning: the backend is garbled, the secret probably doesn't match")
+		return 1
+	}
+	q, _ := url.ParseQuery(claims)
+	if q.Get("until") != "" {
+		until, err := strconv.ParseInt(q.Get("until"), 10, 64)
+		if err != nil {
+			fmt.Fprintln(stderr, "invalid until claim:", q.Get("until"))
+			return 1
+		}
+		fmt.Fprintf(stdout, "until:    %s\n", time.Unix(until, 0).UTC().Format(time.RFC3339))
+	}
+	if q.Get("compress") != "" {
+		fmt.Fprintf(stdout, "compress: %s\n", q.Get("compress"))
+	}
+	if q.Get("encrypt") != "" {
+		fmt.Fprintf(stdout, "encrypt:  %s\n", q.Get("encrypt"))
+	}
+	if q.Get("tenant") != "" {
+		fmt.Fprintf(stdout, "tenant:   %s\n", q.Get("tenant"))
+	}
+	if q.Get("priority") != "" {
+		fmt.Fprintf(stdout, "priority: %s\n", q.Get("priority"))
+	}
+	return 0
+}
+
+func printable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return len(b) > 0
+}
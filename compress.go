@@ -0,0 +1,133 @@
+package frontd
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Tunnels of tokens with the compress=deflate claim carry a deflate stream
+// each way between the client and frontd, backends see the plain bytes. It
+// pays off for compressible protocols over slow links, the metrics below
+// tell the time spent against the bytes saved. Every write to the client is
+// flushed, so latency is unchanged but small writes compress poorly.
+
+const _CompressDeflate = "deflate"
+
+var (
+	_CompressionLevel int64 = flate.BestSpeed
+
+	_CompressionNanos int64 // spent compressing and decompressing
+
+	_MetricCompressedTunnels = newCounter("frontd_compressed_tunnels_total",
+		"Total number of tunnels relayed compressed.")
+	_MetricCompressionBytes = newCounterVec("frontd_compression_bytes_total",
+		"Total number of bytes of compressed tunnels, by direction and whether before (plain) or after (wire) compression.",
+		"direction", "stage")
+	_ = newCounterFunc("frontd_compression_seconds_total",
+		"Total time spent compressing and decompressing tunnels in seconds.", func() float64 {
+			return time.Duration(atomic.LoadInt64(&_CompressionNanos)).Seconds()
+		})
+)
+
+func compressionLevel() int {
+	return int(atomic.LoadInt64(&_CompressionLevel))
+}
+
+// wireIO counts the compressed bytes and the time waiting for the client,
+// which isn't spent compressing
+type wireIO struct {
+	r     io.Reader
+	w     io.Writer
+	bytes *counter
+	wait  time.Duration
+	eof   bool
+}
+
+func (w *wireIO) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.r.Read(p)
+	w.wait += time.Since(start)
+	w.bytes.Add(uint64(n))
+	w.eof = err == io.EOF
+	return n, err
+}
+
+func (w *wireIO) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := w.w.Write(p)
+	w.wait += time.Since(start)
+	w.bytes.Add(uint64(n))
+	return n, err
+}
+
+// spent adds the time since start less the wait to the compression time
+func (w *wireIO) spent(start time.Time) {
+	atomic.AddInt64(&_CompressionNanos, int64(time.Since(start)-w.wait))
+	w.wait = 0
+}
+
+// inflater decompresses what the client sends
+type inflater struct {
+	zr    io.ReadCloser
+	wire  *wireIO
+	plain *counter
+}
+
+func newInflater(r io.Reader) *inflater {
+	wire := &wireIO{r: r, bytes: _MetricCompressionBytes.With("upstream", "wire")}
+	return &inflater{zr: flate.NewReader(wire), wire: wire, plain: _MetricCompressionBytes.With("upstream", "plain")}
+}
+
+func (z *inflater) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := z.zr.Read(p)
+	z.wire.spent(start)
+	z.plain.Add(uint64(n))
+	if errors.Is(err, io.ErrUnexpectedEOF) && z.wire.eof {
+		// clients hang up without ending the stream
+		err = io.EOF
+	}
+	return n, err
+}
+
+// deflater compresses what is sent to the client, flushing every write
+type deflater struct {
+	zw    *flate.Writer
+	wire  *wireIO
+	plain *counter
+}
+
+func newDeflater(w io.Writer) *deflater {
+	wire := &wireIO{w: w, bytes: _MetricCompressionBytes.With("downstream", "wire")}
+	zw, err := flate.NewWriter(wire, compressionLevel())
+	if err != nil {
+		zw, _ = flate.NewWriter(wire, flate.BestSpeed)
+	}
+	return &deflater{zw: zw, wire: wire, plain: _MetricCompressionBytes.With("downstream", "plain")}
+}
+
+func (z *deflater) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := z.zw.Write(p)
+	if err == nil {
+		err = z.zw.Flush()
+	}
+	z.wire.spent(start)
+	z.plain.Add(uint64(n))
+	return n, err
+}
+
+// noDeadlineConn ignores read deadlines, which would break the stream of
+// the inflater reading it. Its tunnel is still closed when idle by the
+// other direction sharing the activity.
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (c noDeadlineConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
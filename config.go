@@ -0,0 +1,327 @@
+package frontd
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// _Config holds the settings of the configuration file keyed by the name of
+// the equivalent environment variable, environment variables take precedence.
+// It's replaced as a whole on reload, see config.
+var _Config atomic.Value // map[string]string
+
+func config() map[string]string {
+	m, _ := _Config.Load().(map[string]string)
+	return m
+}
+
+// _Flags holds the command line flags given explicitly, keyed by the name of
+// the equivalent environment variable, they take precedence over both. It's
+// set by Main or Server.Serve, see flags.
+var _Flags atomic.Value // map[string]string
+
+func flags() map[string]string {
+	m, _ := _Flags.Load().(map[string]string)
+	return m
+}
+
+// getenv returns the setting key from command line flags, the environment
+// variable or the configuration file, in that order
+func getenv(key string) string {
+	v, _ := lookupEnv(key)
+	return v
+}
+
+func lookupEnv(key string) (string, bool) {
+	v, ok := flags()[key]
+	if ok {
+		return v, true
+	}
+	v, ok = os.LookupEnv(key)
+	if ok {
+		return v, true
+	}
+	v, ok = config()[key]
+	return v, ok
+}
+
+// envFlag is a command line flag standing in for an environment variable
+type envFlag struct {
+	env     string
+	value   string
+	boolean bool
+}
+
+func (f *envFlag) String() string   { return f.value }
+func (f *envFlag) IsBoolFlag() bool { return f.boolean }
+
+func (f *envFlag) Set(v string) error {
+	f.value = v
+	return nil
+}
+
+// _FlagEnvs lists the flags and the environment variables they set, usage
+// mentions the default
+var _FlagEnvs = []struct {
+	name, env, usage string
+	boolean          bool
+}{
+	{"config", "CONFIG_FILE", "path of the TOML configuration `file`", false},
+	{"listen", "LISTEN_ADDR", "listen on `host:port`, overrides -port", false},
+	{"port", "LISTEN_PORT", "listen `port` (default 4043)", false},
+	{"backlog", "LISTEN_BACKLOG", "accept queue `size`, capped by net.core.somaxconn (default somaxconn)", false},
+	{"defer-accept", "TCP_DEFER_ACCEPT", "accept connections only once data arrived, waiting up to `seconds`", false},
+	{"secret-file", "SECRET_FILE", "read the secret passphrase from `file`", false},
+	{"backend-allow-internal", "BACKEND_ALLOW_INTERNAL", "allow backends on the `list` of loopback, private or link-local networks", false},
+	{"backend-allow", "BACKEND_ALLOW", "only relay to backends matching the `list` of host[:ports] rules", false},
+	{"backend-deny", "BACKEND_DENY", "never relay to backends matching the `list` of host[:ports] rules", false},
+	{"reconnect-backends", "RECONNECT_BACKENDS", "redial backends matching the `list` of host[:ports] rules when they drop under a live tunnel", false},
+	{"route-script", "ROUTE_SCRIPT", "route handshakes with the Lua `file`, reloaded when modified", false},
+	{"host-routes", "HOST_ROUTES", "route HTTP requests without a cipher address by their Host header, `list` of host=backend where host may be *.domain or *", false},
+	{"authz-webhook", "AUTHZ_WEBHOOK", "allow, deny or reroute handshakes as decided by the webhook at `url`", false},
+	{"alert-webhook", "ALERT_WEBHOOK", "post alerts about failing backends to the webhook at `url`", false},
+	{"middlewares", "MIDDLEWARES", "ordered `list` of the middlewares handling connections (default " + _DefaultMiddlewares + ")", false},
+	{"backend-timeout", "BACKEND_TIMEOUT", "backend dial timeout in `seconds` (default 5)", false},
+	{"read-timeout", "CONN_READ_TIMEOUT", "idle read timeout of connections in `seconds` (default 30)", false},
+	{"max-http-header-size", "MAX_HTTP_HEADER_SIZE", "maximum HTTP header size in `bytes` (default 8192)", false},
+	{"max-conns", "MAX_CONNS", "maximum `number` of client connections handled, 0 derives it from the open file limit (default 0)", false},
+	{"tls-cert", "TLS_CERT_FILE", "terminate TLS with the certificate `file`, clients choose the handshake by ALPN", false},
+	{"tls-key", "TLS_KEY_FILE", "private key `file` of -tls-cert", false},
+	{"ech-key", "ECH_KEY_FILE", "accept Encrypted ClientHello with the key and configuration in `file`, see frontdctl ech keygen", false},
+	{"sni-routes", "SNI_ROUTES", "relay TLS clients over TLS to backends by server name, `list` of name=backend where name may be *.domain or *", false},
+	{"sni-backend-ca", "SNI_BACKEND_CA_FILE", "verify backends of -sni-routes with the CA certificates in `file` instead of the system roots", false},
+	{"mux-http", "MUX_HTTP", "also serve /metrics and /healthz over HTTP on the listener", true},
+	{"transport", "TRANSPORT", "`name` of the transport of client connections, plain or scramble (default plain)", false},
+	{"obfuscate", "OBFUSCATE", "scramble everything clients send and receive, short for -transport scramble", true},
+	{"ticket-lifetime", "TICKET_LIFETIME", "`seconds` session tickets let clients reconnect without decrypting their address, 0 disables (default 3600)", false},
+	{"watchdog-timeout", "WATCHDOG_TIMEOUT", "force-close connections stuck outside the relay for `seconds`, 0 disables (default 300)", false},
+	{"idle-timeout", "IDLE_TIMEOUT", "close tunnels moving no bytes either way for `seconds`, 0 disables (default 0)", false},
+	{"linger", "CONN_LINGER", "SO_LINGER of client connections in `seconds`, 0 resets them on close", false},
+	{"error-close", "ERROR_CLOSE", "after an error code close, flush or reset the connection (default close)", false},
+	{"replay-window", "REPLAY_WINDOW", "reject cipher addresses seen within `seconds`, 0 disables (default 0)", false},
+	{"failure-delay", "FAILURE_DELAY", "answer failed handshakes `ms` after they were read, hiding which step failed, 0 disables (default 50)", false},
+	{"auth-failure", "AUTH_FAILURE", "answer failed handshakes with the error code, a decoy, or drop or tarpit them silently (default code)", false},
+	{"tarpit-timeout", "TARPIT_TIMEOUT", "hold tarpitted connections for `seconds` (default 30)", false},
+	{"client-allow", "CLIENT_ALLOW", "only accept clients from the `list` of networks, comma separated CIDRs or addresses", false},
+	{"client-deny", "CLIENT_DENY", "refuse clients from the `list` of networks, takes precedence over -client-allow", false},
+	{"geoip-country-db", "GEOIP_COUNTRY_DB", "MaxMind country or city database `file` for -client-allow-countries", false},
+	{"geoip-asn-db", "GEOIP_ASN_DB", "MaxMind ASN database `file` for -client-allow-asns", false},
+	{"client-allow-countries", "CLIENT_ALLOW_COUNTRIES", "only accept clients from the `list` of ISO country codes", false},
+	{"client-deny-countries", "CLIENT_DENY_COUNTRIES", "refuse clients from the `list` of ISO country codes", false},
+	{"client-allow-asns", "CLIENT_ALLOW_ASNS", "only accept clients from the `list` of AS numbers", false},
+	{"client-deny-asns", "CLIENT_DENY_ASNS", "refuse clients from the `list` of AS numbers", false},
+	{"ban-threshold", "BAN_THRESHOLD", "ban clients after `n` failed handshakes within -ban-window, 0 disables banning (default 0)", false},
+	{"ban-window", "BAN_WINDOW", "window of -ban-threshold in `seconds` (default 60)", false},
+	{"ban-duration", "BAN_DURATION", "ban clients for `seconds` (default 600)", false},
+	{"dscp", "DSCP", "mark tunnel traffic with the DSCP `value`", false},
+	{"dscp-backends", "DSCP_BACKENDS", "per backend DSCP values, `list` of backend=dscp where backend is host:port, host or CIDR", false},
+	{"max-panics", "MAX_PANICS_PER_MINUTE", "exit once more than `n` panics are recovered within a minute, 0 never exits (default 0)", false},
+	{"max-conn-lifetime", "MAX_CONN_LIFETIME", "close tunnels older than `seconds`, 0 for unlimited (default 0)", false},
+	{"disable-addr-cache", "DISABLE_ADDR_CACHE", "decrypt backend addresses on every connection", true},
+	{"addr-cache-type", "ADDR_CACHE_TYPE", "address cache `type`, cow or syncmap (default cow)", false},
+	{"addr-cache-file", "ADDR_CACHE_FILE", "persist the address cache to `file`", false},
+	{"usage-file", "USAGE_FILE", "account the usage of tokens, tenants and backends in `file`", false},
+	{"usage-export", "USAGE_EXPORT", "export the usage on USAGE_EXPORT_SCHEDULE to the file://, s3:// or http(s):// `url`", false},
+	{"quotas", "QUOTAS", "`list` of scope=limit:action quotas of tokens and tenants, e.g. tenant=10GB/day:throttle", false},
+	{"priority-backends", "PRIORITY_BACKENDS", "per backend priority classes, `list` of backend=class where class is high, normal or low", false},
+	{"priority-shed-conns", "PRIORITY_SHED_CONNS", "refuse tunnels of a class beyond connections, `list` of class=n, e.g. low=800", false},
+	{"bandwidth-limit", "BANDWIDTH_LIMIT", "cap the bytes per second relayed each way by all tunnels to `rate`, e.g. 100MB", false},
+	{"bandwidth-backends", "BANDWIDTH_BACKENDS", "per backend bandwidth caps, `list` of backend=rate where backend is host:port, host or CIDR", false},
+	{"log-level", "LOG_LEVEL", "`level` of debug, info, warn or error (default info)", false},
+	{"log-format", "LOG_FORMAT", "log `format`, json or text (default json)", false},
+	{"log-file", "LOG_FILE", "write logs to `file` instead of stderr", false},
+	{"log-rate-limit", "LOG_RATE_LIMIT", "warnings per second and class, 0 for unlimited (default 100)", false},
+	{"access-log", "ACCESS_LOG", "write the access log to `file`, - for stdout", false},
+	{"audit-log", "AUDIT_LOG", "write the hash chained audit log of handshakes to `file`, - for stdout", false},
+	{"metrics-port", "METRICS_PORT", "serve prometheus metrics on `port`", false},
+	{"admin-addr", "ADMIN_ADDR", "serve the admin API on `addr`, loopback if only a port is given", false},
+	{"drain-timeout", "DRAIN_TIMEOUT", "on shutdown wait `seconds` for tunnels to finish (default 30)", false},
+	{"pid-file", "PID_FILE", "write the process ID to `file`", false},
+	{"user", "RUN_AS_USER", "switch to `user` once listening", false},
+	{"group", "RUN_AS_GROUP", "switch to `group` once listening, defaults to the group of -user", false},
+	{"chroot", "CHROOT", "chroot to `dir` once listening", false},
+	{"sandbox", "SANDBOX", "restrict system calls with seccomp once listening", true},
+	{"daemon", "DAEMON", "detach from the terminal and run in the background", true},
+}
+
+// defineFlags registers the flags of _FlagEnvs on fs
+func defineFlags(fs *flag.FlagSet) {
+	for _, f := range _FlagEnvs {
+		fs.Var(&envFlag{env: f.env, boolean: f.boolean}, f.name, f.usage+" ($"+f.env+")")
+	}
+}
+
+// flagSettings returns the flags set explicitly on fs
+func flagSettings(fs *flag.FlagSet) map[string]string {
+	m := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if ef, ok := f.Value.(*envFlag); ok {
+			m[ef.env] = ef.value
+		}
+	})
+	return m
+}
+
+// loadConfig reads a TOML configuration file. Every key maps to the
+// environment variable of the same name, keys of a table are prefixed with
+// the table name, so
+//
+//	secret = "SomePassphrase"
+//
+//	[log]
+//	level = "debug"
+//
+// sets SECRET and LOG_LEVEL. Only strings, integers, floats, booleans and
+// arrays of strings, which are joined by commas, are supported.
+func loadConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := make(map[string]string)
+	table := ""
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || !isComment(line[end+1:]) {
+				return nil, fmt.Errorf("%s:%d: invalid table header", path, n)
+			}
+			table, err = configKey(strings.TrimSpace(line[1:end]))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		key, err := configKey(strings.TrimSpace(line[:eq]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if table != "" {
+			key = table + "_" + key
+		}
+		val, err := configValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, n, key, err)
+		}
+		if _, ok := cfg[key]; ok {
+			return nil, fmt.Errorf("%s:%d: %s defined twice", path, n, key)
+		}
+		cfg[key] = val
+	}
+	return cfg, scanner.Err()
+}
+
+// configKey converts a bare TOML key to the environment variable name
+func configKey(k string) (string, error) {
+	if k == "" {
+		return "", fmt.Errorf("empty key")
+	}
+	for _, c := range k {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return "", fmt.Errorf("invalid key %q", k)
+		}
+	}
+	return strings.ToUpper(strings.Replace(k, "-", "_", -1)), nil
+}
+
+func isComment(s string) bool {
+	s = strings.TrimSpace(s)
+	return s == "" || s[0] == '#'
+}
+
+// configValue parses a TOML value followed by an optional comment
+func configValue(s string) (string, error) {
+	if s == "" {
+		return "", fmt.Errorf("missing value")
+	}
+
+	switch s[0] {
+	case '"', '\'':
+		v, rest, err := configString(s)
+		if err != nil {
+			return "", err
+		}
+		if !isComment(rest) {
+			return "", fmt.Errorf("unexpected %q after value", rest)
+		}
+		return v, nil
+	case '[':
+		var items []string
+		rest := strings.TrimSpace(s[1:])
+		for len(rest) > 0 && rest[0] != ']' {
+			v, r, err := configString(rest)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+			rest = strings.TrimSpace(r)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "]") {
+				return "", fmt.Errorf("arrays must be on a single line")
+			}
+		}
+		if len(rest) == 0 || !isComment(rest[1:]) {
+			return "", fmt.Errorf("unterminated array")
+		}
+		return strings.Join(items, ","), nil
+	}
+
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	switch s {
+	case "true", "false":
+		return s, nil
+	}
+	num := strings.Replace(s, "_", "", -1)
+	if _, err := strconv.ParseInt(num, 10, 64); err == nil {
+		return num, nil
+	}
+	if _, err := strconv.ParseFloat(num, 64); err == nil {
+		return num, nil
+	}
+	return "", fmt.Errorf("invalid value %q, strings must be quoted", s)
+}
+
+// configString parses a basic or literal string at the start of s and
+// returns the remainder
+func configString(s string) (v, rest string, err error) {
+	if s == "" || s[0] != '"' && s[0] != '\'' {
+		return "", "", fmt.Errorf("expected a string")
+	}
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if q == '"' {
+				i++
+			}
+		case q:
+			if q == '\'' {
+				return s[1:i], s[i+1:], nil
+			}
+			v, err = strconv.Unquote(s[:i+1])
+			return v, s[i+1:], err
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
@@ -0,0 +1,167 @@
+package frontd
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// _Sessions holds every live session keyed by connection ID
+var _Sessions sync.Map
+
+type connInfo struct {
+	ID        string  `json:"id"`
+	Client    string  `json:"client"`
+	Backend   string  `json:"backend,omitempty"`
+	State     string  `json:"state"`
+	Age       float64 `json:"age"`
+	BytesUp   uint64  `json:"bytes_up"`
+	BytesDown uint64  `json:"bytes_down"`
+}
+
+// liveConns returns the connection table, oldest first
+func liveConns() []connInfo {
+	now := time.Now()
+	conns := []connInfo{}
+	_Sessions.Range(func(k, v interface{}) bool {
+		s := v.(*session)
+		state, backend := s.status()
+		conns = append(conns, connInfo{
+			ID:        s.id,
+			Client:    s.RemoteAddr().String(),
+			Backend:   backend,
+			State:     state,
+			Age:       now.Sub(s.start).Seconds(),
+			BytesUp:   s.up.Value(),
+			BytesDown: s.down.Value(),
+		})
+		return true
+	})
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Age > conns[j].Age })
+	return conns
+}
+
+type backendInfo struct {
+	Backend     string  `json:"backend"`
+	Active      int     `json:"active"`
+	Connections uint64  `json:"connections"`
+	Errors      uint64  `json:"errors"`
+	ErrorRate   float64 `json:"error_rate"`
+	BytesUp     uint64  `json:"bytes_up"`
+	BytesDown   uint64  `json:"bytes_down"`
+}
+
+// backendStats returns the totals of every backend seen since start,
+// busiest first
+func backendStats() []backendInfo {
+	m := make(map[string]*backendInfo)
+	get := func(addr string) *backendInfo {
+		b, ok := m[addr]
+		if !ok {
+			b = &backendInfo{Backend: addr}
+			m[addr] = b
+		}
+		return b
+	}
+	for _, c := range _MetricBackendConns.counters() {
+		get(c.values[0]).Connections = c.Value()
+	}
+	for _, c := range _MetricBackendErrors.counters() {
+		get(c.values[0]).Errors = c.Value()
+	}
+	for _, c := range _MetricBackendBytes.counters() {
+		if c.values[1] == "upstream" {
+			get(c.values[0]).BytesUp = c.Value()
+		} else {
+			get(c.values[0]).BytesDown = c.Value()
+		}
+	}
+	_Sessions.Range(func(k, v interface{}) bool {
+		state, backend := v.(*session).status()
+		if state == stateRelaying {
+			get(backend).Active++
+		}
+		return true
+	})
+
+	backends := make([]backendInfo, 0, len(m))
+	for _, b := range m {
+		if b.Connections > 0 {
+			b.ErrorRate = float64(b.Errors) / float64(b.Connections)
+		}
+		backends = append(backends, *b)
+	}
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].BytesUp+backends[i].BytesDown > backends[j].BytesUp+backends[j].BytesDown
+	})
+	return backends
+}
+
+// backendsHandler lists per backend counters as JSON
+func backendsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backendStats())
+}
+
+// terminateConns closes live sessions matched by f and returns how many
+func terminateConns(f func(s *session) bool) int {
+	n := 0
+	_Sessions.Range(func(k, v interface{}) bool {
+		s := v.(*session)
+		if f(s) {
+			s.terminate()
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// connectionsHandler lists live connections as JSON on GET, DELETE with a
+// backend query parameter closes every tunnel to that backend
+func connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET", "HEAD":
+		json.NewEncoder(w).Encode(liveConns())
+	case "DELETE":
+		backend := r.URL.Query().Get("backend")
+		if backend == "" {
+			http.Error(w, "backend parameter required", http.StatusBadRequest)
+			return
+		}
+		n := terminateConns(func(s *session) bool {
+			_, b := s.status()
+			return b == backend
+		})
+		logger().Info("connections terminated by admin", "backend_addr", backend, "count", n)
+		json.NewEncoder(w).Encode(map[string]int{"closed": n})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// connectionHandler closes the connection of the ID in the path on DELETE
+func connectionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/connections/")
+	v, ok := _Sessions.Load(id)
+	if !ok {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+	v.(*session).terminate()
+	logger().Info("connection terminated by admin", "conn_id", id)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"closed": 1})
+}
@@ -0,0 +1,106 @@
+package frontd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a schedule of the five fields of crontab(5): minute, hour,
+// day of month, month and day of week, each *, a number, a range a-b, a
+// step */n or a-b/n, or a list of them. Like cron a day matches if either
+// its day of month or of week does when both are restricted. Schedules are
+// evaluated in UTC.
+type cronSchedule struct {
+	fields [5]uint64 // bit i set if value i matches
+	anyDom bool
+	anyDow bool
+}
+
+var _CronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+var _CronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseCron(v string) (*cronSchedule, error) {
+	if m, ok := _CronMacros[v]; ok {
+		v = m
+	}
+	parts := strings.Fields(v)
+	if len(parts) != 5 {
+		return nil, fmt.Errorf("expected 5 fields or a macro like @daily, got %q", v)
+	}
+	c := &cronSchedule{anyDom: parts[2] == "*", anyDow: parts[4] == "*"}
+	for i, part := range parts {
+		lo, hi := _CronRanges[i][0], _CronRanges[i][1]
+		for _, item := range strings.Split(part, ",") {
+			rng, step, hasStep := strings.Cut(item, "/")
+			first, last := lo, hi
+			if rng != "*" {
+				a, b, isRange := strings.Cut(rng, "-")
+				var err error
+				first, err = strconv.Atoi(a)
+				if err != nil {
+					return nil, fmt.Errorf("invalid field %q", item)
+				}
+				last = first
+				if isRange {
+					last, err = strconv.Atoi(b)
+					if err != nil {
+						return nil, fmt.Errorf("invalid field %q", item)
+					}
+				} else if hasStep {
+					last = hi
+				}
+			}
+			n := 1
+			if hasStep {
+				var err error
+				n, err = strconv.Atoi(step)
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("invalid step in %q", item)
+				}
+			}
+			if first < lo || last > hi || first > last {
+				return nil, fmt.Errorf("%q out of range %d-%d", item, lo, hi)
+			}
+			for j := first; j <= last; j += n {
+				c.fields[i] |= 1 << uint(j)
+			}
+		}
+	}
+	// 7 is Sunday too
+	if c.fields[4]&(1<<7) != 0 {
+		c.fields[4] |= 1
+	}
+	return c, nil
+}
+
+func checkCron(v string) error {
+	_, err := parseCron(v)
+	return err
+}
+
+// match reports whether the minute of t is scheduled
+func (c *cronSchedule) match(t time.Time) bool {
+	t = t.UTC()
+	has := func(i, v int) bool { return c.fields[i]&(1<<uint(v)) != 0 }
+	if !has(0, t.Minute()) || !has(1, t.Hour()) || !has(3, int(t.Month())) {
+		return false
+	}
+	dom, dow := has(2, t.Day()), has(4, int(t.Weekday()))
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	}
+	return dom || dow
+}
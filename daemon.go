@@ -0,0 +1,62 @@
+package frontd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// set in the environment of the detached process
+const _DaemonEnv = "FRONTD_DAEMON"
+
+// how long daemonize waits for the detached process to accept connections
+const _DaemonStartTimeout = time.Second * 30
+
+// _PidFile is written once connections are accepted and removed on exit
+var _PidFile string
+
+// daemonize starts frontd again detached from the terminal in a new session
+// and returns the exit code for this process: 0 once the detached process
+// accepts connections, 1 if it fails to start.
+func daemonize() int {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		logger().Error("daemon not started", "err", err)
+		return 1
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		logger().Error("daemon not started", "err", err)
+		return 1
+	}
+	defer null.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), _DaemonEnv+"=1")
+	cmd.Stdin = null
+	cmd.Stdout = null
+	cmd.Stderr = null
+	cmd.SysProcAttr = detachedProcAttr()
+	err = startReady(cmd, _DaemonStartTimeout)
+	if err != nil {
+		logger().Error("daemon not started, see LOG_FILE or syslog for details", "err", err)
+		return 1
+	}
+	return 0
+}
+
+func writePidFile(path string) error {
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidFile removes the PID file unless a process started by an upgrade
+// has replaced it already
+func removePidFile(path string) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil && string(bytes.TrimSpace(b)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(path)
+	}
+}
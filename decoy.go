@@ -0,0 +1,35 @@
+package frontd
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// _TLSAlert is a fatal handshake_failure alert, what TLS servers without a
+// matching certificate or cipher suite answer
+var _TLSAlert = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x28}
+
+// decoyPage imitates the error pages of a stock nginx
+func decoyPage(status int) []byte {
+	title := fmt.Sprintf("%d %s", status, http.StatusText(status))
+	body := "<html>\r\n<head><title>" + title + "</title></head>\r\n<body>\r\n<center><h1>" + title +
+		"</h1></center>\r\n<hr><center>nginx</center>\r\n</body>\r\n</html>\r\n"
+	return []byte(fmt.Sprintf("HTTP/1.1 %s\r\nServer: nginx\r\nDate: %s\r\nContent-Type: text/html\r\n"+
+		"Content-Length: %d\r\nConnection: close\r\n\r\n%s",
+		title, time.Now().UTC().Format(http.TimeFormat), len(body), body))
+}
+
+// writeDecoy answers a failed handshake like a boring web server would, so
+// scanners don't classify the port as a relay: a TLS alert to TLS clients, a
+// 404 page to HTTP requests and a 400 page to anything else
+func writeDecoy(s *session, httpws bool) {
+	switch {
+	case s.tls:
+		s.Write(_TLSAlert)
+	case httpws:
+		s.Write(decoyPage(http.StatusNotFound))
+	default:
+		s.Write(decoyPage(http.StatusBadRequest))
+	}
+}
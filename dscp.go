@@ -0,0 +1,87 @@
+package frontd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// dscpRule marks tunnels to backends matching an address, a host or a
+// network with a DSCP value
+type dscpRule struct {
+	addr  string // host:port or host
+	ipnet *net.IPNet
+	value int
+}
+
+// _DSCPRules are the per backend rules of DSCP_BACKENDS, _DSCP applies to
+// the other tunnels, -1 leaves sockets unmarked
+var (
+	_DSCPRules atomic.Value // []dscpRule
+	_DSCP      int64        = -1
+)
+
+func parseDSCP(v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > 63 {
+		return 0, fmt.Errorf("invalid DSCP value %q, must be between 0 and 63", v)
+	}
+	return n, nil
+}
+
+// parseDSCPRules parses a comma separated list of backend=dscp, where
+// backend is a host:port, a host or a network in CIDR notation
+func parseDSCPRules(v string) ([]dscpRule, error) {
+	var rules []dscpRule
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.LastIndexByte(item, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("expected backend=dscp, got %q", item)
+		}
+		value, err := parseDSCP(item[eq+1:])
+		if err != nil {
+			return nil, err
+		}
+		r := dscpRule{addr: item[:eq], value: value}
+		if strings.Contains(r.addr, "/") {
+			_, r.ipnet, err = net.ParseCIDR(r.addr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func checkDSCPRules(v string) error {
+	_, err := parseDSCPRules(v)
+	return err
+}
+
+// dscpFor returns the DSCP value of tunnels to the backend addr, -1 for none
+func dscpFor(addr string) int {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	rules, _ := _DSCPRules.Load().([]dscpRule)
+	for _, r := range rules {
+		switch {
+		case r.ipnet != nil:
+			if ip != nil && r.ipnet.Contains(ip) {
+				return r.value
+			}
+		case r.addr == addr || r.addr == host:
+			return r.value
+		}
+	}
+	return int(atomic.LoadInt64(&_DSCP))
+}
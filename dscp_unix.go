@@ -0,0 +1,37 @@
+//go:build !windows
+
+package frontd
+
+import (
+	"net"
+	"syscall"
+)
+
+// setDSCP marks the packets sent on c, the ECN bits are left clear
+func setDSCP(c net.Conn, dscp int) error {
+	tc := tcpConn(c)
+	if tc == nil {
+		return nil
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	// IPv4 includes IPv4-mapped addresses of dual stack sockets
+	v4 := true
+	if a, ok := tc.LocalAddr().(*net.TCPAddr); ok && a.IP.To4() == nil {
+		v4 = false
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if v4 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, dscp<<2)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, dscp<<2)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
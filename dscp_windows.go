@@ -0,0 +1,11 @@
+package frontd
+
+import (
+	"errors"
+	"net"
+)
+
+// Windows ignores IP_TOS, packets are marked through QoS policies instead
+func setDSCP(c net.Conn, dscp int) error {
+	return errors.New("DSCP marking is not supported on Windows")
+}
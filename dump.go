@@ -0,0 +1,104 @@
+package frontd
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+)
+
+// number of backends listed in a stats dump
+const _DumpTopBackends = 10
+
+type backendTraffic struct {
+	Addr  string
+	Conns int
+	Bytes uint64
+}
+
+// topBackends aggregates live sessions by backend, busiest first
+func topBackends(n int) []backendTraffic {
+	m := make(map[string]*backendTraffic)
+	_Sessions.Range(func(k, v interface{}) bool {
+		s := v.(*session)
+		_, backend := s.status()
+		if backend == "" {
+			return true
+		}
+		b, ok := m[backend]
+		if !ok {
+			b = &backendTraffic{Addr: backend}
+			m[backend] = b
+		}
+		b.Conns++
+		b.Bytes += s.up.Value() + s.down.Value()
+		return true
+	})
+
+	top := make([]backendTraffic, 0, len(m))
+	for _, b := range m {
+		top = append(top, *b)
+	}
+	sort.Slice(top, func(i, j int) bool { return top[i].Bytes > top[j].Bytes })
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// dumpStats logs a snapshot of the process state to lg
+func dumpStats(lg *slog.Logger) {
+	states := make(map[string]int)
+	_Sessions.Range(func(k, v interface{}) bool {
+		state, _ := v.(*session).status()
+		states[state]++
+		return true
+	})
+
+	var backends []interface{}
+	for _, b := range topBackends(_DumpTopBackends) {
+		backends = append(backends, slog.Group(b.Addr, "conns", b.Conns, "bytes", b.Bytes))
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	lg.Info("stats dump",
+		slog.Group("conns",
+			"accepted", _MetricConnAccepted.Value(),
+			"active", _MetricConnActive.Value(),
+			stateHandshake, states[stateHandshake],
+			stateDialing, states[stateDialing],
+			stateRelaying, states[stateRelaying],
+			stateClosing, states[stateClosing],
+		),
+		slog.Group("bytes",
+			"up", _MetricUpstreamBytes.Value(),
+			"down", _MetricDownstreamBytes.Value(),
+		),
+		slog.Group("addr_cache",
+			"entries", _BackendAddrCache.Len(),
+			"hits", _MetricCacheHits.Value(),
+			"misses", _MetricCacheMisses.Value(),
+		),
+		slog.Group("runtime",
+			"goroutines", runtime.NumGoroutine(),
+			"heap_alloc", ms.HeapAlloc,
+			"num_gc", ms.NumGC,
+		),
+		slog.Group("top_backends", backends...),
+	)
+}
+
+// dumpStatsOnSignal dumps stats to the log every time SIGUSR1 is received
+func dumpStatsOnSignal() {
+	if _SignalDumpStats == nil {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, _SignalDumpStats)
+	for range c {
+		dumpStats(logger())
+	}
+}
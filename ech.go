@@ -0,0 +1,117 @@
+package frontd
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// With ECH_KEY_FILE the TLS listener accepts Encrypted ClientHello, so the
+// server name clients ask for, e.g. of SNI_ROUTES, isn't visible on the wire,
+// only the public name of the ECH configuration is. The file holds the
+// PKCS#8 "PRIVATE KEY" and the "ECHCONFIG" list published to clients, the
+// format of OpenSSL written by frontdctl ech keygen. Clients failing to
+// use the configuration are sent it to retry.
+
+var (
+	_ECHKeys atomic.Value // []tls.EncryptedClientHelloKey
+
+	_MetricECHAccepted = newCounter("frontd_tls_ech_accepted_total",
+		"Total number of TLS handshakes with an accepted Encrypted ClientHello.")
+)
+
+// echKeys returns the keys to decrypt ClientHellos with, empty but not nil
+// without ECH as crypto/tls requires
+func echKeys() []tls.EncryptedClientHelloKey {
+	keys, _ := _ECHKeys.Load().([]tls.EncryptedClientHelloKey)
+	if keys == nil {
+		return []tls.EncryptedClientHelloKey{}
+	}
+	return keys
+}
+
+// loadECHKeys reads ECH_KEY_FILE, it returns nil without it
+func loadECHKeys() ([]tls.EncryptedClientHelloKey, error) {
+	path := getenv("ECH_KEY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var priv []byte
+	var configs [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "PRIVATE KEY":
+			priv, err = parseECHKey(block.Bytes)
+		case "ECHCONFIG":
+			configs, err = splitECHConfigList(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if priv == nil || len(configs) == 0 {
+		return nil, fmt.Errorf("%s: expected a PRIVATE KEY and an ECHCONFIG block", path)
+	}
+	keys := make([]tls.EncryptedClientHelloKey, len(configs))
+	for i, config := range configs {
+		keys[i] = tls.EncryptedClientHelloKey{Config: config, PrivateKey: priv, SendAsRetry: true}
+	}
+	return keys, nil
+}
+
+// parseECHKey returns the private key in the format of HPKE
+func parseECHKey(der []byte) ([]byte, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *ecdh.PrivateKey:
+		return k.Bytes(), nil
+	case *ecdsa.PrivateKey:
+		ek, err := k.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		return ek.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported ECH key %T", key)
+}
+
+// splitECHConfigList returns the ECHConfigs of an ECHConfigList
+func splitECHConfigList(list []byte) ([][]byte, error) {
+	errMalformed := errors.New("malformed ECHConfigList")
+	if len(list) < 2 || int(binary.BigEndian.Uint16(list)) != len(list)-2 {
+		return nil, errMalformed
+	}
+	var configs [][]byte
+	for b := list[2:]; len(b) > 0; {
+		// version and length of the contents
+		if len(b) < 4 {
+			return nil, errMalformed
+		}
+		n := 4 + int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < n {
+			return nil, errMalformed
+		}
+		configs = append(configs, b[:n])
+		b = b[n:]
+	}
+	return configs, nil
+}
@@ -0,0 +1,298 @@
+package frontd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With EVENTS_URL set, connection lifecycle events are published to a
+// message bus: to a NATS server for nats:// URLs, or posted in batches to a
+// Kafka REST proxy topic for http(s):// URLs. Events are queued without ever
+// blocking connections, and dropped if the bus can't keep up.
+
+const (
+	_EventOpened        = "opened"
+	_EventAuthenticated = "authenticated"
+	_EventClosed        = "closed"
+)
+
+const (
+	_EventsQueueSize  = 4096
+	_EventsBatchSize  = 256
+	_EventsFlushDelay = time.Millisecond * 200
+)
+
+// connEvent is published as JSON
+type connEvent struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Host      string    `json:"host"`
+	ConnID    string    `json:"conn_id"`
+	Client    string    `json:"client"`
+	Backend   string    `json:"backend,omitempty"`
+	Token     string    `json:"token,omitempty"`
+	Duration  float64   `json:"duration,omitempty"`
+	BytesUp   uint64    `json:"bytes_up,omitempty"`
+	BytesDown uint64    `json:"bytes_down,omitempty"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// eventPublisher publishes batches of events
+type eventPublisher interface {
+	publish(events []connEvent) error
+}
+
+// eventQueue holds events until they're published
+type eventQueue struct {
+	ch   chan connEvent
+	host string
+}
+
+var (
+	_Events atomic.Value // *eventQueue, nil unless EVENTS_URL is configured
+
+	_MetricEventsPublished = newCounter("frontd_events_published_total",
+		"Total number of connection events published.")
+	_MetricEventsDropped = newCounter("frontd_events_dropped_total",
+		"Total number of connection events dropped as the queue was full or publishing failed.")
+)
+
+// newEventPublisher returns the publisher of the EVENTS_URL u, subject is the
+// prefix of NATS subjects
+func newEventPublisher(u, subject string) (eventPublisher, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	switch pu.Scheme {
+	case "nats":
+		if pu.Host == "" {
+			return nil, errors.New("missing NATS server address")
+		}
+		return &natsPublisher{url: pu, subject: subject}, nil
+	case "http", "https":
+		if pu.Host == "" {
+			return nil, errors.New("missing Kafka REST proxy address")
+		}
+		return &kafkaRESTPublisher{url: u, client: &http.Client{Timeout: time.Second * 10}}, nil
+	}
+	return nil, fmt.Errorf("unsupported scheme %q, nats, http or https expected", pu.Scheme)
+}
+
+func checkEventsURL(v string) error {
+	_, err := newEventPublisher(v, "")
+	return err
+}
+
+// startEvents starts publishing events with p
+func startEvents(p eventPublisher) {
+	q := &eventQueue{ch: make(chan connEvent, _EventsQueueSize)}
+	q.host, _ = os.Hostname()
+	_Events.Store(q)
+	go runEvents(p, q.ch)
+}
+
+func runEvents(p eventPublisher, queue chan connEvent) {
+	batch := make([]connEvent, 0, _EventsBatchSize)
+	tick := time.NewTicker(_EventsFlushDelay)
+	for {
+		select {
+		case e := <-queue:
+			batch = append(batch, e)
+			if len(batch) < _EventsBatchSize {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		err := p.publish(batch)
+		if err != nil {
+			logger().Warn("events not published", "err", err, "events", len(batch))
+			_MetricEventsDropped.Add(uint64(len(batch)))
+		} else {
+			_MetricEventsPublished.Add(uint64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+}
+
+// event queues an event of the session about backend, or the backend of
+// its status if empty. It never blocks.
+func (s *session) event(typ, backend string) {
+	q, _ := _Events.Load().(*eventQueue)
+	if q == nil {
+		return
+	}
+	if backend == "" {
+		_, backend = s.status()
+	}
+	e := connEvent{
+		Type:    typ,
+		Time:    time.Now(),
+		Host:    q.host,
+		ConnID:  s.id,
+		Client:  s.RemoteAddr().String(),
+		Backend: backend,
+		Token:   s.token,
+	}
+	if typ == _EventClosed {
+		e.Duration = time.Since(s.start).Seconds()
+		e.BytesUp = s.up.Value()
+		e.BytesDown = s.down.Value()
+		e.ErrorCode = s.errCode
+		if s.err != nil {
+			e.Error = s.err.Error()
+		}
+	}
+	select {
+	case q.ch <- e:
+	default:
+		_MetricEventsDropped.Inc()
+	}
+}
+
+// natsPublisher publishes each event to the subject prefix.type with the
+// core NATS protocol, reconnecting as needed
+type natsPublisher struct {
+	url     *url.URL
+	subject string
+
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+func (p *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.url.Host, time.Second*5)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting from NATS server: %q", line)
+	}
+	if info.TLSRequired {
+		conn.Close()
+		return errors.New("NATS server requires TLS, which isn't supported")
+	}
+
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "frontd", "lang": "go", "version": _Version}
+	if u := p.url.User; u != nil {
+		if pass, ok := u.Password(); ok {
+			opts["user"], opts["pass"] = u.Username(), pass
+		} else {
+			opts["auth_token"] = u.Username()
+		}
+	}
+	b, _ := json.Marshal(opts)
+	// PING makes the server report authentication errors before PONG
+	_, err = fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", b)
+	if err == nil {
+		line, err = r.ReadString('\n')
+	}
+	if err == nil && !strings.HasPrefix(line, "PONG") {
+		err = fmt.Errorf("NATS server refused the connection: %s", strings.TrimSpace(line))
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	// answer the server's pings so it keeps the connection
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if strings.HasPrefix(line, "PING") {
+				conn.Write([]byte("PONG\r\n"))
+			} else if strings.HasPrefix(line, "-ERR") {
+				logger().Warn("NATS server error", "err", strings.TrimSpace(line[4:]))
+			}
+		}
+	}()
+	p.conn, p.w = conn, bufio.NewWriter(conn)
+	return nil
+}
+
+func (p *natsPublisher) publish(events []connEvent) error {
+	if p.conn == nil {
+		err := p.connect()
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range events {
+		b, _ := json.Marshal(e)
+		fmt.Fprintf(p.w, "PUB %s.%s %d\r\n", p.subject, e.Type, len(b))
+		p.w.Write(b)
+		p.w.WriteString("\r\n")
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	err := p.w.Flush()
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+// kafkaRESTPublisher posts events to a topic of a Kafka REST proxy in the
+// v2 JSON format, keyed by connection so events of a connection stay in order
+type kafkaRESTPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func (p *kafkaRESTPublisher) publish(events []connEvent) error {
+	type record struct {
+		Key   string    `json:"key"`
+		Value connEvent `json:"value"`
+	}
+	var req struct {
+		Records []record `json:"records"`
+	}
+	for _, e := range events {
+		req.Records = append(req.Records, record{Key: e.ConnID, Value: e})
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Post(p.url, "application/vnd.kafka.json.v2+json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("kafka rest proxy failed with http status %d", res.StatusCode)
+	}
+	return nil
+}
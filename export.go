@@ -0,0 +1,309 @@
+package frontd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With USAGE_EXPORT frontd pushes the usage accounted in USAGE_FILE on the
+// cron schedule USAGE_EXPORT_SCHEDULE, so billing doesn't have to poll the
+// admin API. Every export is a rollup of the usage of every token, tenant
+// and backend per UTC day, from the day of the last successful export to the
+// current one, in USAGE_EXPORT_FORMAT. Days are exported again as long as
+// they are current, later exports supersede the rows of earlier ones. The
+// destination is a directory as file:///path, a bucket of S3 or a compatible
+// store as s3://bucket/prefix, signed with the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY of the environment, or a webhook posted to as
+// http(s)://.
+
+var (
+	_UsageExport atomic.Value // *usageExportConfig, nil if disabled
+
+	_UsageExportClient = &http.Client{Timeout: time.Second * 30}
+
+	// day of the last successful export, empty before the first
+	_UsageExportedMu  sync.Mutex
+	_UsageExportedDay string
+
+	_MetricUsageExports = newCounterVec("frontd_usage_exports_total",
+		"Total number of usage exports, by result.", "result")
+)
+
+type usageExportConfig struct {
+	dest     *url.URL
+	schedule *cronSchedule
+	format   string // csv or json
+
+	// of s3 destinations
+	endpoint string
+	region   string
+}
+
+func usageExportConf() *usageExportConfig {
+	c, _ := _UsageExport.Load().(*usageExportConfig)
+	return c
+}
+
+func checkUsageExport(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	switch {
+	case u.Scheme == "file" && u.Path != "":
+	case u.Scheme == "s3" && u.Host != "":
+	case (u.Scheme == "http" || u.Scheme == "https") && u.Host != "":
+	default:
+		return fmt.Errorf("must be a file://, s3:// or http(s):// URL")
+	}
+	return nil
+}
+
+// loadUsageExport reads the USAGE_EXPORT* settings, it returns nil without
+// a destination
+func loadUsageExport() (*usageExportConfig, error) {
+	dest := getenv("USAGE_EXPORT")
+	if dest == "" {
+		return nil, nil
+	}
+	err := checkUsageExport(dest)
+	if err != nil {
+		return nil, fmt.Errorf("USAGE_EXPORT: %v", err)
+	}
+	c := &usageExportConfig{format: "csv", region: "us-east-1"}
+	c.dest, _ = url.Parse(dest)
+	schedule := getenv("USAGE_EXPORT_SCHEDULE")
+	if schedule == "" {
+		schedule = "@daily"
+	}
+	c.schedule, err = parseCron(schedule)
+	if err != nil {
+		return nil, fmt.Errorf("USAGE_EXPORT_SCHEDULE: %v", err)
+	}
+	if f := getenv("USAGE_EXPORT_FORMAT"); f != "" {
+		c.format = f
+	}
+	if r := getenv("USAGE_EXPORT_S3_REGION"); r != "" {
+		c.region = r
+	}
+	c.endpoint = getenv("USAGE_EXPORT_S3_ENDPOINT")
+	if c.endpoint == "" {
+		c.endpoint = "https://s3." + c.region + ".amazonaws.com"
+	}
+	return c, nil
+}
+
+// runUsageExports exports the usage at the minutes scheduled
+func runUsageExports() {
+	for {
+		next := time.Now().Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(time.Until(next))
+		if c := usageExportConf(); c != nil && c.schedule.match(next) {
+			err := exportUsage(c, next)
+			if err != nil {
+				_MetricUsageExports.With("error").Inc()
+				logger().Error("usage not exported", "dest", c.dest.Redacted(), "err", err)
+			} else {
+				_MetricUsageExports.With("ok").Inc()
+			}
+		}
+	}
+}
+
+// usageRollup returns the usage of every token, tenant and backend per day
+// from the day from to that of now, in format
+func usageRollup(from string, now time.Time, format string) ([]byte, error) {
+	to := now.UTC().Format(_UsageDayLayout)
+	var rows []usageRow
+	for _, by := range []string{"token", "tenant", "backend"} {
+		rows = append(rows, _Usage.report(by, from, to, true)...)
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].Day < rows[j].Day })
+
+	var buf bytes.Buffer
+	if format == "json" {
+		err := json.NewEncoder(&buf).Encode(rows)
+		return buf.Bytes(), err
+	}
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"day", "kind", "id", "conns", "bytes_up", "bytes_down"})
+	for _, row := range rows {
+		kind, id := "token", row.Token
+		if row.Tenant != "" {
+			kind, id = "tenant", row.Tenant
+		} else if row.Backend != "" {
+			kind, id = "backend", row.Backend
+		}
+		cw.Write([]string{row.Day, kind, id, strconv.FormatUint(row.Conns, 10),
+			strconv.FormatUint(row.BytesUp, 10), strconv.FormatUint(row.BytesDown, 10)})
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// exportUsage sends the rollup since the last successful export, or the day
+// before now for the first one
+func exportUsage(c *usageExportConfig, now time.Time) error {
+	_UsageExportedMu.Lock()
+	defer _UsageExportedMu.Unlock()
+	from := _UsageExportedDay
+	if from == "" {
+		from = now.UTC().AddDate(0, 0, -1).Format(_UsageDayLayout)
+	}
+	body, err := usageRollup(from, now, c.format)
+	if err != nil {
+		return err
+	}
+	name := "usage-" + now.UTC().Format("20060102T150405Z") + "." + c.format
+	contentType := "text/csv"
+	if c.format == "json" {
+		contentType = "application/json"
+	}
+
+	switch c.dest.Scheme {
+	case "file":
+		err = writeFileAtomic(filepath.Join(c.dest.Path, name), body)
+	case "s3":
+		err = putS3(c, strings.TrimPrefix(c.dest.Path, "/")+name, contentType, body)
+	default:
+		err = postUsage(c.dest.String(), contentType, name, body)
+	}
+	if err != nil {
+		return err
+	}
+	_UsageExportedDay = now.UTC().Format(_UsageDayLayout)
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func postUsage(dest, contentType, name string, body []byte) error {
+	req, err := http.NewRequest("POST", dest, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	return doUsageRequest(req)
+}
+
+func doUsageRequest(req *http.Request) error {
+	res, err := _UsageExportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("http status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// putS3 uploads body as key of the bucket of the destination, addressed by
+// path on the endpoint so compatible stores work too
+func putS3(c *usageExportConfig, key, contentType string, body []byte) error {
+	u := strings.TrimSuffix(c.endpoint, "/") + awsEscape("/"+c.dest.Host+"/"+key)
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	signS3(req, body, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		os.Getenv("AWS_SESSION_TOKEN"), c.region, time.Now())
+	return doUsageRequest(req)
+}
+
+// awsEscape escapes a path the way Signature Version 4 canonicalizes it
+func awsEscape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		ch := path[i]
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+			ch == '-' || ch == '.' || ch == '_' || ch == '~' || ch == '/' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3 signs req with AWS Signature Version 4 for S3, covering every
+// header set on it
+func signS3(req *http.Request, body []byte, accessKey, secretKey, sessionToken, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		canonical.String(), signed, hex.EncodeToString(payload[:])}, "\n")
+	hash := sha256.Sum256([]byte(request))
+	scope := day + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
@@ -0,0 +1,128 @@
+package frontd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// geoDB is a MaxMind DB which is reopened when the file is replaced, e.g. by
+// geoipupdate
+type geoDB struct {
+	path string
+	db   atomic.Value // *mmdb
+
+	mu    sync.Mutex
+	mtime time.Time
+}
+
+// GeoIP databases of client addresses, nil if not configured
+var (
+	_GeoCountryDB *geoDB
+	_GeoASNDB     *geoDB
+)
+
+func openGeoDB(path string) (*geoDB, error) {
+	g := &geoDB{path: path}
+	return g, g.reload()
+}
+
+// reload reopens the database if it was modified since it was opened
+func (g *geoDB) reload() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fi, err := os.Stat(g.path)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(g.mtime) {
+		return nil
+	}
+	db, err := openMMDB(g.path)
+	if err != nil {
+		return err
+	}
+	if !g.mtime.IsZero() {
+		logger().Info("GeoIP database reloaded", "path", g.path, "type", db.dbType)
+	}
+	g.db.Store(db)
+	g.mtime = fi.ModTime()
+	return nil
+}
+
+func (g *geoDB) lookup(ip net.IP) interface{} {
+	db, _ := g.db.Load().(*mmdb)
+	if db == nil {
+		return nil
+	}
+	v, err := db.lookup(ip)
+	if err != nil {
+		logger().Warn("GeoIP lookup failed", "path", g.path, "ip", ip.String(), "err", err)
+	}
+	return v
+}
+
+// startGeoIP opens the databases which are set and checks them for updates
+// every interval
+func startGeoIP(countryDB, asnDB string, interval time.Duration) error {
+	var dbs []*geoDB
+	for _, db := range []struct {
+		path string
+		g    **geoDB
+	}{{countryDB, &_GeoCountryDB}, {asnDB, &_GeoASNDB}} {
+		if db.path == "" {
+			continue
+		}
+		g, err := openGeoDB(db.path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", db.path, err)
+		}
+		*db.g = g
+		dbs = append(dbs, g)
+	}
+	go reloadGeoDBs(interval, dbs...)
+	return nil
+}
+
+// reloadGeoDBs checks the databases for updates every interval
+func reloadGeoDBs(interval time.Duration, dbs ...*geoDB) {
+	for range time.Tick(interval) {
+		for _, g := range dbs {
+			err := g.reload()
+			if err != nil {
+				logger().Error("GeoIP database not reloaded", "path", g.path, "err", err)
+			}
+		}
+	}
+}
+
+// ipCountry returns the ISO 3166 code of the country of ip, falling back to
+// the country the network is registered in, or "" if unknown
+func ipCountry(ip net.IP) string {
+	if _GeoCountryDB == nil {
+		return ""
+	}
+	rec := _GeoCountryDB.lookup(ip)
+	if code, ok := mmdbPath(rec, "country", "iso_code").(string); ok {
+		return code
+	}
+	code, _ := mmdbPath(rec, "registered_country", "iso_code").(string)
+	return code
+}
+
+// ipASN returns the autonomous system number of ip or 0 if unknown
+func ipASN(ip net.IP) uint64 {
+	if _GeoASNDB == nil {
+		return 0
+	}
+	return mmdbUint(mmdbPath(_GeoASNDB.lookup(ip), "autonomous_system_number"))
+}
+
+func checkMMDB(v string) error {
+	_, err := openMMDB(v)
+	return err
+}
@@ -0,0 +1,18 @@
+package frontd
+
+import "github.com/google/gops/agent"
+
+// startGops starts a gops agent so a running relay can be inspected with
+// the gops tool, see https://github.com/google/gops
+func startGops(addr string) {
+	err := agent.Listen(agent.Options{
+		Addr: adminAddr(addr),
+		// signals are handled by frontd itself
+		ShutdownCleanup: false,
+	})
+	if err != nil {
+		logger().Error("gops agent disabled", "err", err)
+		return
+	}
+	logger().Info("gops agent listening", "addr", adminAddr(addr))
+}
@@ -0,0 +1,485 @@
+package frontd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/xindong/frontd/seal"
+	"golang.org/x/sync/errgroup"
+)
+
+// A client connection is served by a connHandler in stages: the header
+// stage reads the handshake, the auth stage checks its claims, the dial
+// stage connects to the backend and the relay stage pipes both ways. The
+// middleware chain runs around them, the auth middleware running the first
+// two and the relay at its end the others. Every stage runs under a context
+// of its own derived from the session's, canceled once the stage returns or
+// its timeout elapsed, so what a stage started is torn down with it.
+
+// errRelayDone ends the relay when a direction reached EOF
+var errRelayDone = errors.New("relay done")
+
+// connHandler serves client connections
+type connHandler struct {
+	// timeouts of the header and dial stages, CONN_READ_TIMEOUT and
+	// BACKEND_TIMEOUT if not positive
+	headerTimeout time.Duration
+	dialTimeout   time.Duration
+}
+
+// handleConn serves a client connection, it's torn down once ctx is done
+func handleConn(ctx context.Context, c net.Conn) {
+	(&connHandler{}).serve(ctx, c)
+}
+
+// stage returns the context of a stage of s, done once timeout elapsed if
+// positive, it's to be canceled when the stage returns
+func (h *connHandler) stage(s *session, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(s.ctx, timeout)
+	}
+	return context.WithCancel(s.ctx)
+}
+
+func (h *connHandler) readTimeout() time.Duration {
+	if h.headerTimeout > 0 {
+		return h.headerTimeout
+	}
+	return connReadTimeout()
+}
+
+func (h *connHandler) backendTimeout() time.Duration {
+	if h.dialTimeout > 0 {
+		return h.dialTimeout
+	}
+	return backendDialTimeout()
+}
+
+// serve sets up the session of c and runs it along the middleware chain, it
+// returns once the session is torn down
+func (h *connHandler) serve(ctx context.Context, c net.Conn) {
+	if muxHTTP() {
+		c = sniffHTTP(c)
+		if c == nil {
+			return
+		}
+	}
+	_MetricConnActive.Inc()
+	defer _MetricConnActive.Dec()
+
+	id := newConnID()
+	now := time.Now()
+	s := &session{
+		Conn:  c,
+		id:    id,
+		log:   logger().With("conn_id", id, "client_addr", c.RemoteAddr().String()),
+		sp:    startSpan("frontd.connection", spanKindServer),
+		start: now,
+		state: stateHandshake,
+		since: now,
+	}
+	s.sp.SetAttr("client.address", c.RemoteAddr().String())
+	s.sp.SetAttr("frontd.conn_id", id)
+
+	s.ctx, s.cancel = context.WithCancelCause(ctx)
+	if lifetime := maxConnLifetime(); lifetime > 0 {
+		var cancel context.CancelFunc
+		s.ctx, cancel = context.WithDeadlineCause(s.ctx, s.start.Add(lifetime), errExpired)
+		defer cancel()
+	}
+	// blocked reads and writes of the handshake and the relay return
+	context.AfterFunc(s.ctx, func() { c.Close() })
+
+	_Sessions.Store(id, s)
+	defer func() {
+		_Sessions.Delete(id)
+		s.closeConn()
+		s.cancel(nil)
+		if r := recover(); r != nil {
+			s.fail(fmt.Errorf("panic: %v", r))
+			recoveredPanic(s.log, id, r)
+		}
+		s.sp.End()
+		s.report()
+		s.closed()
+		s.event(_EventClosed, "")
+	}()
+	s.event(_EventOpened, "")
+
+	if linger := connLinger(); linger >= 0 {
+		if tc := tcpConn(c); tc != nil {
+			tc.SetLinger(linger)
+		}
+	}
+	if t, name := clientTransport(); t != nil {
+		if rt := h.readTimeout(); rt > 0 {
+			c.SetDeadline(time.Now().Add(rt))
+		}
+		tc, err := t.Wrap(c, secretPassphrase())
+		c.SetDeadline(time.Time{})
+		if err != nil {
+			s.fail(fmt.Errorf("transport %s: %w", name, err))
+			return
+		}
+		s.Conn = tc
+	}
+	chain()(&Conn{s: s, h: h})
+}
+
+// readHeader runs the header stage, reading the handshake of c within the
+// read timeout. It returns the plain backend address, or sni true if the
+// server name the TLS client asked for is routed and c.backend set to its
+// backend. Failures are answered and ok is false.
+func (h *connHandler) readHeader(c *Conn) (addr []byte, sni, ok bool) {
+	s := c.s
+	ctx, cancel := h.stage(s, h.readTimeout())
+	defer cancel()
+	if d, ok := ctx.Deadline(); ok {
+		s.SetReadDeadline(d)
+	}
+
+	proto, err := negotiateALPN(ctx, s)
+	if err != nil {
+		s.fail(err)
+		return nil, false, false
+	}
+	c.rdr = bufio.NewReader(s.Conn)
+
+	if backend := routeSNI(s); backend != "" {
+		// the whole connection is for the backend, there's no handshake
+		s.log.Debug("handshake", "mode", "sni", "alpn", proto, "server_name", s.backendTLS)
+		c.backend = backend
+		return nil, true, true
+	}
+
+	// clients negotiating HTTP never send the binary handshake
+	if proto != _ALPNHTTP {
+		addr, err = handleBinaryHdr(c.rdr, s)
+		if err != nil {
+			s.fail(err)
+			return nil, false, false
+		}
+		if addr != nil {
+			return addr, false, true
+		}
+	}
+
+	// Read first line
+	line, isPrefix, err := c.rdr.ReadLine()
+	if err != nil || isPrefix {
+		if err == nil {
+			err = errors.New("cipher address line too long")
+		}
+		s.fail(err)
+		writeErrCode(s, []byte("4104"), false)
+		return nil, false, false
+	}
+	s.received = time.Now()
+
+	cipherAddr := line
+	mode := "text"
+	routed := false
+
+	// check if it's HTTP request
+	isHTTP := bytes.Contains(line, []byte("HTTP"))
+	switch {
+	case isHTTP && proto == _ALPNTunnel:
+		s.fail(errors.New("http request negotiating the tunnel protocol"))
+		writeErrCode(s, []byte("4104"), false)
+		return nil, false, false
+	case !isHTTP && proto == _ALPNHTTP:
+		s.fail(errors.New("no http request negotiating http"))
+		writeErrCode(s, []byte("4107"), true)
+		return nil, false, false
+	case isHTTP:
+		mode = "http"
+		c.header = bytes.NewBuffer(line)
+		c.header.Write([]byte("\n"))
+
+		cipherAddr, routed, err = handleHTTPHdr(c.rdr, s, c.header)
+		if err != nil {
+			s.fail(err)
+			return nil, false, false
+		}
+		s.received = time.Now()
+		if routed {
+			mode = "host"
+		}
+		if bytes.HasPrefix(line, []byte("CONNECT ")) {
+			// answered once the backend is connected, nothing of the
+			// request is forwarded
+			mode = "connect"
+			c.header = nil
+			s.httpConnect = true
+		}
+	}
+	s.log.Debug("handshake", "mode", mode, "alpn", proto, "token", tokenHash(cipherAddr))
+
+	if routed {
+		// the backend of the route, not a cipher address
+		return cipherAddr, false, true
+	}
+	// base64 decode
+	dbuf := make([]byte, base64.StdEncoding.DecodedLen(len(cipherAddr)))
+	n, err := base64.StdEncoding.Decode(dbuf, cipherAddr)
+	if err != nil {
+		s.fail(err)
+		writeErrCode(s, []byte("4106"), false)
+		return nil, false, false
+	}
+	addr, err = tracedAddrDecrypt(dbuf[:n], s)
+	if err != nil {
+		s.fail(err)
+		writeErrCode(s, decryptErrCode(err), false)
+		return nil, false, false
+	}
+	return addr, false, true
+}
+
+// authenticate runs the auth stage, enforcing the claims of addr and running
+// OnAuth. It sets c.backend and returns the release of what the claims
+// acquired, failures are answered and ok is false.
+func (h *connHandler) authenticate(c *Conn, addr []byte) (release func(), ok bool) {
+	s := c.s
+	addr, claims, err := parseClaims(addr)
+	if err != nil {
+		s.fail(err)
+		writeErrCode(s, []byte("4106"), false)
+		return nil, false
+	}
+	release, ok = enforceClaims(c, claims)
+	if !ok {
+		return nil, false
+	}
+	if !readSealNonce(c) {
+		release()
+		return nil, false
+	}
+
+	// the until claim bounds the context of the session from now on
+	ctx, cancel := h.stage(s, 0)
+	defer cancel()
+	audit(s, auditAuthSuccess, string(addr))
+	if !runHook(ctx, s, hooks().OnAuth, string(addr), "4100") {
+		release()
+		return nil, false
+	}
+	c.backend = string(addr)
+	s.event(_EventAuthenticated, c.backend)
+	return release, true
+}
+
+// dial runs the dial stage, running OnDial and connecting to the backend of
+// c within the backend timeout. Failures are answered with their error code.
+func (h *connHandler) dial(c *Conn) (net.Conn, error) {
+	s, addr := c.s, c.backend
+	s.setBackend(addr)
+	s.setState(stateDialing)
+	s.sp.SetAttr("frontd.backend", addr)
+	ctx, cancel := h.stage(s, 0)
+	defer cancel()
+
+	s.log.Debug("dialing backend", "backend_addr", addr)
+	if !runHook(ctx, s, hooks().OnDial, addr, "4111") {
+		return nil, s.err
+	}
+
+	timeout := h.backendTimeout()
+	dsp := s.sp.child("frontd.dial", spanKindClient)
+	dsp.SetAttr("server.address", addr)
+	start := time.Now()
+	backend, err := dialBackend(ctx, addr, timeout)
+	_MetricDialDuration.Observe(time.Since(start).Seconds())
+	dsp.SetError(err)
+	dsp.End()
+	if errors.Is(err, errBackendForbidden) {
+		writeErrCode(s, []byte("4111"), false)
+		return nil, err
+	}
+	// forbidden backends aren't labeled, clients can't add series at will
+	label := backendLabel(addr)
+	_MetricBackendConns.With(label).Inc()
+	if err == nil && s.backendTLS != "" {
+		var tc net.Conn
+		tc, err = clientTLS(ctx, s, backend, timeout)
+		if err != nil {
+			backend.Close()
+		}
+		backend = tc
+	}
+	recordDial(addr, err)
+	if err != nil {
+		_MetricBackendErrors.With(label).Inc()
+		// handle error
+		switch err := err.(type) {
+		case net.Error:
+			if err.Timeout() {
+				writeErrCode(s, []byte("4101"), false)
+				return nil, err
+			}
+		}
+		writeErrCode(s, []byte("4102"), false)
+		return nil, err
+	}
+	_MetricHandshakeDuration.Observe(time.Since(s.start).Seconds())
+	return backend, nil
+}
+
+// relay runs the relay stage, piping c and backend both ways under an
+// errgroup. The first direction to end cancels the context of the stage,
+// which closes both connections, so the other one returns from its blocked
+// read at once instead of waiting for a peer to notice.
+func (h *connHandler) relay(c *Conn, backend net.Conn) error {
+	s, addr := c.s, c.backend
+	g, ctx := errgroup.WithContext(s.ctx)
+
+	if dscp := dscpFor(addr); dscp >= 0 {
+		for _, c := range []net.Conn{s.Conn, backend} {
+			err := setDSCP(c, dscp)
+			if err != nil {
+				s.log.Debug("DSCP not set", "dscp", dscp, "err", err)
+			}
+		}
+	}
+
+	var err error
+	if recordBackend(addr, tcpAddr(backend.RemoteAddr()).IP) {
+		s.rec, err = newRecorder(s)
+		if err != nil {
+			s.log.Warn("tunnel not recorded", "err", err)
+		} else {
+			defer s.rec.Close()
+		}
+	}
+
+	upTap, downTap := newTaps(s, backend)
+	var bs *backendSwitch
+	closeBackend := backend.Close
+	// redialed backends would be plain
+	if s.backendTLS == "" && reconnectBackend(addr, tcpAddr(backend.RemoteAddr()).IP) {
+		bs = newBackendSwitch(backend)
+		upTap.Writer = bs
+		closeBackend = bs.Close
+	}
+	client := s.Conn
+	stop := context.AfterFunc(ctx, func() {
+		s.setState(stateClosing)
+		client.Close()
+		closeBackend()
+	})
+	defer stop()
+
+	s.setState(stateRelaying)
+	rsp := s.sp.child("frontd.relay", spanKindInternal)
+	defer rsp.End()
+
+	label := backendLabel(addr)
+	up := []*counter{_MetricUpstreamBytes, _MetricBackendBytes.With(label, "upstream"), &s.up}
+	down := []*counter{_MetricDownstreamBytes, _MetricBackendBytes.With(label, "downstream"), &s.down}
+	for _, lc := range s.live {
+		up = append(up, &lc.counter)
+		down = append(down, &lc.counter)
+	}
+
+	if s.httpConnect {
+		_, err = s.Write(_HTTPConnectEstablished)
+		if err != nil {
+			return err
+		}
+	}
+	if s.ticketAddr != nil {
+		_, err = s.Write(ticketFrame(s))
+		if err != nil {
+			return err
+		}
+	}
+
+	// the bytes on the wire are capped, sealed and compressed ones downstream
+	if caps := currentBandwidthCaps(); caps != nil {
+		if limiters := caps.limiters(addr, 0); len(limiters) > 0 {
+			upTap.Writer = newCappedWriter(ctx, upTap.Writer, limiters)
+		}
+		if limiters := caps.limiters(addr, 1); len(limiters) > 0 {
+			downTap.Writer = newCappedWriter(ctx, downTap.Writer, limiters)
+		}
+	}
+	// the handshake is plain, what follows it is sealed or compressed
+	var src io.Reader = c.rdr
+	var srcconn net.Conn = client
+	var sealed *seal.Writer
+	if s.encrypt == seal.Name {
+		src, sealed, err = sealTunnel(s, src, downTap.Writer)
+		if err != nil {
+			return err
+		}
+		downTap.Writer = sealed
+	}
+	if s.compress == _CompressDeflate {
+		_MetricCompressedTunnels.Inc()
+		src = newInflater(src)
+		srcconn = noDeadlineConn{client}
+		downTap.Writer = newDeflater(downTap.Writer)
+	}
+	if s.throttle > 0 || s.quota != nil {
+		rate := func() int64 { return s.throttle }
+		if s.quota != nil {
+			rate = s.quota.rate
+		}
+		upTap.Writer = newThrottledWriter(ctx, upTap.Writer, rate)
+		downTap.Writer = newThrottledWriter(ctx, downTap.Writer, rate)
+	}
+	if _, ok := priorityBandwidth()[s.priority]; ok {
+		var throttled atomic.Bool
+		rate := func() int64 { return priorityThrottle(s.priority, &throttled) }
+		upTap.Writer = newThrottledWriter(ctx, upTap.Writer, rate)
+		downTap.Writer = newThrottledWriter(ctx, downTap.Writer, rate)
+	}
+	if c.header != nil {
+		n, _ := c.header.WriteTo(upTap)
+		for _, c := range up {
+			c.Add(uint64(n))
+		}
+	}
+
+	// a direction reaching EOF ends the relay as well
+	done := func(err error) error {
+		if err == nil {
+			return errRelayDone
+		}
+		return err
+	}
+	active := time.Now().UnixNano()
+	g.Go(func() error {
+		var err error
+		if bs != nil {
+			err = bs.relayDown(ctx, c, downTap, &active, down...)
+		} else {
+			err = pipe(downTap, backend, client, backend, s.log, "downstream", &active, down...)
+		}
+		if err == nil && sealed != nil {
+			err = sealed.Close()
+		}
+		return done(err)
+	})
+	g.Go(func() error {
+		return done(pipe(upTap, src, backend, srcconn, s.log, "upstream", &active, up...))
+	})
+	err = g.Wait()
+	rsp.SetAttr("frontd.bytes_up", int64(s.up.Value()))
+	rsp.SetAttr("frontd.bytes_down", int64(s.down.Value()))
+
+	// connections closed under the relay were canceled, which is reported
+	// by the cause of the session
+	if err == errRelayDone || errorClass(err) == "closed" {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package frontd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Binary upgrades hand the listening socket over to a new process, like
+// nginx does: on SIGUSR2 frontd starts the binary again with the socket as
+// an inherited file. Once the new process accepts connections the old one
+// closes its copy of the listener and drains its tunnels. The accept queue
+// belongs to the socket, so no connection attempt is refused meanwhile.
+
+// tell a new process which descriptor is the listener and which one is a
+// pipe to report readiness to the old process
+const (
+	_ListenerFDEnv = "FRONTD_LISTENER_FD"
+	_ReadyFDEnv    = "FRONTD_READY_FD"
+)
+
+// how long the old process waits for the new one to start accepting
+const _HandoffTimeout = time.Second * 30
+
+var _Inherited = os.Getenv(_ListenerFDEnv) != ""
+
+// inheritedListener returns the listener handed over by the old process, or
+// nil if there is none
+func inheritedListener() (net.Listener, error) {
+	if !_Inherited {
+		return nil, nil
+	}
+	fd, err := strconv.Atoi(os.Getenv(_ListenerFDEnv))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", _ListenerFDEnv, err)
+	}
+	f := os.NewFile(uintptr(fd), "listener")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	logger().Info("listener inherited", "addr", l.Addr().String())
+	return l, nil
+}
+
+// notifyReady tells the process which started this one, for an upgrade or
+// to run as a daemon, that connections are accepted
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(_ReadyFDEnv))
+	if err == nil {
+		f := os.NewFile(uintptr(fd), "ready")
+		f.Write([]byte("ready"))
+		f.Close()
+	}
+	// processes started by this one must not take these descriptors over
+	os.Unsetenv(_ListenerFDEnv)
+	os.Unsetenv(_ReadyFDEnv)
+}
+
+// listenRetry listens on addr. A new process started by an upgrade retries
+// while the old one still holds the port.
+func listenRetry(addr string) (net.Listener, error) {
+	deadline := time.Now().Add(_ShutdownDelay + _DrainTimeout + _HandoffTimeout)
+	for {
+		l, err := net.Listen("tcp", addr)
+		if err == nil || !_Inherited || !errors.Is(err, syscall.EADDRINUSE) || time.Now().After(deadline) {
+			return l, err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// upgrade starts the binary frontd was started from again, handing over the
+// listener. It returns once the new process accepts connections.
+func upgrade() error {
+	_ListenerMutex.Lock()
+	l, ok := _Listener.(*net.TCPListener)
+	_ListenerMutex.Unlock()
+	if !ok {
+		return errors.New("no listener to hand over")
+	}
+	lf, err := l.File()
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	// resolved again so a binary replaced in place is picked up
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	for _, e := range os.Environ() {
+		// the systemd watchdog is taken over along with MAINPID
+		if !strings.HasPrefix(e, "WATCHDOG_PID=") {
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	cmd.Env = append(cmd.Env, _ListenerFDEnv+"=3")
+	cmd.ExtraFiles = []*os.File{lf}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return startReady(cmd, _HandoffTimeout)
+}
+
+// startReady starts cmd, which must be frontd, and waits until it accepts
+// connections. The process is killed if it isn't ready within timeout.
+func startReady(cmd *exec.Cmd, timeout time.Duration) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd.Env = append(cmd.Env, _ReadyFDEnv+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	logger().Info("new process started", "pid", cmd.Process.Pid, "path", cmd.Path)
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 5)
+		_, err := r.Read(b)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return fmt.Errorf("new process not ready: %v", err)
+	}
+	cmd.Process.Release()
+	return nil
+}
+
+// upgradeOnSignal hands the listener over to a new process on SIGUSR2 and
+// drains this one
+func upgradeOnSignal() {
+	if _SignalUpgrade == nil {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, _SignalUpgrade)
+	for range c {
+		err := upgrade()
+		if err != nil {
+			logger().Error("upgrade failed", "err", err)
+			continue
+		}
+		logger().Info("listener handed over, draining")
+		closeListener()
+		return
+	}
+}
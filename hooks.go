@@ -0,0 +1,101 @@
+package frontd
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes a client connection to hooks
+type ConnInfo struct {
+	ID     string
+	Client net.Addr
+	// Backend is the address decrypted from the handshake, after OnAuth the
+	// address dialed as mapped by the Router
+	Backend string
+	// Token identifies the cipher address without revealing it
+	Token string
+
+	// set once the connection closed
+	Duration  time.Duration
+	BytesUp   uint64
+	BytesDown uint64
+	ErrorCode string // sent to the client, empty if none
+	Err       error
+}
+
+// Hooks are called by Server at the stages of every connection, with a
+// context canceled when the connection is torn down. Nil hooks are skipped.
+// OnAccept, OnAuth and OnDial may refuse the connection by returning an
+// error, the client then receives 4100, 4100 and 4111 respectively.
+type Hooks struct {
+	// OnAccept is called before the handshake is read
+	OnAccept func(ctx context.Context, info *ConnInfo) error
+	// OnAuth is called once the backend address was decrypted
+	OnAuth func(ctx context.Context, info *ConnInfo) error
+	// OnDial is called before the backend is dialed
+	OnDial func(ctx context.Context, info *ConnInfo) error
+	// OnClose is called after the connection was closed and logged
+	OnClose func(info *ConnInfo)
+}
+
+// _Hooks is set by Server.Serve, nil calls none
+var _Hooks atomic.Value // *Hooks
+
+func hooks() *Hooks {
+	h, _ := _Hooks.Load().(*Hooks)
+	if h == nil {
+		return &Hooks{}
+	}
+	return h
+}
+
+// connInfo describes the session to hooks
+func (s *session) connInfo() *ConnInfo {
+	_, backend := s.status()
+	return &ConnInfo{
+		ID:      s.id,
+		Client:  s.RemoteAddr(),
+		Backend: backend,
+		Token:   s.token,
+	}
+}
+
+// runHook calls hook with the session's backend address, and refuses the
+// client with code if it returns an error
+func runHook(ctx context.Context, s *session, hook func(context.Context, *ConnInfo) error, backend, code string) bool {
+	if hook == nil {
+		return true
+	}
+	info := s.connInfo()
+	info.Backend = backend
+	err := hook(ctx, info)
+	if err == nil {
+		return true
+	}
+	s.fail(err)
+	writeErrCode(s, []byte(code), false)
+	return false
+}
+
+// closed calls OnClose once the session is done, panics of the hook are
+// recovered like those of the relay
+func (s *session) closed() {
+	h := hooks().OnClose
+	if h == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			recoveredPanic(s.log, s.id, r)
+		}
+	}()
+	info := s.connInfo()
+	info.Duration = time.Since(s.start)
+	info.BytesUp = s.up.Value()
+	info.BytesDown = s.down.Value()
+	info.ErrorCode = s.errCode
+	info.Err = s.err
+	h(info)
+}
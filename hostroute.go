@@ -0,0 +1,83 @@
+package frontd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// HOST_ROUTES makes frontd a lightweight vhost router alongside the cipher
+// addresses: HTTP handshakes without X-Cipher-Origin are routed by their Host
+// header, and the request head is forwarded to the backend like any other.
+
+var (
+	_HostRoutes atomic.Value // []hostRoute
+
+	_MetricHostRouted = newCounterVec("frontd_host_routed_total",
+		"Total number of HTTP handshakes routed by their Host header, by route.", "route")
+)
+
+// hostRoute routes a host, *.domain for its subdomains or * for all
+type hostRoute struct {
+	host    string
+	backend string
+}
+
+func (r hostRoute) match(host string) bool {
+	switch {
+	case r.host == "*":
+		return true
+	case strings.HasPrefix(r.host, "*."):
+		return strings.HasSuffix(host, r.host[1:])
+	}
+	return host == r.host
+}
+
+// parseHostRoutes parses a comma separated list of host=backend, where
+// backend is a host:port
+func parseHostRoutes(v string) ([]hostRoute, error) {
+	var routes []hostRoute
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.IndexByte(item, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("expected host=backend, got %q", item)
+		}
+		r := hostRoute{host: strings.ToLower(item[:eq]), backend: item[eq+1:]}
+		if _, _, err := net.SplitHostPort(r.backend); err != nil || strings.Contains(r.backend, "?") {
+			return nil, fmt.Errorf("invalid backend %q, must be host:port", r.backend)
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func checkHostRoutes(v string) error {
+	_, err := parseHostRoutes(v)
+	return err
+}
+
+// routeHost returns the backend of the first route matching the value of a
+// Host header, or empty if none does
+func routeHost(host string) string {
+	routes, _ := _HostRoutes.Load().([]hostRoute)
+	if len(routes) == 0 || host == "" {
+		return ""
+	}
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	for _, r := range routes {
+		if r.match(host) {
+			_MetricHostRouted.With(r.host).Inc()
+			return r.backend
+		}
+	}
+	return ""
+}
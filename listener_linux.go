@@ -0,0 +1,38 @@
+package frontd
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// tuneListener sets the accept backlog of l and makes the kernel hold back
+// connections until the client sent data, for up to deferAccept seconds.
+// Zero leaves a setting alone.
+func tuneListener(l net.Listener, backlog, deferAccept int) error {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return errors.New("not a TCP listener")
+	}
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if deferAccept > 0 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, deferAccept)
+			if serr != nil {
+				return
+			}
+		}
+		// listening again only resizes the queue, capped by net.core.somaxconn
+		if backlog > 0 {
+			serr = syscall.Listen(int(fd), backlog)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
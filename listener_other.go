@@ -0,0 +1,12 @@
+//go:build !linux
+
+package frontd
+
+import (
+	"errors"
+	"net"
+)
+
+func tuneListener(l net.Listener, backlog, deferAccept int) error {
+	return errors.New("LISTEN_BACKLOG and TCP_DEFER_ACCEPT are only supported on Linux")
+}
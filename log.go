@@ -0,0 +1,219 @@
+package frontd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// _LogLevel can be changed at runtime through /debug/loglevel
+var _LogLevel = new(slog.LevelVar)
+
+// _LogOutput is where setupLogger writes records unless syslog is used
+var _LogOutput io.Writer = os.Stderr
+
+// _Logger writes structured records to stderr, JSON by default. It's
+// replaced by setupLogger and Server.Serve, see logger.
+var _Logger atomic.Value // *slog.Logger
+
+func init() {
+	_Logger.Store(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: _LogLevel})))
+}
+
+func logger() *slog.Logger {
+	return _Logger.Load().(*slog.Logger)
+}
+
+// setupLogger selects the log format, "text" for logfmt style records and
+// anything else for JSON, and the minimum level: debug, info, warn or error.
+// When rateLimit is positive, at most rateLimit warnings or errors of the
+// same class are written per second. Records go to sl if it isn't nil, or
+// _LogOutput otherwise. Output of the standard log package, e.g. from net/http,
+// is routed through it as well.
+func setupLogger(format, level string, rateLimit int, sl *syslogWriter) {
+	if level != "" {
+		err := _LogLevel.UnmarshalText([]byte(level))
+		if err != nil {
+			logger().Warn("invalid log level", "level", level, "err", err)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: _LogLevel}
+	newH := func(w io.Writer) slog.Handler {
+		if format == "text" {
+			return slog.NewTextHandler(w, opts)
+		}
+		return slog.NewJSONHandler(w, opts)
+	}
+
+	var h slog.Handler
+	if sl != nil {
+		h = newSyslogHandler(sl, _LogLevel, newH)
+	} else {
+		h = newH(_LogOutput)
+	}
+	if rateLimit > 0 {
+		rh := newRateLimitedHandler(h, rateLimit, time.Second)
+		go rh.state.summarize()
+		h = rh
+	}
+	l := slog.New(h)
+	_Logger.Store(l)
+	slog.SetDefault(l)
+}
+
+// logLevelHandler reports the current log level on GET and changes it
+// when a level is PUT or POSTed as the request body.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT", "POST":
+		b, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		old := _LogLevel.Level()
+		err = _LogLevel.UnmarshalText([]byte(strings.TrimSpace(string(b))))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger().Info("log level changed", "from", old.String(), "to", _LogLevel.Level().String())
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	io.WriteString(w, _LogLevel.Level().String()+"\n")
+}
+
+var (
+	// random per process so IDs stay unique across restarts
+	_connIDPrefix = func() string {
+		b := make([]byte, 4)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}()
+	_connIDSeq uint64
+)
+
+// newConnID returns an identifier unique to a client connection
+func newConnID() string {
+	return _connIDPrefix + "-" + strconv.FormatUint(atomic.AddUint64(&_connIDSeq, 1), 36)
+}
+
+// rateLimitedHandler drops warnings and errors of a class exceeding limit
+// records per interval, so a flood of bad handshakes can't turn logging into
+// a DoS. The number of dropped records is logged once per interval.
+// A class is the message plus the error_code attribute if there is one.
+type rateLimitedHandler struct {
+	slog.Handler
+	state *rateLimitState
+}
+
+type rateLimitState struct {
+	base     slog.Handler // for summaries, without attributes of derived loggers
+	limit    int
+	interval time.Duration
+
+	mu      sync.Mutex
+	classes map[string]*logClass
+}
+
+type logClass struct {
+	window     time.Time
+	n          int
+	suppressed int
+}
+
+func newRateLimitedHandler(h slog.Handler, limit int, interval time.Duration) *rateLimitedHandler {
+	return &rateLimitedHandler{
+		Handler: h,
+		state: &rateLimitState{
+			base:     h,
+			limit:    limit,
+			interval: interval,
+			classes:  make(map[string]*logClass),
+		},
+	}
+}
+
+func (h *rateLimitedHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn {
+		return h.Handler.Handle(ctx, r)
+	}
+
+	class := r.Message
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "error_code" {
+			class += ":" + a.Value.String()
+			return false
+		}
+		return true
+	})
+
+	if !h.state.allow(class, r.Time) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *rateLimitedHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &rateLimitedHandler{Handler: h.Handler.WithAttrs(attrs), state: h.state}
+}
+
+func (h *rateLimitedHandler) WithGroup(name string) slog.Handler {
+	return &rateLimitedHandler{Handler: h.Handler.WithGroup(name), state: h.state}
+}
+
+func (st *rateLimitState) allow(class string, now time.Time) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	c, ok := st.classes[class]
+	if !ok {
+		c = &logClass{window: now}
+		st.classes[class] = c
+	}
+	if now.Sub(c.window) >= st.interval {
+		c.window = now
+		c.n = 0
+	}
+	if c.n < st.limit {
+		c.n++
+		return true
+	}
+	c.suppressed++
+	return false
+}
+
+// summarize logs how many records of each class were suppressed
+func (st *rateLimitState) summarize() {
+	for range time.Tick(st.interval) {
+		st.mu.Lock()
+		counts := make(map[string]int)
+		for class, c := range st.classes {
+			if c.suppressed > 0 {
+				counts[class] = c.suppressed
+				c.suppressed = 0
+			}
+		}
+		st.mu.Unlock()
+
+		for class, n := range counts {
+			r := slog.NewRecord(time.Now(), slog.LevelWarn, "suppressed similar log records", 0)
+			r.AddAttrs(slog.String("class", class), slog.Int("count", n))
+			st.base.Handle(context.Background(), r)
+		}
+	}
+}
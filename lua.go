@@ -0,0 +1,1483 @@
+package frontd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A minimal interpreter of a subset of Lua 5.1, enough for routing scripts:
+// local and global variables, functions and closures, if/elseif/else,
+// numeric and generic (ipairs, pairs) for loops, while loops, multiple
+// return values, and read only tables. Scripts can't reach the file system,
+// the network or the process, and run with a bounded number of steps and
+// bounded memory.
+
+// luaValue is nil, bool, float64, string, *luaTable, *luaFunction,
+// luaBuiltin or *luaIterator
+type luaValue interface{}
+
+// luaTable is read only once constructed
+type luaTable struct {
+	m    map[luaValue]luaValue
+	keys []luaValue // in construction order, for pairs
+}
+
+type luaBuiltin func(args []luaValue) ([]luaValue, error)
+
+type luaFunction struct {
+	name   string
+	params []string
+	body   []luaStmt
+	scope  *luaScope
+}
+
+// _LuaMaxSteps bounds the statements and calls a script may run per call
+const _LuaMaxSteps = 100000
+
+// _LuaMaxDepth bounds nested calls
+const _LuaMaxDepth = 200
+
+// _LuaMaxString bounds the length of the strings a script may build
+const _LuaMaxString = 64 * 1024
+
+// _LuaMaxAlloc bounds the bytes of strings and tables a script may allocate
+// per call
+const _LuaMaxAlloc = 4 << 20
+
+// _LuaEntrySize is what a table entry is charged
+const _LuaEntrySize = 32
+
+var (
+	errLuaSteps  = errors.New("script exceeded its step limit")
+	errLuaMemory = errors.New("script exceeded its memory limit")
+	errLuaString = errors.New("string length overflow")
+)
+
+type luaScope struct {
+	vars   map[string]luaValue
+	parent *luaScope
+	frozen bool // assignments shadow the variables instead of changing them
+}
+
+func newLuaScope(parent *luaScope) *luaScope {
+	return &luaScope{vars: make(map[string]luaValue), parent: parent}
+}
+
+func (sc *luaScope) lookup(name string) (luaValue, bool) {
+	for ; sc != nil; sc = sc.parent {
+		if v, ok := sc.vars[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// set assigns an existing variable, or defines a global in the outermost
+// scope that isn't frozen
+func (sc *luaScope) set(name string, v luaValue) {
+	var outer *luaScope
+	for s := sc; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok && !s.frozen {
+			s.vars[name] = v
+			return
+		}
+		if !s.frozen {
+			outer = s
+		}
+	}
+	outer.vars[name] = v
+}
+
+// luaState is the state of a single call into a script
+type luaState struct {
+	steps int
+	depth int
+	mem   int // bytes allocated
+}
+
+func (st *luaState) step() error {
+	st.steps++
+	if st.steps > _LuaMaxSteps {
+		return errLuaSteps
+	}
+	return nil
+}
+
+// alloc charges n bytes allocated by the script
+func (st *luaState) alloc(n int) error {
+	st.mem += n
+	if st.mem > _LuaMaxAlloc {
+		return errLuaMemory
+	}
+	return nil
+}
+
+// allocString charges a string of length n built by the script
+func (st *luaState) allocString(n int) error {
+	if n > _LuaMaxString {
+		return errLuaString
+	}
+	return st.alloc(n)
+}
+
+// luaError is a runtime error with the line it occurred on
+type luaError struct {
+	line int
+	msg  string
+}
+
+func (e *luaError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+func luaErrorf(line int, format string, args ...interface{}) error {
+	return &luaError{line, fmt.Sprintf(format, args...)}
+}
+
+func luaTruthy(v luaValue) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	return true
+}
+
+func luaTypeName(v luaValue) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	}
+	return "function"
+}
+
+func luaToString(v luaValue) string {
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'g', 14, 64)
+	case string:
+		return v
+	}
+	return fmt.Sprintf("%s: %p", luaTypeName(v), v)
+}
+
+func luaToNumber(v luaValue) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (t *luaTable) get(k luaValue) luaValue {
+	return t.m[k]
+}
+
+func (t *luaTable) length() int {
+	n := 0
+	for t.m[float64(n+1)] != nil {
+		n++
+	}
+	return n
+}
+
+func newLuaTable() *luaTable {
+	return &luaTable{m: make(map[luaValue]luaValue)}
+}
+
+func (t *luaTable) put(k, v luaValue) {
+	if _, ok := t.m[k]; !ok {
+		t.keys = append(t.keys, k)
+	}
+	t.m[k] = v
+}
+
+// Lexer
+
+type luaToken struct {
+	kind string // "name", "number", "string", "eof", or the keyword or symbol
+	text string
+	num  float64
+	line int
+}
+
+var _LuaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true, "false": true,
+	"for": true, "function": true, "if": true, "in": true, "local": true, "nil": true, "not": true,
+	"or": true, "return": true, "then": true, "true": true, "while": true,
+}
+
+func luaLex(src string) ([]luaToken, error) {
+	var toks []luaToken
+	line := 1
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "--"):
+			if strings.HasPrefix(src[i+2:], "[[") {
+				end := strings.Index(src[i+4:], "]]")
+				if end < 0 {
+					return nil, luaErrorf(line, "unfinished long comment")
+				}
+				line += strings.Count(src[i:i+4+end], "\n")
+				i += 4 + end + 2
+				continue
+			}
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' ||
+				src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			word := src[i:j]
+			kind := "name"
+			if _LuaKeywords[word] {
+				kind = word
+			}
+			toks = append(toks, luaToken{kind: kind, text: word, line: line})
+			i = j
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i
+			if strings.HasPrefix(src[i:], "0x") || strings.HasPrefix(src[i:], "0X") {
+				j += 2
+				for j < len(src) && strings.IndexByte("0123456789abcdefABCDEF", src[j]) >= 0 {
+					j++
+				}
+				n, err := strconv.ParseUint(src[i+2:j], 16, 64)
+				if err != nil {
+					return nil, luaErrorf(line, "malformed number %q", src[i:j])
+				}
+				toks = append(toks, luaToken{kind: "number", num: float64(n), line: line})
+				i = j
+				continue
+			}
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.' || src[j] == 'e' || src[j] == 'E' ||
+				(src[j] == '-' || src[j] == '+') && (src[j-1] == 'e' || src[j-1] == 'E')) {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, luaErrorf(line, "malformed number %q", src[i:j])
+			}
+			toks = append(toks, luaToken{kind: "number", num: n, line: line})
+			i = j
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\n' {
+					return nil, luaErrorf(line, "unfinished string")
+				}
+				if src[j] != '\\' {
+					sb.WriteByte(src[j])
+					continue
+				}
+				j++
+				if j == len(src) {
+					break
+				}
+				switch e := src[j]; e {
+				case 'n':
+					sb.WriteByte('\n')
+				case 't':
+					sb.WriteByte('\t')
+				case 'r':
+					sb.WriteByte('\r')
+				case '\\', '"', '\'':
+					sb.WriteByte(e)
+				default:
+					return nil, luaErrorf(line, "invalid escape sequence \\%c", e)
+				}
+			}
+			if j >= len(src) {
+				return nil, luaErrorf(line, "unfinished string")
+			}
+			toks = append(toks, luaToken{kind: "string", text: sb.String(), line: line})
+			i = j + 1
+		case strings.HasPrefix(src[i:], "[["):
+			end := strings.Index(src[i+2:], "]]")
+			if end < 0 {
+				return nil, luaErrorf(line, "unfinished long string")
+			}
+			s := src[i+2 : i+2+end]
+			toks = append(toks, luaToken{kind: "string", text: strings.TrimPrefix(s, "\n"), line: line})
+			line += strings.Count(s, "\n")
+			i += 2 + end + 2
+		default:
+			sym := ""
+			for _, s := range []string{"...", "..", "==", "~=", "<=", ">=", "+", "-", "*", "/", "%", "#", "<", ">",
+				"=", "(", ")", "{", "}", "[", "]", ";", ",", ".", ":"} {
+				if strings.HasPrefix(src[i:], s) {
+					sym = s
+					break
+				}
+			}
+			if sym == "" || sym == "..." {
+				return nil, luaErrorf(line, "unexpected symbol %q", string(c))
+			}
+			toks = append(toks, luaToken{kind: sym, text: sym, line: line})
+			i += len(sym)
+		}
+	}
+	return append(toks, luaToken{kind: "eof", line: line}), nil
+}
+
+// Parser
+
+type luaExpr interface {
+	eval(st *luaState, sc *luaScope) (luaValue, error)
+}
+
+// luaMultiExpr is an expression which may yield several values, a call
+type luaMultiExpr interface {
+	evalMulti(st *luaState, sc *luaScope) ([]luaValue, error)
+}
+
+type luaStmt interface {
+	// exec returns the values of a return statement, ret tells whether one
+	// was executed, brk whether a break was
+	exec(st *luaState, sc *luaScope) (vals []luaValue, ret, brk bool, err error)
+}
+
+type luaParser struct {
+	toks []luaToken
+	pos  int
+}
+
+func (p *luaParser) peek() luaToken {
+	return p.toks[p.pos]
+}
+
+func (p *luaParser) next() luaToken {
+	t := p.toks[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *luaParser) accept(kind string) bool {
+	if p.peek().kind == kind {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) expect(kind string) (luaToken, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, luaErrorf(t.line, "%q expected near %q", kind, t.text)
+	}
+	return t, nil
+}
+
+// parseLua compiles the source of a script
+func parseLua(src string) ([]luaStmt, error) {
+	toks, err := luaLex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &luaParser{toks: toks}
+	block, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, luaErrorf(t.line, "unexpected %q", t.text)
+	}
+	return block, nil
+}
+
+func (p *luaParser) blockEnd() bool {
+	switch p.peek().kind {
+	case "eof", "end", "else", "elseif":
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) block() ([]luaStmt, error) {
+	var stmts []luaStmt
+	for !p.blockEnd() {
+		if p.accept(";") {
+			continue
+		}
+		s, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, s)
+		if _, ok := s.(*luaReturn); ok {
+			p.accept(";")
+			if !p.blockEnd() {
+				return nil, luaErrorf(p.peek().line, "'end' expected after return")
+			}
+		}
+	}
+	return stmts, nil
+}
+
+func (p *luaParser) statement() (luaStmt, error) {
+	t := p.peek()
+	switch t.kind {
+	case "local":
+		p.next()
+		if p.accept("function") {
+			name, err := p.expect("name")
+			if err != nil {
+				return nil, err
+			}
+			f, err := p.funcBody(name.text)
+			if err != nil {
+				return nil, err
+			}
+			return &luaLocal{names: []string{name.text}, exprs: []luaExpr{f}, recursive: true, line: t.line}, nil
+		}
+		var names []string
+		for {
+			name, err := p.expect("name")
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, name.text)
+			if !p.accept(",") {
+				break
+			}
+		}
+		var exprs []luaExpr
+		if p.accept("=") {
+			var err error
+			exprs, err = p.exprList()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &luaLocal{names: names, exprs: exprs, line: t.line}, nil
+	case "function":
+		p.next()
+		name, err := p.expect("name")
+		if err != nil {
+			return nil, err
+		}
+		f, err := p.funcBody(name.text)
+		if err != nil {
+			return nil, err
+		}
+		return &luaAssign{names: []string{name.text}, exprs: []luaExpr{f}, line: t.line}, nil
+	case "return":
+		p.next()
+		r := &luaReturn{}
+		if !p.blockEnd() && p.peek().kind != ";" {
+			var err error
+			r.exprs, err = p.exprList()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return r, nil
+	case "break":
+		p.next()
+		return &luaBreak{}, nil
+	case "do":
+		p.next()
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect("end")
+		return &luaDo{body: body}, err
+	case "if":
+		p.next()
+		s := &luaIf{}
+		for {
+			cond, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect("then"); err != nil {
+				return nil, err
+			}
+			body, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			s.conds = append(s.conds, cond)
+			s.blocks = append(s.blocks, body)
+			if !p.accept("elseif") {
+				break
+			}
+		}
+		if p.accept("else") {
+			body, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			s.orElse = body
+		}
+		_, err := p.expect("end")
+		return s, err
+	case "while":
+		p.next()
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect("do"); err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.expect("end")
+		return &luaWhile{cond: cond, body: body}, err
+	case "for":
+		p.next()
+		return p.forStatement(t.line)
+	}
+
+	// assignment or call
+	e, err := p.suffixedExpr()
+	if err != nil {
+		return nil, err
+	}
+	if call, ok := e.(*luaCall); ok && p.peek().kind != "=" && p.peek().kind != "," {
+		return &luaExprStmt{call}, nil
+	}
+	var names []string
+	for {
+		name, ok := e.(*luaName)
+		if !ok {
+			return nil, luaErrorf(t.line, "only variables can be assigned, tables are read only")
+		}
+		names = append(names, name.name)
+		if !p.accept(",") {
+			break
+		}
+		e, err = p.suffixedExpr()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.expect("="); err != nil {
+		return nil, err
+	}
+	exprs, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	return &luaAssign{names: names, exprs: exprs, line: t.line}, nil
+}
+
+func (p *luaParser) forStatement(line int) (luaStmt, error) {
+	first, err := p.expect("name")
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("=") {
+		s := &luaNumericFor{name: first.text, line: line}
+		if s.start, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(","); err != nil {
+			return nil, err
+		}
+		if s.limit, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if p.accept(",") {
+			if s.step, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		if _, err = p.expect("do"); err != nil {
+			return nil, err
+		}
+		if s.body, err = p.block(); err != nil {
+			return nil, err
+		}
+		_, err = p.expect("end")
+		return s, err
+	}
+
+	s := &luaGenericFor{names: []string{first.text}, line: line}
+	for p.accept(",") {
+		name, err := p.expect("name")
+		if err != nil {
+			return nil, err
+		}
+		s.names = append(s.names, name.text)
+	}
+	if _, err = p.expect("in"); err != nil {
+		return nil, err
+	}
+	if s.iter, err = p.expr(); err != nil {
+		return nil, err
+	}
+	if _, err = p.expect("do"); err != nil {
+		return nil, err
+	}
+	if s.body, err = p.block(); err != nil {
+		return nil, err
+	}
+	_, err = p.expect("end")
+	return s, err
+}
+
+func (p *luaParser) funcBody(name string) (*luaFuncExpr, error) {
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+	f := &luaFuncExpr{name: name}
+	for !p.accept(")") {
+		param, err := p.expect("name")
+		if err != nil {
+			return nil, err
+		}
+		f.params = append(f.params, param.text)
+		if !p.accept(",") {
+			if _, err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	f.body = body
+	_, err = p.expect("end")
+	return f, err
+}
+
+func (p *luaParser) exprList() ([]luaExpr, error) {
+	var exprs []luaExpr
+	for {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if !p.accept(",") {
+			return exprs, nil
+		}
+	}
+}
+
+// binary operators by precedence, lowest first, .. is right associative
+var _LuaBinaryOps = [][]string{
+	{"or"},
+	{"and"},
+	{"<", ">", "<=", ">=", "~=", "=="},
+	{".."},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *luaParser) expr() (luaExpr, error) {
+	return p.binary(0)
+}
+
+func (p *luaParser) binary(level int) (luaExpr, error) {
+	if level == len(_LuaBinaryOps) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		found := false
+		for _, op := range _LuaBinaryOps[level] {
+			if t.kind == op {
+				found = true
+			}
+		}
+		if !found {
+			return left, nil
+		}
+		p.next()
+		var right luaExpr
+		if t.kind == ".." {
+			right, err = p.binary(level)
+		} else {
+			right, err = p.binary(level + 1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		left = &luaBinary{op: t.kind, left: left, right: right, line: t.line}
+	}
+}
+
+func (p *luaParser) unary() (luaExpr, error) {
+	t := p.peek()
+	switch t.kind {
+	case "not", "-", "#":
+		p.next()
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &luaUnary{op: t.kind, e: e, line: t.line}, nil
+	}
+	return p.simpleExpr()
+}
+
+func (p *luaParser) simpleExpr() (luaExpr, error) {
+	t := p.peek()
+	switch t.kind {
+	case "nil":
+		p.next()
+		return &luaConst{nil}, nil
+	case "true", "false":
+		p.next()
+		return &luaConst{t.kind == "true"}, nil
+	case "number":
+		p.next()
+		return &luaConst{t.num}, nil
+	case "string":
+		p.next()
+		return &luaConst{t.text}, nil
+	case "function":
+		p.next()
+		return p.funcBody("anonymous")
+	case "{":
+		return p.tableConstructor()
+	}
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) tableConstructor() (luaExpr, error) {
+	if _, err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	tc := &luaTableExpr{}
+	for !p.accept("}") {
+		var key, val luaExpr
+		var err error
+		switch {
+		case p.peek().kind == "[":
+			p.next()
+			if key, err = p.expr(); err != nil {
+				return nil, err
+			}
+			if _, err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			if _, err = p.expect("="); err != nil {
+				return nil, err
+			}
+		case p.peek().kind == "name" && p.toks[p.pos+1].kind == "=":
+			key = &luaConst{p.next().text}
+			p.next()
+		}
+		if val, err = p.expr(); err != nil {
+			return nil, err
+		}
+		tc.keys = append(tc.keys, key)
+		tc.vals = append(tc.vals, val)
+		if !p.accept(",") && !p.accept(";") {
+			if _, err := p.expect("}"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return tc, nil
+}
+
+func (p *luaParser) suffixedExpr() (luaExpr, error) {
+	t := p.next()
+	var e luaExpr
+	switch t.kind {
+	case "name":
+		e = &luaName{name: t.text, line: t.line}
+	case "(":
+		inner, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		// parentheses truncate multiple values to one
+		e = &luaParen{inner}
+	default:
+		return nil, luaErrorf(t.line, "unexpected %q", t.text)
+	}
+	for {
+		t := p.peek()
+		switch t.kind {
+		case ".":
+			p.next()
+			name, err := p.expect("name")
+			if err != nil {
+				return nil, err
+			}
+			e = &luaIndex{obj: e, key: &luaConst{name.text}, line: t.line}
+		case "[":
+			p.next()
+			key, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			e = &luaIndex{obj: e, key: key, line: t.line}
+		case ":":
+			// s:method(...) calls string functions with s as first argument
+			p.next()
+			name, err := p.expect("name")
+			if err != nil {
+				return nil, err
+			}
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = &luaCall{fn: &luaIndex{obj: &luaName{name: "string", line: t.line}, key: &luaConst{name.text}, line: t.line},
+				args: append([]luaExpr{e}, args...), line: t.line}
+		case "(", "string", "{":
+			args, err := p.callArgs()
+			if err != nil {
+				return nil, err
+			}
+			e = &luaCall{fn: e, args: args, line: t.line}
+		default:
+			return e, nil
+		}
+	}
+}
+
+func (p *luaParser) callArgs() ([]luaExpr, error) {
+	t := p.peek()
+	switch t.kind {
+	case "string":
+		p.next()
+		return []luaExpr{&luaConst{t.text}}, nil
+	case "{":
+		tc, err := p.tableConstructor()
+		return []luaExpr{tc}, err
+	}
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+	if p.accept(")") {
+		return nil, nil
+	}
+	args, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.expect(")")
+	return args, err
+}
+
+// Expressions
+
+type luaConst struct{ v luaValue }
+
+func (e *luaConst) eval(st *luaState, sc *luaScope) (luaValue, error) { return e.v, nil }
+
+type luaName struct {
+	name string
+	line int
+}
+
+func (e *luaName) eval(st *luaState, sc *luaScope) (luaValue, error) {
+	v, _ := sc.lookup(e.name)
+	return v, nil
+}
+
+type luaParen struct{ e luaExpr }
+
+func (e *luaParen) eval(st *luaState, sc *luaScope) (luaValue, error) { return e.e.eval(st, sc) }
+
+type luaIndex struct {
+	obj, key luaExpr
+	line     int
+}
+
+func (e *luaIndex) eval(st *luaState, sc *luaScope) (luaValue, error) {
+	obj, err := e.obj.eval(st, sc)
+	if err != nil {
+		return nil, err
+	}
+	key, err := e.key.eval(st, sc)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := obj.(*luaTable)
+	if !ok {
+		return nil, luaErrorf(e.line, "attempt to index a %s value", luaTypeName(obj))
+	}
+	return t.get(key), nil
+}
+
+type luaTableExpr struct {
+	keys []luaExpr // nil for positional values
+	vals []luaExpr
+}
+
+func (e *luaTableExpr) eval(st *luaState, sc *luaScope) (luaValue, error) {
+	if err := st.alloc(_LuaEntrySize * (len(e.keys) + 1)); err != nil {
+		return nil, err
+	}
+	t := newLuaTable()
+	n := 0
+	for i, ke := range e.keys {
+		if ke == nil && i == len(e.keys)-1 {
+			// a trailing call adds all its values
+			vals, err := evalMulti(st, sc, e.vals[i])
+			if err != nil {
+				return nil, err
+			}
+			if err := st.alloc(_LuaEntrySize * len(vals)); err != nil {
+				return nil, err
+			}
+			for _, v := range vals {
+				n++
+				t.put(float64(n), v)
+			}
+			continue
+		}
+		v, err := e.vals[i].eval(st, sc)
+		if err != nil {
+			return nil, err
+		}
+		if ke == nil {
+			n++
+			t.put(float64(n), v)
+			continue
+		}
+		k, err := ke.eval(st, sc)
+		if err != nil {
+			return nil, err
+		}
+		if k == nil {
+			return nil, errors.New("table index is nil")
+		}
+		if v != nil {
+			t.put(k, v)
+		}
+	}
+	return t, nil
+}
+
+type luaFuncExpr struct {
+	name   string
+	params []string
+	body   []luaStmt
+}
+
+func (e *luaFuncExpr) eval(st *luaState, sc *luaScope) (luaValue, error) {
+	return &luaFunction{name: e.name, params: e.params, body: e.body, scope: sc}, nil
+}
+
+type luaUnary struct {
+	op   string
+	e    luaExpr
+	line int
+}
+
+func (e *luaUnary) eval(st *luaState, sc *luaScope) (luaValue, error) {
+	v, err := e.e.eval(st, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "not":
+		return !luaTruthy(v), nil
+	case "-":
+		n, ok := luaToNumber(v)
+		if !ok {
+			return nil, luaErrorf(e.line, "attempt to perform arithmetic on a %s value", luaTypeName(v))
+		}
+		return -n, nil
+	}
+	switch v := v.(type) {
+	case string:
+		return float64(len(v)), nil
+	case *luaTable:
+		return float64(v.length()), nil
+	}
+	return nil, luaErrorf(e.line, "attempt to get length of a %s value", luaTypeName(v))
+}
+
+type luaBinary struct {
+	op          string
+	left, right luaExpr
+	line        int
+}
+
+func (e *luaBinary) eval(st *luaState, sc *luaScope) (luaValue, error) {
+	l, err := e.left.eval(st, sc)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "and":
+		if !luaTruthy(l) {
+			return l, nil
+		}
+		return e.right.eval(st, sc)
+	case "or":
+		if luaTruthy(l) {
+			return l, nil
+		}
+		return e.right.eval(st, sc)
+	}
+	r, err := e.right.eval(st, sc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "==":
+		return l == r, nil
+	case "~=":
+		return l != r, nil
+	case "..":
+		for _, v := range []luaValue{l, r} {
+			switch v.(type) {
+			case string, float64:
+			default:
+				return nil, luaErrorf(e.line, "attempt to concatenate a %s value", luaTypeName(v))
+			}
+		}
+		ls, rs := luaToString(l), luaToString(r)
+		if err := st.allocString(len(ls) + len(rs)); err != nil {
+			if err == errLuaString {
+				err = luaErrorf(e.line, "%v", err)
+			}
+			return nil, err
+		}
+		return ls + rs, nil
+	case "<", ">", "<=", ">=":
+		if ls, ok := l.(string); ok {
+			if rs, ok := r.(string); ok {
+				return luaCompare(e.op, strings.Compare(ls, rs)), nil
+			}
+		}
+		ln, lok := l.(float64)
+		rn, rok := r.(float64)
+		if !lok || !rok {
+			return nil, luaErrorf(e.line, "attempt to compare %s with %s", luaTypeName(l), luaTypeName(r))
+		}
+		c := 0
+		if ln < rn {
+			c = -1
+		} else if ln > rn {
+			c = 1
+		}
+		return luaCompare(e.op, c), nil
+	}
+
+	ln, lok := luaToNumber(l)
+	rn, rok := luaToNumber(r)
+	if !lok || !rok {
+		bad := l
+		if lok {
+			bad = r
+		}
+		return nil, luaErrorf(e.line, "attempt to perform arithmetic on a %s value", luaTypeName(bad))
+	}
+	switch e.op {
+	case "+":
+		return ln + rn, nil
+	case "-":
+		return ln - rn, nil
+	case "*":
+		return ln * rn, nil
+	case "/":
+		return ln / rn, nil
+	}
+	return ln - math.Floor(ln/rn)*rn, nil
+}
+
+func luaCompare(op string, c int) bool {
+	switch op {
+	case "<":
+		return c < 0
+	case ">":
+		return c > 0
+	case "<=":
+		return c <= 0
+	}
+	return c >= 0
+}
+
+type luaCall struct {
+	fn   luaExpr
+	args []luaExpr
+	line int
+}
+
+func (e *luaCall) eval(st *luaState, sc *luaScope) (luaValue, error) {
+	vals, err := e.evalMulti(st, sc)
+	if err != nil || len(vals) == 0 {
+		return nil, err
+	}
+	return vals[0], nil
+}
+
+func (e *luaCall) evalMulti(st *luaState, sc *luaScope) ([]luaValue, error) {
+	fn, err := e.fn.eval(st, sc)
+	if err != nil {
+		return nil, err
+	}
+	args, err := evalList(st, sc, e.args)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := luaCallValue(st, fn, args)
+	if err != nil {
+		if _, ok := err.(*luaError); !ok && err != errLuaSteps && err != errLuaMemory {
+			err = &luaError{e.line, err.Error()}
+		}
+	}
+	return vals, err
+}
+
+// evalMulti evaluates e to all its values
+func evalMulti(st *luaState, sc *luaScope, e luaExpr) ([]luaValue, error) {
+	if m, ok := e.(luaMultiExpr); ok {
+		return m.evalMulti(st, sc)
+	}
+	v, err := e.eval(st, sc)
+	return []luaValue{v}, err
+}
+
+// evalList evaluates exprs, the last one to all its values
+func evalList(st *luaState, sc *luaScope, exprs []luaExpr) ([]luaValue, error) {
+	var vals []luaValue
+	for i, e := range exprs {
+		if i == len(exprs)-1 {
+			vs, err := evalMulti(st, sc, e)
+			if err != nil {
+				return nil, err
+			}
+			return append(vals, vs...), nil
+		}
+		v, err := e.eval(st, sc)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+func luaCallValue(st *luaState, fn luaValue, args []luaValue) ([]luaValue, error) {
+	if err := st.step(); err != nil {
+		return nil, err
+	}
+	switch f := fn.(type) {
+	case luaBuiltin:
+		vals, err := f(args)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vals {
+			if s, ok := v.(string); ok {
+				if err := st.allocString(len(s)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return vals, nil
+	case *luaFunction:
+		if st.depth >= _LuaMaxDepth {
+			return nil, errors.New("stack overflow")
+		}
+		st.depth++
+		defer func() { st.depth-- }()
+		sc := newLuaScope(f.scope)
+		for i, name := range f.params {
+			var v luaValue
+			if i < len(args) {
+				v = args[i]
+			}
+			sc.vars[name] = v
+		}
+		vals, _, _, err := execBlock(st, sc, f.body)
+		return vals, err
+	}
+	return nil, fmt.Errorf("attempt to call a %s value", luaTypeName(fn))
+}
+
+// Statements
+
+func execBlock(st *luaState, sc *luaScope, body []luaStmt) ([]luaValue, bool, bool, error) {
+	// entering counts too, or empty loops would never run out of steps
+	if err := st.step(); err != nil {
+		return nil, false, false, err
+	}
+	for _, s := range body {
+		if err := st.step(); err != nil {
+			return nil, false, false, err
+		}
+		vals, ret, brk, err := s.exec(st, sc)
+		if err != nil || ret || brk {
+			return vals, ret, brk, err
+		}
+	}
+	return nil, false, false, nil
+}
+
+type luaLocal struct {
+	names     []string
+	exprs     []luaExpr
+	recursive bool // local function, visible in its own body
+	line      int
+}
+
+func (s *luaLocal) exec(st *luaState, sc *luaScope) ([]luaValue, bool, bool, error) {
+	if s.recursive {
+		sc.vars[s.names[0]] = nil
+		v, err := s.exprs[0].eval(st, sc)
+		sc.vars[s.names[0]] = v
+		return nil, false, false, err
+	}
+	vals, err := evalList(st, sc, s.exprs)
+	if err != nil {
+		return nil, false, false, err
+	}
+	for i, name := range s.names {
+		var v luaValue
+		if i < len(vals) {
+			v = vals[i]
+		}
+		sc.vars[name] = v
+	}
+	return nil, false, false, nil
+}
+
+type luaAssign struct {
+	names []string
+	exprs []luaExpr
+	line  int
+}
+
+func (s *luaAssign) exec(st *luaState, sc *luaScope) ([]luaValue, bool, bool, error) {
+	vals, err := evalList(st, sc, s.exprs)
+	if err != nil {
+		return nil, false, false, err
+	}
+	for i, name := range s.names {
+		var v luaValue
+		if i < len(vals) {
+			v = vals[i]
+		}
+		sc.set(name, v)
+	}
+	return nil, false, false, nil
+}
+
+type luaExprStmt struct{ call *luaCall }
+
+func (s *luaExprStmt) exec(st *luaState, sc *luaScope) ([]luaValue, bool, bool, error) {
+	_, err := s.call.evalMulti(st, sc)
+	return nil, false, false, err
+}
+
+type luaReturn struct{ exprs []luaExpr }
+
+func (s *luaReturn) exec(st *luaState, sc *luaScope) ([]luaValue, bool, bool, error) {
+	vals, err := evalList(st, sc, s.exprs)
+	return vals, true, false, err
+}
+
+type luaBreak struct{}
+
+func (s *luaBreak) exec(st *luaState, sc *luaScope) ([]luaValue, bool, bool, error) {
+	return nil, false, true, nil
+}
+
+type luaDo struct{ body []luaStmt }
+
+func (s *luaDo) exec(st *luaState, sc *luaScope) ([]luaValue, bool, bool, error) {
+	return execBlock(st, newLuaScope(sc), s.body)
+}
+
+type luaIf struct {
+	conds  []luaExpr
+	blocks [][]luaStmt
+	orElse []luaStmt
+}
+
+func (s *luaIf) exec(st *luaState, sc *luaScope) ([]luaValue, bool, bool, error) {
+	for i, cond := range s.conds {
+		v, err := cond.eval(st, sc)
+		if err != nil {
+			return nil, false, false, err
+		}
+		if luaTruthy(v) {
+			return execBlock(st, newLuaScope(sc), s.blocks[i])
+		}
+	}
+	return execBlock(st, newLuaScope(sc), s.orElse)
+}
+
+type luaWhile struct {
+	cond luaExpr
+	body []luaStmt
+}
+
+func (s *luaWhile) exec(st *luaState, sc *luaScope) ([]luaValue, bool, bool, error) {
+	for {
+		v, err := s.cond.eval(st, sc)
+		if err != nil || !luaTruthy(v) {
+			return nil, false, false, err
+		}
+		vals, ret, brk, err := execBlock(st, newLuaScope(sc), s.body)
+		if err != nil || ret {
+			return vals, ret, false, err
+		}
+		if brk {
+			return nil, false, false, nil
+		}
+	}
+}
+
+type luaNumericFor struct {
+	name               string
+	start, limit, step luaExpr
+	body               []luaStmt
+	line               int
+}
+
+func (s *luaNumericFor) exec(st *luaState, sc *luaScope) ([]luaValue, bool, bool, error) {
+	var nums [3]float64
+	nums[2] = 1
+	for i, e := range []luaExpr{s.start, s.limit, s.step} {
+		if e == nil {
+			continue
+		}
+		v, err := e.eval(st, sc)
+		if err != nil {
+			return nil, false, false, err
+		}
+		n, ok := luaToNumber(v)
+		if !ok {
+			return nil, false, false, luaErrorf(s.line, "'for' value must be a number")
+		}
+		nums[i] = n
+	}
+	if nums[2] == 0 {
+		return nil, false, false, luaErrorf(s.line, "'for' step is zero")
+	}
+	for i := nums[0]; nums[2] > 0 && i <= nums[1] || nums[2] < 0 && i >= nums[1]; i += nums[2] {
+		body := newLuaScope(sc)
+		body.vars[s.name] = i
+		vals, ret, brk, err := execBlock(st, body, s.body)
+		if err != nil || ret {
+			return vals, ret, false, err
+		}
+		if brk {
+			break
+		}
+	}
+	return nil, false, false, nil
+}
+
+type luaGenericFor struct {
+	names []string
+	iter  luaExpr
+	body  []luaStmt
+	line  int
+}
+
+// luaIterator is returned by ipairs and pairs, the generic for only supports
+// those
+type luaIterator struct {
+	t       *luaTable
+	ordered bool // ipairs
+}
+
+func (s *luaGenericFor) exec(st *luaState, sc *luaScope) ([]luaValue, bool, bool, error) {
+	v, err := s.iter.eval(st, sc)
+	if err != nil {
+		return nil, false, false, err
+	}
+	iter, ok := v.(*luaIterator)
+	if !ok {
+		return nil, false, false, luaErrorf(s.line, "'for ... in' only supports ipairs and pairs")
+	}
+	var keys []luaValue
+	if iter.ordered {
+		for i := 1; i <= iter.t.length(); i++ {
+			keys = append(keys, float64(i))
+		}
+	} else {
+		keys = iter.t.keys
+	}
+	for _, k := range keys {
+		body := newLuaScope(sc)
+		vals := []luaValue{k, iter.t.get(k)}
+		for i, name := range s.names {
+			if i < len(vals) {
+				body.vars[name] = vals[i]
+			} else {
+				body.vars[name] = nil
+			}
+		}
+		vals, ret, brk, err := execBlock(st, body, s.body)
+		if err != nil || ret {
+			return vals, ret, false, err
+		}
+		if brk {
+			break
+		}
+	}
+	return nil, false, false, nil
+}
+
+func luaIterate(ordered bool) luaBuiltin {
+	return func(args []luaValue) ([]luaValue, error) {
+		if len(args) == 0 {
+			return nil, errors.New("bad argument #1 (table expected, got no value)")
+		}
+		t, ok := args[0].(*luaTable)
+		if !ok {
+			return nil, fmt.Errorf("bad argument #1 (table expected, got %s)", luaTypeName(args[0]))
+		}
+		return []luaValue{&luaIterator{t: t, ordered: ordered}}, nil
+	}
+}
@@ -1,18 +1,19 @@
-package main
+package frontd
 
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
+	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
-	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,243 +21,881 @@ import (
 	"syscall"
 	"time"
 
-	_ "net/http/pprof"
-
 	"github.com/xindong/frontd/aes256cbc"
 )
 
 const (
 	// max open file should at least be
 	_MaxOpenfile              = uint64(1024 * 1024 * 1024)
+	_ReservedFiles            = 64 // descriptors not counted for MAX_CONNS
 	_MaxBackendAddrCacheCount = 1024 * 1024
 )
 
 var (
 	_hdrCipherOrigin   = []byte("x-cipher-origin")
 	_hdrForwardedFor   = []byte("x-forwarded-for")
-	_maxHTTPHeaderSize = 4096 * 2
+	_hdrTraceParent    = []byte("traceparent:")
+	_hdrHost           = []byte("host:")
 	_minHTTPHeaderSize = 32
 )
 
 var (
-	_SecretPassphase []byte
-	_Aes256CBC       = aes256cbc.New()
+	_Aes256CBC = aes256cbc.New()
 )
 
 var (
-	_BackendAddrCacheMutex sync.Mutex
-	_BackendAddrCache      atomic.Value
+	_BackendAddrCache         addrCache = newCOWAddrCache()
+	_BackendAddrCacheDisabled bool
+
+	_AddrCacheFile             string
+	_AddrCacheSnapshotInterval = time.Second * 60
 )
 
 var (
-	_DefaultPort        = 4043
-	_BackendDialTimeout = 5
-	_ConnReadTimeout    = time.Second * 30
+	_ListenAddr  string
+	_DefaultPort = 4043
+
+	// closed once the main listener is bound and privileges are dropped
+	_PrivilegesDropped = make(chan struct{})
 )
 
-type backendAddrMap map[string][]byte
+// afterPrivilegesDropped runs f in a goroutine once privileges are dropped,
+// so listeners other than the main one are bound as RUN_AS_USER
+func afterPrivilegesDropped(f func()) {
+	go func() {
+		<-_PrivilegesDropped
+		f()
+	}()
+}
 
-func main() {
+// defineCommandFlags registers the flags of the frontd command on fs, they
+// are not registered on import so programs embedding the relay keep their
+// command line to themselves
+func defineCommandFlags(fs *flag.FlagSet) {
+	defineFlags(fs)
+	fs.BoolVar(&_PrintVersion, "version", false, "print version and build information, then exit")
+	fs.StringVar(&_CheckConfig, "check", "", "validate the configuration `file` together with flags and environment, then exit")
+	fs.StringVar(&_VerifyAudit, "verify-audit", "", "verify the hash chain of the audit log `file`, then exit")
+}
+
+// Main runs the frontd command configured by command line flags, the
+// environment and the configuration file, it returns once frontd shut down
+func Main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	os.Setenv("GOTRACEBACK", "crash")
 
-	_BackendAddrCache.Store(make(backendAddrMap))
+	fdLimit, fdErr := raiseOpenFileLimit()
+
+	if len(os.Args) > 1 {
+		if cmd, ok := _Subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
+	if !flag.Parsed() {
+		defineCommandFlags(flag.CommandLine)
+		flag.Parse()
+	}
+	_Flags.Store(flagSettings(flag.CommandLine))
+	if _PrintVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if _CheckConfig != "" {
+		os.Exit(checkConfig(_CheckConfig))
+	}
+	if _VerifyAudit != "" {
+		os.Exit(verifyAudit(_VerifyAudit))
+	}
+
+	configFile, _ := lookupEnv("CONFIG_FILE")
+	if configFile != "" {
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			logger().Error("config not loaded", "err", err)
+			os.Exit(1)
+		}
+		_Config.Store(cfg)
+	}
+
+	logRateLimit, err := strconv.Atoi(getenv("LOG_RATE_LIMIT"))
+	if err != nil {
+		logRateLimit = 100
+	}
+	rotateSize, err := strconv.Atoi(getenv("LOG_ROTATE_SIZE"))
+	if err == nil && rotateSize > 0 {
+		_LogRotateSize = int64(rotateSize) * 1024 * 1024
+	}
+	rotateInterval, err := strconv.Atoi(getenv("LOG_ROTATE_INTERVAL"))
+	if err == nil && rotateInterval > 0 {
+		_LogRotateInterval = time.Hour * time.Duration(rotateInterval)
+	}
+	rotateKeep, err := strconv.Atoi(getenv("LOG_ROTATE_KEEP"))
+	if err == nil && rotateKeep >= 0 {
+		_LogRotateKeep = rotateKeep
+	}
+	rotateCompress, err := strconv.ParseBool(getenv("LOG_ROTATE_COMPRESS"))
+	if err == nil {
+		_LogRotateCompress = rotateCompress
+	}
 
-	var lim syscall.Rlimit
-	syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
-	if lim.Cur < _MaxOpenfile || lim.Max < _MaxOpenfile {
-		lim.Cur = _MaxOpenfile
-		lim.Max = _MaxOpenfile
-		syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim)
+	logFile := getenv("LOG_FILE")
+	if logFile != "" {
+		f, err := newRotatingFile(logFile)
+		if err != nil {
+			logger().Error("log file not opened", "err", err)
+		} else {
+			_LogOutput = f
+		}
 	}
 
-	_SecretPassphase = []byte(os.Getenv("SECRET"))
+	var sl *syslogWriter
+	syslogAddr := getenv("SYSLOG_ADDR")
+	if syslogAddr != "" {
+		facility := getenv("SYSLOG_FACILITY")
+		if facility == "" {
+			facility = "daemon"
+		}
+		sl, err = newSyslogWriter(syslogAddr, facility)
+		if err != nil {
+			logger().Error("syslog disabled", "err", err)
+			sl = nil
+		}
+	}
+	// the level is set by applySettings as it can be reloaded
+	setupLogger(getenv("LOG_FORMAT"), "", logRateLimit, sl)
 
-	mhs, err := strconv.Atoi(os.Getenv("MAX_HTTP_HEADER_SIZE"))
-	if err == nil && mhs > _minHTTPHeaderSize {
-		_maxHTTPHeaderSize = mhs
+	err = applySettings()
+	if err != nil {
+		logger().Error("settings not applied", "err", err)
+		os.Exit(1)
 	}
 
-	bt, err := strconv.Atoi(os.Getenv("BACKEND_TIMEOUT"))
-	if err == nil && bt > 0 {
-		_BackendDialTimeout = bt
+	logger().Info("starting", "version", _Version, "commit", _Commit, "build_date", _BuildDate, "go_version", runtime.Version())
+	if fdErr != nil {
+		logger().Warn("open file limit not raised further", "limit", fdLimit, "max_connections", maxConns(), "err", fdErr)
+	} else if fdLimit > 0 {
+		logger().Info("open file limit", "limit", fdLimit, "max_connections", maxConns())
 	}
 
-	connReadTimeout, err := strconv.Atoi(os.Getenv("CONN_READ_TIMEOUT"))
-	if err == nil && connReadTimeout >= 0 {
-		_ConnReadTimeout = time.Second * time.Duration(connReadTimeout)
+	daemon, _ := strconv.ParseBool(getenv("DAEMON"))
+	if daemon && os.Getenv(_DaemonEnv) == "" {
+		os.Exit(daemonize())
 	}
+	_PidFile = getenv("PID_FILE")
 
-	listenPort, err := strconv.Atoi(os.Getenv("LISTEN_PORT"))
+	accessLogPath := getenv("ACCESS_LOG")
+	if accessLogPath != "" {
+		al, err := openAccessLog(accessLogPath)
+		if err != nil {
+			logger().Error("access log disabled", "err", err)
+		}
+		_AccessLog = al
+	}
+
+	auditLogPath := getenv("AUDIT_LOG")
+	if auditLogPath != "" {
+		al, err := openAuditLog(auditLogPath)
+		if err != nil {
+			logger().Error("audit log not opened", "err", err)
+			os.Exit(1)
+		}
+		_AuditLog = al
+	}
+
+	noCache, err := strconv.ParseBool(getenv("DISABLE_ADDR_CACHE"))
+	if err == nil {
+		_BackendAddrCacheDisabled = noCache
+	}
+
+	switch getenv("ADDR_CACHE_TYPE") {
+	case "syncmap":
+		_BackendAddrCache = newSyncMapAddrCache()
+	}
+
+	listenPort, err := strconv.Atoi(getenv("LISTEN_PORT"))
 	if err == nil && listenPort > 0 && listenPort <= 65535 {
 		_DefaultPort = listenPort
 	}
+	_ListenAddr = getenv("LISTEN_ADDR")
+
+	_AddrCacheFile = getenv("ADDR_CACHE_FILE")
+	snapshotInterval, err := strconv.Atoi(getenv("ADDR_CACHE_SNAPSHOT_INTERVAL"))
+	if err == nil && snapshotInterval > 0 {
+		_AddrCacheSnapshotInterval = time.Second * time.Duration(snapshotInterval)
+	}
+
+	if _AddrCacheFile != "" && !_BackendAddrCacheDisabled {
+		err = loadAddrCache(_AddrCacheFile)
+		if err != nil && !os.IsNotExist(err) {
+			logger().Warn("address cache not loaded", "err", err)
+		}
+		go snapshotAddrCache(_AddrCacheFile, _AddrCacheSnapshotInterval)
+	}
+
+	usagePath := getenv("USAGE_FILE")
+	_UsageFile.Store(usagePath)
+	flushInterval, err := strconv.Atoi(getenv("USAGE_FLUSH_INTERVAL"))
+	if err == nil && flushInterval > 0 {
+		_UsageFlushInterval = time.Second * time.Duration(flushInterval)
+	}
+	if usagePath != "" {
+		err = loadUsage(usagePath)
+		if err != nil && !os.IsNotExist(err) {
+			logger().Warn("usage not loaded", "err", err)
+		}
+		go flushUsage(usagePath, _UsageFlushInterval)
+		go runUsageExports()
+	}
+
+	countryDB, asnDB := getenv("GEOIP_COUNTRY_DB"), getenv("GEOIP_ASN_DB")
+	if countryDB != "" || asnDB != "" {
+		interval := time.Second * 300
+		gi, err := strconv.Atoi(getenv("GEOIP_RELOAD_INTERVAL"))
+		if err == nil && gi > 0 {
+			interval = time.Second * time.Duration(gi)
+		}
+		err = startGeoIP(countryDB, asnDB, interval)
+		if err != nil {
+			logger().Error("GeoIP database not loaded", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	metricsPort, err := strconv.Atoi(getenv("METRICS_PORT"))
+	if err == nil && metricsPort > 0 && metricsPort <= 65535 {
+		afterPrivilegesDropped(func() { listenAndServeMetrics(metricsPort) })
+	}
+
+	statsdAddr := getenv("STATSD_ADDR")
+	if statsdAddr != "" {
+		prefix, ok := lookupEnv("STATSD_PREFIX")
+		if !ok {
+			prefix = "frontd."
+		}
+		dogstatsd, _ := strconv.ParseBool(getenv("STATSD_DOGSTATSD"))
+		interval := time.Second * 10
+		si, err := strconv.Atoi(getenv("STATSD_INTERVAL"))
+		if err == nil && si > 0 {
+			interval = time.Second * time.Duration(si)
+		}
+		startStatsd(statsdAddr, prefix, getenv("STATSD_TAGS"), dogstatsd, interval)
+	}
+
+	eventsURL := getenv("EVENTS_URL")
+	if eventsURL != "" {
+		subject := getenv("EVENTS_SUBJECT")
+		if subject == "" {
+			subject = "frontd.events"
+		}
+		p, err := newEventPublisher(eventsURL, subject)
+		if err != nil {
+			logger().Error("connection events disabled", "err", err)
+		} else {
+			startEvents(p)
+		}
+	}
 
-	pprofPort, err := strconv.Atoi(os.Getenv("PPROF_PORT"))
+	otlpEndpoint := getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if otlpEndpoint != "" {
+		service := getenv("OTEL_SERVICE_NAME")
+		if service == "" {
+			service = "frontd"
+		}
+		startTracing(otlpEndpoint, service)
+	}
+
+	adminAddr := getenv("ADMIN_ADDR")
+	if adminAddr != "" {
+		afterPrivilegesDropped(func() { listenAndServeAdmin(adminAddr) })
+	}
+
+	gopsAddr := getenv("GOPS_ADDR")
+	if gopsAddr != "" {
+		startGops(gopsAddr)
+	}
+
+	pprofPort, err := strconv.Atoi(getenv("PPROF_PORT"))
 	if err == nil && pprofPort > 0 && pprofPort <= 65535 {
-		go func() {
-			log.Println(http.ListenAndServe(":"+strconv.Itoa(pprofPort), nil))
-		}()
+		afterPrivilegesDropped(func() {
+			err := http.ListenAndServe(":"+strconv.Itoa(pprofPort), nil)
+			logger().Error("pprof server stopped", "err", err)
+		})
+	}
+
+	shutdownDelay, err := strconv.Atoi(getenv("SHUTDOWN_DELAY"))
+	if err == nil && shutdownDelay >= 0 {
+		_ShutdownDelay = time.Second * time.Duration(shutdownDelay)
 	}
+	drainTimeout, err := strconv.Atoi(getenv("DRAIN_TIMEOUT"))
+	if err == nil && drainTimeout >= 0 {
+		_DrainTimeout = time.Second * time.Duration(drainTimeout)
+	}
+
+	go dumpStatsOnSignal()
+	go reloadOnSignal()
+	go shutdownOnSignal()
+	go upgradeOnSignal()
+	go runWatchdog()
 
-	listenAndServe()
+	listenAndServe(context.Background())
 
-	log.Println("Exiting")
+	n := drainSessions(_DrainTimeout)
+	if n > 0 {
+		logger().Warn("connections closed after drain timeout", "count", n)
+	}
+	if _AddrCacheFile != "" && !_BackendAddrCacheDisabled {
+		err = saveAddrCache(_AddrCacheFile)
+		if err != nil {
+			logger().Warn("address cache not saved", "err", err)
+		}
+	}
+	if path := usageFile(); path != "" {
+		err = saveUsage(path)
+		if err != nil {
+			logger().Warn("usage not saved", "err", err)
+		}
+	}
+
+	if _PidFile != "" {
+		removePidFile(_PidFile)
+	}
+
+	logger().Info("exiting")
 }
 
-func listenAndServe() {
-	l, err := net.Listen("tcp", ":"+strconv.Itoa(_DefaultPort))
+func listenAndServe(ctx context.Context) {
+	addr := _ListenAddr
+	if addr == "" {
+		addr = ":" + strconv.Itoa(_DefaultPort)
+	}
+	l, err := inheritedListener()
+	if l == nil && err == nil {
+		l, err = systemdListener()
+	}
+	if l == nil && err == nil {
+		l, err = net.Listen("tcp", addr)
+		if errors.Is(err, os.ErrPermission) {
+			logger().Error("listen failed", "err", err, "addr", addr, "hint", privilegedPortHint())
+			os.Exit(1)
+		}
+	}
 	if err != nil {
-		log.Fatal(err)
+		logger().Error("listen failed", "err", err)
+		os.Exit(1)
 	}
+	backlog, _ := strconv.Atoi(getenv("LISTEN_BACKLOG"))
+	deferAccept, _ := strconv.Atoi(getenv("TCP_DEFER_ACCEPT"))
+	if backlog > 0 || deferAccept > 0 {
+		err = tuneListener(l, backlog, deferAccept)
+		if err != nil {
+			logger().Warn("listener not tuned", "err", err)
+		}
+	}
+	setListener(l)
 	defer l.Close()
+	if _PidFile != "" {
+		err = writePidFile(_PidFile)
+		if err != nil {
+			logger().Error("pid file not written", "err", err)
+		}
+	}
+	// listeners of the admin API, metrics and pprof wait for the drop, only
+	// the main listener may use a privileged port
+	err = dropPrivileges(getenv("RUN_AS_USER"), getenv("RUN_AS_GROUP"), getenv("CHROOT"))
+	if err != nil {
+		logger().Error("dropping privileges failed", "err", err)
+		os.Exit(1)
+	}
+	close(_PrivilegesDropped)
+	if sandbox, _ := strconv.ParseBool(getenv("SANDBOX")); sandbox {
+		err = enterSandbox()
+		if err != nil {
+			logger().Error("entering sandbox failed", "err", err)
+			os.Exit(1)
+		}
+	}
+	notifyReady()
+	sdReady()
+	go sdWatchdog()
+	if tlsCert() != nil {
+		// the listener handed over on upgrades stays plain
+		l = tls.NewListener(l, tlsConfig())
+	}
+	err = serve(ctx, l)
+	if err != nil {
+		logger().Error("accept failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// serve accepts connections until the listener is closed on purpose or ctx
+// is done, which returns nil, or fails permanently. Established tunnels are
+// unaffected by accept errors, but are torn down once ctx is done.
+func serve(ctx context.Context, l net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+
 	var tempDelay time.Duration
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-				time.Sleep(tempDelay)
-				continue
+			if stopping() || ctx.Err() != nil {
+				return nil
+			}
+			if !temporaryAcceptError(err) {
+				return err
+			}
+			acceptFailed()
+			_MetricAcceptErrors.Inc()
+			if tempDelay == 0 {
+				tempDelay = 5 * time.Millisecond
+			} else {
+				tempDelay *= 2
+			}
+			if max := 1 * time.Second; tempDelay > max {
+				tempDelay = max
 			}
-			log.Fatal(err)
+			logger().Warn("accept failed, retrying", "err", err, "delay", tempDelay.Seconds())
+			select {
+			case <-time.After(tempDelay):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
 		}
 		tempDelay = 0
-		go handleConn(conn)
+		acceptSucceeded()
+		_MetricConnAccepted.Inc()
+		if max := maxConns(); max > 0 && _MetricConnActive.Value() >= max {
+			// leave descriptors for the backends of the tunnels handled
+			_MetricConnRejected.Inc()
+			conn.Close()
+			continue
+		}
+		go handleConn(ctx, conn)
 	}
 }
 
-func handleConn(c net.Conn) {
-	defer func() {
-		c.Close()
-		if r := recover(); r != nil {
-			log.Println("Recovered in", r, ":", string(debug.Stack()))
+// temporaryAcceptError reports whether accepting may succeed later, e.g. once
+// descriptors or memory are freed, or when only one connection was aborted
+func temporaryAcceptError(err error) bool {
+	for _, errno := range []error{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM,
+		syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR, syscall.EAGAIN} {
+		if errors.Is(err, errno) {
+			return true
 		}
-	}()
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
 
-	c.SetReadDeadline(time.Now().Add(_ConnReadTimeout))
+// causes of sessions canceled by frontd
+var (
+	errTerminated = errors.New("terminated")
+	errExpired    = errors.New("connection lifetime exceeded")
+	errIdle       = errors.New("idle timeout")
+)
 
-	rdr := bufio.NewReader(c)
+// session is the state of a client connection, it's reported when closed
+type session struct {
+	net.Conn
+	// canceled when the client is gone, by the admin API or at
+	// MAX_CONN_LIFETIME, which closes the client connection
+	ctx    context.Context
+	cancel context.CancelCauseFunc
 
-	addr, err := handleBinaryHdr(rdr, c)
-	if err != nil {
-		if err != io.EOF {
-			log.Println("x", err)
-		}
+	id    string
+	log   *slog.Logger
+	sp    *span
+	start time.Time
+
+	// bytes relayed from and to the client
+	up   counter
+	down counter
+
+	// read by the admin API while the session is alive
+	mu      sync.Mutex
+	state   string
+	since   time.Time // of the state
+	backend string
+	wedged  bool // closed by the watchdog
+
+	errCode string
+	err     error
+	tls     bool   // the handshake started like a TLS ClientHello
+	token   string // hash of the cipher address, see tokenHash
+	tenant  string // of the tenant claim of the token
+
+	failover  string // backend redialed if the backend drops, see reconnect.go
+	compress  string // compression of the client leg, see compress.go
+	encrypt   string // encryption of the client leg, see seal.go
+	throttle  int64  // bytes per second each way of a throttled tunnel, see quota.go
+	priority  string // class of the tunnel, see priority.go
+	sealNonce []byte // sent by the client of a sealed tunnel
+
+	httpConnect bool   // the handshake is an HTTP CONNECT request
+	backendTLS  string // server name of SNI_ROUTES the backend is dialed over TLS for
+	ticketAddr  []byte // address sealed into a ticket sent before the relay, see ticket.go
+
+	rec   *recorder    // of the tunnel if it's recorded
+	live  []*liveCount // of the byte quotas of its token and tenant, see quota.go
+	quota *byteQuotas  // evaluated again while relaying, nil without byte quotas
+
+	// when the handshake was read completely, failures are answered no
+	// sooner than the failure delay after it
+	received time.Time
+}
+
+// session states
+const (
+	stateHandshake = "handshake"
+	stateDialing   = "dialing"
+	stateRelaying  = "relaying"
+	stateClosing   = "closing" // the relay is torn down
+)
+
+func (s *session) setState(state string) {
+	s.mu.Lock()
+	s.state = state
+	s.since = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *session) setBackend(addr string) {
+	s.mu.Lock()
+	s.backend = addr
+	s.mu.Unlock()
+}
+
+// terminate cancels the session, which tears down the tunnel
+func (s *session) terminate() {
+	s.cancel(errTerminated)
+}
+
+// ways to close client connections after an error code
+const (
+	_ErrorCloseDefault = "close" // send the code and close
+	_ErrorCloseFlush   = "flush" // send the code and wait for the client to close
+	_ErrorCloseReset   = "reset" // reset without sending the code
+)
+
+// _ErrorFlushTimeout bounds how long the client may take to close
+const _ErrorFlushTimeout = time.Second
+
+// _AuthFailureCodes are the error codes of malformed or undecryptable
+// handshakes, backend failures are not the client's fault
+var _AuthFailureCodes = map[string]bool{
+	"4103": true, "4104": true, "4106": true, "4107": true, "4108": true, "4109": true,
+	"4112": true, "4113": true,
+}
+
+// ways to answer failed handshakes, codes reveal frontd and the cause of the
+// failure to probers
+const (
+	_AuthFailureCode   = "code"   // send the error code
+	_AuthFailureDrop   = "drop"   // close without sending anything
+	_AuthFailureTarpit = "tarpit" // hold the connection silently until the tarpit timeout
+	_AuthFailureDecoy  = "decoy"  // answer like a web server, see writeDecoy
+)
+
+// _MaxTarpitted bounds the connections held by the tarpit, further ones are
+// dropped
+const _MaxTarpitted = 1024
+
+var (
+	_Tarpitted int64
+
+	_ = newGaugeFunc("frontd_tarpitted_connections",
+		"Number of connections held in the tarpit after failed handshakes.", func() float64 {
+			return float64(atomic.LoadInt64(&_Tarpitted))
+		})
+)
+
+// silentFailure reports whether nothing is sent for code
+func silentFailure(code string) bool {
+	if !_AuthFailureCodes[code] {
+		return false
+	}
+	mode := authFailure()
+	return mode == _AuthFailureDrop || mode == _AuthFailureTarpit
+}
+
+// tarpit discards what the client sends until it gives up or the tarpit
+// timeout elapses
+func (s *session) tarpit() {
+	if atomic.AddInt64(&_Tarpitted, 1) > _MaxTarpitted {
+		atomic.AddInt64(&_Tarpitted, -1)
 		return
 	}
+	defer atomic.AddInt64(&_Tarpitted, -1)
+	s.SetReadDeadline(time.Now().Add(tarpitTimeout()))
+	io.Copy(io.Discard, s.Conn)
+}
 
-	var header *bytes.Buffer
-	if addr == nil {
-		// Read first line
-		line, isPrefix, err := rdr.ReadLine()
-		if err != nil || isPrefix {
-			log.Println(err)
-			writeErrCode(c, []byte("4104"), false)
-			return
+// closeConn closes the client connection. After an error code it either
+// half-closes and discards what the client still sends, so unread data
+// doesn't make the kernel reset the connection before the code arrived, or
+// resets it at once.
+func (s *session) closeConn() {
+	if silentFailure(s.errCode) {
+		if authFailure() == _AuthFailureTarpit {
+			s.tarpit()
 		}
+	} else if s.errCode != "" {
+		switch errorClose() {
+		case _ErrorCloseFlush:
+			cw, ok := s.Conn.(interface{ CloseWrite() error })
+			if ok && cw.CloseWrite() == nil {
+				s.SetReadDeadline(time.Now().Add(_ErrorFlushTimeout))
+				io.Copy(io.Discard, io.LimitReader(s.Conn, 64*1024))
+			}
+		case _ErrorCloseReset:
+			if tc := tcpConn(s.Conn); tc != nil {
+				tc.SetLinger(0)
+			}
+		}
+	}
+	s.Close()
+}
 
-		cipherAddr := line
+// status returns the current state and backend of the session
+func (s *session) status() (state, backend string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.backend
+}
 
-		// check if it's HTTP request
-		if bytes.Contains(line, []byte("HTTP")) {
-			header = bytes.NewBuffer(line)
-			header.Write([]byte("\n"))
+// fail records the first error of the session
+func (s *session) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+	s.sp.SetError(err)
+}
 
-			cipherAddr, err = handleHTTPHdr(rdr, c, header)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-		}
+// errorClass classifies an error of a connection: "eof" for a peer hanging
+// up, "reset" for a connection reset or broken by its peer, "timeout",
+// "idle" for a tunnel past IDLE_TIMEOUT, "closed" for a connection closed
+// under frontd, and "error" for anything unexpected. It's empty for nil.
+func errorClass(err error) string {
+	var ne net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNABORTED):
+		return "reset"
+	case errors.Is(err, errIdle):
+		return "idle"
+	case errors.Is(err, net.ErrClosed):
+		return "closed"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	}
+	return "error"
+}
 
-		// base64 decode
-		dbuf := make([]byte, base64.StdEncoding.DecodedLen(len(cipherAddr)))
-		n, err := base64.StdEncoding.Decode(dbuf, cipherAddr)
-		if err != nil {
-			writeErrCode(c, []byte("4106"), false)
-			return
-		}
+// closeReason describes why the session ended: "terminated" by an admin,
+// "expired" at its maximum lifetime, "token_expired" at the until claim of
+// its token, "wedged" if closed by the watchdog, "quota" if closed by a byte
+// quota, the error code sent to the client, the errorClass of its error, or
+// "closed" for a tunnel torn down normally
+func (s *session) closeReason() string {
+	var cause error
+	if s.ctx != nil {
+		cause = context.Cause(s.ctx)
+	}
+	switch {
+	case cause == errTerminated:
+		return "terminated"
+	case cause == errExpired:
+		return "expired"
+	case cause == errTokenExpired:
+		return "token_expired"
+	case cause == errWedged:
+		return "wedged"
+	case cause == errQuotaExceeded:
+		return "quota"
+	case s.errCode != "":
+		return s.errCode
+	case s.err != nil:
+		return errorClass(s.err)
+	}
+	return "closed"
+}
 
-		addr, err = backendAddrDecrypt(dbuf[:n])
-		if err != nil {
-			writeErrCode(c, []byte("4106"), false)
-			return
+// report logs one record describing the whole session
+func (s *session) report() {
+	if _AccessLog != nil {
+		_AccessLog.write(s)
+	}
+	recordUsage(s)
+	releaseLiveBytes(s)
+
+	duration := time.Since(s.start).Seconds()
+	_MetricConnDuration.Observe(duration)
+	reason := s.closeReason()
+	_MetricConnClosed.With(reason).Inc()
+
+	_, backend := s.status()
+	attrs := []slog.Attr{
+		slog.Float64("duration", duration),
+		slog.Uint64("bytes_up", s.up.Value()),
+		slog.Uint64("bytes_down", s.down.Value()),
+		slog.String("close_reason", reason),
+	}
+	if backend != "" {
+		attrs = append(attrs, slog.String("backend_addr", backend))
+	}
+	if s.errCode != "" {
+		attrs = append(attrs, slog.String("error_code", s.errCode))
+	}
+
+	level := slog.LevelInfo
+	if s.err != nil {
+		attrs = append(attrs, slog.String("error", s.err.Error()))
+		switch errorClass(s.err) {
+		case "eof", "closed":
+			// peers hanging up are not a fault of ours
+			level = slog.LevelDebug
+		case "reset", "timeout", "idle":
+			level = slog.LevelInfo
+		default:
+			level = slog.LevelWarn
 		}
 	}
+	s.log.LogAttrs(context.Background(), level, "connection closed", attrs...)
+}
 
-	// TODO: check if addr is allowed
+// _FailureDelayCodes are the error codes of handshakes rejected by frontd,
+// their timing must not reveal which step failed
+var _FailureDelayCodes = map[string]bool{
+	"4103": true, "4104": true, "4106": true, "4107": true, "4108": true, "4109": true,
+	"4111": true, "4112": true, "4113": true,
+}
 
-	// Build tunnel
-	err = tunneling(string(addr), rdr, c, header)
-	if err != nil {
-		log.Println(err)
+// delayFailure makes rejections take the same time whichever step of
+// decoding, decrypting or checking the backend failed, by waiting until the
+// failure delay passed since the handshake was read
+func delayFailure(s *session, code string) {
+	delay := failureDelay()
+	if delay <= 0 || !_FailureDelayCodes[code] {
+		return
+	}
+	if s.received.IsZero() {
+		// reading failed just now
+		s.received = time.Now()
+	}
+	t := time.NewTimer(time.Until(s.received.Add(delay)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.ctx.Done():
 	}
 }
 
-func writeErrCode(c net.Conn, errCode []byte, httpws bool) {
+func writeErrCode(s *session, errCode []byte, httpws bool) {
+	delayFailure(s, string(errCode))
+	_MetricHandshakeFailures.With(string(errCode)).Inc()
+	_MetricHandshakeFailuresBySource.With(string(errCode), failureSource(s.RemoteAddr())).Inc()
+	s.sp.SetAttr("frontd.error_code", string(errCode))
+	s.errCode = string(errCode)
+	recordFailure(s.RemoteAddr(), s.errCode)
+	if _AuthFailureCodes[s.errCode] {
+		audit(s, auditAuthFailure, "")
+	}
+	if _AuthFailureCodes[s.errCode] && authFailure() == _AuthFailureDecoy {
+		writeDecoy(s, httpws)
+		return
+	}
+	if errorClose() == _ErrorCloseReset || silentFailure(s.errCode) {
+		return
+	}
+
 	switch httpws {
 	case true:
-		fmt.Fprintf(c, "HTTP/1.1 %s Error\nConnection: Close", errCode)
+		fmt.Fprintf(s, "HTTP/1.1 %s Error\nConnection: Close", errCode)
 	default:
-		c.Write(errCode)
+		s.Write(errCode)
 	}
 }
 
-func handleBinaryHdr(rdr *bufio.Reader, c net.Conn) (addr []byte, err error) {
+func handleBinaryHdr(rdr *bufio.Reader, s *session) (addr []byte, err error) {
 	// use binary protocol if first byte is 0x00
 	b, err := rdr.ReadByte()
 	if err != nil {
 		// TODO: how to cause error to test this?
-		writeErrCode(c, []byte("4103"), false)
+		writeErrCode(s, []byte("4103"), false)
 		return nil, err
 	}
-	if b == byte(0x00) {
+	if b == _HandshakeResume {
+		return handleResumeHdr(rdr, s)
+	}
+	if b == byte(0x00) || b == _HandshakeTicket {
 		// binary protocol
+		s.log.Debug("handshake", "mode", "binary", "ticket", b == _HandshakeTicket)
 		blen, err := rdr.ReadByte()
 		if err != nil || blen == 0 {
-			writeErrCode(c, []byte("4103"), false)
+			if err == nil {
+				err = errors.New("empty binary cipher address")
+			}
+			writeErrCode(s, []byte("4103"), false)
 			return nil, err
 		}
 		p := make([]byte, blen)
 		n, err := io.ReadFull(rdr, p)
 		if n != int(blen) {
 			// TODO: how to cause error to test this?
-			writeErrCode(c, []byte("4109"), false)
+			writeErrCode(s, []byte("4109"), false)
 			return nil, err
 		}
+		s.received = time.Now()
 
 		// decrypt
-		addr, err := backendAddrDecrypt(p)
+		addr, err := tracedAddrDecrypt(p, s)
 		if err != nil {
-			writeErrCode(c, []byte("4106"), false)
+			writeErrCode(s, decryptErrCode(err), false)
 			return nil, err
 		}
+		if b == _HandshakeTicket {
+			s.ticketAddr = addr
+		}
 
 		return addr, err
 	}
 
+	if b == 0x16 && authFailure() == _AuthFailureDecoy {
+		// a TLS ClientHello never ends with a newline, answer it at once
+		s.tls = true
+		writeErrCode(s, []byte("4104"), false)
+		return nil, errors.New("TLS handshake")
+	}
+
 	rdr.UnreadByte()
 	return nil, nil
 }
 
-func handleHTTPHdr(rdr *bufio.Reader, c net.Conn, header *bytes.Buffer) (addr []byte, err error) {
-	hdrXff := "X-Forwarded-For: " + ipAddrFromRemoteAddr(c.RemoteAddr().String())
+// _HTTPConnectEstablished answers HTTP CONNECT once the backend is connected
+var _HTTPConnectEstablished = []byte("HTTP/1.1 200 Connection Established\r\n\r\n")
+
+// handleHTTPHdr reads the rest of the request head into header and returns
+// the cipher address, or the backend of HOST_ROUTES with routed set if the
+// request has no cipher address
+func handleHTTPHdr(rdr *bufio.Reader, s *session, header *bytes.Buffer) (addr []byte, routed bool, err error) {
+	hdrXff := "X-Forwarded-For: " + ipAddrFromRemoteAddr(s.RemoteAddr().String())
 
 	var cipherAddr []byte
+	var host string
 	for {
 		line, isPrefix, err := rdr.ReadLine()
 		if err != nil || isPrefix {
-			log.Println(err)
-			writeErrCode(c, []byte("4107"), true)
-			return nil, err
+			if err == nil {
+				err = errors.New("http header line too long")
+			}
+			writeErrCode(s, []byte("4107"), true)
+			return nil, false, err
 		}
 
 		if bytes.HasPrefix(bytes.ToLower(line), _hdrCipherOrigin) {
@@ -270,16 +909,34 @@ func handleHTTPHdr(rdr *bufio.Reader, c net.Conn, header *bytes.Buffer) (addr []
 			continue
 		}
 
+		// continue the trace of the client, backend will see frontd as parent
+		if s.sp != nil && bytes.HasPrefix(bytes.ToLower(line), _hdrTraceParent) {
+			s.sp.SetTraceParent(string(bytes.TrimSpace(line[len(_hdrTraceParent):])))
+			continue
+		}
+
+		if bytes.HasPrefix(bytes.ToLower(line), _hdrHost) {
+			host = string(bytes.TrimSpace(line[len(_hdrHost):]))
+		}
+
 		if len(bytes.TrimSpace(line)) == 0 {
 			// end of HTTP header
 			if len(cipherAddr) == 0 {
-				writeErrCode(c, []byte("4108"), true)
-				return nil, errors.New("empty http cipher address header")
+				if backend := routeHost(host); backend != "" {
+					cipherAddr, routed = []byte(backend), true
+				} else {
+					writeErrCode(s, []byte("4108"), true)
+					return nil, false, errors.New("empty http cipher address header")
+				}
 			}
 			if len(hdrXff) > 0 {
 				header.Write([]byte(hdrXff))
 				header.Write([]byte("\n"))
 			}
+			if s.sp != nil {
+				header.Write([]byte("Traceparent: " + s.sp.TraceParent()))
+				header.Write([]byte("\n"))
+			}
 			header.Write(line)
 			header.Write([]byte("\n"))
 			break
@@ -288,96 +945,85 @@ func handleHTTPHdr(rdr *bufio.Reader, c net.Conn, header *bytes.Buffer) (addr []
 		header.Write(line)
 		header.Write([]byte("\n"))
 
-		if header.Len() > _maxHTTPHeaderSize {
-			writeErrCode(c, []byte("4108"), true)
-			return nil, errors.New("http header size overflowed")
+		if header.Len() > maxHTTPHeaderSize() {
+			writeErrCode(s, []byte("4108"), true)
+			return nil, false, errors.New("http header size overflowed")
 		}
 	}
 
-	return cipherAddr, nil
+	return cipherAddr, routed, nil
 }
 
-// tunneling to backend
-func tunneling(addr string, rdr *bufio.Reader, c net.Conn, header *bytes.Buffer) error {
-	backend, err := dialTimeout("tcp", addr, time.Second*time.Duration(_BackendDialTimeout))
-	if err != nil {
-		// handle error
-		switch err := err.(type) {
-		case net.Error:
-			if err.Timeout() {
-				writeErrCode(c, []byte("4101"), false)
-				return err
-			}
-		}
-		writeErrCode(c, []byte("4102"), false)
-		return err
-	}
-	defer backend.Close()
-
-	if header != nil {
-		header.WriteTo(backend)
-	}
-
-	// Start transfering data
-	go pipe(c, backend, c, backend)
-	pipe(backend, rdr, backend, c)
-
-	return nil
+func dialTimeout(network, address string, timeout time.Duration) (conn net.Conn, err error) {
+	return dialWith(context.Background(), &net.Dialer{Timeout: timeout}, network, address)
 }
 
-func dialTimeout(network, address string, timeout time.Duration) (conn net.Conn, err error) {
-	m := int(timeout / time.Second)
+// dialWith dials with d, retrying for up to its timeout while local ports
+// are exhausted, until ctx is done
+func dialWith(ctx context.Context, d *net.Dialer, network, address string) (conn net.Conn, err error) {
+	m := int(d.Timeout / time.Second)
 	for i := 0; i < m; i++ {
-		conn, err = net.DialTimeout(network, address, timeout)
+		conn, err = d.DialContext(ctx, network, address)
 		if err == nil || !strings.Contains(err.Error(), "can't assign requested address") {
 			break
 		}
-		time.Sleep(time.Second)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return nil, err
+		}
 	}
 	return
 }
 
+func tracedAddrDecrypt(key []byte, s *session) ([]byte, error) {
+	s.token = tokenHash(key)
+	dsp := s.sp.child("frontd.decrypt", spanKindInternal)
+	addr, err := backendAddrDecrypt(key)
+	if err == nil {
+		err = checkReplay(key)
+	}
+	dsp.SetError(err)
+	dsp.End()
+	return addr, err
+}
+
+// decryptErrCode is the error code of a cipher address not accepted
+func decryptErrCode(err error) []byte {
+	switch {
+	case errors.Is(err, errReplayed):
+		return []byte("4112")
+	case errors.Is(err, errTicketExpired):
+		return []byte("4113")
+	}
+	return []byte("4106")
+}
+
 func backendAddrDecrypt(key []byte) ([]byte, error) {
+	// always decrypt if cache is disabled
+	if _BackendAddrCacheDisabled {
+		return _Aes256CBC.Decrypt(secretPassphrase(), key)
+	}
+
 	// Try to check cache
-	m1 := _BackendAddrCache.Load().(backendAddrMap)
 	k1 := string(key)
-	addr, ok := m1[k1]
+	addr, ok := _BackendAddrCache.Get(k1)
 	if ok {
+		_MetricCacheHits.Inc()
 		return addr, nil
 	}
+	_MetricCacheMisses.Inc()
 
 	// Try to decrypt it (AES)
-	addr, err := _Aes256CBC.Decrypt(_SecretPassphase, key)
+	addr, err := _Aes256CBC.Decrypt(secretPassphrase(), key)
 	if err != nil {
 		return nil, err
 	}
 
-	backendAddrList(k1, addr)
+	_BackendAddrCache.Set(k1, addr)
 	return addr, nil
 }
 
-func backendAddrList(key string, val []byte) {
-	_BackendAddrCacheMutex.Lock()
-	defer _BackendAddrCacheMutex.Unlock()
-
-	m1 := _BackendAddrCache.Load().(backendAddrMap)
-	// double check
-	if _, ok := m1[key]; ok {
-		return
-	}
-
-	m2 := make(backendAddrMap)
-	// flush cache if there is way too many
-	if len(m1) < _MaxBackendAddrCacheCount {
-		// copy-on-write
-		for k, v := range m1 {
-			m2[k] = v // copy all data from the current object to the new one
-		}
-	}
-	m2[key] = val
-	_BackendAddrCache.Store(m2) // atomically replace the current object with the new one
-}
-
 // Request.RemoteAddress contains port, which we want to remove i.e.:
 // "[::1]:58292" => "[::1]"
 func ipAddrFromRemoteAddr(s string) string {
@@ -388,38 +1034,77 @@ func ipAddrFromRemoteAddr(s string) string {
 	return s[:idx]
 }
 
-// pipe upstream and downstream
-func pipe(dst io.Writer, src io.Reader, dstconn, srcconn net.Conn) {
+// relayError is an error of one direction of a tunnel
+type relayError struct {
+	dir string // "upstream" or "downstream"
+	op  string // "read" or "write"
+	err error
+}
+
+func (e *relayError) Error() string {
+	return e.dir + " " + e.op + ": " + e.err.Error()
+}
+
+func (e *relayError) Unwrap() error {
+	return e.err
+}
+
+// pipe upstream and downstream, it adds the number of bytes written to dst
+// to relayed counters and returns the error that ended it, nil when src
+// reached EOF. Both directions of a tunnel store the time they last read
+// bytes in active, and end once neither did for the IDLE_TIMEOUT.
+func pipe(dst io.Writer, src io.Reader, dstconn, srcconn net.Conn, lg *slog.Logger, dir string, active *int64, relayed ...*counter) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("Recovered in", r, ":", string(debug.Stack()))
+			recoveredPanic(lg, "", r)
+			err = &relayError{dir, "relay", fmt.Errorf("panic: %v", r)}
 		}
 	}()
 
-	// only close dst when done
-	defer dstconn.Close()
-
 	buf := make([]byte, 2*4096)
 	for {
-		srcconn.SetReadDeadline(time.Now().Add(_ConnReadTimeout))
+		var deadline time.Time
+		if rt := connReadTimeout(); rt > 0 {
+			deadline = time.Now().Add(rt)
+		}
+		idle := idleTimeout()
+		if idle > 0 {
+			if d := time.Unix(0, atomic.LoadInt64(active)).Add(idle); deadline.IsZero() || d.Before(deadline) {
+				deadline = d
+			}
+		}
+		srcconn.SetReadDeadline(deadline)
 		nr, er := src.Read(buf)
 		if nr > 0 {
+			atomic.StoreInt64(active, time.Now().UnixNano())
+			if ch := chaos(); ch != nil && ch.disrupt(buf[:nr], dstconn, srcconn) {
+				return
+			}
 			nw, ew := dst.Write(buf[0:nr])
-			if ew != nil {
-				break
+			for _, c := range relayed {
+				c.Add(uint64(nw))
 			}
-			if nr != nw {
-				break
+			if ew == nil && nr != nw {
+				ew = io.ErrShortWrite
+			}
+			if ew != nil {
+				err = &relayError{dir, "write", ew}
+				return
 			}
 		}
 		if neterr, ok := er.(net.Error); ok && neterr.Timeout() {
+			if idle > 0 && time.Since(time.Unix(0, atomic.LoadInt64(active))) >= idle {
+				err = &relayError{dir, "read", errIdle}
+				return
+			}
 			continue
 		}
 		if er == io.EOF {
-			break
+			return
 		}
 		if er != nil {
-			break
+			err = &relayError{dir, "read", er}
+			return
 		}
 	}
 }
@@ -0,0 +1,268 @@
+//go:build !windows
+
+package frontd
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInheritedListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	lf, err := l.(*net.TCPListener).File()
+	if err != nil {
+		panic(err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+	defer r.Close()
+
+	// the descriptors are taken over as if they were inherited
+	lfd, _ := syscall.Dup(int(lf.Fd()))
+	wfd, _ := syscall.Dup(int(w.Fd()))
+	lf.Close()
+	w.Close()
+	t.Setenv(_ListenerFDEnv, strconv.Itoa(lfd))
+	t.Setenv(_ReadyFDEnv, strconv.Itoa(wfd))
+	_Inherited = true
+	defer func() { _Inherited = false }()
+
+	il, err := inheritedListener()
+	if err != nil || il == nil {
+		t.Fatal("listener not inherited:", err)
+	}
+	defer il.Close()
+	if il.Addr().String() != l.Addr().String() {
+		t.Fatal("inherited listener on", il.Addr(), "instead of", l.Addr())
+	}
+
+	notifyReady()
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "ready" {
+		t.Fatal("readiness not reported:", string(b))
+	}
+	if os.Getenv(_ListenerFDEnv) != "" {
+		t.Fatal("handoff environment not cleared")
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	sdReady()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "READY=1\nMAINPID="+strconv.Itoa(os.Getpid()) {
+		t.Fatal("unexpected notification:", string(buf[:n]))
+	}
+
+	if !acceptHealthy(time.Second) {
+		t.Fatal("accept should be healthy")
+	}
+	acceptFailed()
+	defer acceptSucceeded()
+	if !acceptHealthy(time.Second) || acceptHealthy(0) {
+		t.Fatal("accept failures not tracked")
+	}
+}
+
+func TestSystemdListener(t *testing.T) {
+	// sockets passed to another process must be ignored
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getppid()))
+	t.Setenv("LISTEN_FDS", "1")
+	l, err := systemdListener()
+	if l != nil || err != nil {
+		t.Fatal("took over sockets of another process:", err)
+	}
+	if os.Getenv("LISTEN_FDS") != "1" {
+		t.Fatal("environment of another process cleared")
+	}
+
+	if _, err := os.Stat("/proc/self/status"); err == nil {
+		if _, ok := hasNetBindService(); !ok {
+			t.Fatal("capabilities not parsed")
+		}
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	if os.Getenv("FRONTD_TEST_SANDBOX") == "" {
+		// the sandbox can't be left, so it is entered by a child process
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSandbox$", "-test.v")
+		cmd.Env = append(os.Environ(), "FRONTD_TEST_SANDBOX=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(err, string(out))
+		}
+		if strings.Contains(string(out), "--- SKIP") {
+			t.Skip(string(out))
+		}
+		return
+	}
+
+	err := enterSandbox()
+	if err != nil {
+		t.Skip("sandbox not supported:", err)
+	}
+
+	// relaying still works
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Fatal("relay failed:", err)
+	}
+	_, err = ioutil.ReadFile("/etc/hosts")
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	// executing programs is not
+	err = exec.Command("/bin/true").Run()
+	if err == nil {
+		t.Fatal("exec allowed in sandbox")
+	}
+}
+
+func TestDeferAccept(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	err = tuneListener(l, 16, 1)
+	if err != nil {
+		t.Skip("listener tuning not supported:", err)
+	}
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	// nothing is accepted until data arrives
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(time.Millisecond * 200))
+	_, err = l.Accept()
+	if err == nil {
+		t.Fatal("connection accepted without data")
+	}
+	c.Write([]byte("ping"))
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+	ac, err := l.Accept()
+	if err != nil {
+		t.Fatal("connection with data not accepted:", err)
+	}
+	ac.Close()
+}
+
+func TestSetDSCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	defer c.Close()
+
+	err = setDSCP(c, 46)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, _ := c.(*net.TCPConn).SyscallConn()
+	var tos int
+	rc.Control(func(fd uintptr) {
+		tos, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	if err != nil || tos != 46<<2 {
+		t.Fatal("DSCP not set:", tos, err)
+	}
+}
+
+func TestLookupPrivileges(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skip("no current user:", err)
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skip("no primary group:", err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, nil, 0644)
+
+	for _, c := range []struct {
+		user, group, dir string
+		uid, gid         int
+		ok               bool
+	}{
+		{"", "", "", -1, -1, true},
+		{u.Username, "", "", uid, gid, true},
+		{"", g.Name, "", -1, gid, true},
+		{u.Username, g.Name, dir, uid, gid, true},
+		{"frontd-no-such-user", "", "", -1, -1, false},
+		{"", "frontd-no-such-group", "", -1, -1, false},
+		{u.Username, "frontd-no-such-group", "", -1, -1, false},
+		{"", "", filepath.Join(dir, "missing"), -1, -1, false},
+		{"", "", file, -1, -1, false},
+	} {
+		uid, gid, err := lookupPrivileges(c.user, c.group, c.dir)
+		if (err == nil) != c.ok || uid != c.uid || gid != c.gid {
+			t.Errorf("lookupPrivileges(%q, %q, %q) = %d, %d, %v", c.user, c.group, c.dir, uid, gid, err)
+		}
+	}
+
+	// nothing to drop
+	if err := dropPrivileges("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+}
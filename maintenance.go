@@ -0,0 +1,60 @@
+package frontd
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// _Maintenance makes frontd refuse new tunnels with 4110 while established
+// ones are kept, so a host can be drained before a reboot
+var _Maintenance int32
+
+func maintenance() bool {
+	return atomic.LoadInt32(&_Maintenance) == 1
+}
+
+func setMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&_Maintenance, v) != v {
+		logger().Info("maintenance mode changed", "maintenance", on)
+	}
+}
+
+var _ = newGaugeFunc("frontd_maintenance",
+	"Whether new connections are refused for maintenance.", func() float64 {
+		if maintenance() {
+			return 1
+		}
+		return 0
+	})
+
+// maintenanceHandler reports or sets the maintenance mode, PUT or POST true
+// to enable it and false to disable it
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT", "POST":
+		b, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		on, err := strconv.ParseBool(strings.TrimSpace(string(b)))
+		if err != nil {
+			http.Error(w, "expected true or false", http.StatusBadRequest)
+			return
+		}
+		setMaintenance(on)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	io.WriteString(w, strconv.FormatBool(maintenance())+"\n")
+}
@@ -0,0 +1,435 @@
+package frontd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A tiny metrics registry rendering the Prometheus text exposition format,
+// kept dependency free on purpose.
+
+var (
+	_MetricConnAccepted = newCounter("frontd_connections_accepted_total",
+		"Total number of accepted client connections.")
+	_MetricConnRejected = newCounter("frontd_connections_rejected_total",
+		"Total number of client connections closed right away as MAX_CONNS were handled.")
+	_ = newGaugeFunc("frontd_max_connections",
+		"Maximum number of client connections handled, 0 if unlimited.", func() float64 {
+			return float64(maxConns())
+		})
+	_MetricAcceptErrors = newCounter("frontd_accept_errors_total",
+		"Total number of temporary accept errors, e.g. running out of file descriptors.")
+	_MetricConnActive = newGauge("frontd_connections_active",
+		"Number of client connections being handled.")
+	_MetricHandshakeFailures = newCounterVec("frontd_handshake_failures_total",
+		"Total number of failed handshakes by error code.", "code")
+	_MetricHandshakeFailuresBySource = newCounterVec("frontd_handshake_failures_by_source_total",
+		"Total number of failed handshakes by error code and client network.", "code", "source")
+	_MetricRelayedBytes = newCounterVec("frontd_relayed_bytes_total",
+		"Total number of bytes relayed by direction.", "direction")
+	_MetricDialDuration = newHistogram("frontd_backend_dial_duration_seconds",
+		"Latency of dialing backends.",
+		[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5})
+	_MetricHandshakeDuration = newHistogram("frontd_handshake_duration_seconds",
+		"Time from accepting a connection until its backend is connected, including reading the header, decrypting and dialing.",
+		[]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30})
+	_MetricConnClosed = newCounterVec("frontd_connections_closed_total",
+		"Total number of client connections closed by close reason, see the access log.", "reason")
+	_MetricConnDuration = newHistogram("frontd_connection_duration_seconds",
+		"Lifetime of client connections.",
+		[]float64{.1, 1, 5, 10, 30, 60, 300, 600, 1800, 3600, 7200, 21600, 86400})
+	_MetricCacheHits = newCounter("frontd_addr_cache_hits_total",
+		"Total number of backend address cache hits.")
+	_MetricCacheMisses = newCounter("frontd_addr_cache_misses_total",
+		"Total number of backend address cache misses.")
+	_ = newGaugeFunc("frontd_addr_cache_entries",
+		"Number of cached backend addresses.", func() float64 {
+			return float64(_BackendAddrCache.Len())
+		})
+
+	_MetricBackendConns = newCounterVec("frontd_backend_connections_total",
+		"Total number of tunnels by backend.", "backend")
+	_MetricBackendErrors = newCounterVec("frontd_backend_errors_total",
+		"Total number of failed backend dials by backend.", "backend")
+	_MetricBackendBytes = newCounterVec("frontd_backend_relayed_bytes_total",
+		"Total number of bytes relayed by backend and direction.", "backend", "direction")
+
+	// client to backend and backend to client
+	_MetricUpstreamBytes   = _MetricRelayedBytes.With("upstream")
+	_MetricDownstreamBytes = _MetricRelayedBytes.With("downstream")
+)
+
+// _MaxFailureSources bounds the distinct client networks tracked by
+// frontd_handshake_failures_by_source_total, the rest is counted as "other"
+const _MaxFailureSources = 1000
+
+var (
+	_FailureSourcesMutex sync.Mutex
+	_FailureSources      = make(map[string]struct{})
+)
+
+// failureSource buckets a client address into its /24 for IPv4 or /48 for
+// IPv6, so probing from a network shows up as one series
+func failureSource(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		ip = net.ParseIP(ipAddrFromRemoteAddr(addr.String()))
+	}
+	if ip == nil {
+		return "other"
+	}
+
+	var source string
+	if ip4 := ip.To4(); ip4 != nil {
+		source = ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	} else {
+		source = ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	}
+
+	_FailureSourcesMutex.Lock()
+	defer _FailureSourcesMutex.Unlock()
+	if _, ok := _FailureSources[source]; !ok {
+		if len(_FailureSources) >= _MaxFailureSources {
+			return "other"
+		}
+		_FailureSources[source] = struct{}{}
+	}
+	return source
+}
+
+// _MaxBackendLabels bounds the distinct backends tracked by the
+// frontd_backend_* metrics, the rest is counted as "other"
+const _MaxBackendLabels = 1000
+
+var (
+	_BackendLabelsMutex sync.Mutex
+	_BackendLabels      = make(map[string]struct{})
+)
+
+// backendLabel is the label of addr in the frontd_backend_* metrics, only
+// backends allowed by the backend policy are to be labeled
+func backendLabel(addr string) string {
+	_BackendLabelsMutex.Lock()
+	defer _BackendLabelsMutex.Unlock()
+	if _, ok := _BackendLabels[addr]; !ok {
+		if len(_BackendLabels) >= _MaxBackendLabels {
+			return "other"
+		}
+		_BackendLabels[addr] = struct{}{}
+	}
+	return addr
+}
+
+type metric interface {
+	// write the samples of metric name in text exposition format
+	write(w io.Writer, name string)
+	// collect calls f with the current value of every sample
+	collect(f func(labels, values []string, v float64))
+}
+
+type metricFamily struct {
+	name string
+	help string
+	typ  string
+	m    metric
+}
+
+var (
+	_MetricsMutex sync.Mutex
+	_Metrics      []metricFamily
+)
+
+func register(name, help, typ string, m metric) {
+	_MetricsMutex.Lock()
+	_Metrics = append(_Metrics, metricFamily{name, help, typ, m})
+	_MetricsMutex.Unlock()
+}
+
+// writeMetrics renders all registered metrics
+func writeMetrics(w io.Writer) {
+	_MetricsMutex.Lock()
+	families := _Metrics
+	_MetricsMutex.Unlock()
+
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		f.m.write(w, f.name)
+	}
+}
+
+// collectMetrics calls f with the current value of every registered sample
+func collectMetrics(f func(name, typ string, labels, values []string, v float64)) {
+	_MetricsMutex.Lock()
+	families := _Metrics
+	_MetricsMutex.Unlock()
+
+	for _, m := range families {
+		m.m.collect(func(labels, values []string, v float64) {
+			f(m.name, m.typ, labels, values, v)
+		})
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw)
+	bw.Flush()
+}
+
+// metricsMux serves the endpoints safe to expose to scrapers and load
+// balancers
+func metricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	return mux
+}
+
+func listenAndServeMetrics(port int) {
+	l, err := listenRetry(":" + strconv.Itoa(port))
+	if err == nil {
+		err = http.Serve(l, metricsMux())
+	}
+	logger().Error("metrics server stopped", "err", err)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var _labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(_labelValueEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+type counter struct {
+	v uint64
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{}
+	register(name, help, "counter", c)
+	return c
+}
+
+func (c *counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, c.Value())
+}
+
+func (c *counter) collect(f func(labels, values []string, v float64)) {
+	f(nil, nil, float64(c.Value()))
+}
+
+type gauge struct {
+	v int64
+}
+
+func newGauge(name, help string) *gauge {
+	g := &gauge{}
+	register(name, help, "gauge", g)
+	return g
+}
+
+func (g *gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+func (g *gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+func (g *gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+func (g *gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *gauge) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %d\n", name, g.Value())
+}
+
+func (g *gauge) collect(f func(labels, values []string, v float64)) {
+	f(nil, nil, float64(g.Value()))
+}
+
+type gaugeFunc func() float64
+
+func newGaugeFunc(name, help string, f func() float64) gaugeFunc {
+	register(name, help, "gauge", gaugeFunc(f))
+	return f
+}
+
+// newCounterFunc registers f, which must never decrease, as a counter
+func newCounterFunc(name, help string, f func() float64) gaugeFunc {
+	register(name, help, "counter", gaugeFunc(f))
+	return f
+}
+
+func (f gaugeFunc) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(f()))
+}
+
+func (f gaugeFunc) collect(fn func(labels, values []string, v float64)) {
+	fn(nil, nil, f())
+}
+
+// counterVec is a set of counters partitioned by label values
+type counterVec struct {
+	labels []string
+
+	mu sync.RWMutex
+	m  map[string]*labeledCounter
+}
+
+type labeledCounter struct {
+	counter
+	values []string
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	v := &counterVec{labels: labels, m: make(map[string]*labeledCounter)}
+	register(name, help, "counter", v)
+	return v
+}
+
+// With returns the counter for the label values, creating it if necessary
+func (v *counterVec) With(values ...string) *counter {
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	c, ok := v.m[key]
+	v.mu.RUnlock()
+	if ok {
+		return &c.counter
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok = v.m[key]
+	if !ok {
+		c = &labeledCounter{values: values}
+		v.m[key] = c
+	}
+	return &c.counter
+}
+
+// counters returns all counters sorted by label values
+func (v *counterVec) counters() []*labeledCounter {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.m))
+	for k := range v.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	cs := make([]*labeledCounter, len(keys))
+	for i, k := range keys {
+		cs[i] = v.m[k]
+	}
+	v.mu.RUnlock()
+	return cs
+}
+
+func (v *counterVec) write(w io.Writer, name string) {
+	for _, c := range v.counters() {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(v.labels, c.values), c.Value())
+	}
+}
+
+func (v *counterVec) collect(f func(labels, values []string, v float64)) {
+	for _, c := range v.counters() {
+		f(v.labels, c.values, float64(c.Value()))
+	}
+}
+
+type histogram struct {
+	name    string
+	buckets []float64
+	counts  []uint64 // one more than buckets for +Inf
+	sum     uint64   // float64 bits
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+	register(name, help, "histogram", h)
+	return h
+}
+
+func (h *histogram) Observe(v float64) {
+	if _Statsd != nil {
+		_Statsd.timing(h.name, v)
+	}
+
+	i := sort.SearchFloat64s(h.buckets, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		n := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, n) {
+			return
+		}
+	}
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b), cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.buckets)])
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(math.Float64frombits(atomic.LoadUint64(&h.sum))))
+	fmt.Fprintf(w, "%s_count %d\n", name, cumulative)
+}
+
+// histograms are sent to statsd as timings when observed, see Observe
+func (h *histogram) collect(f func(labels, values []string, v float64)) {}
@@ -0,0 +1,85 @@
+package frontd
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Go runtime and process metrics, named after the ones of the official
+// Prometheus client so existing dashboards and alerts apply.
+
+var (
+	_ = newGaugeFunc("go_goroutines",
+		"Number of goroutines that currently exist.", func() float64 {
+			return float64(runtime.NumGoroutine())
+		})
+	_ = newGaugeFunc("go_memstats_heap_alloc_bytes",
+		"Number of heap bytes allocated and still in use.", func() float64 {
+			return float64(memStats().HeapAlloc)
+		})
+	_ = newGaugeFunc("go_memstats_heap_inuse_bytes",
+		"Number of heap bytes that are in use.", func() float64 {
+			return float64(memStats().HeapInuse)
+		})
+	_ = newGaugeFunc("go_memstats_sys_bytes",
+		"Number of bytes obtained from system.", func() float64 {
+			return float64(memStats().Sys)
+		})
+	_ = newCounterFunc("go_gc_cycles_total",
+		"Number of completed GC cycles.", func() float64 {
+			return float64(memStats().NumGC)
+		})
+	_ = newCounterFunc("go_gc_pause_seconds_total",
+		"Total time the world was stopped for GC.", func() float64 {
+			return float64(memStats().PauseTotalNs) / 1e9
+		})
+	_ = newGaugeFunc("go_gc_last_pause_seconds",
+		"Duration of the most recent GC stop the world pause.", func() float64 {
+			ms := memStats()
+			return float64(ms.PauseNs[(ms.NumGC+255)%256]) / 1e9
+		})
+	_ = newGaugeFunc("process_open_fds",
+		"Number of open file descriptors, -1 if unknown.", openFDs)
+	_ = newGaugeFunc("process_max_fds",
+		"Maximum number of open file descriptors, -1 if unknown.", maxOpenFiles)
+)
+
+// ReadMemStats stops the world, so it is called at most once per scrape
+const _MemStatsMaxAge = time.Second
+
+var (
+	_MemStatsMutex sync.Mutex
+	_MemStats      runtime.MemStats
+	_MemStatsTime  time.Time
+)
+
+func memStats() *runtime.MemStats {
+	_MemStatsMutex.Lock()
+	defer _MemStatsMutex.Unlock()
+	if time.Since(_MemStatsTime) > _MemStatsMaxAge {
+		runtime.ReadMemStats(&_MemStats)
+		_MemStatsTime = time.Now()
+	}
+	ms := _MemStats
+	return &ms
+}
+
+// openFDs counts the entries of the per process descriptor directory
+func openFDs() float64 {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		f, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		// the directory being read is an open descriptor too
+		return float64(len(names) - 1)
+	}
+	return -1
+}
@@ -0,0 +1,263 @@
+package frontd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Connections are handled by a chain of middlewares ending with the relay.
+// MIDDLEWARES orders the built-in ones and those of Server.Middlewares by
+// name, middlewares left out are skipped, except those of the Server which
+// then run last before the relay.
+
+// Conn is a client connection passed along the middleware chain
+type Conn struct {
+	s       *session
+	h       *connHandler
+	rdr     *bufio.Reader
+	header  *bytes.Buffer // HTTP header forwarded to the backend, nil if not HTTP
+	backend string
+}
+
+// Handler handles a client connection
+type Handler func(c *Conn)
+
+// Middleware returns a Handler doing its part of handling a connection and
+// calling next unless it refused it
+type Middleware func(next Handler) Handler
+
+func (c *Conn) ID() string {
+	return c.s.id
+}
+
+// Context is canceled when the connection is torn down
+func (c *Conn) Context() context.Context {
+	return c.s.ctx
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.s.RemoteAddr()
+}
+
+func (c *Conn) Logger() *slog.Logger {
+	return c.s.log
+}
+
+// Backend returns the address to dial, empty before the auth middleware
+// decrypted it
+func (c *Conn) Backend() string {
+	return c.backend
+}
+
+// SetBackend changes the address to dial
+func (c *Conn) SetBackend(addr string) {
+	c.backend = addr
+}
+
+// Bytes returns the number of bytes relayed from and to the client so far,
+// the totals of the tunnel once next returned
+func (c *Conn) Bytes() (up, down uint64) {
+	return c.s.up.Value(), c.s.down.Value()
+}
+
+// Refuse sends the error code to the client, the connection is closed once
+// the middleware returns
+func (c *Conn) Refuse(code string, err error) {
+	c.s.fail(err)
+	writeErrCode(c.s, []byte(code), c.header != nil || c.s.httpConnect)
+}
+
+// _DefaultMiddlewares is the chain without MIDDLEWARES
+const _DefaultMiddlewares = "acl,ban,hooks,auth,authz,quota,script,router,priority,maintenance"
+
+// _Middlewares are the built-in middlewares
+var _Middlewares = map[string]Middleware{
+	"acl":         aclMiddleware,
+	"ban":         banMiddleware,
+	"hooks":       hooksMiddleware,
+	"auth":        authMiddleware,
+	"authz":       authzMiddleware,
+	"quota":       quotaMiddleware,
+	"script":      scriptMiddleware,
+	"router":      routerMiddleware,
+	"priority":    priorityMiddleware,
+	"maintenance": maintenanceMiddleware,
+}
+
+var (
+	// _ServerMiddlewares is set by Server.Serve
+	_ServerMiddlewares atomic.Value // map[string]Middleware
+	_Chain             atomic.Value // Handler
+)
+
+func chain() Handler {
+	h, _ := _Chain.Load().(Handler)
+	if h == nil {
+		h, _ = buildChain(_DefaultMiddlewares)
+	}
+	return h
+}
+
+// buildChain returns the chain of the comma separated middleware names
+func buildChain(names string) (Handler, error) {
+	extra, _ := _ServerMiddlewares.Load().(map[string]Middleware)
+	var mws []Middleware
+	used := map[string]bool{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		mw := extra[name]
+		if mw == nil {
+			mw = _Middlewares[name]
+		}
+		if mw == nil {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		if used[name] {
+			return nil, fmt.Errorf("middleware %q listed twice", name)
+		}
+		used[name] = true
+		mws = append(mws, mw)
+	}
+	if !used["auth"] {
+		return nil, errors.New("the auth middleware is required")
+	}
+	var rest []string
+	for name := range extra {
+		if !used[name] {
+			rest = append(rest, name)
+		}
+	}
+	sort.Strings(rest)
+	for _, name := range rest {
+		mws = append(mws, extra[name])
+	}
+
+	h := relay
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h, nil
+}
+
+func checkMiddlewares(v string) error {
+	_, err := buildChain(v)
+	return err
+}
+
+// relay ends the chain, tunneling the connection to its backend
+func relay(c *Conn) {
+	if c.backend == "" {
+		c.Refuse("4111", errors.New("no backend"))
+		return
+	}
+	backend, err := c.h.dial(c)
+	if err != nil {
+		c.s.fail(err)
+		return
+	}
+	defer backend.Close()
+	err = c.h.relay(c, backend)
+	if err != nil {
+		c.s.fail(err)
+	}
+}
+
+func aclMiddleware(next Handler) Handler {
+	return func(c *Conn) {
+		if !clientAllowed(c.RemoteAddr()) {
+			c.Refuse("4100", errors.New("client address not allowed"))
+			return
+		}
+		next(c)
+	}
+}
+
+func banMiddleware(next Handler) Handler {
+	return func(c *Conn) {
+		if banned(c.RemoteAddr()) {
+			c.Refuse("4100", errors.New("client banned"))
+			return
+		}
+		next(c)
+	}
+}
+
+// hooksMiddleware runs OnAccept, the auth middleware runs OnAuth
+func hooksMiddleware(next Handler) Handler {
+	return func(c *Conn) {
+		if !runHook(c.s.ctx, c.s, hooks().OnAccept, "", "4100") {
+			return
+		}
+		next(c)
+	}
+}
+
+// authMiddleware runs the header and auth stages, reading the handshake and
+// decrypting the backend address
+func authMiddleware(next Handler) Handler {
+	return func(c *Conn) {
+		s := c.s
+		addr, sni, ok := c.h.readHeader(c)
+		if !ok {
+			return
+		}
+		if sni {
+			audit(s, auditAuthSuccess, c.backend)
+			s.event(_EventAuthenticated, c.backend)
+			next(c)
+			return
+		}
+		release, ok := c.h.authenticate(c, addr)
+		if !ok {
+			return
+		}
+		defer release()
+		next(c)
+	}
+}
+
+func scriptMiddleware(next Handler) Handler {
+	return func(c *Conn) {
+		if rs := routingScript(); rs != nil && c.backend != "" {
+			routed, err := rs.route(c.s, c.backend)
+			if err != nil {
+				c.Refuse("4111", err)
+				return
+			}
+			c.backend = routed
+		}
+		next(c)
+	}
+}
+
+func routerMiddleware(next Handler) Handler {
+	return func(c *Conn) {
+		if r := router(); r != nil && c.backend != "" {
+			routed, err := r.Route(c.backend)
+			if err != nil {
+				c.Refuse("4111", err)
+				return
+			}
+			c.backend = routed
+		}
+		next(c)
+	}
+}
+
+func maintenanceMiddleware(next Handler) Handler {
+	return func(c *Conn) {
+		if maintenance() {
+			c.Refuse("4110", errors.New("refused for maintenance"))
+			return
+		}
+		next(c)
+	}
+}
@@ -0,0 +1,284 @@
+package frontd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// A minimal reader of MaxMind DB files, enough to look up GeoIP2 and
+// GeoLite2 country and ASN databases, see
+// https://maxmind.github.io/MaxMind-DB/
+
+var _MMDBMetadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbDataSeparator is the gap between the search tree and the data section
+const mmdbDataSeparator = 16
+
+type mmdb struct {
+	buf        []byte
+	data       []byte // data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dbType     string
+	ipv4Start  uint // node of ::/96 in an IPv6 tree
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseMMDB(b)
+}
+
+func parseMMDB(b []byte) (*mmdb, error) {
+	i := bytes.LastIndex(b, _MMDBMetadataStart)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	d := &mmdbDecoder{buf: b[i+len(_MMDBMetadataStart):]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+
+	db := &mmdb{buf: b}
+	db.nodeCount = uint(mmdbUint(meta["node_count"]))
+	db.recordSize = uint(mmdbUint(meta["record_size"]))
+	db.ipVersion = uint(mmdbUint(meta["ip_version"]))
+	db.dbType, _ = meta["database_type"].(string)
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+mmdbDataSeparator > uint(i) {
+		return nil, errors.New("invalid search tree size")
+	}
+	db.data = b[treeSize+mmdbDataSeparator : i]
+
+	if db.ipVersion == 6 {
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node
+func (db *mmdb) record(node, bit uint) uint {
+	b := db.buf[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// lookup returns the record of ip or nil if there is none
+func (db *mmdb) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errors.New("invalid search tree")
+	}
+	d := &mmdbDecoder{buf: db.data}
+	v, _, err := d.decode(node - db.nodeCount - mmdbDataSeparator)
+	return v, err
+}
+
+type mmdbDecoder struct {
+	buf   []byte
+	depth int
+}
+
+// decode returns the value at offset and the offset following it
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > 64 {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+
+	ctrl, offset, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	typ := uint(ctrl[0] >> 5)
+	if typ == 1 {
+		// pointer into the data section, the value isn't inlined
+		ptr, next, err := d.pointer(ctrl[0], offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(ptr)
+		return v, next, err
+	}
+	if typ == 0 {
+		ext, next, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ, offset = 7+uint(ext[0]), next
+	}
+
+	size := uint(ctrl[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, next, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset = next
+		v := uint(0)
+		for _, c := range b {
+			v = v<<8 | uint(c)
+		}
+		size = []uint{29, 285, 65821}[n-1] + v
+	}
+
+	switch typ {
+	case 2: // string
+		b, next, err := d.bytes(offset, size)
+		return string(b), next, err
+	case 3: // double
+		b, next, err := d.bytes(offset, 8)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case 4: // bytes
+		b, next, err := d.bytes(offset, size)
+		return b, next, err
+	case 5, 6, 9, 10: // unsigned integers, uint128 is truncated
+		b, next, err := d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, next, nil
+	case 8: // int32
+		b, next, err := d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		v := uint32(0)
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), next, nil
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[key], offset, err = d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean
+		return size != 0, offset, nil
+	case 15: // float
+		b, next, err := d.bytes(offset, 4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint) (ptr, next uint, err error) {
+	ss := uint(ctrl>>3) & 3
+	b, next, err := d.bytes(offset, ss+1)
+	if err != nil {
+		return 0, 0, err
+	}
+	v := uint(0)
+	if ss < 3 {
+		v = uint(ctrl & 7)
+	}
+	for _, c := range b {
+		v = v<<8 | uint(c)
+	}
+	return v + []uint{0, 2048, 526336, 0}[ss], next, nil
+}
+
+func (d *mmdbDecoder) bytes(offset, n uint) ([]byte, uint, error) {
+	if offset+n > uint(len(d.buf)) || offset+n < offset {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	return d.buf[offset : offset+n], offset + n, nil
+}
+
+// mmdbUint returns v if it's an unsigned integer, otherwise 0
+func mmdbUint(v interface{}) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
+
+// mmdbPath follows keys through nested maps of v
+func mmdbPath(v interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
@@ -0,0 +1,110 @@
+package frontd
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With MUX_HTTP set, the listener also answers plain HTTP requests for
+// /metrics and /healthz, for deployments exposing a single port. The first
+// bytes of every connection are sniffed, like cmux does, before the
+// transport and the handshake: requests for these paths are served by an
+// HTTP server, all else is handled as usual with the sniffed bytes replayed.
+// The admin API is never served this way, it must not be exposed publicly.
+
+var (
+	_MuxHTTP int32
+
+	// _MuxRequests are the request lines served, followed by a space or ?
+	_MuxRequests = []string{"GET /metrics", "GET /healthz", "HEAD /metrics", "HEAD /healthz"}
+
+	_MuxListener = &chanListener{conns: make(chan net.Conn)}
+	_MuxServe    sync.Once
+
+	_MetricMuxedHTTP = newCounter("frontd_muxed_http_connections_total",
+		"Total number of connections to the listener served as HTTP by MUX_HTTP.")
+)
+
+func muxHTTP() bool {
+	return atomic.LoadInt32(&_MuxHTTP) != 0
+}
+
+// muxConn replays the sniffed bytes
+type muxConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *muxConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *muxConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// sniffHTTP reads as much of c as tells whether it requests a path served by
+// MUX_HTTP, within the read timeout of the handshake. It hands c over to the
+// HTTP server and returns nil if so, or else c replaying what was read.
+// Failing reads are left for the handshake to fail on again.
+func sniffHTTP(c net.Conn) net.Conn {
+	if rt := connReadTimeout(); rt > 0 {
+		c.SetReadDeadline(time.Now().Add(rt))
+	}
+	r := bufio.NewReader(c)
+	mc := &muxConn{Conn: c, r: r}
+	served := false
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			break
+		}
+		matching := false
+		for _, req := range _MuxRequests {
+			if n <= len(req) {
+				matching = matching || req[:n] == string(b)
+			} else if string(b[:len(req)]) == req {
+				served = b[len(req)] == ' ' || b[len(req)] == '?'
+				break
+			}
+		}
+		if served || !matching {
+			break
+		}
+	}
+	c.SetReadDeadline(time.Time{})
+	if !served {
+		return mc
+	}
+
+	_MetricMuxedHTTP.Inc()
+	_MuxServe.Do(func() {
+		go func() {
+			err := http.Serve(_MuxListener, metricsMux())
+			logger().Error("muxed http server stopped", "err", err)
+		}()
+	})
+	_MuxListener.conns <- mc
+	return nil
+}
+
+// chanListener accepts the connections sent to it, it is never closed
+type chanListener struct {
+	conns chan net.Conn
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func (l *chanListener) Close() error {
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "mux", Net: "mux"}
+}
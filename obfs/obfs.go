@@ -0,0 +1,161 @@
+// Package obfs scrambles connections so the protocol they carry doesn't
+// stand out to DPI. Each side first sends a random nonce, then frames of a
+// length, a padding length, random padding and the data, encrypted with
+// AES-CTR under a key derived from the shared secret and the nonce. The
+// stream looks uniformly random and its lengths don't follow the writes.
+// It hides the protocol but authenticates nothing.
+package obfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	mrand "math/rand"
+	"net"
+	"sync"
+)
+
+// DefaultPadding is the padding of frontd unless configured otherwise
+const DefaultPadding = 256
+
+const (
+	nonceSize  = 16
+	maxFrame   = 16 * 1024
+	headerSize = 4 // data and padding length
+)
+
+// Key derives the key of the obfuscation from the shared secret
+func Key(secret []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("frontd obfuscation\x00"))
+	h.Write(secret)
+	return h.Sum(nil)
+}
+
+// Conn scrambles a connection, reads must not be concurrent
+type Conn struct {
+	net.Conn
+	key     []byte
+	padding int
+
+	// reading
+	rnonce [nonceSize]byte
+	rn     int // bytes of rnonce read
+	rs     cipher.Stream
+	hdr    [headerSize]byte
+	hn     int // bytes of hdr read
+	rdata  int // left in the frame
+	rpad   int
+	skip   []byte
+
+	wmu sync.Mutex
+	ws  cipher.Stream
+}
+
+// NewConn scrambles c with key, padding frames with up to padding random
+// bytes
+func NewConn(c net.Conn, key []byte, padding int) *Conn {
+	return &Conn{Conn: c, key: key, padding: padding}
+}
+
+// NetConn returns the scrambled connection
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) stream(nonce []byte) cipher.Stream {
+	block, _ := aes.NewCipher(c.key)
+	return cipher.NewCTR(block, nonce)
+}
+
+// Read returns the data of frames, it keeps its state across errors so
+// reads timing out mid-frame resume where they stopped
+func (c *Conn) Read(p []byte) (int, error) {
+	for c.rdata == 0 || c.rpad > 0 {
+		switch {
+		case c.rs == nil:
+			n, err := c.Conn.Read(c.rnonce[c.rn:])
+			c.rn += n
+			if c.rn == len(c.rnonce) {
+				c.rs = c.stream(c.rnonce[:])
+			} else if err != nil {
+				return 0, err
+			}
+		case c.rpad > 0:
+			if c.skip == nil {
+				c.skip = make([]byte, 512)
+			}
+			buf := c.skip
+			if c.rpad < len(buf) {
+				buf = buf[:c.rpad]
+			}
+			n, err := c.Conn.Read(buf)
+			c.rs.XORKeyStream(buf[:n], buf[:n])
+			c.rpad -= n
+			if err != nil {
+				return 0, err
+			}
+		default:
+			n, err := c.Conn.Read(c.hdr[c.hn:])
+			c.rs.XORKeyStream(c.hdr[c.hn:c.hn+n], c.hdr[c.hn:c.hn+n])
+			c.hn += n
+			if c.hn == len(c.hdr) {
+				c.hn = 0
+				c.rdata = int(binary.BigEndian.Uint16(c.hdr[0:]))
+				c.rpad = int(binary.BigEndian.Uint16(c.hdr[2:]))
+			} else if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(p) > c.rdata {
+		p = p[:c.rdata]
+	}
+	n, err := c.Conn.Read(p)
+	c.rs.XORKeyStream(p[:n], p[:n])
+	c.rdata -= n
+	return n, err
+}
+
+// Write sends p in frames of random padding, with a single write so
+// concurrent writes don't interleave
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var out []byte
+	if c.ws == nil {
+		nonce := make([]byte, nonceSize)
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return 0, err
+		}
+		c.ws = c.stream(nonce)
+		out = nonce
+	}
+	for rest := p; len(rest) > 0; {
+		data := rest
+		if len(data) > maxFrame {
+			data = data[:maxFrame]
+		}
+		rest = rest[len(data):]
+		pad := 0
+		if c.padding > 0 {
+			pad = mrand.Intn(c.padding + 1)
+		}
+		start := len(out)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(data)))
+		out = binary.BigEndian.AppendUint16(out, uint16(pad))
+		// padding first so reading the data ends the frame
+		out = append(out, make([]byte, pad)...)
+		out = append(out, data...)
+		c.ws.XORKeyStream(out[start:], out[start:])
+	}
+	_, err := c.Conn.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
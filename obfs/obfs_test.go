@@ -0,0 +1,86 @@
+package obfs
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// recorder records what is written to it
+type recorder struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	return r.buf.Write(p)
+}
+
+func TestConn(t *testing.T) {
+	key := Key([]byte("p0S8rX680*48"))
+	msgs := [][]byte{[]byte("4106"), bytes.Repeat([]byte("plain text "), 2000), {}, []byte("end")}
+
+	rec := &recorder{}
+	w := NewConn(rec, key, 64)
+	var plain []byte
+	for _, m := range msgs {
+		n, err := w.Write(m)
+		if err != nil || n != len(m) {
+			t.Fatal("not written:", n, err)
+		}
+		plain = append(plain, m...)
+	}
+	wire := rec.buf.Bytes()
+	if bytes.Contains(wire, []byte("plain text")) || bytes.Contains(wire, []byte("4106")) {
+		t.Fatal("not scrambled")
+	}
+	if len(wire) <= len(plain)+nonceSize {
+		t.Fatal("frames not framed:", len(wire))
+	}
+
+	// fed in pieces with reads timing out in between, e.g. under the read
+	// deadlines of the relay, bytes at a time across the nonce and headers
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		for i := 0; i < len(wire); {
+			n := 1000
+			if i < 100 || i > len(wire)-100 {
+				n = 1
+			}
+			n = min(n, len(wire)-i)
+			a.Write(wire[i : i+n])
+			i += n
+			time.Sleep(time.Microsecond * 50)
+		}
+		a.Close()
+	}()
+	r := NewConn(b, key, 0)
+	var got []byte
+	buf := make([]byte, 100)
+	for {
+		b.SetReadDeadline(time.Now().Add(time.Microsecond * 20))
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("not unscrambled:", len(got), len(plain))
+	}
+
+	// the nonce makes every connection differ
+	rec2 := &recorder{}
+	NewConn(rec2, key, 0).Write(msgs[0])
+	rec3 := &recorder{}
+	NewConn(rec3, key, 0).Write(msgs[0])
+	if bytes.Equal(rec2.buf.Bytes()[nonceSize:], rec3.buf.Bytes()[nonceSize:]) {
+		t.Fatal("same stream for different nonces")
+	}
+}
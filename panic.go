@@ -0,0 +1,81 @@
+package frontd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// _PanicHistory is how many recovered panics are kept for /debug/panics
+const _PanicHistory = 32
+
+// panicRecord is a recovered panic as listed by the admin API
+type panicRecord struct {
+	Time   time.Time `json:"time"`
+	ConnID string    `json:"conn_id,omitempty"`
+	Panic  string    `json:"panic"`
+	Stack  string    `json:"stack"`
+}
+
+var (
+	_PanicsMutex sync.Mutex
+	_Panics      []panicRecord // ring buffer, _PanicNext is the oldest once full
+	_PanicNext   int
+	_PanicTimes  []time.Time // of panics within the last minute
+
+	// _MaxPanicsPerMinute makes frontd exit once exceeded, 0 never exits
+	_MaxPanicsPerMinute int64
+)
+
+var _MetricPanics = newCounter("frontd_panics_total",
+	"Total number of recovered panics.")
+
+// recoveredPanic logs and records the panic v recovered while handling the
+// connection connID, if known. It exits the process when panics are more
+// frequent than MAX_PANICS_PER_MINUTE, as state may be corrupted.
+func recoveredPanic(lg *slog.Logger, connID string, v interface{}) {
+	stack := string(debug.Stack())
+	lg.Error("recovered from panic", "panic", fmt.Sprint(v), "stack", stack)
+	_MetricPanics.Inc()
+
+	now := time.Now()
+	_PanicsMutex.Lock()
+	rec := panicRecord{Time: now, ConnID: connID, Panic: fmt.Sprint(v), Stack: stack}
+	if len(_Panics) < _PanicHistory {
+		_Panics = append(_Panics, rec)
+	} else {
+		_Panics[_PanicNext] = rec
+		_PanicNext = (_PanicNext + 1) % _PanicHistory
+	}
+	i := 0
+	for i < len(_PanicTimes) && now.Sub(_PanicTimes[i]) >= time.Minute {
+		i++
+	}
+	_PanicTimes = append(_PanicTimes[i:], now)
+	n := len(_PanicTimes)
+	_PanicsMutex.Unlock()
+
+	max := atomic.LoadInt64(&_MaxPanicsPerMinute)
+	if max > 0 && int64(n) > max {
+		logger().Error("too many panics, exiting", "panics", n, "max_panics_per_minute", max)
+		os.Exit(2)
+	}
+}
+
+// recentPanics returns the recorded panics, oldest first
+func recentPanics() []panicRecord {
+	_PanicsMutex.Lock()
+	defer _PanicsMutex.Unlock()
+	return append(append([]panicRecord{}, _Panics[_PanicNext:]...), _Panics[:_PanicNext]...)
+}
+
+func panicsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recentPanics())
+}
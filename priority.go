@@ -0,0 +1,224 @@
+package frontd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tunnels have a priority class, high, normal or low, set by the priority
+// claim of their token or else by the first rule of PRIORITY_BACKENDS
+// matching their backend, normal by default. Under pressure the lower
+// classes give way first: PRIORITY_SHED_CONNS, e.g. low=800,normal=950,
+// refuses new tunnels of a class with 4115 beyond that many client
+// connections, and PRIORITY_THROTTLE_BANDWIDTH, e.g. low=50MB,normal=80MB,
+// relays the tunnels of a class at PRIORITY_THROTTLE_RATE bytes per second
+// each way while frontd relays that many bytes per second or more. High
+// priority tunnels are neither shed nor throttled.
+
+const (
+	_PriorityHigh   = "high"
+	_PriorityNormal = "normal"
+	_PriorityLow    = "low"
+)
+
+var _PriorityClasses = map[string]bool{_PriorityHigh: true, _PriorityNormal: true, _PriorityLow: true}
+
+var (
+	_PriorityRules        atomic.Value // []priorityRule
+	_PriorityShedConns    atomic.Value // map[string]int64, connections by class
+	_PriorityBandwidth    atomic.Value // map[string]int64, bytes per second by class
+	_PriorityThrottleRate int64        = 64 * 1024
+
+	_RelayRate = &relayRate{}
+
+	errPriorityShed = errors.New("shed for higher priority tunnels")
+
+	_MetricPriorityShed = newCounterVec("frontd_priority_shed_total",
+		"Total number of tunnels refused under connection pressure, by priority class.", "class")
+	_MetricPriorityThrottled = newCounterVec("frontd_priority_throttled_total",
+		"Total number of times tunnels were throttled under bandwidth pressure, by priority class.", "class")
+	_ = newGaugeFunc("frontd_relayed_bytes_per_second",
+		"Number of bytes relayed per second both ways, as last sampled for PRIORITY_THROTTLE_BANDWIDTH.", func() float64 {
+			return float64(atomic.LoadInt64(&_RelayRate.rate))
+		})
+)
+
+func priorityThrottleRate() int64 {
+	return atomic.LoadInt64(&_PriorityThrottleRate)
+}
+
+// priorityRule sets the class of tunnels to backends matching an address, a
+// host or a network
+type priorityRule struct {
+	addr  string // host:port or host
+	ipnet *net.IPNet
+	class string
+}
+
+// parsePriorityRules parses a comma separated list of backend=class, where
+// backend is a host:port, a host or a network in CIDR notation
+func parsePriorityRules(v string) ([]priorityRule, error) {
+	var rules []priorityRule
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.LastIndexByte(item, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("expected backend=class, got %q", item)
+		}
+		r := priorityRule{addr: item[:eq], class: item[eq+1:]}
+		if !_PriorityClasses[r.class] {
+			return nil, fmt.Errorf("invalid priority class %q, must be high, normal or low", r.class)
+		}
+		if strings.Contains(r.addr, "/") {
+			var err error
+			_, r.ipnet, err = net.ParseCIDR(r.addr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func checkPriorityRules(v string) error {
+	_, err := parsePriorityRules(v)
+	return err
+}
+
+// parsePriorityLimits parses a comma separated list of class=limit of the
+// normal and low classes, limits being connections or, if bytes, bytes per
+// second with an optional unit
+func parsePriorityLimits(v string, bytes bool) (map[string]int64, error) {
+	limits := map[string]int64{}
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		class, limit, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected class=limit, got %q", item)
+		}
+		if class != _PriorityNormal && class != _PriorityLow {
+			return nil, fmt.Errorf("invalid priority class %q, must be normal or low", class)
+		}
+		var n uint64
+		if bytes {
+			n, ok = parseSize(limit)
+		} else {
+			var err error
+			n, err = strconv.ParseUint(limit, 10, 31)
+			ok = err == nil && n > 0
+		}
+		if !ok || n > 1<<62 {
+			return nil, fmt.Errorf("invalid limit in %q", item)
+		}
+		limits[class] = int64(n)
+	}
+	return limits, nil
+}
+
+func checkPriorityConns(v string) error {
+	_, err := parsePriorityLimits(v, false)
+	return err
+}
+
+func checkPriorityBandwidth(v string) error {
+	_, err := parsePriorityLimits(v, true)
+	return err
+}
+
+// priorityFor returns the class of tunnels to the backend addr
+func priorityFor(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	rules, _ := _PriorityRules.Load().([]priorityRule)
+	for _, r := range rules {
+		switch {
+		case r.ipnet != nil:
+			if ip != nil && r.ipnet.Contains(ip) {
+				return r.class
+			}
+		case r.addr == addr || r.addr == host:
+			return r.class
+		}
+	}
+	return _PriorityNormal
+}
+
+func priorityShedConns() map[string]int64 {
+	limits, _ := _PriorityShedConns.Load().(map[string]int64)
+	return limits
+}
+
+func priorityBandwidth() map[string]int64 {
+	limits, _ := _PriorityBandwidth.Load().(map[string]int64)
+	return limits
+}
+
+// relayRate samples the bytes relayed per second both ways at most once a
+// second, when the throttled tunnels ask for it
+type relayRate struct {
+	mu    sync.Mutex
+	at    time.Time
+	bytes uint64
+	rate  int64 // of the last sample
+	next  int64 // unix nanoseconds of the next sample
+}
+
+func (r *relayRate) get(now time.Time) int64 {
+	if now.UnixNano() >= atomic.LoadInt64(&r.next) && r.mu.TryLock() {
+		total := _MetricUpstreamBytes.Value() + _MetricDownstreamBytes.Value()
+		if elapsed := now.Sub(r.at).Seconds(); !r.at.IsZero() && elapsed > 0 {
+			atomic.StoreInt64(&r.rate, int64(float64(total-r.bytes)/elapsed))
+		}
+		r.at, r.bytes = now, total
+		atomic.StoreInt64(&r.next, now.Add(time.Second).UnixNano())
+		r.mu.Unlock()
+	}
+	return atomic.LoadInt64(&r.rate)
+}
+
+// priorityThrottle returns the rate a tunnel of class is relayed at, 0 if
+// not under pressure. throttled tracks whether the tunnel already was.
+func priorityThrottle(class string, throttled *atomic.Bool) int64 {
+	limit, ok := priorityBandwidth()[class]
+	if !ok || _RelayRate.get(time.Now()) < limit {
+		throttled.Store(false)
+		return 0
+	}
+	if throttled.CompareAndSwap(false, true) {
+		_MetricPriorityThrottled.With(class).Inc()
+	}
+	return priorityThrottleRate()
+}
+
+// priorityMiddleware sets the class of the tunnel and sheds it if there
+// are too many connections for its class
+func priorityMiddleware(next Handler) Handler {
+	return func(c *Conn) {
+		s := c.s
+		if s.priority == "" {
+			s.priority = priorityFor(c.backend)
+		}
+		if limit, ok := priorityShedConns()[s.priority]; ok && _MetricConnActive.Value() > limit {
+			_MetricPriorityShed.With(s.priority).Inc()
+			c.Refuse("4115", errPriorityShed)
+			return
+		}
+		next(c)
+	}
+}
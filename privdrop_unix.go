@@ -0,0 +1,87 @@
+//go:build !windows
+
+package frontd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges chroots to dir, if not empty, and switches to the user and
+// group, so listeners on privileged ports can be bound as root at start.
+// group defaults to the primary group of the user.
+func dropPrivileges(username, group, dir string) error {
+	// the user database is not available once chrooted
+	uid, gid, err := lookupPrivileges(username, group, dir)
+	if err != nil {
+		return err
+	}
+
+	if dir != "" {
+		err := syscall.Chroot(dir)
+		if err != nil {
+			return fmt.Errorf("chroot: %v", err)
+		}
+		err = os.Chdir("/")
+		if err != nil {
+			return err
+		}
+	}
+
+	if gid >= 0 {
+		err := syscall.Setgroups([]int{gid})
+		if err != nil {
+			return fmt.Errorf("setgroups: %v", err)
+		}
+		err = syscall.Setgid(gid)
+		if err != nil {
+			return fmt.Errorf("setgid: %v", err)
+		}
+	}
+	if uid >= 0 {
+		err := syscall.Setuid(uid)
+		if err != nil {
+			return fmt.Errorf("setuid: %v", err)
+		}
+		// make sure root can't be regained
+		if uid != 0 && syscall.Setuid(0) == nil {
+			return errors.New("privileges not dropped")
+		}
+	}
+	return nil
+}
+
+// lookupPrivileges returns the ids of the user and group, -1 if not set, and
+// checks dir is a directory
+func lookupPrivileges(username, group, dir string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return -1, -1, err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return -1, -1, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if dir != "" {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return -1, -1, fmt.Errorf("chroot: %v", err)
+		}
+		if !fi.IsDir() {
+			return -1, -1, fmt.Errorf("chroot: %s is not a directory", dir)
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,10 @@
+package frontd
+
+import "errors"
+
+func dropPrivileges(username, group, dir string) error {
+	if username == "" && group == "" && dir == "" {
+		return nil
+	}
+	return errors.New("dropping privileges is not supported on Windows")
+}
@@ -0,0 +1,47 @@
+package frontd
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// capability bit of CAP_NET_BIND_SERVICE, see capabilities(7)
+const _CapNetBindService = 10
+
+// hasNetBindService reports whether the process may bind ports below 1024
+// without being root. ok is false if it can't be determined, e.g. not on
+// Linux.
+func hasNetBindService() (has, ok bool) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(line[len("CapEff:"):]), 16, 64)
+		if err != nil {
+			return false, false
+		}
+		return caps&(1<<_CapNetBindService) != 0, true
+	}
+	return false, false
+}
+
+// privilegedPortHint explains the ways to listen on a privileged port
+func privilegedPortHint() string {
+	hint := "ports below 1024 require root (see RUN_AS_USER), the CAP_NET_BIND_SERVICE capability " +
+		"(setcap cap_net_bind_service=+ep frontd, or AmbientCapabilities= with systemd), " +
+		"systemd socket activation, or lowering net.ipv4.ip_unprivileged_port_start"
+	if has, ok := hasNetBindService(); ok && !has {
+		hint = "CAP_NET_BIND_SERVICE is missing, " + hint
+	}
+	return hint
+}
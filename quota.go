@@ -0,0 +1,481 @@
+package frontd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QUOTAS limits the usage of tokens and tenants with a comma separated list
+// of scope=limit:action rules. The scope is token or tenant, each of them
+// limited alike, or token:<hash> and tenant:<name> for a single one. The
+// limit is either bytes per UTC day, e.g. 10GB/day, evaluated against the
+// usage accounted in USAGE_FILE and the live tunnels, or connections per
+// hour, e.g. 100conns/hour, counted in memory as they are made, or
+// concurrent tunnels, e.g. 20sessions, so a leaked token can't be used by a
+// botnet to open thousands at once. On breach the action warn (default) logs
+// it, throttle relays the tunnel at QUOTA_THROTTLE_RATE bytes per second each
+// way and reject refuses it with 4114. The quota middleware evaluates them
+// once the token is known, byte quotas are evaluated again every second while
+// the tunnel relays, throttling it or closing it for reject.
+
+const (
+	_QuotaWarn     = "warn"
+	_QuotaThrottle = "throttle"
+	_QuotaReject   = "reject"
+)
+
+// _QuotaActions ranks the actions, the most severe of the rules breached
+// is taken
+var _QuotaActions = map[string]int{_QuotaWarn: 1, _QuotaThrottle: 2, _QuotaReject: 3}
+
+var _SizeUnits = []struct {
+	suffix string
+	n      uint64
+}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+var (
+	_Quotas            atomic.Value // []quotaRule
+	_QuotaThrottleRate int64        = 64 * 1024
+
+	_QuotaConns    = &hourlyConns{}
+	_QuotaSessions = &liveSessions{}
+	_LiveBytes     = &liveBytes{}
+
+	errQuotaExceeded = errors.New("quota exceeded")
+
+	_MetricQuotaBreaches = newCounterVec("frontd_quota_breaches_total",
+		"Total number of connections breaching a quota, by the action taken.", "action")
+)
+
+func quotaThrottleRate() int64 {
+	return atomic.LoadInt64(&_QuotaThrottleRate)
+}
+
+type quotaRule struct {
+	rule     string // as configured
+	kind     string // token or tenant
+	key      string // empty for every token or tenant
+	bytes    uint64 // per day, 0 if connections or sessions are limited
+	conns    uint64 // per hour
+	sessions uint64 // concurrent
+	action   string
+}
+
+func parseQuotas(v string) ([]quotaRule, error) {
+	var rules []quotaRule
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		scope, limit, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected scope=limit[:action], got %q", item)
+		}
+		r := quotaRule{rule: item, action: _QuotaWarn}
+		r.kind, r.key, _ = strings.Cut(scope, ":")
+		if r.kind != "token" && r.kind != "tenant" {
+			return nil, fmt.Errorf("invalid quota scope %q, must be token or tenant", scope)
+		}
+		limit, action, ok := strings.Cut(limit, ":")
+		if ok {
+			if _QuotaActions[action] == 0 {
+				return nil, fmt.Errorf("invalid quota action %q, must be warn, throttle or reject", action)
+			}
+			r.action = action
+		}
+		r.bytes, r.conns, r.sessions, ok = parseQuotaLimit(limit)
+		if !ok {
+			return nil, fmt.Errorf("invalid quota limit in %q, must be like 10GB/day, 100conns/hour or 20sessions", item)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseQuotaLimit parses bytes per day, connections per hour or concurrent
+// sessions
+func parseQuotaLimit(v string) (bytes, conns, sessions uint64, ok bool) {
+	if n, ok := strings.CutSuffix(v, "conns/hour"); ok {
+		conns, err := strconv.ParseUint(n, 10, 64)
+		return 0, conns, 0, err == nil && conns > 0
+	}
+	if n, ok := strings.CutSuffix(v, "sessions"); ok {
+		sessions, err := strconv.ParseUint(n, 10, 64)
+		return 0, 0, sessions, err == nil && sessions > 0
+	}
+	n, ok := strings.CutSuffix(v, "/day")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	if !strings.HasSuffix(n, "B") {
+		return 0, 0, 0, false
+	}
+	bytes, ok = parseSize(n)
+	return bytes, 0, 0, ok
+}
+
+// parseSize parses a positive number of bytes with an optional unit, e.g.
+// 10GB
+func parseSize(v string) (uint64, bool) {
+	for _, u := range _SizeUnits {
+		if s, ok := strings.CutSuffix(v, u.suffix); ok {
+			n, err := strconv.ParseUint(s, 10, 64)
+			return n * u.n, err == nil && n > 0 && n <= 1<<63/u.n
+		}
+	}
+	n, err := strconv.ParseUint(v, 10, 63)
+	return n, err == nil && n > 0
+}
+
+func checkQuotas(v string) error {
+	_, err := parseQuotas(v)
+	return err
+}
+
+func quotas() []quotaRule {
+	rules, _ := _Quotas.Load().([]quotaRule)
+	return rules
+}
+
+// hourlyConns counts the connections of every token and tenant of the
+// current hour. Keys beyond _MaxUsageEntries share the count of
+// _QuotaOverflow, so they're limited together rather than not at all.
+type hourlyConns struct {
+	mu   sync.Mutex
+	hour int64
+	n    map[string]uint64
+}
+
+const _QuotaOverflow = "overflow"
+
+// add counts a connection of key and returns those of the hour
+func (h *hourlyConns) add(key string, now time.Time) uint64 {
+	hour := now.Unix() / 3600
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hour != h.hour || h.n == nil {
+		h.hour = hour
+		h.n = make(map[string]uint64)
+	}
+	n, ok := h.n[key]
+	if !ok && len(h.n) >= _MaxUsageEntries {
+		key = _QuotaOverflow
+		n = h.n[key]
+	}
+	n++
+	h.n[key] = n
+	return n
+}
+
+// liveSessions counts the tunnels of every token and tenant being handled
+type liveSessions struct {
+	mu sync.Mutex
+	n  map[string]uint64
+}
+
+// acquire counts a session of key and returns those of key
+func (l *liveSessions) acquire(key string) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n == nil {
+		l.n = make(map[string]uint64)
+	}
+	l.n[key]++
+	return l.n[key]
+}
+
+// release uncounts a session of key acquired before
+func (l *liveSessions) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n[key] <= 1 {
+		delete(l.n, key)
+		return
+	}
+	l.n[key]--
+}
+
+// today returns the bytes of key of the current UTC day, by token or tenant
+func (st *usageStore) today(kind, key string) uint64 {
+	day := time.Now().UTC().Format(_UsageDayLayout)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	d, ok := st.days[day]
+	if !ok {
+		return 0
+	}
+	u, ok := d.by(kind)[key]
+	if !ok {
+		return 0
+	}
+	return u.BytesUp + u.BytesDown
+}
+
+// liveBytes counts the bytes relayed by the live tunnels of every token and
+// tenant, which are accounted in the usage once they end. The tunnels add to
+// the counters of their keys as they relay.
+type liveBytes struct {
+	mu sync.Mutex
+	n  map[string]*liveCount
+}
+
+// liveCount is the bytes of the live tunnels of a key
+type liveCount struct {
+	counter
+	key      string
+	sessions int
+}
+
+// acquire returns the counter of key for a session to add its bytes to
+func (l *liveBytes) acquire(key string) *liveCount {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n == nil {
+		l.n = make(map[string]*liveCount)
+	}
+	c, ok := l.n[key]
+	if !ok {
+		c = &liveCount{key: key}
+		l.n[key] = c
+	}
+	c.sessions++
+	return c
+}
+
+// release takes the n bytes a session added off c acquired before
+func (l *liveBytes) release(c *liveCount, n uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c.sessions--
+	if c.sessions <= 0 {
+		delete(l.n, c.key)
+		return
+	}
+	if n > 0 {
+		atomic.AddUint64(&c.v, ^(n - 1))
+	}
+}
+
+// releaseLiveBytes takes the bytes of s off the live counters once they're
+// accounted in the usage
+func releaseLiveBytes(s *session) {
+	n := s.up.Value() + s.down.Value()
+	for _, c := range s.live {
+		_LiveBytes.release(c, n)
+	}
+}
+
+// evalQuotas returns the most severe action of the rules s breaches, empty
+// if none, and the sessions it acquired to release once s ends
+func evalQuotas(s *session, rules []quotaRule) (action string, acquired []string) {
+	keys := map[string]string{"token": s.token, "tenant": s.tenant}
+	now := time.Now()
+	conns := map[string]uint64{}
+	sessions := map[string]uint64{}
+	live := map[string]*liveCount{}
+	for _, r := range rules {
+		key := keys[r.kind]
+		if key == "" || (r.key != "" && r.key != key) {
+			continue
+		}
+		var used, limit uint64
+		if r.conns > 0 {
+			n, ok := conns[r.kind]
+			if !ok {
+				n = _QuotaConns.add(r.kind+":"+key, now)
+				conns[r.kind] = n
+			}
+			// this connection is the one over the limit
+			used, limit = n, r.conns+1
+		} else if r.sessions > 0 {
+			n, ok := sessions[r.kind]
+			if !ok {
+				n = _QuotaSessions.acquire(r.kind + ":" + key)
+				sessions[r.kind] = n
+				acquired = append(acquired, r.kind+":"+key)
+			}
+			used, limit = n, r.sessions+1
+		} else {
+			c, ok := live[r.kind]
+			if !ok {
+				c = _LiveBytes.acquire(r.kind + ":" + key)
+				live[r.kind] = c
+				s.live = append(s.live, c)
+			}
+			used, limit = _Usage.today(r.kind, key)+c.Value(), r.bytes
+		}
+		if used < limit {
+			continue
+		}
+		_MetricQuotaBreaches.With(r.action).Inc()
+		s.log.Warn("quota exceeded", "quota", r.rule, r.kind, key, "usage", used, "action", r.action)
+		if _QuotaActions[r.action] > _QuotaActions[action] {
+			action = r.action
+		}
+	}
+	return action, acquired
+}
+
+func quotaMiddleware(next Handler) Handler {
+	return func(c *Conn) {
+		rules := quotas()
+		if len(rules) > 0 && c.s.token != "" {
+			action, acquired := evalQuotas(c.s, rules)
+			for _, key := range acquired {
+				defer _QuotaSessions.release(key)
+			}
+			switch action {
+			case _QuotaReject:
+				c.Refuse("4114", errQuotaExceeded)
+				return
+			case _QuotaThrottle:
+				c.s.throttle = quotaThrottleRate()
+			}
+			c.s.quota = newByteQuotas(c.s, rules)
+		}
+		next(c)
+	}
+}
+
+// _QuotaRecheckInterval is how often the byte quotas of a relaying tunnel
+// are evaluated again
+const _QuotaRecheckInterval = time.Second
+
+// byteQuotas evaluates the byte quotas of a tunnel again while it relays, so
+// a long-lived one is throttled or closed once its token or tenant ran over
+// rather than only the tunnels started later
+type byteQuotas struct {
+	s        *session
+	rules    []quotaRule  // the byte quotas of the token and tenant of s
+	live     []*liveCount // of each rule
+	mu       sync.Mutex
+	next     time.Time // of the next evaluation
+	breached []bool    // by rule
+	throttle bool
+}
+
+// newByteQuotas returns the byte quotas of the rules s is subject to, nil if
+// none. Those breached already were handled by evalQuotas.
+func newByteQuotas(s *session, rules []quotaRule) *byteQuotas {
+	keys := map[string]string{"token": s.token, "tenant": s.tenant}
+	q := &byteQuotas{s: s, next: time.Now().Add(_QuotaRecheckInterval)}
+	for _, r := range rules {
+		key := keys[r.kind]
+		if r.bytes == 0 || key == "" || (r.key != "" && r.key != key) {
+			continue
+		}
+		var live *liveCount
+		for _, c := range s.live {
+			if c.key == r.kind+":"+key {
+				live = c
+			}
+		}
+		if live == nil {
+			continue
+		}
+		q.rules = append(q.rules, r)
+		q.live = append(q.live, live)
+		q.breached = append(q.breached, _Usage.today(r.kind, key)+live.Value() >= r.bytes)
+	}
+	if len(q.rules) == 0 {
+		return nil
+	}
+	return q
+}
+
+// rate is the rate func of the throttled writers of the tunnel, evaluating
+// the quotas at most every _QuotaRecheckInterval. A quota breached with
+// reject cancels the session.
+func (q *byteQuotas) rate() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now := time.Now(); now.After(q.next) {
+		q.next = now.Add(_QuotaRecheckInterval)
+		q.evaluate()
+	}
+	if q.throttle {
+		return quotaThrottleRate()
+	}
+	return q.s.throttle
+}
+
+func (q *byteQuotas) evaluate() {
+	keys := map[string]string{"token": q.s.token, "tenant": q.s.tenant}
+	for i, r := range q.rules {
+		if q.breached[i] {
+			continue
+		}
+		key := keys[r.kind]
+		used := _Usage.today(r.kind, key) + q.live[i].Value()
+		if used < r.bytes {
+			continue
+		}
+		q.breached[i] = true
+		_MetricQuotaBreaches.With(r.action).Inc()
+		q.s.log.Warn("quota exceeded", "quota", r.rule, r.kind, key, "usage", used, "action", r.action)
+		switch r.action {
+		case _QuotaReject:
+			q.s.cancel(errQuotaExceeded)
+		case _QuotaThrottle:
+			q.throttle = true
+		}
+	}
+}
+
+// throttledWriter paces the writes to w at the bytes per second rate
+// returns, writes aren't paced while it returns 0
+type throttledWriter struct {
+	w    io.Writer
+	ctx  context.Context
+	rate func() int64
+	due  time.Time // when what was written is due at the rate
+}
+
+func newThrottledWriter(ctx context.Context, w io.Writer, rate func() int64) *throttledWriter {
+	return &throttledWriter{w: w, ctx: ctx, rate: rate}
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		rate := t.rate()
+		if rate <= 0 {
+			t.due = time.Time{}
+			m, err := t.w.Write(p)
+			return n + m, err
+		}
+		if wait := time.Until(t.due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.ctx.Done():
+				timer.Stop()
+				return n, context.Cause(t.ctx)
+			}
+		}
+		// at most a tenth of a second of data at once
+		chunk := p
+		if max := int(rate/10) + 1; len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		m, err := t.w.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if now := time.Now(); t.due.Before(now) {
+			t.due = now
+		}
+		t.due = t.due.Add(time.Duration(m) * time.Second / time.Duration(rate))
+		p = p[m:]
+	}
+	return n, nil
+}
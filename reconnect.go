@@ -0,0 +1,225 @@
+package frontd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Tunnels to backends matching RECONNECT_BACKENDS survive their backend
+// dropping, i.e. reads from it failing, not it closing the tunnel cleanly:
+// while the client is still connected the backend is redialed, or
+// the failover address claimed by the token, up to RECONNECT_MAX times per
+// tunnel, and the client is spliced onto the new connection. The failover is
+// checked like the backend was before it was dialed. Bytes in flight
+// to the dropped backend are lost, so it only suits protocols tolerating
+// reconnects, e.g. ones resending unacknowledged messages.
+var (
+	_ReconnectRules atomic.Value // []backendRule
+	_ReconnectMax   int64        = 3
+
+	_MetricBackendReconnects = newCounterVec("frontd_backend_reconnects_total",
+		"Total number of backends redialed under live tunnels, by result.", "result")
+)
+
+// reconnectBackend reports whether tunnels to addr, connected at ip, are
+// redialed when the backend drops
+func reconnectBackend(addr string, ip net.IP) bool {
+	rules, _ := _ReconnectRules.Load().([]backendRule)
+	if len(rules) == 0 {
+		return false
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, _ := strconv.Atoi(p)
+	for i := range rules {
+		if rules[i].matchName(host, port) || ip != nil && rules[i].matchIP(ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// backendSwitch is the backend of a reconnecting tunnel, writes wait for
+// the connection replacing a dropped one
+type backendSwitch struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	conn   net.Conn
+	closed bool // the tunnel is torn down
+}
+
+func newBackendSwitch(conn net.Conn) *backendSwitch {
+	b := &backendSwitch{conn: conn}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// current returns the backend connection, nil once torn down
+func (b *backendSwitch) current() net.Conn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	return b.conn
+}
+
+// await waits until old is replaced, it returns false if the tunnel is torn
+// down instead
+func (b *backendSwitch) await(old net.Conn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.conn == old && !b.closed {
+		b.cond.Wait()
+	}
+	return !b.closed
+}
+
+func (b *backendSwitch) swap(conn net.Conn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		conn.Close()
+		return false
+	}
+	b.conn = conn
+	b.cond.Broadcast()
+	return true
+}
+
+func (b *backendSwitch) Write(p []byte) (n int, err error) {
+	for {
+		conn := b.current()
+		if conn == nil {
+			return n, net.ErrClosed
+		}
+		m, err := conn.Write(p[n:])
+		n += m
+		if err == nil {
+			return n, nil
+		}
+		// the read of relayDown notices the drop and redials
+		conn.Close()
+		if !b.await(conn) {
+			return n, err
+		}
+	}
+}
+
+// Close tears down the tunnel
+func (b *backendSwitch) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+	return b.conn.Close()
+}
+
+// relayDown pipes the backend to the client like pipe, redialing the backend
+// of c or its failover when the backend drops while the client is still
+// connected, until ctx of the relay is done
+func (b *backendSwitch) relayDown(ctx context.Context, c *Conn, dst io.Writer, active *int64, relayed ...*counter) error {
+	s := c.s
+	left := atomic.LoadInt64(&_ReconnectMax)
+	for {
+		conn := b.current()
+		if conn == nil {
+			return nil
+		}
+		err := pipe(dst, conn, s.Conn, conn, s.log, "downstream", active, relayed...)
+
+		// only reads failing are the backend dropping, writes failing are
+		// the client's and a clean EOF ends the tunnel
+		var re *relayError
+		if err == nil || errors.As(err, &re) && re.op != "read" || errors.Is(err, errIdle) ||
+			left <= 0 || ctx.Err() != nil || b.current() == nil {
+			return err
+		}
+		left--
+		next := b.redial(ctx, c)
+		if next == nil || !b.swap(next) {
+			return err
+		}
+	}
+}
+
+// redial returns a new connection to the backend of c, or else to its
+// failover, nil if neither connected or ctx is done
+func (b *backendSwitch) redial(ctx context.Context, c *Conn) net.Conn {
+	s := c.s
+	for i, addr := range []string{c.backend, s.failover} {
+		if addr == "" {
+			continue
+		}
+		if i > 0 {
+			var err error
+			addr, err = routeFailover(ctx, c, addr)
+			if err != nil {
+				s.log.Info("failover refused", "backend_addr", s.failover, "err", err)
+				continue
+			}
+		}
+		conn, err := dialBackend(ctx, addr, backendDialTimeout())
+		recordDial(addr, err)
+		if err != nil {
+			s.log.Info("backend not reconnected", "backend_addr", addr, "err", err)
+			continue
+		}
+		_MetricBackendReconnects.With("success").Inc()
+		s.log.Info("backend reconnected", "backend_addr", addr)
+		s.setBackend(addr)
+		return conn
+	}
+	_MetricBackendReconnects.With("failure").Inc()
+	return nil
+}
+
+// routeFailover runs the failover claimed by the token of c through what the
+// backend went through before it was dialed: the authorization webhook, the
+// routing script, the Router and OnDial. It returns the address to dial.
+func routeFailover(ctx context.Context, c *Conn, addr string) (string, error) {
+	if ac := authzConf(); ac != nil {
+		fc := *c
+		fc.backend = addr
+		resp, err := ac.authorize(&fc)
+		switch {
+		case err != nil:
+			if ac.failure == _AuthzDeny {
+				return "", err
+			}
+		case resp.Decision == _AuthzDeny:
+			return "", errors.New("denied by the authorization webhook")
+		case resp.Backend != "":
+			addr = resp.Backend
+		}
+	}
+	if rs := routingScript(); rs != nil {
+		routed, err := rs.route(c.s, addr)
+		if err != nil {
+			return "", err
+		}
+		addr = routed
+	}
+	if r := router(); r != nil {
+		routed, err := r.Route(addr)
+		if err != nil {
+			return "", err
+		}
+		addr = routed
+	}
+	if h := hooks().OnDial; h != nil {
+		info := c.s.connInfo()
+		info.Backend = addr
+		if err := h(ctx, info); err != nil {
+			return "", err
+		}
+	}
+	return addr, nil
+}
@@ -0,0 +1,273 @@
+package frontd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tunnels to backends matching RECORD_BACKENDS are recorded to a file per
+// connection in RECORD_DIR, frontd replay sends the client's side of a
+// recording to a backend again to reproduce what it did.
+//
+// A recording starts with _RecordMagic and a JSON line of recordingInfo,
+// followed by chunks: a direction byte, the nanoseconds since the tunnel was
+// established and the length as big endian uint64 and uint32, then the data.
+
+const _RecordMagic = "frontd-recording 1\n"
+
+const (
+	_RecordUp   = '>' // from the client to the backend
+	_RecordDown = '<' // from the backend to the client
+)
+
+// recordingInfo describes the recorded tunnel
+type recordingInfo struct {
+	ConnID  string    `json:"conn_id"`
+	Client  string    `json:"client"`
+	Backend string    `json:"backend"`
+	Start   time.Time `json:"start"`
+}
+
+var (
+	_RecordRules   atomic.Value // []backendRule
+	_RecordDir     atomic.Value // string, recording is disabled if empty
+	_RecordMaxSize int64        = 64 * 1024 * 1024
+)
+
+func recordDir() string {
+	d, _ := _RecordDir.Load().(string)
+	return d
+}
+
+// recordBackend reports whether tunnels to addr, connected at ip, are
+// recorded
+func recordBackend(addr string, ip net.IP) bool {
+	rules, _ := _RecordRules.Load().([]backendRule)
+	if len(rules) == 0 || recordDir() == "" {
+		return false
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, _ := strconv.Atoi(p)
+	for i := range rules {
+		if rules[i].matchName(host, port) || ip != nil && rules[i].matchIP(ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// recorder writes the recording of a tunnel, it stops recording once the
+// recording exceeds RECORD_MAX_SIZE
+type recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	start time.Time
+	size  int64
+}
+
+// newRecorder creates the recording of the session's tunnel
+func newRecorder(s *session) (*recorder, error) {
+	path := filepath.Join(recordDir(), s.id+".rec")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, addr := s.status()
+	r := &recorder{f: f, w: bufio.NewWriter(f), start: time.Now()}
+	r.w.WriteString(_RecordMagic)
+	b, _ := json.Marshal(recordingInfo{ConnID: s.id, Client: s.RemoteAddr().String(), Backend: addr, Start: r.start})
+	r.w.Write(append(b, '\n'))
+	return r, nil
+}
+
+func (r *recorder) write(dir byte, p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w == nil {
+		return
+	}
+	r.size += int64(len(p))
+	if r.size > atomic.LoadInt64(&_RecordMaxSize) {
+		r.close()
+		return
+	}
+	var hdr [13]byte
+	hdr[0] = dir
+	binary.BigEndian.PutUint64(hdr[1:], uint64(time.Since(r.start)))
+	binary.BigEndian.PutUint32(hdr[9:], uint32(len(p)))
+	r.w.Write(hdr[:])
+	r.w.Write(p)
+}
+
+// close flushes the recording, it must be called with mu held
+func (r *recorder) close() {
+	if r.w == nil {
+		return
+	}
+	r.w.Flush()
+	r.f.Close()
+	r.w = nil
+}
+
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.close()
+	return nil
+}
+
+// recordChunk is a chunk of a recording
+type recordChunk struct {
+	dir  byte
+	at   time.Duration
+	data []byte
+}
+
+// readRecording reads the recording at path
+func readRecording(path string) (info recordingInfo, chunks []recordChunk, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	rd := bufio.NewReader(f)
+	magic := make([]byte, len(_RecordMagic))
+	_, err = io.ReadFull(rd, magic)
+	if err != nil || string(magic) != _RecordMagic {
+		return info, nil, errors.New("not a frontd recording")
+	}
+	line, err := rd.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &info)
+	}
+	if err != nil {
+		return info, nil, fmt.Errorf("invalid recording header: %v", err)
+	}
+	for {
+		var hdr [13]byte
+		_, err = io.ReadFull(rd, hdr[:])
+		if err == io.EOF {
+			return info, chunks, nil
+		}
+		if err != nil {
+			return info, chunks, err
+		}
+		c := recordChunk{dir: hdr[0], at: time.Duration(binary.BigEndian.Uint64(hdr[1:]))}
+		c.data = make([]byte, binary.BigEndian.Uint32(hdr[9:]))
+		_, err = io.ReadFull(rd, c.data)
+		if err != nil {
+			// the recording of a killed frontd may be cut short
+			return info, chunks, nil
+		}
+		chunks = append(chunks, c)
+	}
+}
+
+// replay sends the client's side of a recording to a backend with the
+// recorded timing and compares the replies with the recorded ones
+func replay(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	backend := fs.String("backend", "", "backend `addr` to replay to, defaults to the recorded backend")
+	speed := fs.Float64("speed", 1, "replay `factor` times faster than recorded, 0 sends without pauses")
+	wait := fs.Duration("wait", time.Second, "`duration` to wait for replies after the recorded end")
+	output := fs.String("o", "", "write the replies of the backend to `file`")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: frontd replay [flags] recording")
+		fs.PrintDefaults()
+	}
+	if fs.Parse(args) != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || *speed < 0 {
+		fs.Usage()
+		return 2
+	}
+
+	info, chunks, err := readRecording(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if *backend == "" {
+		*backend = info.Backend
+	}
+	conn, err := net.DialTimeout("tcp", *backend, time.Second*5)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	var replies bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&replies, conn)
+		close(done)
+	}()
+
+	var recorded []byte
+	var sent int
+	var end time.Duration
+	start := time.Now()
+	for _, c := range chunks {
+		if *speed > 0 {
+			end = time.Duration(float64(c.at) / *speed)
+		}
+		if c.dir == _RecordDown {
+			recorded = append(recorded, c.data...)
+			continue
+		}
+		time.Sleep(time.Until(start.Add(end)))
+		_, err = conn.Write(c.data)
+		if err != nil {
+			fmt.Fprintln(stderr, "replay interrupted:", err)
+			break
+		}
+		sent += len(c.data)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Until(start.Add(end + *wait))):
+		conn.Close()
+		<-done
+	}
+
+	got := replies.Bytes()
+	fmt.Fprintf(stdout, "replayed %s (%s to %s) to %s\n", fs.Arg(0), info.Client, info.Backend, *backend)
+	fmt.Fprintf(stdout, "sent %d bytes, received %d bytes, %d recorded\n", sent, len(got), len(recorded))
+	if *output != "" {
+		err = os.WriteFile(*output, got, 0644)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+	if bytes.Equal(got, recorded) {
+		fmt.Fprintln(stdout, "replies match the recording")
+		return 0
+	}
+	i := 0
+	for i < len(got) && i < len(recorded) && got[i] == recorded[i] {
+		i++
+	}
+	fmt.Fprintf(stdout, "replies differ from the recording at byte %d\n", i)
+	return 0
+}
@@ -0,0 +1,496 @@
+package frontd
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/xindong/frontd/obfs"
+)
+
+// Settings read by every new connection. They are replaced by applySettings
+// when the configuration is reloaded on SIGHUP, so they are only accessed
+// atomically through the functions below.
+var (
+	_SecretPassphase    atomic.Value // []byte
+	_BackendDialTimeout int64        = 5
+	_ConnReadTimeout    int64        = int64(time.Second * 30)
+	_maxHTTPHeaderSize  int64        = 4096 * 2
+	_MaxConnLifetime    int64             // nanoseconds, 0 for unlimited
+	_MaxConns           int64             // 0 for unlimited
+	_IdleTimeout        int64             // nanoseconds, 0 for never
+	_ConnLinger         int64        = -1 // seconds, negative for the system default
+	_ErrorClose         atomic.Value      // string
+	_AuthFailure        atomic.Value      // string
+	_TarpitTimeout      int64        = int64(time.Second * 30)
+	_FailureDelay       int64        = int64(time.Millisecond * 50)
+)
+
+func secretPassphrase() []byte {
+	b, _ := _SecretPassphase.Load().([]byte)
+	return b
+}
+
+func backendDialTimeout() time.Duration {
+	return time.Second * time.Duration(atomic.LoadInt64(&_BackendDialTimeout))
+}
+
+func connReadTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&_ConnReadTimeout))
+}
+
+func maxHTTPHeaderSize() int {
+	return int(atomic.LoadInt64(&_maxHTTPHeaderSize))
+}
+
+func maxConnLifetime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&_MaxConnLifetime))
+}
+
+func maxConns() int64 {
+	return atomic.LoadInt64(&_MaxConns)
+}
+
+func idleTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&_IdleTimeout))
+}
+
+func connLinger() int {
+	return int(atomic.LoadInt64(&_ConnLinger))
+}
+
+// errorClose is how client connections are closed after an error code, one
+// of the _ErrorClose* constants
+func errorClose() string {
+	s, _ := _ErrorClose.Load().(string)
+	if s == "" {
+		return _ErrorCloseDefault
+	}
+	return s
+}
+
+// authFailure is how failed handshakes are answered, one of the
+// _AuthFailure* constants
+func authFailure() string {
+	s, _ := _AuthFailure.Load().(string)
+	if s == "" {
+		return _AuthFailureCode
+	}
+	return s
+}
+
+func tarpitTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&_TarpitTimeout))
+}
+
+func failureDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&_FailureDelay))
+}
+
+// applySettings reads the reloadable settings, unset or invalid ones fall
+// back to their defaults. Nothing is changed if an error is returned.
+func applySettings() error {
+	secret := []byte(getenv("SECRET"))
+	secretFile := getenv("SECRET_FILE")
+	if secretFile != "" {
+		b, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return err
+		}
+		secret = bytes.TrimRight(b, "\r\n")
+	}
+	// an empty passphrase still derives a key, which anybody can encrypt
+	// cipher addresses with
+	if len(secret) == 0 {
+		if secretFile != "" {
+			return fmt.Errorf("SECRET_FILE %s is empty", secretFile)
+		}
+		return errors.New("SECRET or SECRET_FILE required")
+	}
+	if len(secret) < _MinSecretLength {
+		logger().Warn("weak secret passphrase", "length", len(secret), "recommended", _MinSecretLength)
+	}
+
+	backendTimeout := int64(5)
+	bt, err := strconv.Atoi(getenv("BACKEND_TIMEOUT"))
+	if err == nil && bt > 0 {
+		backendTimeout = int64(bt)
+	}
+
+	readTimeout := time.Second * 30
+	rt, err := strconv.Atoi(getenv("CONN_READ_TIMEOUT"))
+	if err == nil && rt >= 0 {
+		readTimeout = time.Second * time.Duration(rt)
+	}
+
+	headerSize := 4096 * 2
+	mhs, err := strconv.Atoi(getenv("MAX_HTTP_HEADER_SIZE"))
+	if err == nil && mhs > _minHTTPHeaderSize {
+		headerSize = mhs
+	}
+
+	var lifetime time.Duration
+	ml, err := strconv.Atoi(getenv("MAX_CONN_LIFETIME"))
+	if err == nil && ml > 0 {
+		lifetime = time.Second * time.Duration(ml)
+	}
+
+	// every tunnel takes a descriptor for the client and one for the
+	// backend, the rest are kept for listeners, logs and the admin API
+	var maxConnCount int64
+	mc, err := strconv.Atoi(getenv("MAX_CONNS"))
+	if err == nil && mc > 0 {
+		maxConnCount = int64(mc)
+	} else if n := int64(maxOpenFiles()); n > _ReservedFiles {
+		maxConnCount = (n - _ReservedFiles) / 2
+	}
+
+	watchdog := time.Minute * 5
+	wt, err := strconv.Atoi(getenv("WATCHDOG_TIMEOUT"))
+	if err == nil && wt >= 0 {
+		watchdog = time.Second * time.Duration(wt)
+	}
+
+	tickets := time.Hour
+	tl, err := strconv.Atoi(getenv("TICKET_LIFETIME"))
+	if err == nil && tl >= 0 {
+		tickets = time.Second * time.Duration(tl)
+	}
+
+	compression := int64(flate.BestSpeed)
+	cpl, err := strconv.Atoi(getenv("COMPRESSION_LEVEL"))
+	if err == nil && cpl >= flate.BestSpeed && cpl <= flate.BestCompression {
+		compression = int64(cpl)
+	}
+
+	var muxHTTP int32
+	if mux, _ := strconv.ParseBool(getenv("MUX_HTTP")); mux {
+		muxHTTP = 1
+	}
+
+	cert, err := loadTLSCert()
+	if err != nil {
+		return err
+	}
+	ech, err := loadECHKeys()
+	if err != nil {
+		return err
+	}
+	sniRoutes, err := loadSNIRoutes()
+	if err != nil {
+		return err
+	}
+	transport, err := loadTransport()
+	if err != nil {
+		return err
+	}
+	obfsPadding := int64(obfs.DefaultPadding)
+	op, err := strconv.Atoi(getenv("OBFUSCATE_PADDING"))
+	if err == nil && op >= 0 && op <= 65535 {
+		obfsPadding = int64(op)
+	}
+
+	var idle time.Duration
+	it, err := strconv.Atoi(getenv("IDLE_TIMEOUT"))
+	if err == nil && it > 0 {
+		idle = time.Second * time.Duration(it)
+	}
+
+	linger := int64(-1)
+	cl, err := strconv.Atoi(getenv("CONN_LINGER"))
+	if err == nil && cl >= 0 {
+		linger = int64(cl)
+	}
+
+	dscp := int64(-1)
+	if v := getenv("DSCP"); v != "" {
+		d, err := parseDSCP(v)
+		if err != nil {
+			return err
+		}
+		dscp = int64(d)
+	}
+	dscpRules, err := parseDSCPRules(getenv("DSCP_BACKENDS"))
+	if err != nil {
+		return err
+	}
+
+	hostRoutes, err := parseHostRoutes(getenv("HOST_ROUTES"))
+	if err != nil {
+		return err
+	}
+
+	quotaRules, err := parseQuotas(getenv("QUOTAS"))
+	if err != nil {
+		return err
+	}
+	throttleRate := int64(64 * 1024)
+	if tr, err := strconv.Atoi(getenv("QUOTA_THROTTLE_RATE")); err == nil && tr > 0 {
+		throttleRate = int64(tr)
+	}
+
+	priorityRules, err := parsePriorityRules(getenv("PRIORITY_BACKENDS"))
+	if err != nil {
+		return err
+	}
+	shedConns, err := parsePriorityLimits(getenv("PRIORITY_SHED_CONNS"), false)
+	if err != nil {
+		return err
+	}
+	bandwidth, err := parsePriorityLimits(getenv("PRIORITY_THROTTLE_BANDWIDTH"), true)
+	if err != nil {
+		return err
+	}
+	priorityRate := int64(64 * 1024)
+	if tr, err := strconv.Atoi(getenv("PRIORITY_THROTTLE_RATE")); err == nil && tr > 0 {
+		priorityRate = int64(tr)
+	}
+
+	allowInternal, err := parseIPNets(getenv("BACKEND_ALLOW_INTERNAL"))
+	if err != nil {
+		return err
+	}
+
+	policy := &backendPolicy{}
+	policy.allow, err = parseBackendRules(getenv("BACKEND_ALLOW"))
+	if err != nil {
+		return err
+	}
+	policy.deny, err = parseBackendRules(getenv("BACKEND_DENY"))
+	if err != nil {
+		return err
+	}
+
+	acl, err := loadClientACL()
+	if err != nil {
+		return err
+	}
+
+	var banThreshold int64
+	bth, err := strconv.Atoi(getenv("BAN_THRESHOLD"))
+	if err == nil && bth > 0 {
+		banThreshold = int64(bth)
+	}
+	banWindow := time.Minute
+	bw, err := strconv.Atoi(getenv("BAN_WINDOW"))
+	if err == nil && bw > 0 {
+		banWindow = time.Second * time.Duration(bw)
+	}
+	banDuration := time.Minute * 10
+	bd, err := strconv.Atoi(getenv("BAN_DURATION"))
+	if err == nil && bd > 0 {
+		banDuration = time.Second * time.Duration(bd)
+	}
+
+	var maxPanics int64
+	mp, err := strconv.Atoi(getenv("MAX_PANICS_PER_MINUTE"))
+	if err == nil && mp > 0 {
+		maxPanics = int64(mp)
+	}
+
+	closeMode := getenv("ERROR_CLOSE")
+	switch closeMode {
+	case _ErrorCloseDefault, _ErrorCloseFlush, _ErrorCloseReset:
+	default:
+		closeMode = _ErrorCloseDefault
+	}
+
+	authMode := getenv("AUTH_FAILURE")
+	switch authMode {
+	case _AuthFailureCode, _AuthFailureDrop, _AuthFailureTarpit, _AuthFailureDecoy:
+	default:
+		authMode = _AuthFailureCode
+	}
+
+	var replayWindow time.Duration
+	rw, err := strconv.Atoi(getenv("REPLAY_WINDOW"))
+	if err == nil && rw > 0 {
+		replayWindow = time.Second * time.Duration(rw)
+	}
+
+	failDelay := time.Millisecond * 50
+	fd, err := strconv.Atoi(getenv("FAILURE_DELAY"))
+	if err == nil && fd >= 0 {
+		failDelay = time.Millisecond * time.Duration(fd)
+	}
+
+	tarpit := time.Second * 30
+	tt, err := strconv.Atoi(getenv("TARPIT_TIMEOUT"))
+	if err == nil && tt > 0 {
+		tarpit = time.Second * time.Duration(tt)
+	}
+
+	recordRules, err := parseBackendRules(getenv("RECORD_BACKENDS"))
+	if err != nil {
+		return err
+	}
+	reconnectRules, err := parseBackendRules(getenv("RECONNECT_BACKENDS"))
+	if err != nil {
+		return err
+	}
+	reconnectMax := int64(3)
+	rm, err := strconv.Atoi(getenv("RECONNECT_MAX"))
+	if err == nil && rm > 0 {
+		reconnectMax = int64(rm)
+	}
+
+	recordMaxSize := int64(64)
+	rms, err := strconv.Atoi(getenv("RECORD_MAX_SIZE"))
+	if err == nil && rms > 0 {
+		recordMaxSize = int64(rms)
+	}
+
+	chaosCfg, err := loadChaos()
+	if err != nil {
+		return err
+	}
+
+	authz, err := loadAuthz()
+	if err != nil {
+		return err
+	}
+
+	usageExport, err := loadUsageExport()
+	if err != nil {
+		return err
+	}
+	bandwidthCaps, err := loadBandwidthCaps(currentBandwidthCaps())
+	if err != nil {
+		return err
+	}
+	alerts, err := loadAlerts()
+	if err != nil {
+		return err
+	}
+
+	mws := getenv("MIDDLEWARES")
+	if mws == "" {
+		mws = _DefaultMiddlewares
+	}
+	handler, err := buildChain(mws)
+	if err != nil {
+		return err
+	}
+
+	var script *routeScript
+	if path := getenv("ROUTE_SCRIPT"); path != "" {
+		script, err = openRouteScript(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	level := getenv("LOG_LEVEL")
+	if level != "" {
+		err = _LogLevel.UnmarshalText([]byte(level))
+		if err != nil {
+			logger().Warn("invalid log level", "level", level, "err", err)
+		}
+	}
+
+	if old := secretPassphrase(); old != nil && !bytes.Equal(old, secret) {
+		// cached addresses were decrypted with the old passphrase
+		_BackendAddrCache.Restore(backendAddrMap{})
+		logger().Info("secret changed, address cache flushed")
+	}
+	_SecretPassphase.Store(secret)
+	atomic.StoreInt64(&_BackendDialTimeout, backendTimeout)
+	atomic.StoreInt64(&_ConnReadTimeout, int64(readTimeout))
+	atomic.StoreInt64(&_maxHTTPHeaderSize, int64(headerSize))
+	atomic.StoreInt64(&_MaxConnLifetime, int64(lifetime))
+	atomic.StoreInt64(&_IdleTimeout, int64(idle))
+	atomic.StoreInt64(&_WatchdogTimeout, int64(watchdog))
+	atomic.StoreInt64(&_TicketLifetime, int64(tickets))
+	atomic.StoreInt64(&_CompressionLevel, compression)
+	_Transport.Store(transport)
+	_TLSCert.Store(cert)
+	_SNIRoutes.Store(sniRoutes)
+	_ECHKeys.Store(ech)
+	atomic.StoreInt32(&_MuxHTTP, muxHTTP)
+	atomic.StoreInt64(&_ObfsMaxPadding, obfsPadding)
+	atomic.StoreInt64(&_MaxConns, maxConnCount)
+	atomic.StoreInt64(&_ConnLinger, linger)
+	_ErrorClose.Store(closeMode)
+	_AuthFailure.Store(authMode)
+	atomic.StoreInt64(&_TarpitTimeout, int64(tarpit))
+	atomic.StoreInt64(&_ReplayWindow, int64(replayWindow))
+	atomic.StoreInt64(&_FailureDelay, int64(failDelay))
+	atomic.StoreInt64(&_DSCP, dscp)
+	_DSCPRules.Store(dscpRules)
+	atomic.StoreInt64(&_MaxPanicsPerMinute, maxPanics)
+	_ClientACL.Store(acl)
+	_BackendAllowInternal.Store(allowInternal)
+	_BackendPolicy.Store(policy)
+	atomic.StoreInt64(&_BanThreshold, banThreshold)
+	atomic.StoreInt64(&_BanWindow, int64(banWindow))
+	atomic.StoreInt64(&_BanDuration, int64(banDuration))
+	if chaosCfg != nil && chaos() == nil {
+		logger().Warn("chaos mode enabled, tunnels are disrupted on purpose")
+	}
+	_Chaos.Store(chaosCfg)
+	_RouteScript.Store(script)
+	_HostRoutes.Store(hostRoutes)
+	_Quotas.Store(quotaRules)
+	atomic.StoreInt64(&_QuotaThrottleRate, throttleRate)
+	_PriorityRules.Store(priorityRules)
+	_PriorityShedConns.Store(shedConns)
+	_PriorityBandwidth.Store(bandwidth)
+	atomic.StoreInt64(&_PriorityThrottleRate, priorityRate)
+	_Authz.Store(authz)
+	_Alerts.Store(alerts)
+	_UsageExport.Store(usageExport)
+	_BandwidthCaps.Store(bandwidthCaps)
+	_Chain.Store(handler)
+	_RecordRules.Store(recordRules)
+	_RecordDir.Store(getenv("RECORD_DIR"))
+	_CaptureDir.Store(getenv("CAPTURE_DIR"))
+	_ReconnectRules.Store(reconnectRules)
+	atomic.StoreInt64(&_ReconnectMax, reconnectMax)
+	atomic.StoreInt64(&_RecordMaxSize, recordMaxSize*1024*1024)
+	return nil
+}
+
+// reloadConfig re-reads the configuration file and applies the reloadable
+// settings, established tunnels are not affected
+func reloadConfig() error {
+	configFile, _ := lookupEnv("CONFIG_FILE")
+	if configFile != "" {
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			return err
+		}
+		old := config()
+		_Config.Store(cfg)
+		err = applySettings()
+		if err != nil {
+			_Config.Store(old)
+			return err
+		}
+		return nil
+	}
+	return applySettings()
+}
+
+// reloadOnSignal reloads the configuration every time SIGHUP is received
+func reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		sdNotify("RELOADING=1")
+		err := reloadConfig()
+		sdNotify("READY=1")
+		if err != nil {
+			logger().Error("configuration not reloaded", "err", err)
+			continue
+		}
+		logger().Info("configuration reloaded")
+	}
+}
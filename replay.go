@@ -0,0 +1,79 @@
+package frontd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errReplayed = errors.New("cipher address replayed")
+
+// Salts of accepted cipher addresses are remembered for the replay window, a
+// cipher address seen again within it is rejected, so a sniffed handshake
+// can't be reused. 0 disables the check, clients then may reuse their cipher
+// addresses.
+var _ReplayWindow int64 // nanoseconds
+
+// _MaxReplayTracked bounds the salts remembered per window, the window is
+// cut short once it is reached
+const _MaxReplayTracked = 1 << 20
+
+var _opensslSaltHeader = []byte("Salted__")
+
+// replayFilter remembers salts in two generations, the current and the
+// previous window, so a salt is remembered for at least one window
+type replayFilter struct {
+	mu    sync.Mutex
+	start time.Time // of the current generation
+	cur   map[uint64]struct{}
+	prev  map[uint64]struct{}
+}
+
+var (
+	_Replays replayFilter
+
+	_MetricReplays = newCounter("frontd_replays_total",
+		"Total number of handshakes rejected as replays.")
+)
+
+// seen records the salt and reports whether it was already seen
+func (f *replayFilter) seen(salt uint64, window time.Duration) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if age := now.Sub(f.start); age >= window || len(f.cur) >= _MaxReplayTracked {
+		f.prev = f.cur
+		if age >= window*2 {
+			f.prev = nil
+		}
+		f.cur = make(map[uint64]struct{})
+		f.start = now
+	}
+	if _, ok := f.cur[salt]; ok {
+		return true
+	}
+	if _, ok := f.prev[salt]; ok {
+		return true
+	}
+	f.cur[salt] = struct{}{}
+	return false
+}
+
+// checkReplay rejects cipher addresses accepted before within the replay
+// window, key is the decoded cipher address starting with the OpenSSL salt
+// header
+func checkReplay(key []byte) error {
+	window := time.Duration(atomic.LoadInt64(&_ReplayWindow))
+	if window <= 0 || len(key) < 16 || !bytes.Equal(key[:8], _opensslSaltHeader) {
+		return nil
+	}
+	if _Replays.seen(binary.BigEndian.Uint64(key[8:16]), window) {
+		_MetricReplays.Inc()
+		return errReplayed
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package frontd
+
+// the descriptor limit is left alone where its type differs or there is none
+
+func raiseOpenFileLimit() (uint64, error) {
+	return 0, nil
+}
+
+func maxOpenFiles() float64 {
+	return -1
+}
@@ -0,0 +1,65 @@
+//go:build linux || darwin
+
+package frontd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// raiseOpenFileLimit raises the open file limit to _MaxOpenfile, or as far
+// as the system allows: Linux caps it to fs.nr_open, macOS to
+// kern.maxfilesperproc, and without CAP_SYS_RESOURCE only the soft limit
+// can be raised up to the hard one. It returns the limit set, and the
+// error that kept it lower.
+func raiseOpenFileLimit() (uint64, error) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return 0, err
+	}
+	want := _MaxOpenfile
+	if n := nrOpen(); n > 0 && n < want {
+		want = n
+	}
+	if lim.Cur >= want {
+		return uint64(lim.Cur), nil
+	}
+
+	var err error
+	if lim.Max < want {
+		err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &syscall.Rlimit{Cur: want, Max: want})
+		if err == nil {
+			return want, nil
+		}
+	}
+	// the soft limit can always be raised up to the hard one
+	soft := lim.Max
+	if soft > want {
+		soft = want
+	}
+	if e := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &syscall.Rlimit{Cur: soft, Max: lim.Max}); e != nil {
+		return uint64(lim.Cur), e
+	}
+	return uint64(soft), err
+}
+
+// nrOpen returns the system cap of the open file limit on Linux, 0 elsewhere
+func nrOpen() uint64 {
+	b, err := os.ReadFile("/proc/sys/fs/nr_open")
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	return n
+}
+
+// maxOpenFiles returns the open file limit, -1 if unknown
+func maxOpenFiles() float64 {
+	var lim syscall.Rlimit
+	if syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim) != nil {
+		return -1
+	}
+	return float64(lim.Cur)
+}
@@ -0,0 +1,177 @@
+package frontd
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotation settings shared by the access log and LOG_FILE
+var (
+	_LogRotateSize     int64 // bytes, 0 disables size based rotation
+	_LogRotateInterval time.Duration
+	_LogRotateKeep     = 7
+	_LogRotateCompress bool
+)
+
+const _RotatedSuffixLayout = "20060102T150405.000"
+
+// rotatingFile is an append only log file which is renamed with a timestamp
+// suffix once it exceeds maxSize or at every interval boundary. Rotated files
+// are optionally gzipped and only the newest keep of them are retained.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	interval time.Duration
+	keep     int
+	compress bool
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	deadline time.Time // next interval boundary
+
+	// serialize compression and pruning of rotated files
+	cleanup sync.Mutex
+}
+
+func newRotatingFile(path string) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:     path,
+		maxSize:  _LogRotateSize,
+		interval: _LogRotateInterval,
+		keep:     _LogRotateKeep,
+		compress: _LogRotateCompress,
+	}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	if r.interval > 0 {
+		r.deadline = time.Now().Truncate(r.interval).Add(r.interval)
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rotate := r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize
+	if r.interval > 0 && !time.Now().Before(r.deadline) {
+		rotate = true
+		r.deadline = time.Now().Truncate(r.interval).Add(r.interval)
+	}
+	// never rotate to leave an empty file behind
+	if rotate && r.size > 0 && r.f != nil {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if r.f == nil {
+		err := r.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	if err != nil {
+		return err
+	}
+
+	rotated := r.path + "." + time.Now().Format(_RotatedSuffixLayout)
+	err = os.Rename(r.path, rotated)
+	if err != nil {
+		return err
+	}
+
+	err = r.open()
+	go r.cleanupRotated(rotated)
+	return err
+}
+
+// cleanupRotated compresses the newly rotated file and removes old ones
+func (r *rotatingFile) cleanupRotated(rotated string) {
+	r.cleanup.Lock()
+	defer r.cleanup.Unlock()
+
+	if r.compress {
+		err := gzipFile(rotated)
+		if err != nil {
+			logger().Error("compressing rotated log failed", "path", rotated, "err", err)
+		}
+	}
+
+	if r.keep <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	var rotatedFiles []string
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, r.path+"."), ".gz")
+		if _, err := time.Parse(_RotatedSuffixLayout, suffix); err == nil {
+			rotatedFiles = append(rotatedFiles, m)
+		}
+	}
+	// timestamps sort lexically, oldest first
+	sort.Strings(rotatedFiles)
+	for len(rotatedFiles) > r.keep {
+		os.Remove(rotatedFiles[0])
+		rotatedFiles = rotatedFiles[1:]
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,65 @@
+//go:build linux && (amd64 || arm64)
+
+package frontd
+
+import (
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// seccomp(2) and prctl(2) constants missing from package syscall
+const (
+	_PR_SET_NO_NEW_PRIVS        = 38
+	_SECCOMP_SET_MODE_FILTER    = 1
+	_SECCOMP_FILTER_FLAG_TSYNC  = 1
+	_SECCOMP_RET_ALLOW          = 0x7fff0000
+	_SECCOMP_RET_ERRNO          = 0x00050000
+	_SeccompDataArchOffset      = 4
+	_SeccompDataNrOffset        = 0
+	_SeccompFirstForeignSyscall = 0x40000000 // x32 ABI on amd64
+)
+
+// enterSandbox restricts all threads of the process to the system calls of
+// _SandboxSyscalls. Any other call fails with EPERM, so a missing entry shows
+// up as an error instead of killing the process. It can't be undone.
+func enterSandbox() error {
+	deny := syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: _SECCOMP_RET_ERRNO | uint32(syscall.EPERM)}
+	allow := syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: _SECCOMP_RET_ALLOW}
+	jeq := func(k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: jt, Jf: jf, K: k}
+	}
+
+	n := len(_SandboxSyscalls)
+	filter := []syscall.SockFilter{
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: _SeccompDataArchOffset},
+		jeq(_SandboxArch, 1, 0),
+		deny,
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: _SeccompDataNrOffset},
+		{Code: syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K, Jt: uint8(n), K: _SeccompFirstForeignSyscall},
+	}
+	for i, nr := range _SandboxSyscalls {
+		// jump to allow after the remaining entries and deny
+		filter = append(filter, jeq(uint32(nr), uint8(n-i), 0))
+	}
+	filter = append(filter, deny, allow)
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// no_new_privs is set on this thread and synchronized to the others
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, _PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	r, _, errno := syscall.RawSyscall(_SYS_SECCOMP, _SECCOMP_SET_MODE_FILTER, _SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return errno
+	}
+	if r != 0 {
+		// thread r couldn't be synchronized
+		return syscall.ESRCH
+	}
+	return nil
+}
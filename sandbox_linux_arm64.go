@@ -0,0 +1,46 @@
+package frontd
+
+import "syscall"
+
+const (
+	_SandboxArch = 0xc00000b7 // AUDIT_ARCH_AARCH64
+	_SYS_SECCOMP = 277
+)
+
+// _SandboxSyscalls lists the system calls used by the Go runtime, networking,
+// DNS resolution, logging and configuration reloads
+var _SandboxSyscalls = []int{
+	// memory, threads and signals
+	syscall.SYS_MMAP, syscall.SYS_MUNMAP, syscall.SYS_MPROTECT, syscall.SYS_MADVISE,
+	syscall.SYS_MREMAP, syscall.SYS_MINCORE, syscall.SYS_BRK, syscall.SYS_CLONE, 435, // clone3
+	syscall.SYS_EXIT, syscall.SYS_EXIT_GROUP, syscall.SYS_FUTEX, syscall.SYS_SCHED_YIELD,
+	syscall.SYS_SCHED_GETAFFINITY, syscall.SYS_NANOSLEEP, syscall.SYS_CLOCK_GETTIME,
+	syscall.SYS_CLOCK_NANOSLEEP, syscall.SYS_GETTIMEOFDAY,
+	syscall.SYS_GETPID, syscall.SYS_GETTID, syscall.SYS_TGKILL, syscall.SYS_KILL,
+	syscall.SYS_RT_SIGACTION, syscall.SYS_RT_SIGPROCMASK, syscall.SYS_RT_SIGRETURN,
+	syscall.SYS_SIGALTSTACK, syscall.SYS_RESTART_SYSCALL, syscall.SYS_SETITIMER,
+	syscall.SYS_TIMER_CREATE, syscall.SYS_TIMER_SETTIME, syscall.SYS_TIMER_DELETE,
+	278, // getrandom
+	293, // rseq, required by glibc threads
+	syscall.SYS_SET_ROBUST_LIST,
+	syscall.SYS_GETRLIMIT, syscall.SYS_PRLIMIT64, syscall.SYS_UNAME,
+	syscall.SYS_GETUID, syscall.SYS_GETEUID, syscall.SYS_GETGID, syscall.SYS_GETEGID,
+
+	// file descriptors and files
+	syscall.SYS_READ, syscall.SYS_WRITE, syscall.SYS_READV, syscall.SYS_WRITEV,
+	syscall.SYS_PREAD64, syscall.SYS_PWRITE64, syscall.SYS_CLOSE, syscall.SYS_FCNTL,
+	syscall.SYS_IOCTL, syscall.SYS_LSEEK, syscall.SYS_FSYNC, syscall.SYS_DUP3,
+	syscall.SYS_OPENAT, syscall.SYS_FSTAT, syscall.SYS_FSTATAT, 291, // statx
+	syscall.SYS_READLINKAT, syscall.SYS_GETDENTS64, syscall.SYS_RENAMEAT,
+	276, // renameat2
+	syscall.SYS_UNLINKAT, syscall.SYS_PIPE2,
+	syscall.SYS_EPOLL_CREATE1, syscall.SYS_EPOLL_CTL, syscall.SYS_EPOLL_PWAIT,
+	syscall.SYS_EVENTFD2,
+
+	// sockets
+	syscall.SYS_SOCKET, syscall.SYS_CONNECT, syscall.SYS_BIND, syscall.SYS_LISTEN,
+	syscall.SYS_ACCEPT, syscall.SYS_ACCEPT4, syscall.SYS_GETSOCKNAME,
+	syscall.SYS_GETPEERNAME, syscall.SYS_SETSOCKOPT, syscall.SYS_GETSOCKOPT,
+	syscall.SYS_SENDTO, syscall.SYS_RECVFROM, syscall.SYS_SENDMSG,
+	syscall.SYS_RECVMSG, syscall.SYS_SHUTDOWN, syscall.SYS_SPLICE, syscall.SYS_SENDFILE,
+}
@@ -0,0 +1,9 @@
+//go:build !linux || !(amd64 || arm64)
+
+package frontd
+
+import "errors"
+
+func enterSandbox() error {
+	return errors.New("the seccomp sandbox is only supported on linux/amd64 and linux/arm64")
+}
@@ -0,0 +1,362 @@
+package frontd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A routing script is a Lua file given by ROUTE_SCRIPT defining
+//
+//	function route(req) ... end
+//
+// which is called for every handshake with a table describing it and
+// returns the backend address to dial, nil to dial the decrypted one, and
+// optionally "deny" as second value to refuse the client with 4111. The
+// script is reloaded when the file is modified, without restarting frontd.
+
+var errScriptDenied = errors.New("denied by the routing script")
+
+// _ScriptCheckInterval is how often the script file is checked for changes
+const _ScriptCheckInterval = time.Second
+
+// routeProgram is a loaded routing script
+type routeProgram struct {
+	route *luaFunction
+}
+
+// routeScript is the routing script, reloaded when the file is modified
+type routeScript struct {
+	path string
+	prog atomic.Value // *routeProgram
+
+	mu      sync.Mutex
+	mtime   time.Time
+	checked time.Time
+}
+
+var (
+	_RouteScript atomic.Value // *routeScript, nil if not configured
+
+	_MetricScriptErrors = newCounter("frontd_route_script_errors_total",
+		"Total number of handshakes refused because the routing script failed.")
+)
+
+func routingScript() *routeScript {
+	rs, _ := _RouteScript.Load().(*routeScript)
+	return rs
+}
+
+// loadRouteScript compiles the routing script at path, running its top
+// level statements once
+func loadRouteScript(path string) (*routeProgram, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	body, err := parseLua(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	builtins := luaBuiltins()
+	builtins.frozen = true
+	globals := newLuaScope(builtins)
+	_, _, _, err = execBlock(&luaState{}, globals, body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	// calls share the globals, they can't change them
+	globals.frozen = true
+	f, ok := globals.vars["route"].(*luaFunction)
+	if !ok {
+		return nil, fmt.Errorf("%s: function route(req) not defined", path)
+	}
+	return &routeProgram{route: f}, nil
+}
+
+func checkRouteScript(v string) error {
+	_, err := loadRouteScript(v)
+	return err
+}
+
+func openRouteScript(path string) (*routeScript, error) {
+	rs := &routeScript{path: path}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := loadRouteScript(path)
+	if err != nil {
+		return nil, err
+	}
+	rs.prog.Store(prog)
+	rs.mtime = fi.ModTime()
+	rs.checked = time.Now()
+	return rs, nil
+}
+
+// program returns the script, reloading it first if the file was modified.
+// A script failing to load is logged and the previous one kept.
+func (rs *routeScript) program() *routeProgram {
+	rs.mu.Lock()
+	if time.Since(rs.checked) >= _ScriptCheckInterval {
+		rs.checked = time.Now()
+		fi, err := os.Stat(rs.path)
+		if err == nil && !fi.ModTime().Equal(rs.mtime) {
+			rs.mtime = fi.ModTime()
+			prog, err := loadRouteScript(rs.path)
+			if err != nil {
+				logger().Error("routing script not reloaded", "err", err)
+			} else {
+				rs.prog.Store(prog)
+				logger().Info("routing script reloaded", "path", rs.path)
+			}
+		}
+	}
+	rs.mu.Unlock()
+	return rs.prog.Load().(*routeProgram)
+}
+
+// route calls the script for the handshake of s decrypted to addr, it
+// returns the address to dial
+func (rs *routeScript) route(s *session, addr string) (string, error) {
+	req := newLuaTable()
+	req.put("backend", addr)
+	req.put("token", s.token)
+	if s.tenant != "" {
+		req.put("tenant", s.tenant)
+	}
+	// the priority middleware runs after the script, the class is the one
+	// claimed by the token or else matching the decrypted backend
+	priority := s.priority
+	if priority == "" {
+		priority = priorityFor(addr)
+	}
+	req.put("priority", priority)
+	if tc := tlsConn(s.Conn); tc != nil && tc.ConnectionState().ServerName != "" {
+		req.put("server_name", tc.ConnectionState().ServerName)
+	}
+	if ip := addrIP(s.RemoteAddr()); ip != nil {
+		req.put("client_ip", ip.String())
+		req.put("client_port", float64(addrPort(s.RemoteAddr())))
+		if c := ipCountry(ip); c != "" {
+			req.put("country", c)
+		}
+		if asn := ipASN(ip); asn != 0 {
+			req.put("asn", float64(asn))
+		}
+	}
+
+	vals, err := luaCallValue(&luaState{}, rs.program().route, []luaValue{req})
+	if err != nil {
+		_MetricScriptErrors.Inc()
+		return "", fmt.Errorf("routing script failed: %v", err)
+	}
+	var action luaValue
+	if len(vals) > 1 {
+		action = vals[1]
+	}
+	switch action {
+	case nil, "allow":
+	case "deny":
+		return "", errScriptDenied
+	default:
+		_MetricScriptErrors.Inc()
+		return "", fmt.Errorf("routing script returned the invalid action %s", luaToString(action))
+	}
+	if len(vals) == 0 || vals[0] == nil {
+		return addr, nil
+	}
+	routed, ok := vals[0].(string)
+	if !ok {
+		_MetricScriptErrors.Inc()
+		return "", fmt.Errorf("routing script returned a %s instead of an address", luaTypeName(vals[0]))
+	}
+	return routed, nil
+}
+
+// luaArg returns argument i of a builtin, checked to be of type typ
+func luaArg(args []luaValue, i int, typ string) (luaValue, error) {
+	var v luaValue
+	if i < len(args) {
+		v = args[i]
+	}
+	if luaTypeName(v) != typ {
+		return nil, fmt.Errorf("bad argument #%d (%s expected, got %s)", i+1, typ, luaTypeName(v))
+	}
+	return v, nil
+}
+
+func luaStringFunc(f func(s string, args []luaValue) ([]luaValue, error)) luaBuiltin {
+	return func(args []luaValue) ([]luaValue, error) {
+		if n, err := luaArg(args, 0, "number"); err == nil {
+			args = append([]luaValue{luaToString(n)}, args[1:]...)
+		}
+		s, err := luaArg(args, 0, "string")
+		if err != nil {
+			return nil, err
+		}
+		return f(s.(string), args[1:])
+	}
+}
+
+// luaStringPair is a builtin of two strings
+func luaStringPair(f func(a, b string) luaValue) luaBuiltin {
+	return func(args []luaValue) ([]luaValue, error) {
+		a, err := luaArg(args, 0, "string")
+		if err != nil {
+			return nil, err
+		}
+		b, err := luaArg(args, 1, "string")
+		if err != nil {
+			return nil, err
+		}
+		return []luaValue{f(a.(string), b.(string))}, nil
+	}
+}
+
+// luaBuiltins returns the scope of the functions available to scripts: a
+// part of the Lua standard library and helpers for routing
+func luaBuiltins() *luaScope {
+	strs := newLuaTable()
+	strs.put("lower", luaStringFunc(func(s string, args []luaValue) ([]luaValue, error) {
+		return []luaValue{strings.ToLower(s)}, nil
+	}))
+	strs.put("upper", luaStringFunc(func(s string, args []luaValue) ([]luaValue, error) {
+		return []luaValue{strings.ToUpper(s)}, nil
+	}))
+	strs.put("len", luaStringFunc(func(s string, args []luaValue) ([]luaValue, error) {
+		return []luaValue{float64(len(s))}, nil
+	}))
+	strs.put("sub", luaStringFunc(func(s string, args []luaValue) ([]luaValue, error) {
+		i, j := 1, -1
+		if n, ok := luaToNumber(luaArgOrNil(args, 0)); ok {
+			i = int(n)
+		}
+		if n, ok := luaToNumber(luaArgOrNil(args, 1)); ok {
+			j = int(n)
+		}
+		if i < 0 {
+			i = len(s) + i + 1
+		}
+		if j < 0 {
+			j = len(s) + j + 1
+		}
+		if i < 1 {
+			i = 1
+		}
+		if j > len(s) {
+			j = len(s)
+		}
+		if i > j {
+			return []luaValue{""}, nil
+		}
+		return []luaValue{s[i-1 : j]}, nil
+	}))
+	// only plain searches, Lua patterns aren't supported
+	strs.put("find", luaStringFunc(func(s string, args []luaValue) ([]luaValue, error) {
+		sub, err := luaArg(args, 0, "string")
+		if err != nil {
+			return nil, fmt.Errorf("bad argument #2 (string expected, got %s)", luaTypeName(luaArgOrNil(args, 0)))
+		}
+		i := strings.Index(s, sub.(string))
+		if i < 0 {
+			return []luaValue{nil}, nil
+		}
+		return []luaValue{float64(i + 1), float64(i + len(sub.(string)))}, nil
+	}))
+
+	sc := newLuaScope(nil)
+	sc.vars["string"] = strs
+	sc.vars["ipairs"] = luaIterate(true)
+	sc.vars["pairs"] = luaIterate(false)
+	sc.vars["type"] = luaBuiltin(func(args []luaValue) ([]luaValue, error) {
+		return []luaValue{luaTypeName(luaArgOrNil(args, 0))}, nil
+	})
+	sc.vars["tostring"] = luaBuiltin(func(args []luaValue) ([]luaValue, error) {
+		return []luaValue{luaToString(luaArgOrNil(args, 0))}, nil
+	})
+	sc.vars["tonumber"] = luaBuiltin(func(args []luaValue) ([]luaValue, error) {
+		if n, ok := luaToNumber(luaArgOrNil(args, 0)); ok {
+			return []luaValue{n}, nil
+		}
+		return []luaValue{nil}, nil
+	})
+	sc.vars["error"] = luaBuiltin(func(args []luaValue) ([]luaValue, error) {
+		return nil, errors.New(luaToString(luaArgOrNil(args, 0)))
+	})
+	sc.vars["log"] = luaBuiltin(func(args []luaValue) ([]luaValue, error) {
+		var parts []string
+		for _, a := range args {
+			parts = append(parts, luaToString(a))
+		}
+		logger().Info("routing script", "msg", strings.Join(parts, " "))
+		return nil, nil
+	})
+
+	sc.vars["has_prefix"] = luaStringPair(func(s, prefix string) luaValue { return strings.HasPrefix(s, prefix) })
+	sc.vars["has_suffix"] = luaStringPair(func(s, suffix string) luaValue { return strings.HasSuffix(s, suffix) })
+	sc.vars["glob"] = luaStringPair(func(s, pattern string) luaValue {
+		ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(s))
+		return ok
+	})
+	// cidr(ip, nets) reports whether ip is in one of nets, a comma separated
+	// string or a table of networks or addresses
+	sc.vars["cidr"] = luaBuiltin(func(args []luaValue) ([]luaValue, error) {
+		ipArg, err := luaArg(args, 0, "string")
+		if err != nil {
+			return nil, err
+		}
+		var list []string
+		switch nets := luaArgOrNil(args, 1).(type) {
+		case string:
+			list = []string{nets}
+		case *luaTable:
+			for i := 1; i <= nets.length(); i++ {
+				list = append(list, luaToString(nets.get(float64(i))))
+			}
+		default:
+			return nil, fmt.Errorf("bad argument #2 (string or table expected, got %s)", luaTypeName(nets))
+		}
+		nets, err := parseIPNets(strings.Join(list, ","))
+		if err != nil {
+			return nil, err
+		}
+		ip := net.ParseIP(ipArg.(string))
+		return []luaValue{ip != nil && containsIP(nets, ip)}, nil
+	})
+	sc.vars["split_host_port"] = luaBuiltin(func(args []luaValue) ([]luaValue, error) {
+		addr, err := luaArg(args, 0, "string")
+		if err != nil {
+			return nil, err
+		}
+		host, port, err := net.SplitHostPort(addr.(string))
+		if err != nil {
+			return []luaValue{nil}, nil
+		}
+		p, _ := strconv.Atoi(port)
+		return []luaValue{host, float64(p)}, nil
+	})
+	sc.vars["join_host_port"] = luaBuiltin(func(args []luaValue) ([]luaValue, error) {
+		host, err := luaArg(args, 0, "string")
+		if err != nil {
+			return nil, err
+		}
+		return []luaValue{net.JoinHostPort(host.(string), luaToString(luaArgOrNil(args, 1)))}, nil
+	})
+	return sc
+}
+
+func luaArgOrNil(args []luaValue, i int) luaValue {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package frontd
+
+import (
+	"errors"
+	"io"
+
+	"github.com/xindong/frontd/seal"
+)
+
+// Tunnels of tokens with the encrypt=aes-256-gcm claim are sealed between the
+// client and frontd, see package seal, so what they carry stays private and
+// can't be tampered with even over plain TCP without TLS. Backends see the
+// plain bytes. The client sends its nonce right after the handshake, which
+// HTTP requests forwarded to the backend can't be followed by, and the
+// downstream ends with the final frame of package seal once the backend
+// closed it.
+
+var _MetricEncryptedTunnels = newCounter("frontd_encrypted_tunnels_total",
+	"Total number of tunnels relayed encrypted.")
+
+// readSealNonce reads the nonce of the client of a sealed tunnel, it refuses
+// the connection if it fails
+func readSealNonce(c *Conn) bool {
+	s := c.s
+	if s.encrypt == "" {
+		return true
+	}
+	if c.header != nil {
+		c.Refuse("4106", errors.New("encrypt claim on an HTTP request"))
+		return false
+	}
+	nonce := make([]byte, seal.NonceSize)
+	_, err := io.ReadFull(c.rdr, nonce)
+	if err != nil {
+		c.Refuse("4103", err)
+		return false
+	}
+	s.sealNonce = nonce
+	return true
+}
+
+// sealTunnel sends the nonce of frontd and seals both directions of the
+// tunnel of s, what is read from src and written to dst
+func sealTunnel(s *session, src io.Reader, dst io.Writer) (io.Reader, *seal.Writer, error) {
+	nonce, err := seal.NewNonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = s.Write(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	_MetricEncryptedTunnels.Inc()
+	secret := secretPassphrase()
+	return seal.NewReader(src, seal.UpstreamKey(secret, s.sealNonce, nonce)),
+		seal.NewWriter(dst, seal.DownstreamKey(secret, s.sealNonce, nonce)), nil
+}
@@ -0,0 +1,271 @@
+// Package seal encrypts and authenticates tunnels end to end between the
+// client and frontd. The client sends a random nonce right after the
+// handshake and frontd one before relaying. Each direction is a sequence of
+// frames of a 2 byte length and the data sealed with AES-256-GCM under a key
+// derived from the shared secret and both nonces, so a recorded tunnel can't
+// be replayed to another one, and the client writes once it read the nonce
+// of frontd. The nonce of a frame is its sequence number, so frames can't be
+// reordered, dropped or replayed within a tunnel without failing to open.
+// An empty frame ends each direction, so a tunnel cut short at a frame
+// boundary fails to open too.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Name is the value of the encrypt claim of sealed tunnels
+const Name = "aes-256-gcm"
+
+// NonceSize is the size of the nonce each side sends
+const NonceSize = 16
+
+const (
+	maxChunk   = 16 * 1024
+	headerSize = 2 // sealed length
+)
+
+var (
+	errOpen   = errors.New("seal: message authentication failed")
+	errClosed = errors.New("seal: write after close")
+)
+
+// NewNonce returns a random nonce
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+func key(label string, secret []byte, nonces ...[]byte) cipher.AEAD {
+	h := sha256.New()
+	h.Write([]byte(label))
+	h.Write(secret)
+	for _, n := range nonces {
+		h.Write(n)
+	}
+	block, _ := aes.NewCipher(h.Sum(nil))
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// UpstreamKey is the key of what the client sends
+func UpstreamKey(secret, clientNonce, serverNonce []byte) cipher.AEAD {
+	return key("frontd seal upstream\x00", secret, clientNonce, serverNonce)
+}
+
+// DownstreamKey is the key of what frontd sends
+func DownstreamKey(secret, clientNonce, serverNonce []byte) cipher.AEAD {
+	return key("frontd seal downstream\x00", secret, clientNonce, serverNonce)
+}
+
+func seqNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// serverNonce reads the nonce of frontd for both directions of a client,
+// whichever needs its key first
+type serverNonce struct {
+	r           io.Reader
+	secret      []byte
+	clientNonce []byte
+
+	mu       sync.Mutex
+	nonce    [NonceSize]byte
+	n        int // of the nonce read
+	up, down cipher.AEAD
+}
+
+// keys reads the nonce unless it already did, it keeps its state across
+// errors like Reader
+func (k *serverNonce) keys() (up, down cipher.AEAD, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for k.up == nil {
+		n, err := k.r.Read(k.nonce[k.n:])
+		k.n += n
+		if k.n == NonceSize {
+			k.up = UpstreamKey(k.secret, k.clientNonce, k.nonce[:])
+			k.down = DownstreamKey(k.secret, k.clientNonce, k.nonce[:])
+		} else if err != nil {
+			if err == io.EOF && k.n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, nil, err
+		}
+	}
+	return k.up, k.down, nil
+}
+
+// ready returns the upstream key if the nonce was read
+func (k *serverNonce) ready() cipher.AEAD {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.up
+}
+
+// Writer seals what is written to it
+type Writer struct {
+	w    io.Writer
+	aead cipher.AEAD
+	keys *serverNonce // of the client, see NewClient
+
+	mu     sync.Mutex
+	seq    uint64
+	closed bool
+}
+
+func NewWriter(w io.Writer, aead cipher.AEAD) *Writer {
+	return &Writer{w: w, aead: aead}
+}
+
+// NewClient returns the Reader and Writer of a client, the Reader reads the
+// nonce of frontd from r and then opens what it sends. Writes wait for the
+// nonce as well, reading it themselves if the Reader isn't.
+func NewClient(r io.Reader, w io.Writer, secret, clientNonce []byte) (*Reader, *Writer) {
+	keys := &serverNonce{r: r, secret: secret, clientNonce: clientNonce}
+	return &Reader{r: r, keys: keys}, &Writer{w: w, keys: keys}
+}
+
+// Write seals p in frames sent with a single write, so concurrent writes
+// don't interleave
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, errClosed
+	}
+	if w.aead == nil {
+		up, _, err := w.keys.keys()
+		if err != nil {
+			return 0, err
+		}
+		w.aead = up
+	}
+	var out []byte
+	for rest := p; len(rest) > 0; {
+		data := rest
+		if len(data) > maxChunk {
+			data = data[:maxChunk]
+		}
+		rest = rest[len(data):]
+		out = binary.BigEndian.AppendUint16(out, uint16(len(data)+w.aead.Overhead()))
+		out = w.aead.Seal(out, seqNonce(w.aead, w.seq), data, nil)
+		w.seq++
+	}
+	_, err := w.w.Write(out)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the stream with an empty frame, it doesn't close the writer
+// underneath. It sends nothing while a Write is in progress, or when the
+// Writer of a client has no key yet, which the other end then reads as
+// truncated.
+func (w *Writer) Close() error {
+	if !w.mu.TryLock() {
+		return nil
+	}
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.aead == nil {
+		if w.aead = w.keys.ready(); w.aead == nil {
+			return nil
+		}
+	}
+	out := binary.BigEndian.AppendUint16(nil, uint16(w.aead.Overhead()))
+	out = w.aead.Seal(out, seqNonce(w.aead, w.seq), nil, nil)
+	w.seq++
+	_, err := w.w.Write(out)
+	return err
+}
+
+// Reader opens the frames read from r. It keeps its state across errors, so
+// reads timing out mid-frame resume where they stopped. It returns io.EOF
+// once it opened the empty frame ending the stream, and
+// io.ErrUnexpectedEOF if r ends before it.
+type Reader struct {
+	r    io.Reader
+	aead cipher.AEAD
+	keys *serverNonce // of the client, see NewClient
+
+	hdr   [headerSize]byte
+	n     int // of the header or frame read
+	frame []byte
+	plain []byte // opened but not read
+	seq   uint64
+	eof   bool // the stream ended
+}
+
+func NewReader(r io.Reader, aead cipher.AEAD) *Reader {
+	return &Reader{r: r, aead: aead}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		switch {
+		case r.eof:
+			return 0, io.EOF
+		case r.aead == nil:
+			_, down, err := r.keys.keys()
+			if err != nil {
+				return 0, err
+			}
+			r.aead = down
+		case r.frame == nil:
+			n, err := r.r.Read(r.hdr[r.n:])
+			r.n += n
+			if r.n == headerSize {
+				r.n = 0
+				size := int(binary.BigEndian.Uint16(r.hdr[:]))
+				if size < r.aead.Overhead() {
+					return 0, errOpen
+				}
+				r.frame = make([]byte, size)
+			} else if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+		default:
+			n, err := r.r.Read(r.frame[r.n:])
+			r.n += n
+			if r.n == len(r.frame) {
+				plain, oerr := r.aead.Open(r.frame[:0], seqNonce(r.aead, r.seq), r.frame, nil)
+				if oerr != nil {
+					return 0, errOpen
+				}
+				r.seq++
+				r.n = 0
+				r.frame = nil
+				r.plain = plain
+				r.eof = len(plain) == 0
+			} else if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
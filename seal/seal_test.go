@@ -0,0 +1,147 @@
+package seal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+// trickle returns the bytes of b one at a time, failing every other read
+// with a timeout
+type trickle struct {
+	b    []byte
+	fail bool
+}
+
+func (t *trickle) Read(p []byte) (int, error) {
+	t.fail = !t.fail
+	if t.fail {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if len(t.b) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = t.b[0]
+	t.b = t.b[1:]
+	return 1, nil
+}
+
+func TestSeal(t *testing.T) {
+	secret := []byte("p0S8rX680*48")
+	clientNonce, _ := NewNonce()
+	serverNonce, _ := NewNonce()
+	msgs := [][]byte{[]byte("hello"), bytes.Repeat([]byte("plain text "), 5000), {}, []byte("end")}
+
+	var wire bytes.Buffer
+	wire.Write(serverNonce)
+	w := NewWriter(&wire, DownstreamKey(secret, clientNonce, serverNonce))
+	var plain []byte
+	for _, m := range msgs {
+		n, err := w.Write(m)
+		if err != nil || n != len(m) {
+			t.Fatal("not written:", n, err)
+		}
+		plain = append(plain, m...)
+	}
+	end := wire.Len()
+	if w.Close() != nil {
+		t.Fatal("not closed")
+	}
+	if _, err := w.Write(msgs[0]); err != errClosed {
+		t.Fatal("written after close:", err)
+	}
+	if bytes.Contains(wire.Bytes(), []byte("plain text")) {
+		t.Fatal("not sealed")
+	}
+
+	downstream := func(r io.Reader, secret []byte) *Reader {
+		cr, _ := NewClient(r, io.Discard, secret, clientNonce)
+		return cr
+	}
+	got, err := io.ReadAll(downstream(bytes.NewReader(wire.Bytes()), secret))
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatal("not opened:", len(got), err)
+	}
+
+	// reads resume after timeouts
+	r := downstream(&trickle{b: wire.Bytes()}, secret)
+	got = nil
+	buf := make([]byte, 100)
+	for {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("not opened across timeouts:", len(got))
+	}
+
+	// tampered, truncated and reordered frames fail, as do streams cut at a
+	// frame boundary
+	tampered := bytes.Clone(wire.Bytes())
+	tampered[len(tampered)-1] ^= 1
+	_, err = io.ReadAll(downstream(bytes.NewReader(tampered), secret))
+	if err != errOpen {
+		t.Error("tampered frame opened:", err)
+	}
+	_, err = io.ReadAll(downstream(bytes.NewReader(wire.Bytes()[:wire.Len()-1]), secret))
+	if err != io.ErrUnexpectedEOF {
+		t.Error("truncated frame opened:", err)
+	}
+	got, err = io.ReadAll(downstream(bytes.NewReader(wire.Bytes()[:end]), secret))
+	if err != io.ErrUnexpectedEOF || !bytes.Equal(got, plain) {
+		t.Error("truncated stream ended:", len(got), err)
+	}
+	var a, b bytes.Buffer
+	w = NewWriter(&a, UpstreamKey(secret, clientNonce, serverNonce))
+	w.Write([]byte("first"))
+	a.WriteTo(&b)
+	w.Write([]byte("second"))
+	a.Write(b.Bytes())
+	_, err = io.ReadAll(NewReader(&a, UpstreamKey(secret, clientNonce, serverNonce)))
+	if err != errOpen {
+		t.Error("reordered frame opened:", err)
+	}
+
+	// the keys depend on the secret and both nonces, and both directions
+	// differ
+	_, err = io.ReadAll(downstream(bytes.NewReader(wire.Bytes()), []byte("other")))
+	if err != errOpen {
+		t.Error("opened with another secret:", err)
+	}
+	_, err = io.ReadAll(NewReader(bytes.NewReader(wire.Bytes()[NonceSize:]), UpstreamKey(secret, clientNonce, serverNonce)))
+	if err != errOpen {
+		t.Error("opened with the upstream key:", err)
+	}
+	a.Reset()
+	w = NewWriter(&a, UpstreamKey(secret, clientNonce, serverNonce))
+	w.Write([]byte("replayed"))
+	otherNonce, _ := NewNonce()
+	_, err = io.ReadAll(NewReader(&a, UpstreamKey(secret, clientNonce, otherNonce)))
+	if err != errOpen {
+		t.Error("upstream replayed to another nonce of frontd:", err)
+	}
+
+	// the Writer of the client waits for the nonce of frontd
+	var up bytes.Buffer
+	cr, cw := NewClient(bytes.NewReader(wire.Bytes()), &up, secret, clientNonce)
+	if cw.Write([]byte("up")); up.Len() == 0 {
+		t.Fatal("client didn't write")
+	}
+	cw.Close()
+	got, err = io.ReadAll(NewReader(&up, UpstreamKey(secret, clientNonce, serverNonce)))
+	if err != nil || string(got) != "up" {
+		t.Error("upstream not opened:", string(got), err)
+	}
+	got, err = io.ReadAll(cr)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Error("downstream not opened after the Writer read the nonce:", len(got), err)
+	}
+}
@@ -0,0 +1,109 @@
+package frontd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/xindong/frontd/client"
+)
+
+// selftest tunnels to an echo backend it starts with a token encrypted by
+// the configured secret, through a relay started on loopback with the
+// configured settings or through a running frontd. It exits non-zero if the
+// round trip fails, e.g. for deploy verification or container health checks.
+func selftest(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	config := fs.String("config", "", "path of the TOML configuration `file` ($CONFIG_FILE)")
+	target := fs.String("target", "", "`addr` of a running frontd to test, which must allow loopback backends by BACKEND_ALLOW_INTERNAL, defaults to a relay started on loopback")
+	timeout := fs.Duration("timeout", time.Second*5, "`duration` the round trip may take")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+	if *config == "" {
+		*config = os.Getenv("CONFIG_FILE")
+	}
+	if *config != "" {
+		cfg, err := loadConfig(*config)
+		if err != nil {
+			fmt.Fprintln(stderr, "selftest failed:", err)
+			return 1
+		}
+		_Config.Store(cfg)
+	}
+
+	rtt, err := runSelftest(*target, *timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, "selftest failed:", err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "ok, round trip in %.1fms\n", rtt.Seconds()*1000)
+	return 0
+}
+
+func runSelftest(target string, timeout time.Duration) (time.Duration, error) {
+	err := applySettings()
+	if err != nil {
+		return 0, err
+	}
+	secret := secretPassphrase()
+	if len(secret) == 0 {
+		return 0, errors.New("SECRET not set")
+	}
+
+	echo, err := echoServer()
+	if err != nil {
+		return 0, fmt.Errorf("echo backend not started: %v", err)
+	}
+	defer echo.Close()
+	backend := echo.Addr().String()
+
+	if target == "" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, err
+		}
+		// loopback backends are refused by default, only the echo backend
+		// is allowed in addition to the configured networks
+		allow, _ := _BackendAllowInternal.Load().([]*net.IPNet)
+		ip := echo.Addr().(*net.TCPAddr).IP.To4()
+		_BackendAllowInternal.Store(append(allow[:len(allow):len(allow)], &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go serve(ctx, l)
+		target = l.Addr().String()
+	}
+
+	start := time.Now()
+	d := &client.Dialer{Gateway: target, Secret: secret, Timeout: timeout, Obfuscate: obfuscate()}
+	conn, err := d.Dial("tcp", backend)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(timeout))
+
+	out := make([]byte, 64)
+	rand.Read(out)
+	in := make([]byte, len(out))
+	_, err = conn.Write(out)
+	if err == nil {
+		_, err = io.ReadFull(conn, in)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(in, out) {
+		return 0, errors.New("echo mismatch")
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,170 @@
+package frontd
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config holds settings keyed by the names of their environment variables,
+// e.g. "SECRET" or "BACKEND_TIMEOUT", see LoadConfig. Settings missing from
+// Config are read from the environment.
+type Config map[string]string
+
+// LoadConfig reads a TOML configuration file in the format of the -config
+// flag
+func LoadConfig(path string) (Config, error) {
+	return loadConfig(path)
+}
+
+// Router maps the backend address decrypted from a handshake to the address
+// dialed. Returning an error refuses the client with 4111.
+type Router interface {
+	Route(addr string) (string, error)
+}
+
+// RouterFunc adapts a function to a Router
+type RouterFunc func(addr string) (string, error)
+
+func (f RouterFunc) Route(addr string) (string, error) {
+	return f(addr)
+}
+
+// _Router is set by Server.Serve, nil dials backends as decrypted
+var _Router atomic.Value // *routerHolder
+
+type routerHolder struct {
+	r Router
+}
+
+func router() Router {
+	h, _ := _Router.Load().(*routerHolder)
+	if h == nil {
+		return nil
+	}
+	return h.r
+}
+
+// Dialer connects to backends, *net.Dialer is one. DialContext is called
+// with the address mapped by the Router, network "tcp" and a context carrying
+// the BACKEND_TIMEOUT deadline.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// _Dialer is set by Server.Serve, nil dials with a net.Dialer
+var _Dialer atomic.Value // *dialerHolder
+
+type dialerHolder struct {
+	d Dialer
+}
+
+func dialer() Dialer {
+	h, _ := _Dialer.Load().(*dialerHolder)
+	if h == nil {
+		return nil
+	}
+	return h.d
+}
+
+// Cipher encrypts and decrypts backend addresses with the shared secret,
+// in the format clients send them in the handshake
+type Cipher struct {
+	secret []byte
+}
+
+func NewCipher(secret []byte) *Cipher {
+	return &Cipher{secret: secret}
+}
+
+// Encrypt returns the base64 encoded cipher address of addr
+func (c *Cipher) Encrypt(addr string) (string, error) {
+	b, err := _Aes256CBC.EncryptString(c.secret, []byte(addr))
+	return string(b), err
+}
+
+// Decrypt returns the backend address of a base64 encoded cipher address
+func (c *Cipher) Decrypt(cipherAddr string) (string, error) {
+	b, err := _Aes256CBC.DecryptString(c.secret, []byte(cipherAddr))
+	return string(b), err
+}
+
+// Server relays client connections to backends. Settings, metrics and the
+// admin API are process wide, so a process runs a single Server; Main runs
+// one configured by the command line.
+type Server struct {
+	// Config takes precedence over the environment like command line flags
+	Config Config
+	// Router maps backend addresses, nil dials them as decrypted
+	Router Router
+	// Dialer connects to backends, nil dials TCP. A *net.Dialer has the
+	// addresses it connects to checked like the default. Host names given to
+	// other Dialers are only checked by the BACKEND_ALLOW and BACKEND_DENY
+	// patterns, and the address they connected to if it's a TCP address.
+	Dialer Dialer
+	// Hooks are called at the stages of every connection, nil calls none
+	Hooks *Hooks
+	// Logger receives the records of the relay, nil writes JSON to stderr
+	// unless the frontd command configured logging
+	Logger *slog.Logger
+	// Middlewares handle connections along the built-in ones, by name in the
+	// order of the MIDDLEWARES setting, or last before the relay if not listed
+	Middlewares map[string]Middleware
+	// Transports wrap client connections, the one named by the TRANSPORT
+	// setting is used, replacing a built-in one of the same name
+	Transports map[string]ClientTransport
+
+	mu   sync.Mutex
+	l    net.Listener // guarded by mu
+	shut bool         // Shutdown was called
+}
+
+// Serve applies the settings and relays connections accepted on l until
+// Shutdown is called or ctx is done, which return nil, or accepting fails
+// permanently. Tunnels are torn down at once when ctx is done, Shutdown gives
+// them time to finish.
+func (srv *Server) Serve(ctx context.Context, l net.Listener) error {
+	if srv.Config != nil {
+		_Flags.Store(map[string]string(srv.Config))
+	}
+	if srv.Logger != nil {
+		_Logger.Store(srv.Logger)
+	}
+	// the chain is built by applySettings
+	_ServerMiddlewares.Store(srv.Middlewares)
+	_ServerTransports.Store(srv.Transports)
+	err := applySettings()
+	if err != nil {
+		return err
+	}
+	_Router.Store(&routerHolder{srv.Router})
+	_Dialer.Store(&dialerHolder{srv.Dialer})
+	_Hooks.Store(srv.Hooks)
+	srv.mu.Lock()
+	if srv.shut {
+		srv.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	srv.l = l
+	srv.mu.Unlock()
+	return serve(ctx, l)
+}
+
+// Shutdown stops accepting connections and waits up to timeout for tunnels
+// to finish, then closes the remaining ones and returns how many were closed.
+// A Serve called concurrently or afterwards returns at once.
+func (srv *Server) Shutdown(timeout time.Duration) int {
+	atomic.StoreInt32(&_Stopping, 1)
+	srv.mu.Lock()
+	srv.shut = true
+	l := srv.l
+	srv.mu.Unlock()
+	if l != nil {
+		l.Close()
+	}
+	return drainSessions(timeout)
+}
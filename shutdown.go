@@ -0,0 +1,106 @@
+package frontd
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// _ShutdownDelay is how long /healthz fails before the listener is
+	// closed, giving load balancers time to take frontd out of rotation
+	_ShutdownDelay time.Duration
+	// _DrainTimeout is how long established tunnels may take to finish
+	_DrainTimeout = time.Second * 30
+)
+
+var (
+	_Draining int32 // health checks fail
+	_Stopping int32 // the listener is closed on purpose
+
+	_ListenerMutex sync.Mutex
+	_Listener      net.Listener
+)
+
+func draining() bool {
+	return atomic.LoadInt32(&_Draining) == 1
+}
+
+func stopping() bool {
+	return atomic.LoadInt32(&_Stopping) == 1
+}
+
+func setListener(l net.Listener) {
+	_ListenerMutex.Lock()
+	_Listener = l
+	_ListenerMutex.Unlock()
+}
+
+// healthHandler fails once frontd is shutting down or in maintenance
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if draining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if maintenance() {
+		http.Error(w, "maintenance", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// shutdown stops accepting connections, listenAndServe returns after it
+func shutdown() {
+	if !atomic.CompareAndSwapInt32(&_Draining, 0, 1) {
+		return
+	}
+	logger().Info("shutting down", "delay", _ShutdownDelay.Seconds(), "drain_timeout", _DrainTimeout.Seconds())
+	sdNotify("STOPPING=1")
+	time.Sleep(_ShutdownDelay)
+	closeListener()
+}
+
+// closeListener makes listenAndServe return, established tunnels are kept
+func closeListener() {
+	atomic.StoreInt32(&_Stopping, 1)
+	_ListenerMutex.Lock()
+	if _Listener != nil {
+		_Listener.Close()
+	}
+	_ListenerMutex.Unlock()
+}
+
+// drainSessions waits up to timeout for live sessions to finish, then closes
+// the remaining ones and returns how many were closed
+func drainSessions(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		n := 0
+		_Sessions.Range(func(k, v interface{}) bool {
+			n++
+			return true
+		})
+		if n == 0 {
+			return 0
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return terminateConns(func(s *session) bool { return true })
+}
+
+// shutdownOnSignal starts a graceful shutdown on SIGTERM or SIGINT, a second
+// signal exits immediately
+func shutdownOnSignal() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	<-c
+	go shutdown()
+	<-c
+	logger().Warn("exiting without draining")
+	os.Exit(1)
+}
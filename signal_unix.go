@@ -0,0 +1,18 @@
+//go:build !windows
+
+package frontd
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	_SignalDumpStats os.Signal = syscall.SIGUSR1
+	_SignalUpgrade   os.Signal = syscall.SIGUSR2
+)
+
+// detachedProcAttr starts a daemon in a new session, without terminal
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
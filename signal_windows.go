@@ -0,0 +1,21 @@
+package frontd
+
+import (
+	"os"
+	"syscall"
+)
+
+// there are no user defined signals on Windows, stats dumps and upgrades
+// are not available
+var (
+	_SignalDumpStats os.Signal
+	_SignalUpgrade   os.Signal
+)
+
+// detachedProcAttr starts a daemon without console
+func detachedProcAttr() *syscall.SysProcAttr {
+	const detachedProcess = 0x00000008
+	return &syscall.SysProcAttr{
+		CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+}
@@ -0,0 +1,103 @@
+package frontd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// SNI_ROUTES makes frontd a TLS-aware edge for a small set of named services:
+// TLS clients asking for a routed server name skip the handshake, their
+// connection is relayed to the backend of the route over a new TLS
+// connection. The certificate of TLS_CERT_FILE must cover the names routed,
+// backends are verified against SNI_BACKEND_CA_FILE or the system roots for
+// the server name of the client.
+
+var (
+	_SNIRoutes atomic.Value // *sniRoutes
+
+	_MetricSNIRouted = newCounterVec("frontd_sni_routed_total",
+		"Total number of TLS connections routed by their server name, by route.", "route")
+)
+
+type sniRoutes struct {
+	routes []hostRoute
+	roots  *x509.CertPool // nil for the system roots
+}
+
+// loadSNIRoutes reads SNI_ROUTES and SNI_BACKEND_CA_FILE, it returns nil
+// without routes
+func loadSNIRoutes() (*sniRoutes, error) {
+	routes, err := parseHostRoutes(getenv("SNI_ROUTES"))
+	if err != nil || len(routes) == 0 {
+		return nil, err
+	}
+	r := &sniRoutes{routes: routes}
+	if caFile := getenv("SNI_BACKEND_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		r.roots = x509.NewCertPool()
+		if !r.roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+	}
+	return r, nil
+}
+
+// routeSNI returns the backend of the first route matching the server name
+// the TLS client of s asked for, or empty if none does or s isn't TLS
+func routeSNI(s *session) string {
+	r, _ := _SNIRoutes.Load().(*sniRoutes)
+	tc := tlsConn(s.Conn)
+	if r == nil || tc == nil {
+		return ""
+	}
+	name := tc.ConnectionState().ServerName
+	if name == "" {
+		return ""
+	}
+	for _, route := range r.routes {
+		if route.match(name) {
+			_MetricSNIRouted.With(route.host).Inc()
+			s.sp.SetAttr("tls.server_name", name)
+			s.backendTLS = name
+			return route.backend
+		}
+	}
+	return ""
+}
+
+// clientTLS re-encrypts the connection to the backend of a routed server
+// name, offering the protocol negotiated with the client, until ctx is done
+// or the timeout elapsed
+func clientTLS(ctx context.Context, s *session, backend net.Conn, timeout time.Duration) (net.Conn, error) {
+	r, _ := _SNIRoutes.Load().(*sniRoutes)
+	if r == nil {
+		return nil, errors.New("sni routes removed")
+	}
+	cfg := &tls.Config{ServerName: s.backendTLS, RootCAs: r.roots, MinVersion: tls.VersionTLS12}
+	if tc := tlsConn(s.Conn); tc != nil {
+		if proto := tc.ConnectionState().NegotiatedProtocol; proto != "" && proto != _ALPNTunnel {
+			cfg.NextProtos = []string{proto}
+		}
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	tc := tls.Client(backend, cfg)
+	err := tc.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
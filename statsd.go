@@ -0,0 +1,150 @@
+package frontd
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum payload of a single statsd datagram, fits common ethernet MTU
+const _StatsdMaxPacketSize = 1432
+
+// label values such as backend addresses are folded into metric names
+var _StatsdNameReplacer = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_")
+
+// _Statsd is nil unless STATSD_ADDR is configured
+var _Statsd *statsdSink
+
+// statsdSink periodically pushes the registered metrics to a statsd server.
+// Counters are sent as deltas, gauges as absolute values and histograms as
+// timings in milliseconds at the moment they are observed.
+type statsdSink struct {
+	conn      net.Conn
+	prefix    string
+	tags      []string
+	dogstatsd bool
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	last map[string]float64 // last sent counter values, to compute deltas
+}
+
+// newStatsdSink creates a sink sending to addr over UDP. tags are only sent
+// in DogStatsD mode, otherwise metric labels are folded into the name.
+func newStatsdSink(addr, prefix string, tags []string, dogstatsd bool) (*statsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{
+		conn:      conn,
+		prefix:    prefix,
+		tags:      tags,
+		dogstatsd: dogstatsd,
+		last:      make(map[string]float64),
+	}, nil
+}
+
+// name converts a prometheus style metric name to a statsd one
+func (s *statsdSink) name(name string, labels, values []string) (string, []string) {
+	name = s.prefix + strings.TrimPrefix(name, "frontd_")
+	if s.dogstatsd {
+		tags := make([]string, 0, len(s.tags)+len(labels))
+		tags = append(tags, s.tags...)
+		for i, l := range labels {
+			tags = append(tags, l+":"+values[i])
+		}
+		return name, tags
+	}
+	for _, v := range values {
+		name += "." + _StatsdNameReplacer.Replace(v)
+	}
+	return name, nil
+}
+
+func (s *statsdSink) line(name, value, typ string, tags []string) string {
+	l := name + ":" + value + "|" + typ
+	if len(tags) > 0 {
+		l += "|#" + strings.Join(tags, ",")
+	}
+	return l
+}
+
+// add queues a line, flushing first if the datagram would grow too large
+func (s *statsdSink) add(l string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.buf.Len() > 0 && s.buf.Len()+1+len(l) > _StatsdMaxPacketSize {
+		s.flushLocked()
+	}
+	if s.buf.Len() > 0 {
+		s.buf.WriteByte('\n')
+	}
+	s.buf.WriteString(l)
+}
+
+func (s *statsdSink) flushLocked() {
+	if s.buf.Len() == 0 {
+		return
+	}
+	// statsd is best effort, a lost datagram only loses samples
+	s.conn.Write(s.buf.Bytes())
+	s.buf.Reset()
+}
+
+func (s *statsdSink) flush() {
+	s.mu.Lock()
+	s.flushLocked()
+	s.mu.Unlock()
+}
+
+// timing queues a histogram observation in seconds as a timing in ms
+func (s *statsdSink) timing(name string, seconds float64) {
+	n, tags := s.name(strings.TrimSuffix(name, "_seconds"), nil, nil)
+	s.add(s.line(n, strconv.FormatFloat(seconds*1000, 'f', 3, 64), "ms", tags))
+}
+
+// report queues the current value of every counter and gauge and flush
+func (s *statsdSink) report() {
+	collectMetrics(func(name, typ string, labels, values []string, v float64) {
+		n, tags := s.name(name, labels, values)
+		switch typ {
+		case "counter":
+			key := n + "|" + strings.Join(tags, ",")
+			s.mu.Lock()
+			delta := v - s.last[key]
+			s.last[key] = v
+			s.mu.Unlock()
+			if delta > 0 {
+				s.add(s.line(strings.TrimSuffix(n, "_total"), formatFloat(delta), "c", tags))
+			}
+		case "gauge":
+			s.add(s.line(n, formatFloat(v), "g", tags))
+		}
+	})
+	s.flush()
+}
+
+func (s *statsdSink) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.report()
+	}
+}
+
+func startStatsd(addr, prefix, tags string, dogstatsd bool, interval time.Duration) {
+	var t []string
+	if tags != "" {
+		t = strings.Split(tags, ",")
+	}
+	s, err := newStatsdSink(addr, prefix, t, dogstatsd)
+	if err != nil {
+		logger().Error("statsd disabled", "err", err)
+		return
+	}
+	_Statsd = s
+	go s.run(interval)
+}
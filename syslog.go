@@ -0,0 +1,164 @@
+package frontd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _SyslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogWriter sends RFC 5424 messages to a local or remote syslog daemon
+type syslogWriter struct {
+	network  string
+	addr     string
+	facility int
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newSyslogWriter parses addr which is "local" for the local daemon,
+// "udp://host:port" or "tcp://host:port"
+func newSyslogWriter(addr, facility string) (*syslogWriter, error) {
+	f, ok := _SyslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+
+	w := &syslogWriter{facility: f}
+	w.hostname, _ = os.Hostname()
+	if w.hostname == "" {
+		w.hostname = "-"
+	}
+
+	switch {
+	case addr == "local":
+		w.network = "unixgram"
+	case strings.HasPrefix(addr, "udp://"):
+		w.network, w.addr = "udp", strings.TrimPrefix(addr, "udp://")
+	case strings.HasPrefix(addr, "tcp://"):
+		w.network, w.addr = "tcp", strings.TrimPrefix(addr, "tcp://")
+	default:
+		return nil, fmt.Errorf("invalid syslog address %q", addr)
+	}
+
+	return w, w.connect()
+}
+
+func (w *syslogWriter) connect() (err error) {
+	if w.network != "unixgram" {
+		w.conn, err = net.DialTimeout(w.network, w.addr, time.Second*5)
+		return err
+	}
+	for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+		w.conn, err = net.Dial("unixgram", path)
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.New("local syslog daemon not found")
+}
+
+// severity maps slog levels to syslog severities
+func severity(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3
+	case l >= slog.LevelWarn:
+		return 4
+	case l >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
+
+func (w *syslogWriter) write(l slog.Level, t time.Time, msg []byte) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s frontd %d - - ", w.facility*8+severity(l),
+		t.Format("2006-01-02T15:04:05.000000Z07:00"), w.hostname, os.Getpid())
+	b.Write(msg)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil {
+		err := w.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if w.network == "tcp" {
+		// octet counting framing, RFC 6587
+		_, err = w.conn.Write(append([]byte(strconv.Itoa(b.Len())+" "), b.Bytes()...))
+	} else {
+		_, err = w.conn.Write(b.Bytes())
+	}
+	if err != nil {
+		// reconnect on next write
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+// syslogHandler formats records with the configured log format and sends
+// each of them as one syslog message
+type syslogHandler struct {
+	w     *syslogWriter
+	newH  func(io.Writer) slog.Handler
+	level slog.Leveler
+	ops   []func(slog.Handler) slog.Handler // WithAttrs and WithGroup calls
+}
+
+func newSyslogHandler(w *syslogWriter, level slog.Leveler, newH func(io.Writer) slog.Handler) *syslogHandler {
+	return &syslogHandler{w: w, newH: newH, level: level}
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	fh := h.newH(&buf)
+	for _, op := range h.ops {
+		fh = op(fh)
+	}
+	err := fh.Handle(ctx, r)
+	if err != nil {
+		return err
+	}
+	return h.w.write(r.Level, r.Time, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+func (h *syslogHandler) with(op func(slog.Handler) slog.Handler) *syslogHandler {
+	h2 := *h
+	h2.ops = append(h.ops[:len(h.ops):len(h.ops)], op)
+	return &h2
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(fh slog.Handler) slog.Handler { return fh.WithAttrs(attrs) })
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(fh slog.Handler) slog.Handler { return fh.WithGroup(name) })
+}
@@ -0,0 +1,103 @@
+package frontd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// _AcceptFailingSince is when accept started failing persistently, in unix
+// nanoseconds, or 0 while connections are accepted
+var _AcceptFailingSince int64
+
+func acceptFailed() {
+	atomic.CompareAndSwapInt64(&_AcceptFailingSince, 0, time.Now().UnixNano())
+}
+
+func acceptSucceeded() {
+	atomic.StoreInt64(&_AcceptFailingSince, 0)
+}
+
+// acceptHealthy reports false once accept has been failing for longer than d,
+// e.g. because file descriptors are exhausted
+func acceptHealthy(d time.Duration) bool {
+	since := atomic.LoadInt64(&_AcceptFailingSince)
+	return since == 0 || time.Since(time.Unix(0, since)) < d
+}
+
+// systemdListener returns the first socket passed by systemd socket
+// activation, see sd_listen_fds(3), or nil if there is none. It allows
+// listening on privileged ports without ever running as root.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// passed descriptors start at 3
+	f := os.NewFile(3, "systemd")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	logger().Info("listener passed by systemd", "addr", l.Addr().String())
+	return l, nil
+}
+
+// sdNotify sends a state to systemd, see sd_notify(3). It does nothing unless
+// frontd is started by systemd with Type=notify.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		// abstract socket
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdReady tells systemd frontd is accepting connections, MAINPID lets a
+// process started by an upgrade take over supervision
+func sdReady() {
+	err := sdNotify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid()))
+	if err != nil {
+		logger().Warn("systemd notification failed", "err", err)
+	}
+}
+
+// sdWatchdog pings the systemd watchdog at half the configured interval as
+// long as connections can be accepted, so a wedged relay gets restarted
+func sdWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	for range time.Tick(interval) {
+		if !acceptHealthy(interval) {
+			logger().Error("accept failing, withholding watchdog ping")
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
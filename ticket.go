@@ -0,0 +1,138 @@
+package frontd
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Clients reconnecting often, e.g. flapping mobile ones, can ask for a
+// session ticket with the binary handshake starting with 0x02 instead of
+// 0x00. Once the backend is connected, frontd sends them a ticket frame
+// before relaying: 0x02, the length of the ticket in 2 bytes and the ticket,
+// empty if tickets are disabled. The handshake 0x03, the length in 2 bytes
+// and the ticket then routes at once, skipping the decryption of the cipher
+// address, and is answered with a renewed ticket.
+//
+// Tickets seal the address with its claims, the hash of its token and their
+// expiry with AES-GCM under a key derived from the secret, so changing the
+// secret revokes them. They can be presented again until they expire, which
+// REPLAY_WINDOW doesn't prevent.
+
+const (
+	_HandshakeTicket = 0x02 // binary handshake asking for a ticket
+	_HandshakeResume = 0x03 // handshake presenting a ticket
+	_TicketFrame     = 0x02
+)
+
+var (
+	_TicketLifetime int64 = int64(time.Hour) // nanoseconds, 0 disables tickets
+
+	errTicketInvalid = errors.New("invalid ticket")
+	errTicketExpired = errors.New("ticket expired")
+
+	_MetricTicketsIssued = newCounter("frontd_tickets_issued_total",
+		"Total number of session tickets sent to clients.")
+	_MetricTicketResumptions = newCounterVec("frontd_ticket_resumptions_total",
+		"Total number of handshakes presenting a session ticket, by result.", "result")
+)
+
+func ticketLifetime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&_TicketLifetime))
+}
+
+func ticketAEAD() cipher.AEAD {
+	key := sha256.Sum256(append([]byte("frontd ticket\x00"), secretPassphrase()...))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+// sealTicket returns the ticket of addr and the hash of its token
+func sealTicket(addr []byte, token string, expiry time.Time) []byte {
+	aead := ticketAEAD()
+	plain := binary.BigEndian.AppendUint64(nil, uint64(expiry.Unix()))
+	plain = append(plain, byte(len(token)))
+	plain = append(plain, token...)
+	plain = append(plain, addr...)
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plain, nil)
+}
+
+// openTicket returns the address and the hash of the token of a ticket
+func openTicket(ticket []byte, now time.Time) (addr []byte, token string, err error) {
+	aead := ticketAEAD()
+	if len(ticket) < aead.NonceSize() {
+		return nil, "", errTicketInvalid
+	}
+	plain, err := aead.Open(nil, ticket[:aead.NonceSize()], ticket[aead.NonceSize():], nil)
+	if err != nil || len(plain) < 9 || len(plain) < 9+int(plain[8]) {
+		return nil, "", errTicketInvalid
+	}
+	if now.Unix() >= int64(binary.BigEndian.Uint64(plain)) {
+		return nil, "", errTicketExpired
+	}
+	n := 9 + int(plain[8])
+	return plain[n:], string(plain[9:n]), nil
+}
+
+// handleResumeHdr reads the ticket of the handshake 0x03, whose first byte
+// was read, and returns its address
+func handleResumeHdr(rdr *bufio.Reader, s *session) ([]byte, error) {
+	s.log.Debug("handshake", "mode", "ticket")
+	var l [2]byte
+	_, err := io.ReadFull(rdr, l[:])
+	if err != nil || binary.BigEndian.Uint16(l[:]) == 0 {
+		if err == nil {
+			err = errors.New("empty ticket")
+		}
+		writeErrCode(s, []byte("4103"), false)
+		return nil, err
+	}
+	ticket := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(rdr, ticket)
+	if err != nil {
+		writeErrCode(s, []byte("4109"), false)
+		return nil, err
+	}
+	s.received = time.Now()
+
+	addr, token, err := openTicket(ticket, s.received)
+	if err == nil && ticketLifetime() <= 0 {
+		err = errors.New("tickets disabled")
+	}
+	if err != nil {
+		result := "invalid"
+		if errors.Is(err, errTicketExpired) {
+			result = "expired"
+		}
+		_MetricTicketResumptions.With(result).Inc()
+		writeErrCode(s, decryptErrCode(err), false)
+		return nil, err
+	}
+	_MetricTicketResumptions.With("ok").Inc()
+	s.token = token
+	s.ticketAddr = addr
+	return addr, nil
+}
+
+// ticketFrame returns the frame of a new ticket of the session, with an
+// empty ticket if tickets are disabled
+func ticketFrame(s *session) []byte {
+	var ticket []byte
+	if lifetime := ticketLifetime(); lifetime > 0 {
+		ticket = sealTicket(s.ticketAddr, s.token, time.Now().Add(lifetime))
+		_MetricTicketsIssued.Inc()
+	}
+	frame := []byte{_TicketFrame}
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(ticket)))
+	return append(frame, ticket...)
+}
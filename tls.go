@@ -0,0 +1,101 @@
+package frontd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// With TLS_CERT_FILE and TLS_KEY_FILE set, the listener terminates TLS and
+// clients choose how they are handled by ALPN: "frontd" for the binary or
+// text handshake of a raw tunnel, "http/1.1" for HTTP, whether a request
+// carrying X-Cipher-Origin forwarded with the tunnel, e.g. a WebSocket
+// upgrade, or an HTTP CONNECT. Clients negotiating no protocol have their
+// handshake detected as on plain listeners, so one port serves them all.
+// The certificate is reloaded with the configuration.
+
+const (
+	_ALPNTunnel = "frontd"
+	_ALPNHTTP   = "http/1.1"
+)
+
+var _TLSCert atomic.Value // *tls.Certificate, nil without TLS
+
+func tlsCert() *tls.Certificate {
+	c, _ := _TLSCert.Load().(*tls.Certificate)
+	return c
+}
+
+// loadTLSCert reads TLS_CERT_FILE and TLS_KEY_FILE, it returns nil without
+// them
+func loadTLSCert() (*tls.Certificate, error) {
+	certFile, keyFile := getenv("TLS_CERT_FILE"), getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// tlsConfig serves the current certificate
+func tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := tlsCert()
+			if cert == nil {
+				return nil, errors.New("no certificate")
+			}
+			return cert, nil
+		},
+		GetEncryptedClientHelloKeys: func(*tls.ClientHelloInfo) ([]tls.EncryptedClientHelloKey, error) {
+			return echKeys(), nil
+		},
+		NextProtos: []string{_ALPNTunnel, _ALPNHTTP},
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// tlsConn returns the TLS connection of c, also under wrappers exposing the
+// connection they wrap, or nil if c isn't one
+func tlsConn(c net.Conn) *tls.Conn {
+	for {
+		switch conn := c.(type) {
+		case *tls.Conn:
+			return conn
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// negotiateALPN completes the TLS handshake of the session, if it's TLS,
+// until ctx is done and returns the protocol the client chose, empty if none
+func negotiateALPN(ctx context.Context, s *session) (string, error) {
+	tc := tlsConn(s.Conn)
+	if tc == nil {
+		return "", nil
+	}
+	err := tc.HandshakeContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	state := tc.ConnectionState()
+	if state.ECHAccepted {
+		_MetricECHAccepted.Inc()
+		s.sp.SetAttr("tls.ech", true)
+	}
+	if state.NegotiatedProtocol != "" {
+		s.sp.SetAttr("tls.alpn", state.NegotiatedProtocol)
+	}
+	return state.NegotiatedProtocol, nil
+}
@@ -0,0 +1,294 @@
+package frontd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal OpenTelemetry tracing, spans are exported with OTLP/HTTP in its
+// JSON encoding so no SDK is required.
+
+// span kinds as defined by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const (
+	_TracingBatchSize  = 512
+	_TracingQueueSize  = 8192
+	_TracingFlushDelay = time.Second * 5
+)
+
+// _Tracer is nil unless OTEL_EXPORTER_OTLP_ENDPOINT is configured
+var _Tracer *otlpExporter
+
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu     sync.Mutex
+	attrs  []otlpKeyValue
+	errMsg string
+}
+
+// startSpan starts a root span, it returns nil if tracing is disabled.
+// All span methods are safe to call on a nil span.
+func startSpan(name string, kind int) *span {
+	if _Tracer == nil {
+		return nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now()}
+	rand.Read(s.traceID[:])
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// child starts a span sharing the trace of s
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{name: name, kind: kind, start: time.Now()}
+	s.mu.Lock()
+	c.traceID = s.traceID
+	c.parentID = s.spanID
+	s.mu.Unlock()
+	rand.Read(c.spanID[:])
+	return c
+}
+
+// SetAttr records an attribute, v should be a string, int, int64 or bool
+func (s *span) SetAttr(key string, v interface{}) {
+	if s == nil {
+		return
+	}
+	var av otlpAnyValue
+	switch v := v.(type) {
+	case string:
+		av.StringValue = &v
+	case int:
+		i := strconv.Itoa(v)
+		av.IntValue = &i
+	case int64:
+		i := strconv.FormatInt(v, 10)
+		av.IntValue = &i
+	case bool:
+		av.BoolValue = &v
+	default:
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, otlpKeyValue{Key: key, Value: av})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// TraceParent returns the W3C traceparent header value pointing at s
+func (s *span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// SetTraceParent makes s a child of a remote span from a W3C traceparent
+// header value, spans already started from s are not affected
+func (s *span) SetTraceParent(tp string) {
+	if s == nil {
+		return
+	}
+	parts := strings.Split(strings.TrimSpace(tp), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return
+	}
+	var traceID [16]byte
+	var parentID [8]byte
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.traceID = traceID
+	s.parentID = parentID
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+
+	s.mu.Lock()
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.errMsg != "" {
+		o.Status = &otlpStatus{Code: 2, Message: s.errMsg}
+	}
+	s.mu.Unlock()
+
+	_Tracer.enqueue(o)
+}
+
+// OTLP/JSON wire types, see opentelemetry-proto trace/v1/trace.proto
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+// otlpExporter batches finished spans and posts them to an OTLP collector
+type otlpExporter struct {
+	url     string
+	service string
+	queue   chan otlpSpan
+	client  *http.Client
+}
+
+func newOTLPExporter(endpoint, service string) *otlpExporter {
+	return &otlpExporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		queue:   make(chan otlpSpan, _TracingQueueSize),
+		client:  &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// enqueue never blocks, spans are dropped if the exporter falls behind
+func (e *otlpExporter) enqueue(s otlpSpan) {
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+func (e *otlpExporter) run() {
+	batch := make([]otlpSpan, 0, _TracingBatchSize)
+	tick := time.NewTicker(_TracingFlushDelay)
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < _TracingBatchSize {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		err := e.export(batch)
+		if err != nil {
+			logger().Warn("span export failed", "err", err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func (e *otlpExporter) export(spans []otlpSpan) error {
+	var rs otlpResourceSpans
+	service := e.service
+	rs.Resource.Attributes = []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: &service}}}
+	ss := otlpScopeSpans{Spans: spans}
+	ss.Scope.Name = "frontd"
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+
+	b, err := json.Marshal(otlpExportRequest{ResourceSpans: []otlpResourceSpans{rs}})
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp export failed with http status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func startTracing(endpoint, service string) {
+	_Tracer = newOTLPExporter(endpoint, service)
+	go _Tracer.run()
+}
@@ -0,0 +1,121 @@
+package frontd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/xindong/frontd/obfs"
+)
+
+// TRANSPORT names the ClientTransport deciding how the client leg looks on
+// the wire: "plain" leaves connections as they are, "scramble" scrambles
+// and pads them with the obfs package, with up to OBFUSCATE_PADDING bytes
+// per frame, and Server.Transports adds further ones. OBFUSCATE is short
+// for TRANSPORT=scramble. Clients must use the same transport, the cipher
+// address still authenticates them.
+
+// ClientTransport wraps accepted client connections before the handshake is
+// read, frontd reads from and writes to the client through the returned
+// connection only. Wrap may exchange data with the client, it's bounded by
+// CONN_READ_TIMEOUT, and an error closes the connection.
+type ClientTransport interface {
+	Wrap(c net.Conn, secret []byte) (net.Conn, error)
+}
+
+// ClientTransportFunc adapts a function to a ClientTransport
+type ClientTransportFunc func(c net.Conn, secret []byte) (net.Conn, error)
+
+func (f ClientTransportFunc) Wrap(c net.Conn, secret []byte) (net.Conn, error) {
+	return f(c, secret)
+}
+
+const _DefaultTransport = "plain"
+
+// _Transports are the built-in transports
+var _Transports = map[string]ClientTransport{
+	"plain":    nil,
+	"scramble": ClientTransportFunc(scramble),
+}
+
+var (
+	// _ServerTransports is set by Server.Serve
+	_ServerTransports atomic.Value // map[string]ClientTransport
+	_Transport        atomic.Value // *transportHolder
+
+	_ObfsMaxPadding int64 = obfs.DefaultPadding // bytes per frame
+)
+
+type transportHolder struct {
+	name string
+	t    ClientTransport // nil for plain
+}
+
+// clientTransport returns the transport wrapping client connections and its
+// name, nil for plain ones
+func clientTransport() (ClientTransport, string) {
+	h, _ := _Transport.Load().(*transportHolder)
+	if h == nil {
+		return nil, _DefaultTransport
+	}
+	return h.t, h.name
+}
+
+// obfuscate reports whether clients must scramble their connections
+func obfuscate() bool {
+	_, name := clientTransport()
+	return name == "scramble"
+}
+
+func obfsMaxPadding() int {
+	return int(atomic.LoadInt64(&_ObfsMaxPadding))
+}
+
+func scramble(c net.Conn, secret []byte) (net.Conn, error) {
+	return obfs.NewConn(c, obfs.Key(secret), obfsMaxPadding()), nil
+}
+
+// findTransport returns the transport named name, those of the Server
+// replacing built-in ones
+func findTransport(name string) (*transportHolder, error) {
+	extra, _ := _ServerTransports.Load().(map[string]ClientTransport)
+	if t, ok := extra[name]; ok && t != nil {
+		return &transportHolder{name, t}, nil
+	}
+	t, ok := _Transports[name]
+	if !ok {
+		var names []string
+		for n := range _Transports {
+			names = append(names, n)
+		}
+		for n := range extra {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown transport %q, one of %s expected", name, strings.Join(names, ", "))
+	}
+	return &transportHolder{name, t}, nil
+}
+
+func checkTransport(v string) error {
+	_, err := findTransport(v)
+	return err
+}
+
+// loadTransport reads TRANSPORT and OBFUSCATE
+func loadTransport() (*transportHolder, error) {
+	name := getenv("TRANSPORT")
+	if ob, _ := strconv.ParseBool(getenv("OBFUSCATE")); ob {
+		if name != "" && name != "scramble" {
+			return nil, fmt.Errorf("OBFUSCATE conflicts with TRANSPORT %s", name)
+		}
+		name = "scramble"
+	}
+	if name == "" {
+		name = _DefaultTransport
+	}
+	return findTransport(name)
+}
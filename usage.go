@@ -0,0 +1,426 @@
+package frontd
+
+import (
+	"encoding/csv"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With USAGE_FILE frontd accounts the sessions and bytes of every token, by
+// the hash of its cipher address, of every tenant claimed by tokens and of
+// every backend, and keeps them in the file across restarts so operators can
+// bill or audit usage over time. The counts are kept in memory and written
+// to the file atomically every USAGE_FLUSH_INTERVAL and on exit, what a
+// crash loses is bounded by the interval. Tokens, tenants or backends beyond
+// _MaxUsageEntries are only counted by frontd_usage_dropped_total. The
+// admin API reports the usage of every UTC day of the last
+// _UsageRetentionDays at /usage.
+
+const _MaxUsageEntries = 1024 * 1024
+
+var (
+	_UsageFile          atomic.Value // string, set by Main
+	_UsageFlushInterval = time.Second * 60
+
+	_Usage = newUsageStore()
+
+	_MetricUsageDropped = newCounter("frontd_usage_dropped_total",
+		"Total number of sessions not accounted as their token, tenant or backend exceeded the usage entries.")
+)
+
+// usageFile returns USAGE_FILE, empty if usage isn't accounted
+func usageFile() string {
+	path, _ := _UsageFile.Load().(string)
+	return path
+}
+
+// usageCounts is the usage of a token, tenant or backend
+type usageCounts struct {
+	Conns     uint64
+	BytesUp   uint64
+	BytesDown uint64
+	First     time.Time // end of the first session
+	Last      time.Time // end of the last session
+}
+
+func (u *usageCounts) add(up, down uint64, at time.Time) {
+	if u.Conns == 0 {
+		u.First = at
+	}
+	u.Conns++
+	u.BytesUp += up
+	u.BytesDown += down
+	u.Last = at
+}
+
+// usageTable is the usage of every token, tenant and backend over a period
+type usageTable struct {
+	Tokens   map[string]usageCounts
+	Tenants  map[string]usageCounts
+	Backends map[string]usageCounts
+}
+
+// usageSnapshot is the on-disk form of the usage store
+type usageSnapshot struct {
+	Since    time.Time // start of the accounting
+	Tokens   map[string]usageCounts
+	Tenants  map[string]usageCounts
+	Backends map[string]usageCounts
+	Days     map[string]usageTable // by UTC day, see _UsageDayLayout
+}
+
+const (
+	_UsageDayLayout     = "2006-01-02"
+	_UsageRetentionDays = 400 // days kept for reports, totals are kept forever
+)
+
+type usageMaps struct {
+	tokens   map[string]*usageCounts
+	tenants  map[string]*usageCounts
+	backends map[string]*usageCounts
+}
+
+func newUsageMaps() *usageMaps {
+	return &usageMaps{
+		tokens:   make(map[string]*usageCounts),
+		tenants:  make(map[string]*usageCounts),
+		backends: make(map[string]*usageCounts),
+	}
+}
+
+// by returns the usage of every token, tenant or backend
+func (m *usageMaps) by(kind string) map[string]*usageCounts {
+	switch kind {
+	case "tenant":
+		return m.tenants
+	case "backend":
+		return m.backends
+	}
+	return m.tokens
+}
+
+func (m *usageMaps) table() usageTable {
+	return usageTable{Tokens: copyUsage(m.tokens), Tenants: copyUsage(m.tenants), Backends: copyUsage(m.backends)}
+}
+
+func (t usageTable) maps() *usageMaps {
+	return &usageMaps{tokens: restoreUsage(t.Tokens), tenants: restoreUsage(t.Tenants), backends: restoreUsage(t.Backends)}
+}
+
+// account adds a session to the usage of m[key], it reports whether there
+// was room for it
+func account(m map[string]*usageCounts, key string, up, down uint64, at time.Time) bool {
+	u, ok := m[key]
+	if !ok {
+		if len(m) >= _MaxUsageEntries {
+			return false
+		}
+		u = &usageCounts{}
+		m[key] = u
+	}
+	u.add(up, down, at)
+	return true
+}
+
+func (m *usageMaps) record(token, tenant, backend string, up, down uint64, at time.Time) bool {
+	ok := true
+	if token != "" {
+		ok = account(m.tokens, token, up, down, at)
+	}
+	if tenant != "" {
+		ok = account(m.tenants, tenant, up, down, at) && ok
+	}
+	if backend != "" {
+		ok = account(m.backends, backend, up, down, at) && ok
+	}
+	return ok
+}
+
+func copyUsage(m map[string]*usageCounts) map[string]usageCounts {
+	c := make(map[string]usageCounts, len(m))
+	for k, u := range m {
+		c[k] = *u
+	}
+	return c
+}
+
+func restoreUsage(m map[string]usageCounts) map[string]*usageCounts {
+	c := make(map[string]*usageCounts, len(m))
+	for k, u := range m {
+		c[k] = &u
+	}
+	return c
+}
+
+type usageStore struct {
+	mu    sync.Mutex
+	since time.Time
+	total *usageMaps
+	days  map[string]*usageMaps
+}
+
+func newUsageStore() *usageStore {
+	return &usageStore{
+		since: time.Now().UTC(),
+		total: newUsageMaps(),
+		days:  make(map[string]*usageMaps),
+	}
+}
+
+// record accounts a session of token and tenant to backend, any of them may
+// be empty
+func (st *usageStore) record(token, tenant, backend string, up, down uint64) {
+	at := time.Now().UTC()
+	day := at.Format(_UsageDayLayout)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	d, ok := st.days[day]
+	if !ok {
+		d = newUsageMaps()
+		st.days[day] = d
+		oldest := at.AddDate(0, 0, -_UsageRetentionDays).Format(_UsageDayLayout)
+		for k := range st.days {
+			if k < oldest {
+				delete(st.days, k)
+			}
+		}
+	}
+	ok = st.total.record(token, tenant, backend, up, down, at)
+	ok = d.record(token, tenant, backend, up, down, at) && ok
+	if !ok {
+		_MetricUsageDropped.Inc()
+	}
+}
+
+// Snapshot returns a copy of the usage
+func (st *usageStore) Snapshot() usageSnapshot {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	total := st.total.table()
+	snap := usageSnapshot{
+		Since:    st.since,
+		Tokens:   total.Tokens,
+		Tenants:  total.Tenants,
+		Backends: total.Backends,
+		Days:     make(map[string]usageTable, len(st.days)),
+	}
+	for day, d := range st.days {
+		snap.Days[day] = d.table()
+	}
+	return snap
+}
+
+// Restore replaces the usage with snap
+func (st *usageStore) Restore(snap usageSnapshot) {
+	total := usageTable{Tokens: snap.Tokens, Tenants: snap.Tenants, Backends: snap.Backends}.maps()
+	days := make(map[string]*usageMaps, len(snap.Days))
+	for day, t := range snap.Days {
+		days[day] = t.maps()
+	}
+	st.mu.Lock()
+	st.since = snap.Since
+	st.total = total
+	st.days = days
+	st.mu.Unlock()
+}
+
+type usageRow struct {
+	Day       string `json:"day,omitempty"`
+	Token     string `json:"token,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	Backend   string `json:"backend,omitempty"`
+	Conns     uint64 `json:"conns"`
+	BytesUp   uint64 `json:"bytes_up"`
+	BytesDown uint64 `json:"bytes_down"`
+}
+
+// report aggregates the usage by token, tenant or backend over the days from
+// to to included, empty for unbounded, with a row per day if daily. Rows are
+// sorted by day and then busiest first.
+func (st *usageStore) report(by string, from, to string, daily bool) []usageRow {
+	rows := make(map[[2]string]*usageRow)
+	st.mu.Lock()
+	for day, d := range st.days {
+		if (from != "" && day < from) || (to != "" && day > to) {
+			continue
+		}
+		if !daily {
+			day = ""
+		}
+		for k, u := range d.by(by) {
+			row, ok := rows[[2]string{day, k}]
+			if !ok {
+				row = &usageRow{Day: day}
+				switch by {
+				case "tenant":
+					row.Tenant = k
+				case "backend":
+					row.Backend = k
+				default:
+					row.Token = k
+				}
+				rows[[2]string{day, k}] = row
+			}
+			row.Conns += u.Conns
+			row.BytesUp += u.BytesUp
+			row.BytesDown += u.BytesDown
+		}
+	}
+	st.mu.Unlock()
+
+	report := make([]usageRow, 0, len(rows))
+	for _, row := range rows {
+		report = append(report, *row)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		a, b := report[i], report[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.BytesUp+a.BytesDown != b.BytesUp+b.BytesDown {
+			return a.BytesUp+a.BytesDown > b.BytesUp+b.BytesDown
+		}
+		return a.Token+a.Tenant+a.Backend < b.Token+b.Tenant+b.Backend
+	})
+	return report
+}
+
+// usageHandler reports the usage accounted as JSON or CSV. Its query selects
+// by=token (default), tenant or backend, the UTC days from and to, both included,
+// daily=true for a row per day, and format=json (default) or csv.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if usageFile() == "" {
+		http.Error(w, "usage not accounted without USAGE_FILE", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	by := q.Get("by")
+	switch by {
+	case "":
+		by = "token"
+	case "token", "tenant", "backend":
+	default:
+		http.Error(w, "by must be token, tenant or backend", http.StatusBadRequest)
+		return
+	}
+	from, to := q.Get("from"), q.Get("to")
+	for _, day := range []string{from, to} {
+		if _, err := time.Parse(_UsageDayLayout, day); day != "" && err != nil {
+			http.Error(w, "from and to must be days like 2006-01-02", http.StatusBadRequest)
+			return
+		}
+	}
+	daily := false
+	if v := q.Get("daily"); v != "" {
+		var err error
+		daily, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "daily must be a boolean", http.StatusBadRequest)
+			return
+		}
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	rows := _Usage.report(by, from, to, daily)
+	if format != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rows)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	cw := csv.NewWriter(w)
+	header := []string{by, "conns", "bytes_up", "bytes_down"}
+	if daily {
+		header = append([]string{"day"}, header...)
+	}
+	cw.Write(header)
+	for _, row := range rows {
+		rec := []string{row.Token + row.Tenant + row.Backend, strconv.FormatUint(row.Conns, 10),
+			strconv.FormatUint(row.BytesUp, 10), strconv.FormatUint(row.BytesDown, 10)}
+		if daily {
+			rec = append([]string{row.Day}, rec...)
+		}
+		cw.Write(rec)
+	}
+	cw.Flush()
+}
+
+// recordUsage accounts the session s if USAGE_FILE is set, sessions refused
+// before the token is known are not
+func recordUsage(s *session) {
+	if usageFile() == "" || s.token == "" {
+		return
+	}
+	_, backend := s.status()
+	_Usage.record(s.token, s.tenant, backend, s.up.Value(), s.down.Value())
+}
+
+// loadUsage restores the usage from path
+func loadUsage(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var snap usageSnapshot
+	err = gob.NewDecoder(f).Decode(&snap)
+	if err != nil {
+		return err
+	}
+	_Usage.Restore(snap)
+
+	logger().Info("usage loaded", "tokens", len(snap.Tokens), "tenants", len(snap.Tenants), "backends", len(snap.Backends), "path", path)
+	return nil
+}
+
+// saveUsage writes the usage to path atomically
+func saveUsage(path string) error {
+	snap := _Usage.Snapshot()
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = gob.NewEncoder(f).Encode(&snap)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// flushUsage saves the usage every interval
+func flushUsage(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := saveUsage(path)
+		if err != nil {
+			logger().Error("usage not saved", "err", err)
+		}
+	}
+}
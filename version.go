@@ -0,0 +1,72 @@
+package frontd
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// set at build time, e.g.
+//
+//	go build -ldflags "-X github.com/xindong/frontd._Version=1.2.0 -X github.com/xindong/frontd._Commit=$(git rev-parse HEAD) ..." ./cmd/frontd
+//
+// otherwise filled from the build info embedded by the go command
+var (
+	_Version   = ""
+	_Commit    = ""
+	_BuildDate = ""
+)
+
+// _PrintVersion is set by -version
+var _PrintVersion bool
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if ok {
+		if _Version == "" && info.Main.Version != "(devel)" {
+			_Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && _Commit == "":
+				_Commit = s.Value
+			case s.Key == "vcs.time" && _BuildDate == "":
+				_BuildDate = s.Value
+			}
+		}
+	}
+	if _Version == "" {
+		_Version = "dev"
+	}
+
+	register("frontd_build_info", "Version of the running binary, always 1.", "gauge", buildInfo{})
+}
+
+func versionString() string {
+	return fmt.Sprintf("frontd %s (commit %s, built %s, %s)", _Version, orUnknown(_Commit), orUnknown(_BuildDate), runtime.Version())
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// buildInfo exposes the version as labels of a constant gauge
+type buildInfo struct{}
+
+var _BuildInfoLabels = []string{"version", "commit", "go_version"}
+
+func (buildInfo) values() []string {
+	return []string{_Version, _Commit, runtime.Version()}
+}
+
+func (b buildInfo) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s%s 1\n", name, formatLabels(_BuildInfoLabels, b.values()))
+}
+
+func (b buildInfo) collect(f func(labels, values []string, v float64)) {
+	f(_BuildInfoLabels, b.values(), 1)
+}
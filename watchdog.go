@@ -0,0 +1,70 @@
+package frontd
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// The watchdog force-closes sessions stuck in the handshake, dialing or
+// closing state for WATCHDOG_TIMEOUT, e.g. behind a dial or hook ignoring
+// its timeout or a relay goroutine that never returned. Every state is
+// bounded by timeouts of its own, so they are wedged by a bug, which the
+// watchdog contains and makes visible instead of leaking descriptors.
+
+// _WatchdogInterval is how often sessions are checked
+const _WatchdogInterval = time.Second * 5
+
+var (
+	_WatchdogTimeout int64 = int64(time.Minute * 5) // nanoseconds, 0 disables the watchdog
+
+	errWedged = errors.New("wedged")
+
+	_MetricConnWedged = newCounterVec("frontd_connections_wedged_total",
+		"Total number of connections force-closed by the watchdog, by state.", "state")
+)
+
+func watchdogTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&_WatchdogTimeout))
+}
+
+// runWatchdog checks sessions every _WatchdogInterval
+func runWatchdog() {
+	tick := time.NewTicker(_WatchdogInterval)
+	defer tick.Stop()
+	for now := range tick.C {
+		closeWedged(now, watchdogTimeout())
+	}
+}
+
+// closeWedged force-closes sessions in a state other than relaying since
+// before now minus timeout, and returns how many
+func closeWedged(now time.Time, timeout time.Duration) int {
+	if timeout <= 0 {
+		return 0
+	}
+	n := 0
+	_Sessions.Range(func(k, v interface{}) bool {
+		s := v.(*session)
+		s.mu.Lock()
+		state, since := s.state, s.since
+		stuck := state != stateRelaying && !s.wedged && now.Sub(since) >= timeout
+		if stuck {
+			s.wedged = true
+		}
+		s.mu.Unlock()
+		if !stuck {
+			return true
+		}
+
+		_MetricConnWedged.With(state).Inc()
+		s.log.Warn("wedged connection closed", "state", state, "stuck", now.Sub(since).Seconds())
+		// closing the client makes the handshake fail and the relay
+		// return even if the session was canceled before
+		s.cancel(errWedged)
+		s.Close()
+		n++
+		return true
+	})
+	return n
+}